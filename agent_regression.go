@@ -0,0 +1,491 @@
+package main
+
+import (
+	"fmt"
+	"log"
+	"sort"
+	"strings"
+	"time"
+
+	"gorm.io/gorm"
+	"gorm.io/gorm/clause"
+)
+
+// agentRegressionConfig is the `agent_regression` section of config.yaml.
+type agentRegressionConfig struct {
+	Enabled  bool   `yaml:"enabled"`
+	Interval string `yaml:"interval"`
+	// Window is how far back each pass compares runs, e.g. "14d".
+	Window  string `yaml:"window"`
+	MinRuns int    `yaml:"min_runs"`
+}
+
+const (
+	defaultAgentRegressionInterval = time.Hour
+	defaultAgentRegressionWindow   = 14 * 24 * time.Hour
+	defaultAgentRegressionMinRuns  = 30
+	// agentRegressionJobLimit bounds the versions one pass compares, like the
+	// limit of /api/agent-versions/regressions.
+	agentRegressionJobLimit     = 50
+	agentRegressionJobRuleLimit = 20
+)
+
+// agentRegressionPolicy is a validated agentRegressionConfig.
+type agentRegressionPolicy struct {
+	Interval time.Duration
+	Window   time.Duration
+	MinRuns  int
+}
+
+func newAgentRegressionPolicy(cfg agentRegressionConfig) (agentRegressionPolicy, error) {
+	policy := agentRegressionPolicy{
+		Interval: defaultAgentRegressionInterval,
+		Window:   defaultAgentRegressionWindow,
+		MinRuns:  defaultAgentRegressionMinRuns,
+	}
+	if cfg.Interval != "" {
+		interval, err := parseRetentionDuration(cfg.Interval)
+		if err != nil || interval <= 0 {
+			return policy, fmt.Errorf("agent_regression.interval: invalid duration %q", cfg.Interval)
+		}
+		policy.Interval = interval
+	}
+	if cfg.Window != "" {
+		window, err := parseRetentionDuration(cfg.Window)
+		if err != nil || window <= 0 {
+			return policy, fmt.Errorf("agent_regression.window: invalid duration %q", cfg.Window)
+		}
+		policy.Window = window
+	}
+	if cfg.MinRuns != 0 {
+		if cfg.MinRuns < 1 {
+			return policy, fmt.Errorf("agent_regression.min_runs must be positive")
+		}
+		policy.MinRuns = cfg.MinRuns
+	}
+	return policy, nil
+}
+
+// Metrics named in agentVersionRegression.Regressions.
+const (
+	regressionHitDensity      = "hit_density"
+	regressionZeroHitRate     = "zero_hit_rate"
+	regressionImprovementRate = "improvement_rate"
+	regressionRuleHitShare    = "rule_hit_share"
+)
+
+// agentRegressionQuery selects the agent versions DetectAgentRegressions
+// compares. A non-empty AgentVersion compares only that version.
+type agentRegressionQuery struct {
+	AgentVersion string
+	// MinRuns is the number of runs on matched repos each side needs before
+	// differences are flagged.
+	MinRuns       int
+	Limit         int
+	RuleLimit     int
+	RegressedOnly bool
+}
+
+// agentVersionMetrics is what one agent version observed on the matched repos.
+type agentVersionMetrics struct {
+	AgentVersion string   `json:"agent_version"`
+	Runs         uint64   `json:"runs"`
+	HitDensity   estimate `json:"hit_density"`
+	// ZeroHitRate is the share of runs without any hit.
+	ZeroHitRate estimate `json:"zero_hit_rate"`
+	// ImprovementRate averages (max - min) / max of total hits over the
+	// changes with at least two runs of the version.
+	ImprovementRate estimate `json:"improvement_rate"`
+}
+
+type agentVersionDiff struct {
+	HitDensity      difference `json:"hit_density"`
+	ZeroHitRate     difference `json:"zero_hit_rate"`
+	ImprovementRate difference `json:"improvement_rate"`
+}
+
+// ruleHitShareRow is the share of all hits that one rule produced under the
+// baseline and the current version.
+type ruleHitShareRow struct {
+	RuleID   string     `json:"rule_id"`
+	Baseline estimate   `json:"baseline"`
+	Current  estimate   `json:"current"`
+	Diff     difference `json:"diff"`
+
+	Catalog *ruleCatalogEntry `json:"catalog"`
+}
+
+type agentVersionRegression struct {
+	AgentVersion    string    `json:"agent_version"`
+	BaselineVersion string    `json:"baseline_version"`
+	FirstSeenAt     time.Time `json:"first_seen_at"`
+	// MatchedRepos is the number of repos with runs of both versions; all
+	// metrics only count runs in these repos.
+	MatchedRepos uint64              `json:"matched_repos"`
+	Baseline     agentVersionMetrics `json:"baseline"`
+	Current      agentVersionMetrics `json:"current"`
+	// Diff and the rule share differences are current minus baseline.
+	Diff  agentVersionDiff  `json:"diff"`
+	Rules []ruleHitShareRow `json:"rules"`
+
+	// InsufficientData is set when either side has fewer than MinRuns runs;
+	// nothing is flagged then.
+	InsufficientData bool     `json:"insufficient_data"`
+	Regressed        bool     `json:"regressed"`
+	Regressions      []string `json:"regressions"`
+}
+
+type agentVersionFirstSeen struct {
+	AgentVersion string
+	FirstSeenAt  scanTime
+}
+
+type ruleHitSums struct {
+	RuleID  string
+	SumHits float64
+	SumSq   float64
+	SumWith float64
+}
+
+// DetectAgentRegressions compares each agent version that ran in [from, to]
+// with the version first seen before it, newest version first. Versions are
+// ordered by their first run among all retained runs, not only those in the
+// range, so a version's baseline does not change with the range. Only runs in
+// [from, to] of the repos both versions ran in are compared.
+func (s *gormStore) DetectAgentRegressions(from, to time.Time, f queryFilter, q agentRegressionQuery) ([]agentVersionRegression, error) {
+	var versions []agentVersionFirstSeen
+	if err := applyRunFilters(s.db.Model(&CrAgentRun{}), f).
+		Where("agent_version IN (?)", s.runsInRange(from, to, f).Distinct("agent_version")).
+		Select("agent_version, MIN(reported_at) AS first_seen_at").
+		Group("agent_version").Order("first_seen_at, agent_version").Scan(&versions).Error; err != nil {
+		return nil, err
+	}
+
+	var results []agentVersionRegression
+	for i := len(versions) - 1; i >= 1 && len(results) < q.Limit; i-- {
+		if q.AgentVersion != "" && versions[i].AgentVersion != q.AgentVersion {
+			continue
+		}
+		result, err := s.compareAgentVersions(versions[i-1].AgentVersion, versions[i].AgentVersion, from, to, f, q)
+		if err != nil {
+			return nil, err
+		}
+		result.FirstSeenAt = versions[i].FirstSeenAt.Time
+		if q.RegressedOnly && !result.Regressed {
+			continue
+		}
+		results = append(results, result)
+	}
+	return results, nil
+}
+
+func (s *gormStore) compareAgentVersions(baseline, current string, from, to time.Time, f queryFilter, q agentRegressionQuery) (agentVersionRegression, error) {
+	result := agentVersionRegression{AgentVersion: current, BaselineVersion: baseline, Regressions: []string{}}
+	if err := s.matchedRuns(from, to, f, current, baseline).
+		Select("COUNT(DISTINCT repo)").Scan(&result.MatchedRepos).Error; err != nil {
+		return result, err
+	}
+
+	var err error
+	if result.Baseline, err = s.loadAgentVersionMetrics(from, to, f, baseline, current); err != nil {
+		return result, err
+	}
+	if result.Current, err = s.loadAgentVersionMetrics(from, to, f, current, baseline); err != nil {
+		return result, err
+	}
+	result.Diff = agentVersionDiff{
+		HitDensity:      diffEstimate(result.Baseline.HitDensity, result.Current.HitDensity),
+		ZeroHitRate:     diffEstimate(result.Baseline.ZeroHitRate, result.Current.ZeroHitRate),
+		ImprovementRate: diffEstimate(result.Baseline.ImprovementRate, result.Current.ImprovementRate),
+	}
+	if result.Rules, err = s.loadRuleHitShares(from, to, f, baseline, current, q.RuleLimit); err != nil {
+		return result, err
+	}
+
+	minRuns := uint64(q.MinRuns)
+	result.InsufficientData = result.Baseline.Runs < minRuns || result.Current.Runs < minRuns
+	if result.InsufficientData {
+		return result, nil
+	}
+	// Finding less, coming back empty more often and leading to fewer fixes
+	// are regressions; a significant shift in which rules hit is flagged
+	// either way.
+	if d := result.Diff.HitDensity; d.Significant && *d.Value < 0 {
+		result.Regressions = append(result.Regressions, regressionHitDensity)
+	}
+	if d := result.Diff.ZeroHitRate; d.Significant && *d.Value > 0 {
+		result.Regressions = append(result.Regressions, regressionZeroHitRate)
+	}
+	if d := result.Diff.ImprovementRate; d.Significant && *d.Value < 0 {
+		result.Regressions = append(result.Regressions, regressionImprovementRate)
+	}
+	for _, rule := range result.Rules {
+		if rule.Diff.Significant {
+			result.Regressions = append(result.Regressions, regressionRuleHitShare)
+			break
+		}
+	}
+	result.Regressed = len(result.Regressions) > 0
+	return result, nil
+}
+
+// matchedRuns selects the runs of version in [from, to] whose repo also has
+// runs of other.
+func (s *gormStore) matchedRuns(from, to time.Time, f queryFilter, version, other string) *gorm.DB {
+	scope := f
+	scope.AgentVersion = version
+	otherScope := f
+	otherScope.AgentVersion = other
+	return s.runsInRange(from, to, scope).
+		Where("repo IN (?)", s.runsInRange(from, to, otherScope).Select("repo"))
+}
+
+func (s *gormStore) loadAgentVersionMetrics(from, to time.Time, f queryFilter, version, other string) (agentVersionMetrics, error) {
+	metrics := agentVersionMetrics{AgentVersion: version}
+	runs, err := loadRunSums(s.matchedRuns(from, to, f, version, other))
+	if err != nil {
+		return metrics, err
+	}
+	metrics.Runs = runs.Runs
+	metrics.HitDensity = runs.hitDensity()
+	metrics.ZeroHitRate = proportionEstimate(runs.ZeroHitRuns, runs.Runs)
+
+	// code_change_summary mixes agent versions, so the improvement rate is
+	// recomputed from the runs of this version with the summary's formula.
+	changes := s.matchedRuns(from, to, f, version, other).
+		Select("1.0 * (MAX(triggered_total_hits) - MIN(triggered_total_hits)) / MAX(triggered_total_hits) AS rate").
+		Group("repo, code_change_id").
+		Having("COUNT(*) >= 2 AND MAX(triggered_total_hits) > 0")
+	var sums meanSums
+	if err := s.db.Table("(?) c", changes).
+		Select("COUNT(*) AS n, SUM(rate) AS sum, SUM(rate * rate) AS sum_sq").Scan(&sums).Error; err != nil {
+		return metrics, err
+	}
+	metrics.ImprovementRate = meanEstimate(sums.N, sums.Sum.Float64, sums.SumSq.Float64)
+	return metrics, nil
+}
+
+// loadRuleHitShares estimates each rule's share of all hits per version as a
+// ratio over runs, so hits clustered in a few runs widen the interval. Rules
+// are ordered by their combined hits and limited to limit.
+func (s *gormStore) loadRuleHitShares(from, to time.Time, f queryFilter, baseline, current string, limit int) ([]ruleHitShareRow, error) {
+	type side struct {
+		totals runSums
+		rules  map[string]ruleHitSums
+	}
+	load := func(version, other string) (side, error) {
+		var result side
+		var err error
+		if result.totals, err = loadRunSums(s.matchedRuns(from, to, f, version, other)); err != nil {
+			return result, err
+		}
+		var rows []ruleHitSums
+		if err := s.db.Table("cr_agent_run_rule r").
+			Joins("JOIN (?) a ON a.id = r.run_id", s.matchedRuns(from, to, f, version, other).Select("id, triggered_total_hits")).
+			Select("r.rule_id, SUM(r.hit_count) AS sum_hits, " +
+				"SUM(1.0 * r.hit_count * r.hit_count) AS sum_sq, " +
+				"SUM(1.0 * r.hit_count * a.triggered_total_hits) AS sum_with").
+			Group("r.rule_id").Scan(&rows).Error; err != nil {
+			return result, err
+		}
+		result.rules = make(map[string]ruleHitSums, len(rows))
+		for _, row := range rows {
+			result.rules[row.RuleID] = row
+		}
+		return result, nil
+	}
+	base, err := load(baseline, current)
+	if err != nil {
+		return nil, err
+	}
+	cur, err := load(current, baseline)
+	if err != nil {
+		return nil, err
+	}
+
+	share := func(sd side, ruleID string) estimate {
+		rule := sd.rules[ruleID]
+		t := sd.totals
+		return ratioEstimate(t.Runs, rule.SumHits, t.SumHits, rule.SumSq, t.SumHitsSq, rule.SumWith)
+	}
+	combined := make(map[string]float64, len(base.rules)+len(cur.rules))
+	for ruleID, rule := range base.rules {
+		combined[ruleID] += rule.SumHits
+	}
+	for ruleID, rule := range cur.rules {
+		combined[ruleID] += rule.SumHits
+	}
+	ruleIDs := make([]string, 0, len(combined))
+	for ruleID := range combined {
+		ruleIDs = append(ruleIDs, ruleID)
+	}
+	sort.Slice(ruleIDs, func(i, j int) bool {
+		if combined[ruleIDs[i]] != combined[ruleIDs[j]] {
+			return combined[ruleIDs[i]] > combined[ruleIDs[j]]
+		}
+		return ruleIDs[i] < ruleIDs[j]
+	})
+	if len(ruleIDs) > limit {
+		ruleIDs = ruleIDs[:limit]
+	}
+
+	rows := make([]ruleHitShareRow, 0, len(ruleIDs))
+	for _, ruleID := range ruleIDs {
+		row := ruleHitShareRow{RuleID: ruleID, Baseline: share(base, ruleID), Current: share(cur, ruleID)}
+		row.Diff = diffEstimate(row.Baseline, row.Current)
+		rows = append(rows, row)
+	}
+	return rows, nil
+}
+
+// agentRegressionTally reports one regression detection pass.
+type agentRegressionTally struct {
+	Versions int
+	Recorded int
+	New      []string
+	Cleared  int
+}
+
+// runAgentRegressionDetection compares the agent versions that ran in the
+// policy window ending at now over every repo and records the regressed ones.
+func runAgentRegressionDetection(store Store, policy agentRegressionPolicy, now time.Time) (agentRegressionTally, error) {
+	var tally agentRegressionTally
+	results, err := store.DetectAgentRegressions(now.Add(-policy.Window), now, queryFilter{}, agentRegressionQuery{
+		MinRuns:   policy.MinRuns,
+		Limit:     agentRegressionJobLimit,
+		RuleLimit: agentRegressionJobRuleLimit,
+	})
+	if err != nil {
+		return tally, fmt.Errorf("detect regressions: %w", err)
+	}
+	tally.Versions = len(results)
+
+	stamp := now.UTC()
+	var regressions []CrAgentRegression
+	for _, r := range results {
+		if !r.Regressed {
+			continue
+		}
+		regressions = append(regressions, CrAgentRegression{
+			AgentVersion:    r.AgentVersion,
+			BaselineVersion: r.BaselineVersion,
+			FirstSeenAt:     r.FirstSeenAt.UTC(),
+			MatchedRepos:    r.MatchedRepos,
+			BaselineRuns:    r.Baseline.Runs,
+			CurrentRuns:     r.Current.Runs,
+			Regressions:     strings.Join(r.Regressions, ","),
+			DetectedAt:      stamp,
+			UpdatedAt:       stamp,
+		})
+	}
+	newVersions, cleared, err := store.ReplaceAgentRegressions(regressions)
+	if err != nil {
+		return tally, fmt.Errorf("record regressions: %w", err)
+	}
+	tally.Recorded = len(regressions)
+	tally.New = newVersions
+	tally.Cleared = cleared
+	return tally, nil
+}
+
+// startAgentRegressionJob runs a detection pass right away and then every
+// policy.Interval for the lifetime of the process.
+func startAgentRegressionJob(store Store, policy agentRegressionPolicy) {
+	go func() {
+		for {
+			tally, err := runAgentRegressionDetection(store, policy, time.Now())
+			if err != nil {
+				log.Printf("agent regression: %v", err)
+			} else if len(tally.New) > 0 || tally.Cleared > 0 {
+				log.Printf("agent regression: %d of %d versions regressed, new: %s, %d cleared",
+					tally.Recorded, tally.Versions, strings.Join(tally.New, ", "), tally.Cleared)
+			}
+			time.Sleep(policy.Interval)
+		}
+	}()
+}
+
+// ReplaceAgentRegressions makes regressions the recorded set: versions that
+// are no longer regressed are deleted and the rest are upserted, keeping the
+// detected_at of versions found by an earlier pass. It returns the versions
+// that were not recorded before and how many were deleted.
+func (s *gormStore) ReplaceAgentRegressions(regressions []CrAgentRegression) ([]string, int, error) {
+	found := make(map[string]bool, len(regressions))
+	for _, r := range regressions {
+		found[r.AgentVersion] = true
+	}
+
+	var newVersions []string
+	cleared := 0
+	err := s.db.Transaction(func(tx *gorm.DB) error {
+		var existing []CrAgentRegression
+		if err := tx.Select("id, agent_version").Find(&existing).Error; err != nil {
+			return err
+		}
+		known := make(map[string]bool, len(existing))
+		var stale []uint64
+		for _, r := range existing {
+			known[r.AgentVersion] = true
+			if !found[r.AgentVersion] {
+				stale = append(stale, r.ID)
+			}
+		}
+		if len(stale) > 0 {
+			if err := tx.Where("id IN ?", stale).Delete(&CrAgentRegression{}).Error; err != nil {
+				return err
+			}
+			cleared = len(stale)
+		}
+		for _, r := range regressions {
+			if !known[r.AgentVersion] {
+				newVersions = append(newVersions, r.AgentVersion)
+			}
+		}
+		if len(regressions) == 0 {
+			return nil
+		}
+		return tx.Clauses(clause.OnConflict{
+			Columns: []clause.Column{{Name: "agent_version"}},
+			DoUpdates: clause.AssignmentColumns([]string{"baseline_version", "first_seen_at", "matched_repos",
+				"baseline_runs", "current_runs", "regressions", "updated_at"}),
+		}).Create(&regressions).Error
+	})
+	return newVersions, cleared, err
+}
+
+// recordedRegressionRow is one version recorded by the regression job.
+type recordedRegressionRow struct {
+	AgentVersion    string    `json:"agent_version"`
+	BaselineVersion string    `json:"baseline_version"`
+	FirstSeenAt     time.Time `json:"first_seen_at"`
+	MatchedRepos    uint64    `json:"matched_repos"`
+	BaselineRuns    uint64    `json:"baseline_runs"`
+	CurrentRuns     uint64    `json:"current_runs"`
+	Regressions     []string  `json:"regressions"`
+	DetectedAt      time.Time `json:"detected_at"`
+	UpdatedAt       time.Time `json:"updated_at"`
+}
+
+// ListAgentRegressions returns the recorded regressions, newest version
+// first.
+func (s *gormStore) ListAgentRegressions() ([]recordedRegressionRow, error) {
+	var records []CrAgentRegression
+	if err := s.db.Order("first_seen_at DESC, agent_version").Find(&records).Error; err != nil {
+		return nil, err
+	}
+	rows := make([]recordedRegressionRow, 0, len(records))
+	for _, r := range records {
+		rows = append(rows, recordedRegressionRow{
+			AgentVersion:    r.AgentVersion,
+			BaselineVersion: r.BaselineVersion,
+			FirstSeenAt:     r.FirstSeenAt.UTC(),
+			MatchedRepos:    r.MatchedRepos,
+			BaselineRuns:    r.BaselineRuns,
+			CurrentRuns:     r.CurrentRuns,
+			Regressions:     strings.Split(r.Regressions, ","),
+			DetectedAt:      r.DetectedAt.UTC(),
+			UpdatedAt:       r.UpdatedAt.UTC(),
+		})
+	}
+	return rows, nil
+}
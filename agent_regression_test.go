@@ -0,0 +1,131 @@
+package main
+
+import (
+	"net/http"
+	"testing"
+	"time"
+)
+
+// storeVersionRuns stores n runs of version in each repo, one minute apart
+// from start, with hits rule hits each.
+func storeVersionRuns(t *testing.T, store *gormStore, seq *int, version string, start time.Time, n int, hits uint32, repos ...string) {
+	t.Helper()
+	for _, repo := range repos {
+		for i := 0; i < n; i++ {
+			*seq++
+			ruleHits := map[string]uint32{}
+			if hits > 0 {
+				ruleHits["R1"] = hits
+			}
+			run := testRun(repo, "c1", *seq, start.Add(time.Duration(i)*time.Minute), ruleHits)
+			run.AgentVersion = version
+			if _, _, err := store.CreateAgentRun(pendingAgentRun{Req: run, DiffLines: *run.DiffLines}); err != nil {
+				t.Fatal(err)
+			}
+		}
+	}
+}
+
+// TestAgentRegressionBaselineIgnoresRange checks that versions are ordered by
+// their first run overall, so a version first seen before the range is not
+// compared with an older version that happens to run earlier in the range.
+func TestAgentRegressionBaselineIgnoresRange(t *testing.T) {
+	store := newTestStore(t)
+	now := time.Now().UTC().Truncate(time.Hour)
+	from := now.Add(-7 * 24 * time.Hour)
+	seq := 0
+	storeVersionRuns(t, store, &seq, "v1", now.Add(-30*24*time.Hour), 2, 1, "org/a")
+	storeVersionRuns(t, store, &seq, "v2", now.Add(-20*24*time.Hour), 2, 1, "org/a")
+	// In the range v2 runs before v1 does.
+	storeVersionRuns(t, store, &seq, "v2", from.Add(time.Hour), 2, 1, "org/a")
+	storeVersionRuns(t, store, &seq, "v1", from.Add(2*time.Hour), 2, 1, "org/a")
+	storeVersionRuns(t, store, &seq, "v3", from.Add(3*time.Hour), 2, 1, "org/a")
+
+	results, err := store.DetectAgentRegressions(from, now, queryFilter{}, agentRegressionQuery{MinRuns: 1, Limit: 5, RuleLimit: 5})
+	if err != nil {
+		t.Fatal(err)
+	}
+	if len(results) != 2 {
+		t.Fatalf("%d comparisons, want 2: %+v", len(results), results)
+	}
+	for i, want := range [][2]string{{"v3", "v2"}, {"v2", "v1"}} {
+		if results[i].AgentVersion != want[0] || results[i].BaselineVersion != want[1] {
+			t.Fatalf("comparison %d: %s against %s, want %s against %s", i, results[i].AgentVersion, results[i].BaselineVersion, want[0], want[1])
+		}
+	}
+	if first := results[1].FirstSeenAt.UTC(); !first.Equal(now.Add(-20 * 24 * time.Hour)) {
+		t.Fatalf("v2 first seen at %v, want its first run before the range", first)
+	}
+	// Only runs inside the range are compared.
+	if runs := results[1].Current.Runs; runs != 2 {
+		t.Fatalf("v2 compared over %d runs, want 2", runs)
+	}
+}
+
+func TestAgentRegressionJobRecordsRegressedVersions(t *testing.T) {
+	store := newTestStore(t)
+	now := time.Now().UTC().Truncate(time.Hour)
+	policy, err := newAgentRegressionPolicy(agentRegressionConfig{Window: "7d", MinRuns: 10})
+	if err != nil {
+		t.Fatal(err)
+	}
+	seq := 0
+	// v2 stops finding anything on the repos v1 ran in.
+	storeVersionRuns(t, store, &seq, "v1", now.Add(-6*24*time.Hour), 20, 3, "org/a", "org/b")
+	storeVersionRuns(t, store, &seq, "v2", now.Add(-3*24*time.Hour), 20, 0, "org/a", "org/b")
+
+	tally, err := runAgentRegressionDetection(store, policy, now)
+	if err != nil {
+		t.Fatal(err)
+	}
+	if tally.Versions != 1 || tally.Recorded != 1 || len(tally.New) != 1 || tally.New[0] != "v2" {
+		t.Fatalf("first pass %+v", tally)
+	}
+	rows, err := store.ListAgentRegressions()
+	if err != nil || len(rows) != 1 {
+		t.Fatalf("recorded %v, %v", rows, err)
+	}
+	first := rows[0]
+	if first.AgentVersion != "v2" || first.BaselineVersion != "v1" || first.MatchedRepos != 2 || first.CurrentRuns != 40 {
+		t.Fatalf("recorded %+v", first)
+	}
+	if !contains(first.Regressions, regressionHitDensity) || !contains(first.Regressions, regressionZeroHitRate) {
+		t.Fatalf("regressions %v", first.Regressions)
+	}
+
+	// A later pass keeps the first detection time and reports nothing new.
+	tally, err = runAgentRegressionDetection(store, policy, now.Add(time.Hour))
+	if err != nil || tally.Recorded != 1 || len(tally.New) != 0 {
+		t.Fatalf("second pass %+v, %v", tally, err)
+	}
+	rows, _ = store.ListAgentRegressions()
+	if !rows[0].DetectedAt.Equal(first.DetectedAt) || !rows[0].UpdatedAt.After(first.UpdatedAt) {
+		t.Fatalf("second pass detected_at %v updated_at %v, first %v %v", rows[0].DetectedAt, rows[0].UpdatedAt, first.DetectedAt, first.UpdatedAt)
+	}
+
+	base := newTestServer(t, store, authPolicy{}, alertPolicy{})
+	status, body := doRequest(t, http.MethodGet, base+"/api/agent-versions/regressions/recorded", nil, nil)
+	var resp struct {
+		Data []recordedRegressionRow `json:"data"`
+	}
+	decodeJSON(t, body, &resp)
+	if status != http.StatusOK || len(resp.Data) != 1 || resp.Data[0].AgentVersion != "v2" {
+		t.Fatalf("recorded regressions: %d %s", status, body)
+	}
+
+	// Once the window no longer holds both versions nothing is compared and
+	// the recorded regression is cleared.
+	tally, err = runAgentRegressionDetection(store, policy, now.Add(30*24*time.Hour))
+	if err != nil || tally.Cleared != 1 || tally.Recorded != 0 {
+		t.Fatalf("pass after the window %+v, %v", tally, err)
+	}
+}
+
+func contains(values []string, value string) bool {
+	for _, v := range values {
+		if v == value {
+			return true
+		}
+	}
+	return false
+}
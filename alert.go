@@ -0,0 +1,886 @@
+package main
+
+import (
+	"errors"
+	"fmt"
+	"log"
+	"net/url"
+	"sort"
+	"strings"
+	"time"
+	"unicode/utf8"
+
+	"gorm.io/gorm"
+	"gorm.io/gorm/clause"
+)
+
+// alertingConfig is the `alerting` section of config.yaml.
+type alertingConfig struct {
+	Enabled  bool                 `yaml:"enabled"`
+	Interval string               `yaml:"interval"`
+	Webhooks []alertWebhookConfig `yaml:"webhooks"`
+	Rules    []alertRuleSpec      `yaml:"rules"`
+}
+
+type alertWebhookConfig struct {
+	Name    string            `yaml:"name"`
+	URL     string            `yaml:"url"`
+	Timeout string            `yaml:"timeout"`
+	Headers map[string]string `yaml:"headers"`
+}
+
+const (
+	defaultAlertInterval       = time.Minute
+	defaultAlertWebhookTimeout = 5 * time.Second
+	maxAlertNameLen            = 64
+	maxAlertWebhooksLen        = 512
+	maxAlertCommentLen         = 512
+	maxAlertCreatedByLen       = 128
+	maxAlertErrorLen           = 512
+	// maxAlertWindow bounds the window of one rule; longer windows belong on
+	// the dashboard rather than in a query run every interval.
+	maxAlertWindow = 90 * 24 * time.Hour
+)
+
+// Metrics an alert rule can watch. Each is computed over the rule's window
+// by the same query as the dashboard endpoint named in the comment.
+const (
+	alertMetricRuns              = "runs"                // /api/summary total_runs
+	alertMetricHits              = "hits"                // /api/summary total_hits
+	alertMetricHitDensity        = "hit_density"         // /api/summary hit density
+	alertMetricImprovementRate   = "improvement_rate"    // /api/change-effectiveness/summary
+	alertMetricFixRate           = "fix_rate"            // /api/rule-quality
+	alertMetricFalsePositiveRate = "false_positive_rate" // /api/rule-quality
+)
+
+var alertMetrics = map[string]bool{
+	alertMetricRuns:              true,
+	alertMetricHits:              true,
+	alertMetricHitDensity:        true,
+	alertMetricImprovementRate:   true,
+	alertMetricFixRate:           true,
+	alertMetricFalsePositiveRate: true,
+}
+
+var alertOperators = map[string]func(value, threshold float64) bool{
+	">":  func(v, t float64) bool { return v > t },
+	">=": func(v, t float64) bool { return v >= t },
+	"<":  func(v, t float64) bool { return v < t },
+	"<=": func(v, t float64) bool { return v <= t },
+}
+
+// Alert states and notification statuses.
+const (
+	alertStateOK       = "ok"
+	alertStatePending  = "pending"
+	alertStateFiring   = "firing"
+	alertStateResolved = "resolved"
+)
+
+// alertRuleSpec defines one alert rule in config.yaml or through
+// POST /v1/alert-rules: the rule fires when Metric over the last Window
+// compares to Threshold with Operator for at least For.
+type alertRuleSpec struct {
+	Name      string  `json:"name" yaml:"name"`
+	Metric    string  `json:"metric" yaml:"metric"`
+	Operator  string  `json:"operator" yaml:"operator"`
+	Threshold float64 `json:"threshold" yaml:"threshold"`
+	Window    string  `json:"window" yaml:"window"`
+	For       string  `json:"for" yaml:"for"`
+	// RepeatInterval re-sends the firing notification while the rule keeps
+	// firing; empty sends it once.
+	RepeatInterval string `json:"repeat_interval" yaml:"repeat_interval"`
+	// MinRuns treats windows with fewer matching runs as having no data.
+	MinRuns uint32 `json:"min_runs" yaml:"min_runs"`
+
+	Repo           string `json:"repo" yaml:"repo"`
+	RulesetVersion string `json:"ruleset_version" yaml:"ruleset_version"`
+	AgentVersion   string `json:"agent_version" yaml:"agent_version"`
+	// RuleID narrows fix_rate and false_positive_rate to one rule; without it
+	// they average over all rules.
+	RuleID string `json:"rule_id" yaml:"rule_id"`
+
+	Severity string `json:"severity" yaml:"severity"`
+	// Webhooks names the configured webhooks to notify; empty notifies all.
+	Webhooks []string `json:"webhooks" yaml:"webhooks"`
+	Disabled bool     `json:"disabled" yaml:"disabled"`
+}
+
+// alertRule is a validated alertRuleSpec.
+type alertRule struct {
+	alertRuleSpec
+	Source         string
+	WindowDuration time.Duration
+	ForDuration    time.Duration
+	Repeat         time.Duration
+}
+
+func (r alertRule) filter() queryFilter {
+	return queryFilter{Repo: r.Repo, RulesetVersion: r.RulesetVersion, AgentVersion: r.AgentVersion, RuleID: r.RuleID}
+}
+
+func (r alertRule) matches(value float64) bool {
+	return alertOperators[r.Operator](value, r.Threshold)
+}
+
+// alertWebhook is a validated alertWebhookConfig.
+type alertWebhook struct {
+	Name    string
+	URL     string
+	Timeout time.Duration
+	Headers map[string]string
+}
+
+// alertPolicy is a validated alertingConfig. Its rules are the ones from
+// config.yaml; rules created through the API are read from the store on
+// every evaluation.
+type alertPolicy struct {
+	// Enabled reports whether the evaluation job runs; the API can manage
+	// rules and silences either way.
+	Enabled  bool
+	Interval time.Duration
+	Webhooks map[string]alertWebhook
+	Rules    []alertRule
+}
+
+func newAlertPolicy(cfg alertingConfig) (alertPolicy, error) {
+	policy := alertPolicy{Enabled: cfg.Enabled, Interval: defaultAlertInterval, Webhooks: make(map[string]alertWebhook, len(cfg.Webhooks))}
+	if cfg.Interval != "" {
+		interval, err := parseRetentionDuration(cfg.Interval)
+		if err != nil || interval <= 0 {
+			return policy, fmt.Errorf("alerting.interval: invalid duration %q", cfg.Interval)
+		}
+		policy.Interval = interval
+	}
+	for i, w := range cfg.Webhooks {
+		if w.Name == "" || !isValidRuleID(w.Name) {
+			return policy, fmt.Errorf("alerting.webhooks[%d].name is required and may only contain letters, digits and . _ - : /", i)
+		}
+		if _, ok := policy.Webhooks[w.Name]; ok {
+			return policy, fmt.Errorf("alerting.webhooks[%d]: duplicate name %q", i, w.Name)
+		}
+		if u, err := url.Parse(w.URL); err != nil || (u.Scheme != "http" && u.Scheme != "https") || u.Host == "" {
+			return policy, fmt.Errorf("alerting.webhooks[%d].url must be an http(s) URL", i)
+		}
+		webhook := alertWebhook{Name: w.Name, URL: w.URL, Timeout: defaultAlertWebhookTimeout, Headers: w.Headers}
+		if w.Timeout != "" {
+			timeout, err := time.ParseDuration(w.Timeout)
+			if err != nil || timeout <= 0 {
+				return policy, fmt.Errorf("alerting.webhooks[%d].timeout: invalid duration %q", i, w.Timeout)
+			}
+			webhook.Timeout = timeout
+		}
+		policy.Webhooks[w.Name] = webhook
+	}
+
+	seen := make(map[string]bool, len(cfg.Rules))
+	for i, spec := range cfg.Rules {
+		rule, errs := policy.parseAlertRule(spec, "config")
+		if len(errs) > 0 {
+			return policy, fmt.Errorf("alerting.rules[%d].%s: %s", i, errs[0].Field, errs[0].Message)
+		}
+		if seen[rule.Name] {
+			return policy, fmt.Errorf("alerting.rules[%d]: duplicate name %q", i, rule.Name)
+		}
+		seen[rule.Name] = true
+		policy.Rules = append(policy.Rules, rule)
+	}
+	return policy, nil
+}
+
+// configRule returns the config.yaml rule called name, if any.
+func (p alertPolicy) configRule(name string) (alertRule, bool) {
+	for _, rule := range p.Rules {
+		if rule.Name == name {
+			return rule, true
+		}
+	}
+	return alertRule{}, false
+}
+
+// parseAlertRule validates spec against the column sizes of cr_alert_rule and
+// the configured webhooks.
+func (p alertPolicy) parseAlertRule(spec alertRuleSpec, source string) (alertRule, []fieldError) {
+	rule := alertRule{alertRuleSpec: spec, Source: source}
+	var errs []fieldError
+	add := func(field, code, message string) {
+		errs = append(errs, fieldError{Field: field, Code: code, Message: message})
+	}
+	checkLen := func(field, value string, maxLen int) {
+		if utf8.RuneCountInString(value) > maxLen {
+			add(field, "too_long", fmt.Sprintf("%s must be at most %d characters", field, maxLen))
+		}
+	}
+	parseDuration := func(field, value string) time.Duration {
+		if value == "" {
+			return 0
+		}
+		d, err := parseRetentionDuration(value)
+		if err != nil || d <= 0 || d > maxAlertWindow {
+			add(field, "invalid_format", field+" must be a positive duration like 30m, 2h or 7d, at most 90d")
+			return 0
+		}
+		return d
+	}
+
+	switch {
+	case spec.Name == "":
+		add("name", "required", "name is required")
+	case utf8.RuneCountInString(spec.Name) > maxAlertNameLen:
+		add("name", "too_long", fmt.Sprintf("name must be at most %d characters", maxAlertNameLen))
+	case !isValidRuleID(spec.Name):
+		add("name", "invalid_format", "name may only contain letters, digits and . _ - : /")
+	}
+	if !alertMetrics[spec.Metric] {
+		add("metric", "invalid_format", "metric must be runs|hits|hit_density|improvement_rate|fix_rate|false_positive_rate")
+	}
+	if alertOperators[spec.Operator] == nil {
+		add("operator", "invalid_format", "operator must be one of > >= < <=")
+	}
+	if spec.Window == "" {
+		add("window", "required", "window is required")
+	} else {
+		rule.WindowDuration = parseDuration("window", spec.Window)
+	}
+	rule.ForDuration = parseDuration("for", spec.For)
+	rule.Repeat = parseDuration("repeat_interval", spec.RepeatInterval)
+
+	checkLen("repo", spec.Repo, maxRepoLen)
+	checkLen("ruleset_version", spec.RulesetVersion, maxVersionLen)
+	checkLen("agent_version", spec.AgentVersion, maxVersionLen)
+	if spec.RuleID != "" {
+		switch {
+		case spec.Metric != alertMetricFixRate && spec.Metric != alertMetricFalsePositiveRate:
+			add("rule_id", "invalid_format", "rule_id only applies to fix_rate and false_positive_rate")
+		case utf8.RuneCountInString(spec.RuleID) > maxRuleIDLen:
+			add("rule_id", "too_long", fmt.Sprintf("rule_id must be at most %d characters", maxRuleIDLen))
+		case !isValidRuleID(spec.RuleID):
+			add("rule_id", "invalid_format", "rule_id may only contain letters, digits and . _ - : /")
+		}
+	}
+
+	if rule.Severity == "" {
+		rule.Severity = "warning"
+	}
+	if rule.Severity != "warning" && rule.Severity != "critical" {
+		add("severity", "invalid_format", "severity must be warning|critical")
+	}
+	for i, name := range spec.Webhooks {
+		if _, ok := p.Webhooks[name]; !ok {
+			add(fmt.Sprintf("webhooks[%d]", i), "not_found", fmt.Sprintf("webhook %q is not configured in alerting.webhooks", name))
+		}
+	}
+	checkLen("webhooks", strings.Join(spec.Webhooks, ","), maxAlertWebhooksLen)
+	return rule, errs
+}
+
+// webhooksFor returns the webhooks rule notifies, ordered by name.
+func (p alertPolicy) webhooksFor(rule alertRule) []alertWebhook {
+	names := rule.Webhooks
+	if len(names) == 0 {
+		for name := range p.Webhooks {
+			names = append(names, name)
+		}
+		sort.Strings(names)
+	}
+	webhooks := make([]alertWebhook, 0, len(names))
+	for _, name := range names {
+		if w, ok := p.Webhooks[name]; ok {
+			webhooks = append(webhooks, w)
+		}
+	}
+	return webhooks
+}
+
+// loadAlertRules returns the config.yaml rules followed by the API rules. An
+// API rule shadowed by a config rule of the same name is skipped, as is one
+// that no longer validates, e.g. because its webhook was removed from the
+// config.
+func loadAlertRules(store Store, policy alertPolicy) ([]alertRule, error) {
+	specs, err := store.ListAlertRules()
+	if err != nil {
+		return nil, err
+	}
+	rules := append([]alertRule(nil), policy.Rules...)
+	for _, spec := range specs {
+		if _, ok := policy.configRule(spec.Name); ok {
+			log.Printf("alerting: rule %q is defined in config.yaml; the API rule is ignored", spec.Name)
+			continue
+		}
+		rule, errs := policy.parseAlertRule(spec, "api")
+		if len(errs) > 0 {
+			log.Printf("alerting: rule %q skipped: %s", spec.Name, validationMessage(errs))
+			continue
+		}
+		rules = append(rules, rule)
+	}
+	return rules, nil
+}
+
+// evaluateAlertRule computes the rule's metric over its window ending at now.
+// A nil value means there was no data, which never fires.
+func evaluateAlertRule(store Store, rule alertRule, now time.Time) (*float64, error) {
+	from, to := now.Add(-rule.WindowDuration), now
+	f := rule.filter()
+	if rule.MinRuns > 0 && rule.Metric != alertMetricRuns {
+		runs, err := store.CountRuns(from, to, f)
+		if err != nil {
+			return nil, err
+		}
+		if runs < uint64(rule.MinRuns) {
+			return nil, nil
+		}
+	}
+
+	switch rule.Metric {
+	case alertMetricRuns:
+		runs, err := store.CountRuns(from, to, f)
+		if err != nil {
+			return nil, err
+		}
+		return floatPtr(float64(runs)), nil
+	case alertMetricHits, alertMetricHitDensity:
+		totals, err := store.LoadRunTotals(from, to, f)
+		if err != nil {
+			return nil, err
+		}
+		if rule.Metric == alertMetricHits {
+			return floatPtr(float64(totals.TotalHits)), nil
+		}
+		if totals.TotalDiffLines == 0 {
+			return nil, nil
+		}
+		return floatPtr(float64(totals.TotalHits) / float64(totals.TotalDiffLines)), nil
+	case alertMetricImprovementRate:
+		stats, err := store.LoadChangeEffectivenessStats(from, to, f, 2)
+		if err != nil {
+			return nil, err
+		}
+		if stats.TotalChanges == 0 {
+			return nil, nil
+		}
+		return floatPtr(stats.AvgImprovementRate), nil
+	case alertMetricFixRate, alertMetricFalsePositiveRate:
+		if rule.RuleID != "" {
+			rows, err := store.ListRuleQuality(from, to, f, ruleQualityListQuery{Sort: "rule_id", Limit: 1})
+			if err != nil || len(rows) == 0 {
+				return nil, err
+			}
+			rate := rows[0].FixRate
+			if rule.Metric == alertMetricFalsePositiveRate {
+				rate = rows[0].FalsePositiveRate
+			}
+			if !rate.Valid {
+				return nil, nil
+			}
+			return floatPtr(rate.Float64), nil
+		}
+		stats, err := store.LoadRuleQualityStats(from, to, f, 1, 1)
+		if err != nil {
+			return nil, err
+		}
+		if rule.Metric == alertMetricFixRate {
+			if stats.TotalRules == 0 {
+				return nil, nil
+			}
+			return floatPtr(stats.AvgFixRate), nil
+		}
+		if stats.TotalFeedback == 0 {
+			return nil, nil
+		}
+		return floatPtr(stats.AvgFalsePositiveRate), nil
+	}
+	return nil, fmt.Errorf("unknown metric %q", rule.Metric)
+}
+
+// advanceAlertState moves state to where value puts it at now: a matching
+// value makes the rule pending, then firing once it has matched for the
+// rule's For duration; anything else, including no data, resolves it.
+func advanceAlertState(state *CrAlertState, rule alertRule, value *float64, now time.Time) {
+	state.Value = value
+	state.EvaluatedAt = now
+	if value != nil && rule.matches(*value) {
+		if state.ActiveSince == nil {
+			state.ActiveSince = &now
+		}
+		if state.State == alertStateFiring {
+			return
+		}
+		if now.Sub(*state.ActiveSince) >= rule.ForDuration {
+			state.State = alertStateFiring
+			state.FiredAt = &now
+			state.ResolvedAt = nil
+			state.Notified = ""
+		} else {
+			state.State = alertStatePending
+		}
+		return
+	}
+	state.ActiveSince = nil
+	if state.State == alertStateFiring {
+		state.ResolvedAt = &now
+	}
+	state.State = alertStateOK
+}
+
+// dueNotification returns the status to deliver for state at now, or "" when
+// the receivers are up to date. A firing episode is announced once, repeated
+// every rule.Repeat if set, and resolved only if its firing was delivered.
+func dueNotification(state CrAlertState, rule alertRule, now time.Time) string {
+	switch {
+	case state.State == alertStateFiring && state.Notified != alertStateFiring:
+		return alertStateFiring
+	case state.State == alertStateFiring && rule.Repeat > 0 && state.NotifiedAt != nil && now.Sub(*state.NotifiedAt) >= rule.Repeat:
+		return alertStateFiring
+	case state.State != alertStateFiring && state.Notified == alertStateFiring:
+		return alertStateResolved
+	}
+	return ""
+}
+
+// alertSilenced reports whether one of the active silences covers rule.
+func alertSilenced(rule alertRule, silences []alertSilenceRow) bool {
+	for _, s := range silences {
+		if (s.RuleName == "" || s.RuleName == rule.Name) && (s.Repo == "" || s.Repo == rule.Repo) {
+			return true
+		}
+	}
+	return false
+}
+
+// alertTally reports one evaluation pass.
+type alertTally struct {
+	Rules    int
+	Firing   int
+	Pending  int
+	Notified int
+	Failed   int
+}
+
+// runAlertEvaluation evaluates every enabled rule at now, advances its state
+// and delivers the notifications that are due and not silenced. A failed
+// delivery is retried on the next pass; receivers can use dedup_key to drop
+// repeats.
+func runAlertEvaluation(store Store, policy alertPolicy, now time.Time) (alertTally, error) {
+	var tally alertTally
+	now = now.UTC()
+	rules, err := loadAlertRules(store, policy)
+	if err != nil {
+		return tally, fmt.Errorf("load rules: %w", err)
+	}
+	states, err := store.LoadAlertStates()
+	if err != nil {
+		return tally, fmt.Errorf("load states: %w", err)
+	}
+	silences, err := store.ListAlertSilences(alertSilenceQuery{ActiveAt: now})
+	if err != nil {
+		return tally, fmt.Errorf("load silences: %w", err)
+	}
+
+	next := make([]CrAlertState, 0, len(rules))
+	for _, rule := range rules {
+		if rule.Disabled {
+			continue
+		}
+		tally.Rules++
+		state, ok := states[rule.Name]
+		if !ok {
+			state = CrAlertState{RuleName: rule.Name, State: alertStateOK}
+		}
+		value, err := evaluateAlertRule(store, rule, now)
+		if err != nil {
+			// Keep the previous state; a failing query is not a resolution.
+			state.LastError = truncateRunes("evaluate: "+err.Error(), maxAlertErrorLen)
+			state.EvaluatedAt = now
+			next = append(next, state)
+			tally.Failed++
+			continue
+		}
+		advanceAlertState(&state, rule, value, now)
+		state.LastError = ""
+
+		if status := dueNotification(state, rule, now); status != "" && !alertSilenced(rule, silences) {
+			if err := sendAlertNotification(policy.webhooksFor(rule), newAlertNotification(rule, state, status, now)); err != nil {
+				state.LastError = truncateRunes("notify: "+err.Error(), maxAlertErrorLen)
+				tally.Failed++
+			} else {
+				state.Notified = status
+				state.NotifiedAt = &now
+				tally.Notified++
+			}
+		}
+		switch state.State {
+		case alertStateFiring:
+			tally.Firing++
+		case alertStatePending:
+			tally.Pending++
+		}
+		next = append(next, state)
+	}
+
+	if err := store.SaveAlertStates(next); err != nil {
+		return tally, fmt.Errorf("save states: %w", err)
+	}
+	return tally, nil
+}
+
+func truncateRunes(s string, maxLen int) string {
+	if utf8.RuneCountInString(s) <= maxLen {
+		return s
+	}
+	return string([]rune(s)[:maxLen])
+}
+
+// startAlertJob runs an evaluation pass right away and then every
+// policy.Interval for the lifetime of the process.
+func startAlertJob(store Store, policy alertPolicy) {
+	go func() {
+		for {
+			tally, err := runAlertEvaluation(store, policy, time.Now())
+			if err != nil {
+				log.Printf("alerting: %v", err)
+			} else if tally.Notified > 0 || tally.Failed > 0 {
+				log.Printf("alerting: %d rules, %d firing, %d notifications sent, %d failures", tally.Rules, tally.Firing, tally.Notified, tally.Failed)
+			}
+			time.Sleep(policy.Interval)
+		}
+	}()
+}
+
+// ListAlertRules returns the rules created through the API, ordered by name.
+func (s *gormStore) ListAlertRules() ([]alertRuleSpec, error) {
+	var records []CrAlertRule
+	if err := s.db.Order("name").Find(&records).Error; err != nil {
+		return nil, err
+	}
+	specs := make([]alertRuleSpec, 0, len(records))
+	for _, r := range records {
+		spec := alertRuleSpec{
+			Name:           r.Name,
+			Metric:         r.Metric,
+			Operator:       r.Operator,
+			Threshold:      r.Threshold,
+			Window:         r.EvalWindow,
+			For:            r.ForDuration,
+			RepeatInterval: r.RepeatInterval,
+			MinRuns:        r.MinRuns,
+			Repo:           r.Repo,
+			RulesetVersion: r.RulesetVersion,
+			AgentVersion:   r.AgentVersion,
+			RuleID:         r.RuleID,
+			Severity:       r.Severity,
+			Webhooks:       []string{},
+			Disabled:       r.Disabled,
+		}
+		if r.Webhooks != "" {
+			spec.Webhooks = strings.Split(r.Webhooks, ",")
+		}
+		specs = append(specs, spec)
+	}
+	return specs, nil
+}
+
+// UpsertAlertRule creates or replaces the API rule called rule.Name and
+// reports whether it was created.
+func (s *gormStore) UpsertAlertRule(rule alertRuleSpec) (bool, error) {
+	now := time.Now().UTC()
+	record := CrAlertRule{
+		Name:           rule.Name,
+		Metric:         rule.Metric,
+		Operator:       rule.Operator,
+		Threshold:      rule.Threshold,
+		EvalWindow:     rule.Window,
+		ForDuration:    rule.For,
+		RepeatInterval: rule.RepeatInterval,
+		MinRuns:        rule.MinRuns,
+		Repo:           rule.Repo,
+		RulesetVersion: rule.RulesetVersion,
+		AgentVersion:   rule.AgentVersion,
+		RuleID:         rule.RuleID,
+		Severity:       rule.Severity,
+		Webhooks:       strings.Join(rule.Webhooks, ","),
+		Disabled:       rule.Disabled,
+		CreatedAt:      now,
+		UpdatedAt:      now,
+	}
+	created := false
+	err := s.db.Transaction(func(tx *gorm.DB) error {
+		var existing int64
+		if err := tx.Model(&CrAlertRule{}).Where("name = ?", rule.Name).Count(&existing).Error; err != nil {
+			return err
+		}
+		created = existing == 0
+		return tx.Clauses(clause.OnConflict{
+			Columns: []clause.Column{{Name: "name"}},
+			DoUpdates: clause.AssignmentColumns([]string{"metric", "operator", "threshold", "eval_window", "for_duration",
+				"repeat_interval", "min_runs", "repo", "ruleset_version", "agent_version", "rule_id", "severity",
+				"webhooks", "disabled", "updated_at"}),
+		}).Create(&record).Error
+	})
+	return created, err
+}
+
+// DeleteAlertRule deletes the API rule called name together with its state.
+// No resolved notification is sent for a rule deleted while firing.
+func (s *gormStore) DeleteAlertRule(name string) (bool, error) {
+	deleted := false
+	err := s.db.Transaction(func(tx *gorm.DB) error {
+		res := tx.Where("name = ?", name).Delete(&CrAlertRule{})
+		if res.Error != nil {
+			return res.Error
+		}
+		deleted = res.RowsAffected > 0
+		return tx.Where("rule_name = ?", name).Delete(&CrAlertState{}).Error
+	})
+	return deleted, err
+}
+
+// LoadAlertStates returns the stored state of every rule keyed by rule name.
+func (s *gormStore) LoadAlertStates() (map[string]CrAlertState, error) {
+	var records []CrAlertState
+	if err := s.db.Find(&records).Error; err != nil {
+		return nil, err
+	}
+	states := make(map[string]CrAlertState, len(records))
+	for _, state := range records {
+		states[state.RuleName] = state
+	}
+	return states, nil
+}
+
+// SaveAlertStates makes states the stored set: the states of rules that were
+// deleted or disabled since are dropped.
+func (s *gormStore) SaveAlertStates(states []CrAlertState) error {
+	return s.db.Transaction(func(tx *gorm.DB) error {
+		if len(states) == 0 {
+			return tx.Where("1 = 1").Delete(&CrAlertState{}).Error
+		}
+		names := make([]string, 0, len(states))
+		for _, state := range states {
+			names = append(names, state.RuleName)
+		}
+		if err := tx.Where("rule_name NOT IN ?", names).Delete(&CrAlertState{}).Error; err != nil {
+			return err
+		}
+		return tx.Clauses(clause.OnConflict{
+			Columns: []clause.Column{{Name: "rule_name"}},
+			DoUpdates: clause.AssignmentColumns([]string{"state", "value", "active_since", "fired_at", "resolved_at",
+				"notified", "notified_at", "last_error", "evaluated_at"}),
+		}).CreateInBatches(&states, batchInsertSize).Error
+	})
+}
+
+// alertSilenceRequest is the body of POST /v1/alert-silences. Empty RuleName
+// and Repo match every rule; EndsAt or Duration sets the end.
+type alertSilenceRequest struct {
+	RuleName  string     `json:"rule_name"`
+	Repo      string     `json:"repo"`
+	StartsAt  *time.Time `json:"starts_at"`
+	EndsAt    *time.Time `json:"ends_at"`
+	Duration  string     `json:"duration"`
+	Comment   string     `json:"comment"`
+	CreatedBy string     `json:"created_by"`
+}
+
+// validateAlertSilence checks req and returns the silence it describes.
+func validateAlertSilence(req alertSilenceRequest, now time.Time) (CrAlertSilence, []fieldError) {
+	var errs []fieldError
+	add := func(field, code, message string) {
+		errs = append(errs, fieldError{Field: field, Code: code, Message: message})
+	}
+	checkLen := func(field, value string, maxLen int) {
+		if utf8.RuneCountInString(value) > maxLen {
+			add(field, "too_long", fmt.Sprintf("%s must be at most %d characters", field, maxLen))
+		}
+	}
+	checkLen("rule_name", req.RuleName, maxAlertNameLen)
+	checkLen("repo", req.Repo, maxRepoLen)
+	checkLen("comment", req.Comment, maxAlertCommentLen)
+	checkLen("created_by", req.CreatedBy, maxAlertCreatedByLen)
+
+	silence := CrAlertSilence{
+		RuleName:  req.RuleName,
+		Repo:      req.Repo,
+		StartsAt:  now,
+		Comment:   req.Comment,
+		CreatedBy: req.CreatedBy,
+		CreatedAt: now,
+	}
+	if req.StartsAt != nil {
+		silence.StartsAt = req.StartsAt.UTC()
+	}
+	switch {
+	case req.EndsAt != nil && req.Duration != "":
+		add("ends_at", "conflict", "set either ends_at or duration, not both")
+	case req.EndsAt != nil:
+		silence.EndsAt = req.EndsAt.UTC()
+	case req.Duration != "":
+		d, err := parseRetentionDuration(req.Duration)
+		if err != nil || d <= 0 {
+			add("duration", "invalid_format", "duration must be a positive duration like 30m, 2h or 7d")
+		}
+		silence.EndsAt = silence.StartsAt.Add(d)
+	default:
+		add("ends_at", "required", "ends_at or duration is required")
+	}
+	if len(errs) == 0 && (!silence.EndsAt.After(silence.StartsAt) || !silence.EndsAt.After(now)) {
+		add("ends_at", "invalid_range", "ends_at must be after starts_at and in the future")
+	}
+	return silence, errs
+}
+
+// alertSilenceQuery selects silences; a non-zero ActiveAt keeps only the ones
+// in effect at that time.
+type alertSilenceQuery struct {
+	ActiveAt time.Time
+	// Repos keeps the silences of the repos the caller may see; nil means
+	// every silence.
+	Repos repoScope
+	Limit int
+}
+
+type alertSilenceRow struct {
+	ID        uint64    `json:"id"`
+	RuleName  string    `json:"rule_name"`
+	Repo      string    `json:"repo"`
+	StartsAt  time.Time `json:"starts_at"`
+	EndsAt    time.Time `json:"ends_at"`
+	Comment   string    `json:"comment"`
+	CreatedBy string    `json:"created_by"`
+	CreatedAt time.Time `json:"created_at"`
+}
+
+func newAlertSilenceRow(s CrAlertSilence) alertSilenceRow {
+	return alertSilenceRow{
+		ID:        s.ID,
+		RuleName:  s.RuleName,
+		Repo:      s.Repo,
+		StartsAt:  s.StartsAt.UTC(),
+		EndsAt:    s.EndsAt.UTC(),
+		Comment:   s.Comment,
+		CreatedBy: s.CreatedBy,
+		CreatedAt: s.CreatedAt.UTC(),
+	}
+}
+
+func (s *gormStore) CreateAlertSilence(silence CrAlertSilence) (alertSilenceRow, error) {
+	if err := s.db.Create(&silence).Error; err != nil {
+		return alertSilenceRow{}, err
+	}
+	return newAlertSilenceRow(silence), nil
+}
+
+// ListAlertSilences returns silences ending last first.
+func (s *gormStore) ListAlertSilences(q alertSilenceQuery) ([]alertSilenceRow, error) {
+	db := applyRepoScope(s.db.Model(&CrAlertSilence{}), "repo", q.Repos)
+	if !q.ActiveAt.IsZero() {
+		db = db.Where("starts_at <= ? AND ends_at > ?", q.ActiveAt, q.ActiveAt)
+	}
+	if q.Limit > 0 {
+		db = db.Limit(q.Limit)
+	}
+	var records []CrAlertSilence
+	if err := db.Order("ends_at DESC, id DESC").Find(&records).Error; err != nil {
+		return nil, err
+	}
+	rows := make([]alertSilenceRow, 0, len(records))
+	for _, record := range records {
+		rows = append(rows, newAlertSilenceRow(record))
+	}
+	return rows, nil
+}
+
+// errSilenceNotFound is returned by ExpireAlertSilence for an unknown id.
+var errSilenceNotFound = errors.New("silence not found")
+
+// ExpireAlertSilence ends the silence id at now, keeping it for the record.
+// Silences that already ended are left unchanged.
+func (s *gormStore) ExpireAlertSilence(id uint64, now time.Time) (alertSilenceRow, error) {
+	var silence CrAlertSilence
+	err := s.db.Transaction(func(tx *gorm.DB) error {
+		if err := tx.First(&silence, id).Error; err != nil {
+			if errors.Is(err, gorm.ErrRecordNotFound) {
+				return errSilenceNotFound
+			}
+			return err
+		}
+		if !silence.EndsAt.After(now) {
+			return nil
+		}
+		silence.EndsAt = now
+		if silence.StartsAt.After(now) {
+			silence.StartsAt = now
+		}
+		return tx.Model(&silence).Updates(map[string]interface{}{"starts_at": silence.StartsAt, "ends_at": silence.EndsAt}).Error
+	})
+	if err != nil {
+		return alertSilenceRow{}, err
+	}
+	return newAlertSilenceRow(silence), nil
+}
+
+// alertStatusRow is one rule with its evaluation state as returned by
+// /api/alerts. Rules that were never evaluated report state ok with a nil
+// evaluated_at; disabled rules report state disabled.
+type alertStatusRow struct {
+	Rule        alertRuleSpec `json:"rule"`
+	Source      string        `json:"source"`
+	State       string        `json:"state"`
+	Value       *float64      `json:"value"`
+	ActiveSince *time.Time    `json:"active_since"`
+	FiredAt     *time.Time    `json:"fired_at"`
+	ResolvedAt  *time.Time    `json:"resolved_at"`
+	Silenced    bool          `json:"silenced"`
+	Notified    string        `json:"notified"`
+	NotifiedAt  *time.Time    `json:"notified_at"`
+	LastError   string        `json:"last_error"`
+	EvaluatedAt *time.Time    `json:"evaluated_at"`
+}
+
+// listAlertStatuses joins every rule with its stored state and the silences
+// active at now.
+func listAlertStatuses(store Store, policy alertPolicy, now time.Time) ([]alertStatusRow, error) {
+	rules, err := loadAlertRules(store, policy)
+	if err != nil {
+		return nil, err
+	}
+	states, err := store.LoadAlertStates()
+	if err != nil {
+		return nil, err
+	}
+	silences, err := store.ListAlertSilences(alertSilenceQuery{ActiveAt: now})
+	if err != nil {
+		return nil, err
+	}
+
+	utc := func(t *time.Time) *time.Time {
+		if t == nil {
+			return nil
+		}
+		u := t.UTC()
+		return &u
+	}
+	rows := make([]alertStatusRow, 0, len(rules))
+	for _, rule := range rules {
+		row := alertStatusRow{Rule: rule.alertRuleSpec, Source: rule.Source, State: alertStateOK, Silenced: alertSilenced(rule, silences)}
+		if row.Rule.Webhooks == nil {
+			row.Rule.Webhooks = []string{}
+		}
+		if state, ok := states[rule.Name]; ok {
+			row.State = state.State
+			row.Value = state.Value
+			row.ActiveSince = utc(state.ActiveSince)
+			row.FiredAt = utc(state.FiredAt)
+			row.ResolvedAt = utc(state.ResolvedAt)
+			row.Notified = state.Notified
+			row.NotifiedAt = utc(state.NotifiedAt)
+			row.LastError = state.LastError
+			row.EvaluatedAt = utc(&state.EvaluatedAt)
+		}
+		if rule.Disabled {
+			row.State = "disabled"
+		}
+		rows = append(rows, row)
+	}
+	return rows, nil
+}
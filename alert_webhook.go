@@ -0,0 +1,103 @@
+package main
+
+import (
+	"bytes"
+	"encoding/json"
+	"fmt"
+	"io"
+	"net/http"
+	"strconv"
+	"time"
+)
+
+// alertNotification is the JSON body POSTed to alert webhooks. The firing and
+// resolved notifications of one episode share DedupKey; a repeated or retried
+// notification carries the same key as the first.
+type alertNotification struct {
+	Status     string        `json:"status"`
+	DedupKey   string        `json:"dedup_key"`
+	Summary    string        `json:"summary"`
+	Rule       alertRuleSpec `json:"rule"`
+	Value      *float64      `json:"value"`
+	FiredAt    time.Time     `json:"fired_at"`
+	ResolvedAt *time.Time    `json:"resolved_at"`
+	SentAt     time.Time     `json:"sent_at"`
+}
+
+func newAlertNotification(rule alertRule, state CrAlertState, status string, now time.Time) alertNotification {
+	n := alertNotification{
+		Status:  status,
+		Rule:    rule.alertRuleSpec,
+		Value:   state.Value,
+		SentAt:  now,
+		Summary: alertSummary(rule, state.Value),
+	}
+	if n.Rule.Webhooks == nil {
+		n.Rule.Webhooks = []string{}
+	}
+	if state.FiredAt != nil {
+		n.FiredAt = state.FiredAt.UTC()
+		n.DedupKey = rule.Name + ":" + strconv.FormatInt(n.FiredAt.Unix(), 10)
+	}
+	if status == alertStateResolved && state.ResolvedAt != nil {
+		resolvedAt := state.ResolvedAt.UTC()
+		n.ResolvedAt = &resolvedAt
+	}
+	return n
+}
+
+// alertSummary describes the condition in one line, e.g.
+// "org/repo hit_density = 0.07 (> 0.05 over 2h)".
+func alertSummary(rule alertRule, value *float64) string {
+	subject := rule.Metric
+	if rule.RuleID != "" {
+		subject = rule.RuleID + " " + subject
+	}
+	if rule.Repo != "" {
+		subject = rule.Repo + " " + subject
+	}
+	current := "no data"
+	if value != nil {
+		current = strconv.FormatFloat(*value, 'g', 4, 64)
+	}
+	return fmt.Sprintf("%s = %s (%s %s over %s)", subject, current, rule.Operator,
+		strconv.FormatFloat(rule.Threshold, 'g', -1, 64), rule.Window)
+}
+
+// sendAlertNotification POSTs n to every webhook and returns the first
+// failure; a non-2xx response counts as one.
+func sendAlertNotification(webhooks []alertWebhook, n alertNotification) error {
+	body, err := json.Marshal(n)
+	if err != nil {
+		return err
+	}
+	var firstErr error
+	for _, w := range webhooks {
+		if err := postAlertWebhook(w, body); err != nil && firstErr == nil {
+			firstErr = fmt.Errorf("webhook %s: %w", w.Name, err)
+		}
+	}
+	return firstErr
+}
+
+func postAlertWebhook(w alertWebhook, body []byte) error {
+	req, err := http.NewRequest(http.MethodPost, w.URL, bytes.NewReader(body))
+	if err != nil {
+		return err
+	}
+	req.Header.Set("Content-Type", "application/json")
+	for key, value := range w.Headers {
+		req.Header.Set(key, value)
+	}
+	client := http.Client{Timeout: w.Timeout}
+	resp, err := client.Do(req)
+	if err != nil {
+		return err
+	}
+	defer resp.Body.Close()
+	io.Copy(io.Discard, io.LimitReader(resp.Body, 64<<10))
+	if resp.StatusCode < 200 || resp.StatusCode > 299 {
+		return fmt.Errorf("unexpected status %s", resp.Status)
+	}
+	return nil
+}
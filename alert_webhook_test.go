@@ -0,0 +1,126 @@
+package main
+
+import (
+	"encoding/json"
+	"net/http"
+	"net/http/httptest"
+	"sync"
+	"testing"
+	"time"
+)
+
+// webhookReceiver records the notifications POSTed to it; the first fail
+// deliveries are answered with 503.
+type webhookReceiver struct {
+	mu       sync.Mutex
+	fail     int
+	received []alertNotification
+	headers  []http.Header
+}
+
+func (rc *webhookReceiver) ServeHTTP(w http.ResponseWriter, r *http.Request) {
+	rc.mu.Lock()
+	defer rc.mu.Unlock()
+	if rc.fail > 0 {
+		rc.fail--
+		w.WriteHeader(http.StatusServiceUnavailable)
+		return
+	}
+	var n alertNotification
+	if err := json.NewDecoder(r.Body).Decode(&n); err != nil {
+		w.WriteHeader(http.StatusBadRequest)
+		return
+	}
+	rc.received = append(rc.received, n)
+	rc.headers = append(rc.headers, r.Header.Clone())
+}
+
+func (rc *webhookReceiver) notifications() []alertNotification {
+	rc.mu.Lock()
+	defer rc.mu.Unlock()
+	return append([]alertNotification(nil), rc.received...)
+}
+
+func TestAlertWebhookFiringToResolved(t *testing.T) {
+	store := newTestStore(t)
+	receiver := &webhookReceiver{fail: 1}
+	srv := httptest.NewServer(receiver)
+	t.Cleanup(srv.Close)
+	policy, err := newAlertPolicy(alertingConfig{
+		Webhooks: []alertWebhookConfig{{Name: "ops", URL: srv.URL, Headers: map[string]string{"X-Token": "secret"}}},
+		Rules:    []alertRuleSpec{{Name: "busy", Metric: alertMetricRuns, Operator: ">=", Threshold: 2, Window: "1h", Repo: "org/a"}},
+	})
+	if err != nil {
+		t.Fatal(err)
+	}
+
+	now := time.Now().UTC().Truncate(time.Second)
+	for i := 1; i <= 2; i++ {
+		run := testRun("org/a", "c1", i, now.Add(-10*time.Minute), map[string]uint32{"R1": 1})
+		if _, _, err := store.CreateAgentRun(pendingAgentRun{Req: run, DiffLines: *run.DiffLines}); err != nil {
+			t.Fatal(err)
+		}
+	}
+
+	// The first delivery fails and is retried on the next pass.
+	tally, err := runAlertEvaluation(store, policy, now)
+	if err != nil {
+		t.Fatal(err)
+	}
+	if tally.Firing != 1 || tally.Failed != 1 || len(receiver.notifications()) != 0 {
+		t.Fatalf("first pass: %+v, %d received", tally, len(receiver.notifications()))
+	}
+	if tally, err = runAlertEvaluation(store, policy, now.Add(time.Minute)); err != nil || tally.Notified != 1 {
+		t.Fatalf("retry: %+v %v", tally, err)
+	}
+	// Still firing, no repeat interval: nothing new is sent.
+	if tally, err = runAlertEvaluation(store, policy, now.Add(2*time.Minute)); err != nil || tally.Notified != 0 {
+		t.Fatalf("still firing: %+v %v", tally, err)
+	}
+	// The runs have left the window.
+	resolvedAt := now.Add(2 * time.Hour)
+	if tally, err = runAlertEvaluation(store, policy, resolvedAt); err != nil || tally.Notified != 1 || tally.Firing != 0 {
+		t.Fatalf("resolve: %+v %v", tally, err)
+	}
+	if tally, err = runAlertEvaluation(store, policy, resolvedAt.Add(time.Minute)); err != nil || tally.Notified != 0 {
+		t.Fatalf("after resolve: %+v %v", tally, err)
+	}
+
+	got := receiver.notifications()
+	if len(got) != 2 {
+		t.Fatalf("received %d notifications, want 2: %+v", len(got), got)
+	}
+	firing, resolved := got[0], got[1]
+	if firing.Status != alertStateFiring || firing.Value == nil || *firing.Value != 2 || !firing.FiredAt.Equal(now) || firing.ResolvedAt != nil {
+		t.Fatalf("firing notification: %+v", firing)
+	}
+	if resolved.Status != alertStateResolved || resolved.ResolvedAt == nil || !resolved.ResolvedAt.Equal(resolvedAt) || !resolved.FiredAt.Equal(now) {
+		t.Fatalf("resolved notification: %+v", resolved)
+	}
+	if firing.DedupKey == "" || resolved.DedupKey != firing.DedupKey {
+		t.Fatalf("dedup keys %q and %q, want one shared key", firing.DedupKey, resolved.DedupKey)
+	}
+	if firing.Rule.Name != "busy" || firing.Summary != "org/a runs = 2 (>= 2 over 1h)" {
+		t.Fatalf("rule %+v, summary %q", firing.Rule, firing.Summary)
+	}
+	for _, h := range receiver.headers {
+		if h.Get("X-Token") != "secret" || h.Get("Content-Type") != "application/json" {
+			t.Fatalf("headers %v", h)
+		}
+	}
+
+	// A new episode gets a new key.
+	for i := 3; i <= 4; i++ {
+		run := testRun("org/a", "c1", i, resolvedAt.Add(-time.Minute), map[string]uint32{"R1": 1})
+		if _, _, err := store.CreateAgentRun(pendingAgentRun{Req: run, DiffLines: *run.DiffLines}); err != nil {
+			t.Fatal(err)
+		}
+	}
+	if _, err := runAlertEvaluation(store, policy, resolvedAt.Add(2*time.Minute)); err != nil {
+		t.Fatal(err)
+	}
+	got = receiver.notifications()
+	if len(got) != 3 || got[2].Status != alertStateFiring || got[2].DedupKey == firing.DedupKey {
+		t.Fatalf("second episode: %+v", got[len(got)-1])
+	}
+}
@@ -0,0 +1,430 @@
+package main
+
+import (
+	"fmt"
+	"log"
+	"math"
+	"sort"
+	"time"
+
+	"gorm.io/gorm"
+	"gorm.io/gorm/clause"
+)
+
+// anomalyConfig is the `anomaly` section of config.yaml.
+type anomalyConfig struct {
+	Enabled       bool    `yaml:"enabled"`
+	Interval      string  `yaml:"interval"`
+	BaselineWeeks int     `yaml:"baseline_weeks"`
+	MinBaseline   int     `yaml:"min_baseline_days"`
+	MinRuns       int     `yaml:"min_runs"`
+	EvaluateDays  int     `yaml:"evaluate_days"`
+	WarningScore  float64 `yaml:"warning_score"`
+	CriticalScore float64 `yaml:"critical_score"`
+}
+
+const (
+	defaultAnomalyInterval      = time.Hour
+	defaultAnomalyBaselineWeeks = 4
+	defaultAnomalyMinBaseline   = 3
+	defaultAnomalyMinRuns       = 5
+	defaultAnomalyEvaluateDays  = 2
+	defaultAnomalyWarningScore  = 3
+	defaultAnomalyCriticalScore = 6
+	// minAnomalySpread floors the baseline standard deviation at this
+	// fraction of its mean, so a few near-identical baseline days do not turn
+	// small wobbles into anomalies.
+	minAnomalySpread = 0.1
+)
+
+// Metrics modelled by the anomaly job; they match /api/timeseries.
+var anomalyMetrics = []string{"runs", "hits", "density"}
+
+// anomalyPolicy is a validated anomalyConfig.
+type anomalyPolicy struct {
+	Interval      time.Duration
+	BaselineWeeks int
+	MinBaseline   int
+	MinRuns       uint64
+	EvaluateDays  int
+	WarningScore  float64
+	CriticalScore float64
+}
+
+func newAnomalyPolicy(cfg anomalyConfig) (anomalyPolicy, error) {
+	policy := anomalyPolicy{
+		Interval:      defaultAnomalyInterval,
+		BaselineWeeks: defaultAnomalyBaselineWeeks,
+		MinBaseline:   defaultAnomalyMinBaseline,
+		MinRuns:       defaultAnomalyMinRuns,
+		EvaluateDays:  defaultAnomalyEvaluateDays,
+		WarningScore:  defaultAnomalyWarningScore,
+		CriticalScore: defaultAnomalyCriticalScore,
+	}
+	if cfg.Interval != "" {
+		interval, err := parseRetentionDuration(cfg.Interval)
+		if err != nil || interval <= 0 {
+			return policy, fmt.Errorf("anomaly.interval: invalid duration %q", cfg.Interval)
+		}
+		policy.Interval = interval
+	}
+	if cfg.BaselineWeeks != 0 {
+		if cfg.BaselineWeeks < 2 || cfg.BaselineWeeks > 52 {
+			return policy, fmt.Errorf("anomaly.baseline_weeks must be between 2 and 52")
+		}
+		policy.BaselineWeeks = cfg.BaselineWeeks
+	}
+	if cfg.MinBaseline != 0 {
+		if cfg.MinBaseline < 2 || cfg.MinBaseline > policy.BaselineWeeks {
+			return policy, fmt.Errorf("anomaly.min_baseline_days must be between 2 and baseline_weeks (%d)", policy.BaselineWeeks)
+		}
+		policy.MinBaseline = cfg.MinBaseline
+	}
+	if policy.MinBaseline > policy.BaselineWeeks {
+		policy.MinBaseline = policy.BaselineWeeks
+	}
+	if cfg.MinRuns != 0 {
+		if cfg.MinRuns < 1 {
+			return policy, fmt.Errorf("anomaly.min_runs must be positive")
+		}
+		policy.MinRuns = uint64(cfg.MinRuns)
+	}
+	if cfg.EvaluateDays != 0 {
+		if cfg.EvaluateDays < 1 || cfg.EvaluateDays > 31 {
+			return policy, fmt.Errorf("anomaly.evaluate_days must be between 1 and 31")
+		}
+		policy.EvaluateDays = cfg.EvaluateDays
+	}
+	if cfg.WarningScore != 0 {
+		policy.WarningScore = cfg.WarningScore
+	}
+	if cfg.CriticalScore != 0 {
+		policy.CriticalScore = cfg.CriticalScore
+	}
+	if policy.WarningScore <= 0 || policy.CriticalScore < policy.WarningScore {
+		return policy, fmt.Errorf("anomaly: need 0 < warning_score <= critical_score")
+	}
+	return policy, nil
+}
+
+// evaluationDays returns the start of the complete UTC days the job checks at
+// now, oldest first. Today is still filling up and is never checked.
+func (p anomalyPolicy) evaluationDays(now time.Time) []time.Time {
+	today := now.UTC().Truncate(24 * time.Hour)
+	days := make([]time.Time, 0, p.EvaluateDays)
+	for i := p.EvaluateDays; i >= 1; i-- {
+		days = append(days, today.AddDate(0, 0, -i))
+	}
+	return days
+}
+
+// dailyRepoTotals is one repo-day of cr_run_rollup.
+type dailyRepoTotals struct {
+	Repo        string
+	BucketStart scanTime
+	Runs        uint64
+	Hits        uint64
+	DiffLines   uint64
+}
+
+// anomalyTally reports one detection pass.
+type anomalyTally struct {
+	Days     int
+	Points   int
+	Recorded int
+	Cleared  int
+}
+
+// LoadDailyRepoTotals returns the day rollups in [from, to) summed per repo.
+func (s *gormStore) LoadDailyRepoTotals(from, to time.Time) ([]dailyRepoTotals, error) {
+	var rows []dailyRepoTotals
+	err := s.db.Model(&CrRunRollup{}).
+		Select("repo, bucket_start, SUM(run_count) AS runs, SUM(total_hits) AS hits, SUM(total_diff_lines) AS diff_lines").
+		Where("granularity = ? AND bucket_start >= ? AND bucket_start < ?", "day", from, to).
+		Group("repo, bucket_start").Scan(&rows).Error
+	return rows, err
+}
+
+// ReplaceAnomalies makes anomalies the recorded set for the consecutive days:
+// points that are no longer anomalous are deleted and the rest are upserted,
+// keeping the detected_at of points found by an earlier pass. It returns how
+// many points were deleted.
+func (s *gormStore) ReplaceAnomalies(days []time.Time, anomalies []CrAnomaly) (int, error) {
+	type pointKey struct {
+		Repo, Metric string
+		Day          time.Time
+	}
+	found := make(map[pointKey]bool, len(anomalies))
+	for _, a := range anomalies {
+		found[pointKey{a.Repo, a.Metric, a.BucketStart.UTC()}] = true
+	}
+
+	cleared := 0
+	err := s.db.Transaction(func(tx *gorm.DB) error {
+		var existing []CrAnomaly
+		if err := tx.Where("bucket_start >= ? AND bucket_start < ?", days[0], days[len(days)-1].AddDate(0, 0, 1)).
+			Find(&existing).Error; err != nil {
+			return err
+		}
+		var stale []uint64
+		for _, a := range existing {
+			if !found[pointKey{a.Repo, a.Metric, a.BucketStart.UTC()}] {
+				stale = append(stale, a.ID)
+			}
+		}
+		if len(stale) > 0 {
+			if err := tx.Where("id IN ?", stale).Delete(&CrAnomaly{}).Error; err != nil {
+				return err
+			}
+			cleared = len(stale)
+		}
+		if len(anomalies) == 0 {
+			return nil
+		}
+		return tx.Clauses(clause.OnConflict{
+			Columns:   []clause.Column{{Name: "repo"}, {Name: "metric"}, {Name: "bucket_start"}},
+			DoUpdates: clause.AssignmentColumns([]string{"value", "expected", "score", "severity", "direction", "baseline_days", "updated_at"}),
+		}).CreateInBatches(&anomalies, batchInsertSize).Error
+	})
+	return cleared, err
+}
+
+// runAnomalyDetection checks the policy's evaluation days of every repo
+// against the same weekday of the preceding weeks and records the outliers.
+func runAnomalyDetection(store Store, policy anomalyPolicy, now time.Time) (anomalyTally, error) {
+	var tally anomalyTally
+	days := policy.evaluationDays(now)
+	tally.Days = len(days)
+	from := days[0].AddDate(0, 0, -7*policy.BaselineWeeks)
+	to := days[len(days)-1].AddDate(0, 0, 1)
+	rows, err := store.LoadDailyRepoTotals(from, to)
+	if err != nil {
+		return tally, fmt.Errorf("load daily totals: %w", err)
+	}
+
+	byRepo := make(map[string]map[time.Time]dailyRepoTotals)
+	for _, row := range rows {
+		if byRepo[row.Repo] == nil {
+			byRepo[row.Repo] = make(map[time.Time]dailyRepoTotals)
+		}
+		byRepo[row.Repo][row.BucketStart.Time.UTC()] = row
+	}
+	repos := make([]string, 0, len(byRepo))
+	for repo := range byRepo {
+		repos = append(repos, repo)
+	}
+	sort.Strings(repos)
+
+	stamp := now.UTC()
+	var anomalies []CrAnomaly
+	for _, repo := range repos {
+		series := byRepo[repo]
+		for _, day := range days {
+			for _, metric := range anomalyMetrics {
+				a, evaluated := detectAnomaly(policy, series, day, metric)
+				if !evaluated {
+					continue
+				}
+				tally.Points++
+				if a == nil {
+					continue
+				}
+				a.Repo = repo
+				a.DetectedAt = stamp
+				a.UpdatedAt = stamp
+				anomalies = append(anomalies, *a)
+			}
+		}
+	}
+
+	cleared, err := store.ReplaceAnomalies(days, anomalies)
+	if err != nil {
+		return tally, fmt.Errorf("record anomalies: %w", err)
+	}
+	tally.Recorded = len(anomalies)
+	tally.Cleared = cleared
+	return tally, nil
+}
+
+// detectAnomaly scores one repo metric on day against the same weekday of the
+// previous policy.BaselineWeeks weeks. Days without runs are not part of a
+// baseline; a scored day without runs counts as zero runs and hits, so a
+// repo that stops reporting shows up as a drop. Density needs policy.MinRuns
+// runs on the scored day. evaluated is false when there is too little data.
+func detectAnomaly(policy anomalyPolicy, series map[time.Time]dailyRepoTotals, day time.Time, metric string) (anomaly *CrAnomaly, evaluated bool) {
+	current := series[day]
+	value, ok := anomalyMetricValue(current, metric)
+	if !ok || (metric == "density" && current.Runs < policy.MinRuns) {
+		return nil, false
+	}
+
+	var baseline []float64
+	var baselineRuns uint64
+	for week := 1; week <= policy.BaselineWeeks; week++ {
+		past, ok := series[day.AddDate(0, 0, -7*week)]
+		if !ok {
+			continue
+		}
+		if v, ok := anomalyMetricValue(past, metric); ok {
+			baseline = append(baseline, v)
+			baselineRuns += past.Runs
+		}
+	}
+	if len(baseline) < policy.MinBaseline {
+		return nil, false
+	}
+	// Repos this small swing wildly from day to day; skip them unless the
+	// scored day itself is busy.
+	if current.Runs < policy.MinRuns && baselineRuns < policy.MinRuns*uint64(len(baseline)) {
+		return nil, false
+	}
+
+	var sum, sumSq float64
+	for _, v := range baseline {
+		sum += v
+		sumSq += v * v
+	}
+	n := float64(len(baseline))
+	mean := sum / n
+	spread := math.Sqrt(math.Max(0, (sumSq-n*mean*mean)/(n-1)))
+	spread = math.Max(spread, minAnomalySpread*math.Abs(mean))
+	if spread == 0 {
+		// An all-zero baseline: any change from zero is scored as far out.
+		if value == 0 {
+			return nil, true
+		}
+		spread = minAnomalySpread * value
+	}
+	score := (value - mean) / spread
+
+	severity := ""
+	switch {
+	case math.Abs(score) >= policy.CriticalScore:
+		severity = "critical"
+	case math.Abs(score) >= policy.WarningScore:
+		severity = "warning"
+	default:
+		return nil, true
+	}
+	direction := "spike"
+	if score < 0 {
+		direction = "drop"
+	}
+	return &CrAnomaly{
+		Metric:       metric,
+		BucketStart:  day,
+		Value:        value,
+		Expected:     mean,
+		Score:        score,
+		Severity:     severity,
+		Direction:    direction,
+		BaselineDays: uint32(len(baseline)),
+	}, true
+}
+
+func anomalyMetricValue(day dailyRepoTotals, metric string) (float64, bool) {
+	switch metric {
+	case "runs":
+		return float64(day.Runs), true
+	case "hits":
+		return float64(day.Hits), true
+	case "density":
+		if day.DiffLines == 0 {
+			return 0, false
+		}
+		return float64(day.Hits) / float64(day.DiffLines), true
+	}
+	return 0, false
+}
+
+// startAnomalyJob runs a detection pass right away and then every
+// policy.Interval for the lifetime of the process.
+func startAnomalyJob(store Store, policy anomalyPolicy) {
+	go func() {
+		for {
+			tally, err := runAnomalyDetection(store, policy, time.Now())
+			if err != nil {
+				log.Printf("anomaly: %v", err)
+			} else if tally.Recorded > 0 || tally.Cleared > 0 {
+				log.Printf("anomaly: %d anomalies over %d points, %d cleared", tally.Recorded, tally.Points, tally.Cleared)
+			}
+			time.Sleep(policy.Interval)
+		}
+	}()
+}
+
+// anomalyQuery pages through cr_anomaly; From/To bound bucket_start.
+type anomalyQuery struct {
+	From     time.Time
+	To       time.Time
+	Repo     string
+	Metric   string
+	Severity string
+	// Repos limits the anomalies to the repos the caller may see; nil means
+	// every repo.
+	Repos  repoScope
+	Limit  int
+	Offset int
+}
+
+type anomalyRow struct {
+	ID           uint64    `json:"id"`
+	Repo         string    `json:"repo"`
+	Metric       string    `json:"metric"`
+	Day          time.Time `json:"day"`
+	Value        float64   `json:"value"`
+	Expected     float64   `json:"expected"`
+	Score        float64   `json:"score"`
+	Severity     string    `json:"severity"`
+	Direction    string    `json:"direction"`
+	BaselineDays uint32    `json:"baseline_days"`
+	DetectedAt   time.Time `json:"detected_at"`
+	UpdatedAt    time.Time `json:"updated_at"`
+}
+
+func (s *gormStore) anomaliesMatching(q anomalyQuery) *gorm.DB {
+	db := s.db.Model(&CrAnomaly{}).Where("bucket_start BETWEEN ? AND ?", q.From, q.To)
+	if q.Repo != "" {
+		db = db.Where("repo = ?", q.Repo)
+	}
+	db = applyRepoScope(db, "repo", q.Repos)
+	if q.Metric != "" {
+		db = db.Where("metric = ?", q.Metric)
+	}
+	if q.Severity != "" {
+		db = db.Where("severity = ?", q.Severity)
+	}
+	return db
+}
+
+// ListAnomalies returns one page of recorded anomalies, newest day first and
+// critical before warning, and the total number of matches.
+func (s *gormStore) ListAnomalies(q anomalyQuery) ([]anomalyRow, uint64, error) {
+	var total uint64
+	if err := s.anomaliesMatching(q).Select("COUNT(*)").Scan(&total).Error; err != nil {
+		return nil, 0, err
+	}
+	var records []CrAnomaly
+	if err := s.anomaliesMatching(q).Order("bucket_start DESC, severity, repo, metric").
+		Limit(q.Limit).Offset(q.Offset).Find(&records).Error; err != nil {
+		return nil, 0, err
+	}
+	rows := make([]anomalyRow, 0, len(records))
+	for _, a := range records {
+		rows = append(rows, anomalyRow{
+			ID:           a.ID,
+			Repo:         a.Repo,
+			Metric:       a.Metric,
+			Day:          a.BucketStart.UTC(),
+			Value:        a.Value,
+			Expected:     a.Expected,
+			Score:        a.Score,
+			Severity:     a.Severity,
+			Direction:    a.Direction,
+			BaselineDays: a.BaselineDays,
+			DetectedAt:   a.DetectedAt.UTC(),
+			UpdatedAt:    a.UpdatedAt.UTC(),
+		})
+	}
+	return rows, total, nil
+}
@@ -0,0 +1,140 @@
+package main
+
+import (
+	"math"
+	"testing"
+	"time"
+)
+
+// anomalySeries builds a repo series with one day of runs per week before
+// day, oldest week last, plus day itself unless current is nil.
+func anomalySeries(day time.Time, current *dailyRepoTotals, baseline ...dailyRepoTotals) map[time.Time]dailyRepoTotals {
+	series := make(map[time.Time]dailyRepoTotals)
+	if current != nil {
+		series[day] = *current
+	}
+	for i, totals := range baseline {
+		series[day.AddDate(0, 0, -7*(i+1))] = totals
+	}
+	return series
+}
+
+func runsDay(runs, hits uint64) dailyRepoTotals {
+	return dailyRepoTotals{Runs: runs, Hits: hits, DiffLines: 1000}
+}
+
+func TestDetectAnomaly(t *testing.T) {
+	policy, err := newAnomalyPolicy(anomalyConfig{})
+	if err != nil {
+		t.Fatal(err)
+	}
+	day := time.Date(2026, 3, 10, 0, 0, 0, 0, time.UTC)
+	// Runs 10, 12, 14, 12: mean 12, sample standard deviation sqrt(8/3).
+	baseline := []dailyRepoTotals{runsDay(10, 0), runsDay(12, 0), runsDay(14, 0), runsDay(12, 0)}
+	sd := math.Sqrt(8.0 / 3)
+	day20 := runsDay(20, 0)
+	day24 := runsDay(24, 0)
+	day13 := runsDay(13, 0)
+	flat := []dailyRepoTotals{runsDay(10, 0), runsDay(10, 0), runsDay(10, 0)}
+	flat13 := runsDay(13, 0)
+	flat12 := runsDay(12, 0)
+	zeroHits := []dailyRepoTotals{runsDay(10, 0), runsDay(10, 0), runsDay(10, 0)}
+	fiveHits := runsDay(10, 5)
+	noHits := runsDay(10, 0)
+	quiet := []dailyRepoTotals{runsDay(1, 0), runsDay(1, 0), runsDay(1, 0)}
+
+	// Other weekdays carry values far from the baseline; they must not count.
+	withOtherDays := anomalySeries(day, &day20, baseline...)
+	for _, offset := range []int{-1, -3, -6, -8} {
+		withOtherDays[day.AddDate(0, 0, offset)] = runsDay(1000, 0)
+	}
+
+	cases := []struct {
+		name      string
+		series    map[time.Time]dailyRepoTotals
+		metric    string
+		evaluated bool
+		severity  string
+		score     float64
+		expected  float64
+	}{
+		{name: "warning spike", series: anomalySeries(day, &day20, baseline...), metric: "runs", evaluated: true, severity: "warning", score: 8 / sd, expected: 12},
+		{name: "critical spike", series: anomalySeries(day, &day24, baseline...), metric: "runs", evaluated: true, severity: "critical", score: 12 / sd, expected: 12},
+		{name: "within range", series: anomalySeries(day, &day13, baseline...), metric: "runs", evaluated: true},
+		{name: "same weekday only", series: withOtherDays, metric: "runs", evaluated: true, severity: "warning", score: 8 / sd, expected: 12},
+		{name: "spread floored at a tenth of the mean", series: anomalySeries(day, &flat13, flat...), metric: "runs", evaluated: true, severity: "warning", score: 3, expected: 10},
+		{name: "below the floored spread", series: anomalySeries(day, &flat12, flat...), metric: "runs", evaluated: true},
+		{name: "zero baseline, no change", series: anomalySeries(day, &noHits, zeroHits...), metric: "hits", evaluated: true},
+		{name: "zero baseline, any change", series: anomalySeries(day, &fiveHits, zeroHits...), metric: "hits", evaluated: true, severity: "critical", score: 10},
+		{name: "missing day is a drop", series: anomalySeries(day, nil, baseline...), metric: "runs", evaluated: true, severity: "critical", score: -12 / sd, expected: 12},
+		{name: "missing day has no density", series: anomalySeries(day, nil, baseline...), metric: "density"},
+		{name: "too few baseline days", series: anomalySeries(day, &day20, baseline[:2]...), metric: "runs"},
+		{name: "quiet repo", series: anomalySeries(day, nil, quiet...), metric: "runs"},
+	}
+	for _, tc := range cases {
+		t.Run(tc.name, func(t *testing.T) {
+			a, evaluated := detectAnomaly(policy, tc.series, day, tc.metric)
+			if evaluated != tc.evaluated {
+				t.Fatalf("evaluated %v, want %v", evaluated, tc.evaluated)
+			}
+			if tc.severity == "" {
+				if a != nil {
+					t.Fatalf("unexpected anomaly %+v", a)
+				}
+				return
+			}
+			if a == nil {
+				t.Fatal("no anomaly")
+			}
+			if a.Severity != tc.severity || math.Abs(a.Score-tc.score) > 1e-9 || a.Expected != tc.expected || !a.BucketStart.Equal(day) {
+				t.Fatalf("anomaly %+v, want %s with score %v and expected %v", a, tc.severity, tc.score, tc.expected)
+			}
+			want := "spike"
+			if tc.score < 0 {
+				want = "drop"
+			}
+			if a.Direction != want {
+				t.Fatalf("direction %s, want %s", a.Direction, want)
+			}
+		})
+	}
+}
+
+// TestAnomalyDetectionFindsSilentRepo runs a detection pass over stored runs
+// where a busy repo stops reporting.
+func TestAnomalyDetectionFindsSilentRepo(t *testing.T) {
+	store := newTestStore(t)
+	policy, err := newAnomalyPolicy(anomalyConfig{EvaluateDays: 1})
+	if err != nil {
+		t.Fatal(err)
+	}
+	now := time.Date(2026, 3, 11, 6, 0, 0, 0, time.UTC)
+	day := now.Truncate(24*time.Hour).AddDate(0, 0, -1)
+	seq := 0
+	for week := 1; week <= policy.BaselineWeeks; week++ {
+		for i := 0; i < 10; i++ {
+			seq++
+			run := testRun("org/a", "c1", seq, day.AddDate(0, 0, -7*week).Add(time.Duration(i)*time.Hour), map[string]uint32{"R1": 1})
+			if _, _, err := store.CreateAgentRun(pendingAgentRun{Req: run, DiffLines: *run.DiffLines}); err != nil {
+				t.Fatal(err)
+			}
+		}
+	}
+
+	tally, err := runAnomalyDetection(store, policy, now)
+	if err != nil {
+		t.Fatal(err)
+	}
+	if tally.Recorded != 2 {
+		t.Fatalf("tally %+v, want drops in runs and hits", tally)
+	}
+	rows, _, err := store.ListAnomalies(anomalyQuery{From: day, To: day, Limit: 10})
+	if err != nil {
+		t.Fatal(err)
+	}
+	for _, row := range rows {
+		if row.Repo != "org/a" || row.Direction != "drop" || row.Value != 0 || (row.Metric != "runs" && row.Metric != "hits") {
+			t.Fatalf("anomaly %+v", row)
+		}
+	}
+}
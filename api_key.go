@@ -0,0 +1,278 @@
+package main
+
+import (
+	"crypto/rand"
+	"crypto/sha256"
+	"encoding/hex"
+	"errors"
+	"fmt"
+	"strings"
+	"time"
+	"unicode/utf8"
+
+	"gorm.io/gorm"
+)
+
+const (
+	// apiKeyPrefix marks secrets issued by this server so they are easy to
+	// spot in logs and secret scanners.
+	apiKeyPrefix      = "crk_"
+	apiKeySecretBytes = 24
+	// apiKeyDisplayLen is how much of a key is kept in clear as key_prefix.
+	apiKeyDisplayLen = len(apiKeyPrefix) + 8
+	maxAPIKeyNameLen = 128
+	// maxAPIKeyRepos bounds the repo scope of one key.
+	maxAPIKeyRepos = 100
+	// maxAPIKeyGrace bounds how long a rotated key keeps working.
+	maxAPIKeyGrace = 7 * 24 * time.Hour
+)
+
+// errAPIKeyNotFound is returned for an unknown or revoked key id.
+var errAPIKeyNotFound = errors.New("API key not found")
+
+// newAPIKeySecret returns a fresh random key and the part of it that is kept
+// in clear for display.
+func newAPIKeySecret() (key, display string, err error) {
+	buf := make([]byte, apiKeySecretBytes)
+	if _, err := rand.Read(buf); err != nil {
+		return "", "", err
+	}
+	key = apiKeyPrefix + hex.EncodeToString(buf)
+	return key, key[:apiKeyDisplayLen], nil
+}
+
+// hashAPIKey is what is stored and looked up instead of the key. Keys are
+// long random strings, so a plain SHA-256 is enough to make a leaked table
+// useless.
+func hashAPIKey(key string) string {
+	sum := sha256.Sum256([]byte(key))
+	return hex.EncodeToString(sum[:])
+}
+
+// apiKeyRequest is the body of POST /v1/admin/api-keys.
+type apiKeyRequest struct {
+	Name  string   `json:"name"`
+	Repos []string `json:"repos"`
+}
+
+func validateAPIKeyRequest(req apiKeyRequest) []fieldError {
+	var errs []fieldError
+	switch {
+	case strings.TrimSpace(req.Name) == "":
+		errs = append(errs, fieldError{Field: "name", Code: "required", Message: "name is required"})
+	case utf8.RuneCountInString(req.Name) > maxAPIKeyNameLen:
+		errs = append(errs, fieldError{Field: "name", Code: "too_long", Message: fmt.Sprintf("name must be at most %d characters", maxAPIKeyNameLen)})
+	}
+	if len(req.Repos) > maxAPIKeyRepos {
+		return append(errs, fieldError{Field: "repos", Code: "too_long", Message: fmt.Sprintf("repos must contain at most %d entries", maxAPIKeyRepos)})
+	}
+	return append(errs, validateRepoPatterns("repos", req.Repos)...)
+}
+
+// apiKeyRow describes a stored key; the key itself is only returned when it
+// is created or rotated.
+type apiKeyRow struct {
+	ID        uint64    `json:"id"`
+	Name      string    `json:"name"`
+	KeyPrefix string    `json:"key_prefix"`
+	Repos     repoScope `json:"repos"`
+	CreatedAt time.Time `json:"created_at"`
+	// PreviousExpiresAt is when the key replaced by the last rotation stops
+	// working.
+	PreviousExpiresAt *time.Time `json:"previous_expires_at"`
+	RotatedAt         *time.Time `json:"rotated_at"`
+	RevokedAt         *time.Time `json:"revoked_at"`
+	LastUsedAt        *time.Time `json:"last_used_at"`
+}
+
+func newAPIKeyRow(key CrAPIKey, repos []string) apiKeyRow {
+	utc := func(t *time.Time) *time.Time {
+		if t == nil {
+			return nil
+		}
+		u := t.UTC()
+		return &u
+	}
+	if repos == nil {
+		repos = []string{}
+	}
+	return apiKeyRow{
+		ID:                key.ID,
+		Name:              key.Name,
+		KeyPrefix:         key.KeyPrefix,
+		Repos:             repos,
+		CreatedAt:         key.CreatedAt.UTC(),
+		PreviousExpiresAt: utc(key.PreviousExpiresAt),
+		RotatedAt:         utc(key.RotatedAt),
+		RevokedAt:         utc(key.RevokedAt),
+		LastUsedAt:        utc(key.LastUsedAt),
+	}
+}
+
+// CreateAPIKey stores a new key, given as its hash, scoped to repos.
+func (s *gormStore) CreateAPIKey(name string, repos []string, keyHash, keyPrefix string) (apiKeyRow, error) {
+	now := time.Now().UTC()
+	key := CrAPIKey{Name: name, KeyPrefix: keyPrefix, KeyHash: keyHash, CreatedAt: now}
+	err := s.db.Transaction(func(tx *gorm.DB) error {
+		if err := tx.Create(&key).Error; err != nil {
+			return err
+		}
+		scopes := make([]CrAPIKeyRepo, 0, len(repos))
+		for _, repo := range repos {
+			scopes = append(scopes, CrAPIKeyRepo{KeyID: key.ID, RepoPattern: repo})
+		}
+		return tx.Create(&scopes).Error
+	})
+	if err != nil {
+		return apiKeyRow{}, err
+	}
+	return newAPIKeyRow(key, repos), nil
+}
+
+func (s *gormStore) loadAPIKeyRepos(db *gorm.DB, ids []uint64) (map[uint64][]string, error) {
+	var scopes []CrAPIKeyRepo
+	if err := db.Where("key_id IN ?", ids).Order("key_id, repo_pattern").Find(&scopes).Error; err != nil {
+		return nil, err
+	}
+	repos := make(map[uint64][]string, len(ids))
+	for _, scope := range scopes {
+		repos[scope.KeyID] = append(repos[scope.KeyID], scope.RepoPattern)
+	}
+	return repos, nil
+}
+
+// ListAPIKeys returns the keys ordered by id, skipping revoked ones unless
+// includeRevoked is set.
+func (s *gormStore) ListAPIKeys(includeRevoked bool) ([]apiKeyRow, error) {
+	db := s.db.Order("id")
+	if !includeRevoked {
+		db = db.Where("revoked_at IS NULL")
+	}
+	var keys []CrAPIKey
+	if err := db.Find(&keys).Error; err != nil {
+		return nil, err
+	}
+	rows := make([]apiKeyRow, 0, len(keys))
+	if len(keys) == 0 {
+		return rows, nil
+	}
+	ids := make([]uint64, 0, len(keys))
+	for _, key := range keys {
+		ids = append(ids, key.ID)
+	}
+	repos, err := s.loadAPIKeyRepos(s.db, ids)
+	if err != nil {
+		return nil, err
+	}
+	for _, key := range keys {
+		rows = append(rows, newAPIKeyRow(key, repos[key.ID]))
+	}
+	return rows, nil
+}
+
+// activeAPIKey loads key id unless it does not exist or was revoked.
+func activeAPIKey(tx *gorm.DB, id uint64) (CrAPIKey, error) {
+	var key CrAPIKey
+	if err := tx.Where("revoked_at IS NULL").First(&key, id).Error; err != nil {
+		if errors.Is(err, gorm.ErrRecordNotFound) {
+			return key, errAPIKeyNotFound
+		}
+		return key, err
+	}
+	return key, nil
+}
+
+// RotateAPIKey replaces the secret of key id with the one hashed as keyHash.
+// The old secret keeps working for grace; a zero grace disables it at once.
+func (s *gormStore) RotateAPIKey(id uint64, keyHash, keyPrefix string, grace time.Duration) (apiKeyRow, error) {
+	now := time.Now().UTC()
+	var key CrAPIKey
+	var repos map[uint64][]string
+	err := s.db.Transaction(func(tx *gorm.DB) error {
+		var err error
+		if key, err = activeAPIKey(tx, id); err != nil {
+			return err
+		}
+		key.PreviousKeyHash = ""
+		key.PreviousExpiresAt = nil
+		if grace > 0 {
+			expires := now.Add(grace)
+			key.PreviousKeyHash = key.KeyHash
+			key.PreviousExpiresAt = &expires
+		}
+		key.KeyHash = keyHash
+		key.KeyPrefix = keyPrefix
+		key.RotatedAt = &now
+		if err := tx.Model(&key).Select("key_hash", "key_prefix", "previous_key_hash", "previous_expires_at", "rotated_at").
+			Updates(&key).Error; err != nil {
+			return err
+		}
+		repos, err = s.loadAPIKeyRepos(tx, []uint64{id})
+		return err
+	})
+	if err != nil {
+		return apiKeyRow{}, err
+	}
+	return newAPIKeyRow(key, repos[id]), nil
+}
+
+// RevokeAPIKey disables key id, including a rotated secret still in its
+// grace period. The key is kept for the record.
+func (s *gormStore) RevokeAPIKey(id uint64, now time.Time) (apiKeyRow, error) {
+	var key CrAPIKey
+	var repos map[uint64][]string
+	err := s.db.Transaction(func(tx *gorm.DB) error {
+		var err error
+		if key, err = activeAPIKey(tx, id); err != nil {
+			return err
+		}
+		key.RevokedAt = &now
+		if err := tx.Model(&key).Update("revoked_at", now).Error; err != nil {
+			return err
+		}
+		repos, err = s.loadAPIKeyRepos(tx, []uint64{id})
+		return err
+	})
+	if err != nil {
+		return apiKeyRow{}, err
+	}
+	return newAPIKeyRow(key, repos[id]), nil
+}
+
+// apiKeyAuth is what the ingestion middleware needs to know about a key.
+type apiKeyAuth struct {
+	ID         uint64
+	Repos      repoScope
+	LastUsedAt *time.Time
+}
+
+// LookupAPIKey finds the active key whose current secret, or rotated secret
+// still in its grace period, hashes to keyHash. It returns nil when there is
+// none.
+func (s *gormStore) LookupAPIKey(keyHash string, now time.Time) (*apiKeyAuth, error) {
+	var key CrAPIKey
+	err := s.db.Where("revoked_at IS NULL").
+		Where("key_hash = ? OR (previous_key_hash = ? AND previous_expires_at > ?)", keyHash, keyHash, now).
+		First(&key).Error
+	if errors.Is(err, gorm.ErrRecordNotFound) {
+		return nil, nil
+	}
+	if err != nil {
+		return nil, err
+	}
+	repos, err := s.loadAPIKeyRepos(s.db, []uint64{key.ID})
+	if err != nil {
+		return nil, err
+	}
+	// A key whose repo rows are gone may report for no repo; a nil scope
+	// would let it report for all of them.
+	scope := repoScope(repos[key.ID])
+	if scope == nil {
+		scope = repoScope{}
+	}
+	return &apiKeyAuth{ID: key.ID, Repos: scope, LastUsedAt: key.LastUsedAt}, nil
+}
+
+func (s *gormStore) TouchAPIKey(id uint64, now time.Time) error {
+	return s.db.Model(&CrAPIKey{}).Where("id = ?", id).Update("last_used_at", now).Error
+}
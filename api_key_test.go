@@ -0,0 +1,172 @@
+package main
+
+import (
+	"net/http"
+	"testing"
+	"time"
+)
+
+// createTestAPIKey stores a new key for repos and returns its secret.
+func createTestAPIKey(t *testing.T, store *gormStore, repos ...string) (string, apiKeyRow) {
+	t.Helper()
+	secret, display, err := newAPIKeySecret()
+	if err != nil {
+		t.Fatal(err)
+	}
+	row, err := store.CreateAPIKey("ci", repos, hashAPIKey(secret), display)
+	if err != nil {
+		t.Fatal(err)
+	}
+	return secret, row
+}
+
+func TestAPIKeyLifecycle(t *testing.T) {
+	store := newTestStore(t)
+	first, row := createTestAPIKey(t, store, "org/*", "other/service")
+	if row.KeyPrefix != first[:apiKeyDisplayLen] || len(row.Repos) != 2 {
+		t.Fatalf("created key %+v", row)
+	}
+	lookup := func(secret string, at time.Time) *apiKeyAuth {
+		t.Helper()
+		key, err := store.LookupAPIKey(hashAPIKey(secret), at)
+		if err != nil {
+			t.Fatal(err)
+		}
+		return key
+	}
+	now := time.Now().UTC()
+	key := lookup(first, now)
+	if key == nil || key.ID != row.ID || !key.Repos.allows("org/a") || !key.Repos.allows("other/service") || key.Repos.allows("other/x") {
+		t.Fatalf("lookup of a new key: %+v", key)
+	}
+	if key := lookup("crk_unknown", now); key != nil {
+		t.Fatalf("unknown key found: %+v", key)
+	}
+
+	second, _, _ := newAPIKeySecret()
+	rotated, err := store.RotateAPIKey(row.ID, hashAPIKey(second), second[:apiKeyDisplayLen], time.Hour)
+	if err != nil {
+		t.Fatal(err)
+	}
+	if rotated.PreviousExpiresAt == nil || rotated.RotatedAt == nil || len(rotated.Repos) != 2 {
+		t.Fatalf("rotated key %+v", rotated)
+	}
+	expires := *rotated.PreviousExpiresAt
+	if key := lookup(second, now); key == nil || key.ID != row.ID {
+		t.Fatalf("new secret after rotation: %+v", key)
+	}
+	if key := lookup(first, expires.Add(-time.Minute)); key == nil || key.ID != row.ID {
+		t.Fatalf("previous secret within the grace period: %+v", key)
+	}
+	if key := lookup(first, expires.Add(time.Minute)); key != nil {
+		t.Fatalf("previous secret after the grace period: %+v", key)
+	}
+
+	// Rotating again without grace drops the secret still in its grace.
+	third, _, _ := newAPIKeySecret()
+	if _, err := store.RotateAPIKey(row.ID, hashAPIKey(third), third[:apiKeyDisplayLen], 0); err != nil {
+		t.Fatal(err)
+	}
+	for _, secret := range []string{first, second} {
+		if key := lookup(secret, now); key != nil {
+			t.Fatalf("replaced secret still works: %+v", key)
+		}
+	}
+
+	revoked, err := store.RevokeAPIKey(row.ID, now)
+	if err != nil {
+		t.Fatal(err)
+	}
+	if revoked.RevokedAt == nil {
+		t.Fatalf("revoked key %+v", revoked)
+	}
+	if key := lookup(third, now); key != nil {
+		t.Fatalf("revoked key found: %+v", key)
+	}
+	if _, err := store.RevokeAPIKey(row.ID, now); err != errAPIKeyNotFound {
+		t.Fatalf("revoking twice: %v", err)
+	}
+	if _, err := store.RotateAPIKey(row.ID, hashAPIKey(third), third[:apiKeyDisplayLen], 0); err != errAPIKeyNotFound {
+		t.Fatalf("rotating a revoked key: %v", err)
+	}
+	listed, err := store.ListAPIKeys(false)
+	if err != nil || len(listed) != 0 {
+		t.Fatalf("active keys %v, %v", listed, err)
+	}
+	if listed, err = store.ListAPIKeys(true); err != nil || len(listed) != 1 {
+		t.Fatalf("all keys %v, %v", listed, err)
+	}
+}
+
+func TestAPIKeyWithoutReposAllowsNoRepo(t *testing.T) {
+	store := newTestStore(t)
+	secret, row := createTestAPIKey(t, store, "org/a")
+	if err := store.db.Where("key_id = ?", row.ID).Delete(&CrAPIKeyRepo{}).Error; err != nil {
+		t.Fatal(err)
+	}
+	key, err := store.LookupAPIKey(hashAPIKey(secret), time.Now())
+	if err != nil || key == nil {
+		t.Fatalf("lookup: %+v, %v", key, err)
+	}
+	if key.Repos == nil || key.Repos.allows("org/a") {
+		t.Fatalf("scope %#v, want an empty scope", key.Repos)
+	}
+
+	base := newTestServer(t, store, authPolicy{APIKey: true}, alertPolicy{})
+	run := testRun("org/a", "c1", 1, time.Now().Add(-time.Hour), map[string]uint32{"R1": 1})
+	header := http.Header{"Authorization": {"Bearer " + secret}}
+	if status, body := doRequest(t, http.MethodPost, base+"/v1/metrics/agent-runs", run, header); status != http.StatusForbidden {
+		t.Fatalf("status %d %s, want 403", status, body)
+	}
+}
+
+// TestAPIKeyTouchIsThrottled checks that last_used_at is written at most once
+// per apiKeyTouchInterval.
+func TestAPIKeyTouchIsThrottled(t *testing.T) {
+	store := newTestStore(t)
+	secret, row := createTestAPIKey(t, store, "org/a")
+	base := newTestServer(t, store, authPolicy{APIKey: true}, alertPolicy{})
+	header := http.Header{"Authorization": {"Bearer " + secret}}
+	seq := 0
+	report := func() {
+		t.Helper()
+		seq++
+		run := testRun("org/a", "c1", seq, time.Now().Add(-time.Hour), map[string]uint32{"R1": 1})
+		if status, body := doRequest(t, http.MethodPost, base+"/v1/metrics/agent-runs", run, header); status != http.StatusOK {
+			t.Fatalf("status %d %s", status, body)
+		}
+	}
+	lastUsed := func() *time.Time {
+		t.Helper()
+		var key CrAPIKey
+		if err := store.db.First(&key, row.ID).Error; err != nil {
+			t.Fatal(err)
+		}
+		return key.LastUsedAt
+	}
+	setLastUsed := func(at time.Time) {
+		t.Helper()
+		if err := store.TouchAPIKey(row.ID, at); err != nil {
+			t.Fatal(err)
+		}
+	}
+
+	report()
+	if lastUsed() == nil {
+		t.Fatal("last_used_at not set on first use")
+	}
+
+	recent := time.Now().UTC().Add(-apiKeyTouchInterval / 2).Truncate(time.Second)
+	setLastUsed(recent)
+	report()
+	if got := lastUsed(); got == nil || !got.Equal(recent) {
+		t.Fatalf("last_used_at %v rewritten within the interval, want %v", got, recent)
+	}
+
+	stale := time.Now().UTC().Add(-2 * apiKeyTouchInterval).Truncate(time.Second)
+	setLastUsed(stale)
+	report()
+	if got := lastUsed(); got == nil || !got.After(stale) {
+		t.Fatalf("last_used_at %v not updated after the interval", got)
+	}
+}
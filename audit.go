@@ -0,0 +1,339 @@
+package main
+
+import (
+	"bytes"
+	"encoding/json"
+	"flag"
+	"io"
+	"log"
+	"net/http"
+	"os"
+	"os/user"
+	"sync"
+	"time"
+
+	"github.com/gin-gonic/gin"
+	"gorm.io/datatypes"
+	"gorm.io/gorm"
+)
+
+const (
+	// maxAuditBodyBytes bounds the request body kept in an audit entry;
+	// larger bodies, e.g. ruleset manifests, are recorded by size only.
+	maxAuditBodyBytes = 16 << 10
+	// maxAuditResponseBytes is how much of the response is kept to read the
+	// error code and message of a failed request.
+	maxAuditResponseBytes = 4 << 10
+	maxAuditActorLen      = 128
+	maxAuditTargetLen     = 255
+	maxAuditRemoteAddrLen = 64
+	maxAuditErrorLen      = 64
+	maxAuditMessageLen    = 1024
+	// maxAuditRefusalsPerMinute caps the entries for requests refused
+	// before their handler ran, see auditRefusals.
+	maxAuditRefusalsPerMinute = 60
+
+	auditResultSuccess = "success"
+	auditResultFailure = "failure"
+
+	// auditCommandActorPrefix marks the actors of maintenance commands.
+	auditCommandActorPrefix = "cli:"
+
+	// auditTargetKey holds the target named by the handler in the gin
+	// context.
+	auditTargetKey = "audit_target"
+)
+
+// auditParams is what params_json holds: the query string and the JSON body
+// of the request, or the size of a body too large or not JSON.
+type auditParams struct {
+	Query     map[string][]string `json:"query,omitempty"`
+	Body      json.RawMessage     `json:"body,omitempty"`
+	BodyBytes int                 `json:"body_bytes,omitempty"`
+	// Flags are the flags a maintenance command was given.
+	Flags map[string]string `json:"flags,omitempty"`
+}
+
+// auditWriter keeps the start of the response so the error of a failed
+// request can be recorded.
+type auditWriter struct {
+	gin.ResponseWriter
+	head bytes.Buffer
+}
+
+func (w *auditWriter) keep(b []byte) {
+	if room := maxAuditResponseBytes - w.head.Len(); room > 0 {
+		if len(b) > room {
+			b = b[:room]
+		}
+		w.head.Write(b)
+	}
+}
+
+func (w *auditWriter) Write(b []byte) (int, error) {
+	w.keep(b)
+	return w.ResponseWriter.Write(b)
+}
+
+func (w *auditWriter) WriteString(s string) (int, error) {
+	w.keep([]byte(s))
+	return w.ResponseWriter.WriteString(s)
+}
+
+// auditBody keeps the start of the request body as the handler reads it, so
+// a body no handler reads, e.g. of a request refused by auth, is never
+// buffered or recorded.
+type auditBody struct {
+	io.ReadCloser
+	head bytes.Buffer
+	read int
+}
+
+func (b *auditBody) Read(p []byte) (int, error) {
+	n, err := b.ReadCloser.Read(p)
+	if room := maxAuditBodyBytes + 1 - b.head.Len(); room > 0 {
+		b.head.Write(p[:min(n, room)])
+	}
+	b.read += n
+	return n, err
+}
+
+// auditRefusals caps how many requests refused before reaching their handler
+// are recorded per minute: anyone can send those, and the log is
+// append-only. The ones over the cap are only counted in the server log.
+type auditRefusals struct {
+	mu      sync.Mutex
+	window  time.Time
+	used    int
+	dropped int
+}
+
+func (r *auditRefusals) allow(now time.Time) bool {
+	r.mu.Lock()
+	defer r.mu.Unlock()
+	if window := now.Truncate(time.Minute); !window.Equal(r.window) {
+		if r.dropped > 0 {
+			log.Printf("audit: %d refused requests after the first %d of the minute from %s were not recorded",
+				r.dropped, maxAuditRefusalsPerMinute, r.window.Format(time.RFC3339))
+		}
+		r.window, r.used, r.dropped = window, 0, 0
+	}
+	if r.used >= maxAuditRefusalsPerMinute {
+		r.dropped++
+		return false
+	}
+	r.used++
+	return true
+}
+
+// auditLog registers routes with the audit log; the routes of one router
+// share the cap on refused requests.
+type auditLog struct {
+	store    Store
+	refusals auditRefusals
+}
+
+func newAuditLog(store Store) *auditLog {
+	return &auditLog{store: store}
+}
+
+// auditTarget names the object a request acts on, e.g. an alert rule; the
+// handlers call it once they know it.
+func auditTarget(c *gin.Context, target string) {
+	c.Set(auditTargetKey, target)
+}
+
+// record registers a route with the audit log under action. It goes in front
+// of the route's auth middleware so refused requests are recorded too, and
+// appends one entry once the request is done. A request refused before its
+// handler ran is recorded without its body, and only up to
+// maxAuditRefusalsPerMinute of them. A failure to write the entry is logged;
+// it does not fail the request.
+func (a *auditLog) record(action string) gin.HandlerFunc {
+	return func(c *gin.Context) {
+		started := time.Now().UTC()
+		var body *auditBody
+		if c.Request.Body != nil {
+			body = &auditBody{ReadCloser: c.Request.Body}
+			c.Request.Body = body
+		}
+		writer := &auditWriter{ResponseWriter: c.Writer}
+		c.Writer = writer
+
+		c.Next()
+
+		// Only middleware aborts; a handler answers with c.JSON. A refusal
+		// by forbidRepo comes from an authenticated caller and is kept.
+		caller := callerOf(c)
+		if c.IsAborted() && caller == nil && !a.refusals.allow(started) {
+			return
+		}
+		entry := CrAuditLog{
+			CreatedAt:  started,
+			Action:     action,
+			Target:     truncateRunes(c.GetString(auditTargetKey), maxAuditTargetLen),
+			Status:     writer.Status(),
+			Result:     auditResultSuccess,
+			RemoteAddr: c.ClientIP(),
+		}
+		if caller != nil {
+			entry.Actor = caller.User
+		}
+		params := auditParams{Query: c.Request.URL.Query()}
+		if body != nil && body.read > 0 {
+			head := body.head.Bytes()
+			switch {
+			case len(head) <= maxAuditBodyBytes && json.Valid(head):
+				params.Body = head
+			case c.Request.ContentLength > 0:
+				params.BodyBytes = int(c.Request.ContentLength)
+			default:
+				params.BodyBytes = body.read
+			}
+		}
+		if raw, err := json.Marshal(params); err == nil {
+			entry.ParamsJSON = datatypes.JSON(raw)
+		} else {
+			entry.ParamsJSON = datatypes.JSON("{}")
+		}
+		if entry.Status >= http.StatusBadRequest {
+			entry.Result = auditResultFailure
+			var resp errResponse
+			if json.Unmarshal(writer.head.Bytes(), &resp) == nil {
+				entry.Error = truncateRunes(resp.Error, maxAuditErrorLen)
+				entry.Message = truncateRunes(resp.Message, maxAuditMessageLen)
+			}
+		}
+		if err := a.store.AppendAuditEntry(entry); err != nil {
+			log.Printf("audit: record %s by %q: %v", action, entry.Actor, err)
+		}
+	}
+}
+
+// auditCommand appends an entry for a maintenance command that changed
+// data, e.g. `rebuild-summaries`. The actor is the OS user prefixed with
+// cli:, the params are the flags other than -config and the status is 0. Like
+// the middleware it only logs a failure to write the entry.
+func auditCommand(store Store, action, target string, fs *flag.FlagSet, runErr error) {
+	flags := make(map[string]string)
+	fs.Visit(func(f *flag.Flag) {
+		if f.Name != "config" {
+			flags[f.Name] = f.Value.String()
+		}
+	})
+	entry := CrAuditLog{
+		CreatedAt: time.Now().UTC(),
+		Actor:     commandActor(),
+		Action:    action,
+		Target:    truncateRunes(target, maxAuditTargetLen),
+		Result:    auditResultSuccess,
+	}
+	if host, err := os.Hostname(); err == nil {
+		entry.RemoteAddr = truncateRunes(host, maxAuditRemoteAddrLen)
+	}
+	if raw, err := json.Marshal(auditParams{Flags: flags}); err == nil {
+		entry.ParamsJSON = datatypes.JSON(raw)
+	} else {
+		entry.ParamsJSON = datatypes.JSON("{}")
+	}
+	if runErr != nil {
+		entry.Result = auditResultFailure
+		entry.Message = truncateRunes(runErr.Error(), maxAuditMessageLen)
+	}
+	if err := store.AppendAuditEntry(entry); err != nil {
+		log.Printf("audit: record %s by %q: %v", action, entry.Actor, err)
+	}
+}
+
+// commandActor names the OS user running a maintenance command.
+func commandActor() string {
+	name := os.Getenv("USER")
+	if u, err := user.Current(); err == nil {
+		name = u.Username
+	}
+	return truncateRunes(auditCommandActorPrefix+name, maxAuditActorLen)
+}
+
+// auditQuery pages through cr_audit_log; zero From/To leave the range open.
+type auditQuery struct {
+	From   time.Time
+	To     time.Time
+	Actor  string
+	Action string
+	Result string
+	Limit  int
+	Offset int
+}
+
+type auditRow struct {
+	ID         uint64          `json:"id"`
+	CreatedAt  time.Time       `json:"created_at"`
+	Actor      string          `json:"actor"`
+	Action     string          `json:"action"`
+	Target     string          `json:"target"`
+	Params     json.RawMessage `json:"params"`
+	Status     int             `json:"status"`
+	Result     string          `json:"result"`
+	Error      string          `json:"error"`
+	Message    string          `json:"message"`
+	RemoteAddr string          `json:"remote_addr"`
+}
+
+// AppendAuditEntry adds entry to the audit log. There is deliberately no way
+// to change or remove entries.
+func (s *gormStore) AppendAuditEntry(entry CrAuditLog) error {
+	return s.db.Create(&entry).Error
+}
+
+// ListAuditEntries returns one page of audit entries, newest first, and the
+// number of entries matching q.
+func (s *gormStore) ListAuditEntries(q auditQuery) ([]auditRow, uint64, error) {
+	matching := func() *gorm.DB {
+		db := s.db.Model(&CrAuditLog{})
+		if !q.From.IsZero() {
+			db = db.Where("created_at >= ?", q.From)
+		}
+		if !q.To.IsZero() {
+			db = db.Where("created_at <= ?", q.To)
+		}
+		if q.Actor != "" {
+			db = db.Where("actor = ?", q.Actor)
+		}
+		if q.Action != "" {
+			db = db.Where("action = ?", q.Action)
+		}
+		if q.Result != "" {
+			db = db.Where("result = ?", q.Result)
+		}
+		return db
+	}
+	var total uint64
+	if err := matching().Select("COUNT(*)").Scan(&total).Error; err != nil {
+		return nil, 0, err
+	}
+	var records []CrAuditLog
+	if err := matching().Order("created_at DESC, id DESC").Limit(q.Limit).Offset(q.Offset).Find(&records).Error; err != nil {
+		return nil, 0, err
+	}
+	rows := make([]auditRow, 0, len(records))
+	for _, r := range records {
+		params := json.RawMessage(r.ParamsJSON)
+		if !json.Valid(params) {
+			params = json.RawMessage("{}")
+		}
+		rows = append(rows, auditRow{
+			ID:         r.ID,
+			CreatedAt:  r.CreatedAt.UTC(),
+			Actor:      r.Actor,
+			Action:     r.Action,
+			Target:     r.Target,
+			Params:     params,
+			Status:     r.Status,
+			Result:     r.Result,
+			Error:      r.Error,
+			Message:    r.Message,
+			RemoteAddr: r.RemoteAddr,
+		})
+	}
+	return rows, total, nil
+}
@@ -0,0 +1,231 @@
+package main
+
+import (
+	"encoding/json"
+	"net/http"
+	"os"
+	"path/filepath"
+	"strings"
+	"testing"
+	"time"
+
+	"gorm.io/datatypes"
+)
+
+func TestAuditRecordsRequests(t *testing.T) {
+	store := newTestStore(t)
+	base := newTestServer(t, store, authPolicy{AdminToken: testAdminToken}, alertPolicy{})
+	admin := http.Header{"Authorization": {"Bearer " + testAdminToken}}
+
+	catalog := map[string]interface{}{"rules": []map[string]string{{"rule_id": "R1", "title": "Unchecked error"}}}
+	if status, body := doRequest(t, http.MethodPost, base+"/v1/rule-catalog", catalog, nil); status != http.StatusOK {
+		t.Fatalf("upsert: %d %s", status, body)
+	}
+	if status, body := doRequest(t, http.MethodPost, base+"/v1/rule-catalog", `{"rules":[]}`, nil); status != http.StatusBadRequest {
+		t.Fatalf("empty upsert: %d %s", status, body)
+	}
+	// Refused before the handler: the body is not recorded.
+	if status, body := doRequest(t, http.MethodDelete, base+"/v1/admin/api-keys?id=7", `{"secret":"x"}`, nil); status != http.StatusUnauthorized {
+		t.Fatalf("no token: %d %s", status, body)
+	}
+	if status, body := doRequest(t, http.MethodDelete, base+"/v1/admin/api-keys?id=7", nil, admin); status != http.StatusNotFound {
+		t.Fatalf("unknown key: %d %s", status, body)
+	}
+	// Reads are not audited.
+	if status, body := doRequest(t, http.MethodGet, base+"/v1/admin/api-keys", nil, admin); status != http.StatusOK {
+		t.Fatalf("list keys: %d %s", status, body)
+	}
+
+	rows, total, err := store.ListAuditEntries(auditQuery{Limit: 10})
+	if err != nil {
+		t.Fatal(err)
+	}
+	if total != 4 || len(rows) != 4 {
+		t.Fatalf("%d entries (total %d), want 4: %+v", len(rows), total, rows)
+	}
+	// Newest first.
+	notFound, refused, invalid, upsert := rows[0], rows[1], rows[2], rows[3]
+
+	var params auditParams
+	decodeJSON(t, upsert.Params, &params)
+	if upsert.Action != "rule_catalog.upsert" || upsert.Target != "R1" || upsert.Status != http.StatusOK ||
+		upsert.Result != auditResultSuccess || upsert.Error != "" || upsert.Actor != "" || !strings.Contains(string(params.Body), `"Unchecked error"`) {
+		t.Fatalf("upsert entry %+v", upsert)
+	}
+	if invalid.Result != auditResultFailure || invalid.Status != http.StatusBadRequest || invalid.Error != "VALIDATION_ERROR" ||
+		!strings.Contains(invalid.Message, "at least one rule") || string(invalid.Params) != `{"body":{"rules":[]}}` {
+		t.Fatalf("invalid entry %+v", invalid)
+	}
+	params = auditParams{}
+	decodeJSON(t, refused.Params, &params)
+	if refused.Action != "api_key.revoke" || refused.Result != auditResultFailure || refused.Error != "UNAUTHORIZED" ||
+		refused.Target != "" || params.Body != nil || params.BodyBytes != 0 || params.Query["id"][0] != "7" {
+		t.Fatalf("refused entry %+v", refused)
+	}
+	if notFound.Actor != adminTokenUser || notFound.Target != "7" || notFound.Status != http.StatusNotFound || notFound.Error != "NOT_FOUND" {
+		t.Fatalf("not found entry %+v", notFound)
+	}
+}
+
+func TestAuditLargeBodyRecordsSize(t *testing.T) {
+	store := newTestStore(t)
+	base := newTestServer(t, store, authPolicy{}, alertPolicy{})
+	rules := make([]map[string]string, 0, 400)
+	for i := 0; i < 400; i++ {
+		rules = append(rules, map[string]string{"rule_id": "R" + strings.Repeat("x", 40) + string(rune('a'+i%26)), "title": strings.Repeat("t", 20)})
+	}
+	raw, err := json.Marshal(map[string]interface{}{"rules": rules})
+	if err != nil {
+		t.Fatal(err)
+	}
+	doRequest(t, http.MethodPost, base+"/v1/rule-catalog", raw, nil)
+	rows, _, err := store.ListAuditEntries(auditQuery{Limit: 10})
+	if err != nil {
+		t.Fatal(err)
+	}
+	var params auditParams
+	if len(rows) == 1 {
+		decodeJSON(t, rows[0].Params, &params)
+	}
+	if len(rows) != 1 || params.Body != nil || params.BodyBytes != len(raw) {
+		t.Fatalf("entries %+v, want one with body_bytes %d", rows, len(raw))
+	}
+}
+
+func TestAuditRefusalsAreCapped(t *testing.T) {
+	var refusals auditRefusals
+	minute := mustTime(t, "2026-10-01T10:00:00Z")
+	for i := 0; i < maxAuditRefusalsPerMinute; i++ {
+		if !refusals.allow(minute.Add(time.Duration(i) * time.Second / 2)) {
+			t.Fatalf("refusal %d not allowed", i)
+		}
+	}
+	if refusals.allow(minute.Add(59 * time.Second)) {
+		t.Fatal("refusal over the cap allowed")
+	}
+	if !refusals.allow(minute.Add(time.Minute)) {
+		t.Fatal("cap not reset in the next minute")
+	}
+}
+
+func TestListAuditEntriesFilters(t *testing.T) {
+	store := newTestStore(t)
+	at := mustTime(t, "2026-10-01T10:00:00Z")
+	entries := []CrAuditLog{
+		{CreatedAt: at, Actor: "alice", Action: "alert_rule.upsert", Result: auditResultSuccess, Status: 200},
+		{CreatedAt: at.Add(time.Minute), Actor: "bob", Action: "alert_rule.upsert", Result: auditResultFailure, Status: 400},
+		{CreatedAt: at.Add(2 * time.Minute), Actor: "alice", Action: "api_key.create", Result: auditResultSuccess, Status: 200},
+		{CreatedAt: at.Add(3 * time.Minute), Actor: "alice", Action: "alert_rule.upsert", Result: auditResultSuccess, Status: 200},
+		// Same timestamp as the previous one: the later id comes first.
+		{CreatedAt: at.Add(3 * time.Minute), Actor: "", Action: "api_key.revoke", Result: auditResultFailure, Status: 401},
+	}
+	for _, e := range entries {
+		if e.ParamsJSON == nil {
+			e.ParamsJSON = datatypes.JSON("{}")
+		}
+		if err := store.AppendAuditEntry(e); err != nil {
+			t.Fatal(err)
+		}
+	}
+
+	cases := []struct {
+		name  string
+		q     auditQuery
+		ids   []uint64
+		total uint64
+	}{
+		{name: "all", q: auditQuery{}, ids: []uint64{5, 4, 3, 2, 1}, total: 5},
+		{name: "actor", q: auditQuery{Actor: "alice"}, ids: []uint64{4, 3, 1}, total: 3},
+		{name: "action", q: auditQuery{Action: "alert_rule.upsert"}, ids: []uint64{4, 2, 1}, total: 3},
+		{name: "result", q: auditQuery{Result: auditResultFailure}, ids: []uint64{5, 2}, total: 2},
+		{name: "from", q: auditQuery{From: at.Add(2 * time.Minute)}, ids: []uint64{5, 4, 3}, total: 3},
+		{name: "to", q: auditQuery{To: at.Add(time.Minute)}, ids: []uint64{2, 1}, total: 2},
+		{name: "combined", q: auditQuery{Actor: "alice", Action: "alert_rule.upsert", From: at.Add(time.Second)}, ids: []uint64{4}, total: 1},
+		{name: "page", q: auditQuery{Limit: 2, Offset: 1}, ids: []uint64{4, 3}, total: 5},
+	}
+	for _, tc := range cases {
+		t.Run(tc.name, func(t *testing.T) {
+			if tc.q.Limit == 0 {
+				tc.q.Limit = 100
+			}
+			rows, total, err := store.ListAuditEntries(tc.q)
+			if err != nil {
+				t.Fatal(err)
+			}
+			ids := make([]uint64, 0, len(rows))
+			for _, row := range rows {
+				ids = append(ids, row.ID)
+			}
+			if total != tc.total || len(ids) != len(tc.ids) {
+				t.Fatalf("ids %v total %d, want %v total %d", ids, total, tc.ids, tc.total)
+			}
+			for i := range ids {
+				if ids[i] != tc.ids[i] {
+					t.Fatalf("ids %v, want %v", ids, tc.ids)
+				}
+			}
+		})
+	}
+
+	rows, _, err := store.ListAuditEntries(auditQuery{Limit: 1})
+	if err != nil {
+		t.Fatal(err)
+	}
+	if string(rows[0].Params) != "{}" || !rows[0].CreatedAt.Equal(at.Add(3*time.Minute)) || rows[0].CreatedAt.Location() != time.UTC {
+		t.Fatalf("row %+v", rows[0])
+	}
+}
+
+func TestAuditRecordsCommands(t *testing.T) {
+	dir := t.TempDir()
+	configPath := filepath.Join(dir, "config.yaml")
+	config := "storage:\n  driver: sqlite\nsqlite:\n  path: " + filepath.Join(dir, "cli.db") + "\n"
+	if err := os.WriteFile(configPath, []byte(config), 0o600); err != nil {
+		t.Fatal(err)
+	}
+	commands := [][]string{
+		{"migrate", "up", "-config", configPath},
+		{"rebuild-summaries", "-config", configPath, "-repo", "org/a", "-dry-run"},
+		{"rebuild-summaries", "-config", configPath, "-repo", "org/a"},
+		{"verify", "-config", configPath},
+		{"rebuild-rollups", "-config", configPath, "-from", "2026-10-01T00:00:00Z", "-to", "2026-09-01T00:00:00Z"},
+	}
+	for _, args := range commands {
+		// The last one is refused before it touches the store.
+		if err := runCommand(args[0], args[1:]); err != nil && args[0] != "rebuild-rollups" {
+			t.Fatalf("%v: %v", args, err)
+		}
+	}
+
+	cfg, err := loadConfig(configPath)
+	if err != nil {
+		t.Fatal(err)
+	}
+	store, err := openStore(cfg)
+	if err != nil {
+		t.Fatal(err)
+	}
+	t.Cleanup(func() {
+		if sqlDB, err := store.(*gormStore).db.DB(); err == nil {
+			sqlDB.Close()
+		}
+	})
+	rows, _, err := store.ListAuditEntries(auditQuery{Limit: 10})
+	if err != nil {
+		t.Fatal(err)
+	}
+	// Dry runs, plain verify and refused commands change nothing.
+	if len(rows) != 2 {
+		t.Fatalf("entries %+v, want 2", rows)
+	}
+	rebuild, migrate := rows[0], rows[1]
+	var params auditParams
+	decodeJSON(t, rebuild.Params, &params)
+	if rebuild.Action != "summaries.rebuild" || rebuild.Target != "org/a" || rebuild.Result != auditResultSuccess ||
+		!strings.HasPrefix(rebuild.Actor, auditCommandActorPrefix) || len(params.Flags) != 1 || params.Flags["repo"] != "org/a" {
+		t.Fatalf("rebuild entry %+v", rebuild)
+	}
+	if migrate.Action != "migration.up" || !strings.HasPrefix(migrate.Target, "0001,0002,") || migrate.Status != 0 {
+		t.Fatalf("migrate entry %+v", migrate)
+	}
+}
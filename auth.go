@@ -0,0 +1,238 @@
+package main
+
+import (
+	"crypto/subtle"
+	"fmt"
+	"log"
+	"net/http"
+	"strings"
+	"time"
+
+	"github.com/gin-gonic/gin"
+)
+
+// authConfig is the `auth` section of config.yaml.
+type authConfig struct {
+	// Ingest lists the credentials the ingestion routes accept: api_key
+	// and/or hmac. Empty leaves them open.
+	Ingest []string `yaml:"ingest"`
+	// HMAC configures signed reports (auth.ingest: [hmac]).
+	HMAC hmacConfig `yaml:"hmac"`
+	// AdminToken guards the /v1/admin routes, run deletion and the audit
+	// log; without it or OIDC those routes are refused.
+	AdminToken string `yaml:"admin_token"`
+	// OIDC protects the dashboard, /api and the management routes.
+	OIDC oidcConfig `yaml:"oidc"`
+}
+
+const (
+	authMethodAPIKey = "api_key"
+	// minAdminTokenLen keeps admin tokens out of guessing range.
+	minAdminTokenLen = 16
+	// apiKeyTouchInterval limits last_used_at writes to one per key per
+	// interval, so busy keys do not add a write to every report.
+	apiKeyTouchInterval = time.Minute
+	// ingestScopeKey holds the repoScope of the authenticated caller in the
+	// gin context.
+	ingestScopeKey = "ingest_scope"
+	// adminTokenUser is the principal name of a caller authenticated with
+	// auth.admin_token, e.g. in the audit log.
+	adminTokenUser = "admin_token"
+)
+
+// authPolicy is a validated authConfig.
+type authPolicy struct {
+	APIKey      bool
+	HMAC        bool
+	HMACWindow  time.Duration
+	HMACSecrets []hmacSecret
+	AdminToken  string
+	// OIDC is nil unless auth.oidc is configured.
+	OIDC *oidcVerifier
+}
+
+func newAuthPolicy(cfg authConfig) (authPolicy, error) {
+	policy := authPolicy{AdminToken: cfg.AdminToken}
+	for _, method := range cfg.Ingest {
+		switch method {
+		case authMethodAPIKey:
+			policy.APIKey = true
+		case authMethodHMAC:
+			policy.HMAC = true
+		default:
+			return policy, fmt.Errorf("auth.ingest: unknown method %q (expected api_key or hmac)", method)
+		}
+	}
+	if policy.HMAC {
+		var err error
+		if policy.HMACWindow, policy.HMACSecrets, err = newHMACSecrets(cfg.HMAC); err != nil {
+			return policy, err
+		}
+	}
+	if cfg.AdminToken != "" && len(cfg.AdminToken) < minAdminTokenLen {
+		return policy, fmt.Errorf("auth.admin_token must be at least %d characters", minAdminTokenLen)
+	}
+	if o := cfg.OIDC; o.Issuer != "" || o.JWKSFile != "" || o.JWKSURL != "" {
+		var err error
+		if policy.OIDC, err = newOIDCVerifier(o); err != nil {
+			return policy, err
+		}
+	}
+	return policy, nil
+}
+
+// ingestOpen reports whether the ingestion routes accept unauthenticated
+// reports.
+func (p authPolicy) ingestOpen() bool {
+	return !p.APIKey && !p.HMAC
+}
+
+// repoScope lists the repos one credential may report for: exact names or
+// prefixes written as "org/*".
+type repoScope []string
+
+func (s repoScope) allows(repo string) bool {
+	for _, pattern := range s {
+		if prefix, ok := strings.CutSuffix(pattern, "*"); ok {
+			if strings.HasPrefix(repo, prefix) {
+				return true
+			}
+		} else if pattern == repo {
+			return true
+		}
+	}
+	return false
+}
+
+// validateRepoPatterns checks the repo scope of an API key.
+func validateRepoPatterns(field string, patterns []string) []fieldError {
+	var errs []fieldError
+	if len(patterns) == 0 {
+		return append(errs, fieldError{Field: field, Code: "required", Message: field + " must list at least one repo"})
+	}
+	seen := make(map[string]bool, len(patterns))
+	for i, pattern := range patterns {
+		name := fmt.Sprintf("%s[%d]", field, i)
+		prefix, wildcard := strings.CutSuffix(pattern, "/*")
+		switch {
+		case strings.TrimSpace(pattern) == "":
+			errs = append(errs, fieldError{Field: name, Code: "required", Message: "repo patterns must not be empty"})
+		case len(pattern) > maxRepoLen:
+			errs = append(errs, fieldError{Field: name, Code: "too_long", Message: fmt.Sprintf("repo patterns must be at most %d characters", maxRepoLen)})
+		case strings.Contains(prefix, "*") || (wildcard && prefix == ""):
+			errs = append(errs, fieldError{Field: name, Code: "invalid_format", Message: "repo patterns are a repo name or a prefix ending in /*, like org/*"})
+		case seen[pattern]:
+			errs = append(errs, fieldError{Field: name, Code: "duplicate", Message: fmt.Sprintf("repo pattern %s is listed twice", pattern)})
+		}
+		seen[pattern] = true
+	}
+	return errs
+}
+
+// ingestScope returns the repos the caller may report for, or nil when the
+// ingestion routes are open.
+func ingestScope(c *gin.Context) repoScope {
+	if scope, ok := c.Get(ingestScopeKey); ok {
+		return scope.(repoScope)
+	}
+	return nil
+}
+
+// scopeErrors rejects a run whose repo is outside scope; a nil scope allows
+// every repo.
+func scopeErrors(scope repoScope, run pendingAgentRun) []fieldError {
+	if scope == nil || scope.allows(run.Req.Repo) {
+		return nil
+	}
+	return []fieldError{{Field: "repo", Code: "forbidden", Message: fmt.Sprintf("the credential may not report runs for repo %s", run.Req.Repo)}}
+}
+
+// bearerToken returns the token of an `Authorization: Bearer` header, falling
+// back to X-API-Key.
+func bearerToken(c *gin.Context) string {
+	if token, ok := strings.CutPrefix(c.GetHeader("Authorization"), "Bearer "); ok {
+		return strings.TrimSpace(token)
+	}
+	return strings.TrimSpace(c.GetHeader("X-API-Key"))
+}
+
+func abortUnauthorized(c *gin.Context, message string) {
+	c.Header("WWW-Authenticate", "Bearer")
+	c.AbortWithStatusJSON(http.StatusUnauthorized, errResponse{OK: false, Error: "UNAUTHORIZED", Message: message})
+}
+
+// requireIngestAuth authenticates the ingestion routes with the methods of
+// policy and records the caller's repo scope for the handlers, which reject
+// runs for other repos. A request carrying X-Signature is checked as a signed
+// report, anything else as an API key. With streamed, signed reports sign
+// their Content-Digest rather than the body; see verifySignature.
+func requireIngestAuth(store Store, policy authPolicy, streamed bool) gin.HandlerFunc {
+	replays := newReplayCache()
+	return func(c *gin.Context) {
+		if policy.ingestOpen() {
+			c.Next()
+			return
+		}
+		now := time.Now().UTC()
+		if policy.HMAC && isSigned(c) {
+			scope, ok := verifySignature(c, policy, replays, now, streamed)
+			if !ok {
+				return
+			}
+			c.Set(ingestScopeKey, scope)
+			c.Next()
+			return
+		}
+		if !policy.APIKey {
+			abortUnauthorized(c, fmt.Sprintf("a signed report is required (%s, %s and %s headers)", signatureRepoHeader, signatureTimestampHeader, signatureHeader))
+			return
+		}
+		token := bearerToken(c)
+		if token == "" {
+			abortUnauthorized(c, "an API key is required (Authorization: Bearer <key>)")
+			return
+		}
+		key, err := store.LookupAPIKey(hashAPIKey(token), now)
+		if err != nil {
+			c.AbortWithStatusJSON(http.StatusInternalServerError, errResponse{OK: false, Error: "INTERNAL_ERROR", Message: err.Error()})
+			return
+		}
+		if key == nil {
+			abortUnauthorized(c, "the API key is invalid or revoked")
+			return
+		}
+		if key.LastUsedAt == nil || now.Sub(*key.LastUsedAt) >= apiKeyTouchInterval {
+			if err := store.TouchAPIKey(key.ID, now); err != nil {
+				log.Printf("auth: record last_used_at of API key %d: %v", key.ID, err)
+			}
+		}
+		c.Set(ingestScopeKey, key.Repos)
+		c.Next()
+	}
+}
+
+// requireAdmin guards the /v1/admin routes, run deletion and the audit log
+// with auth.admin_token or, with auth.oidc, a token of the admin role.
+// Without either the routes are refused.
+func requireAdmin(policy authPolicy) gin.HandlerFunc {
+	return func(c *gin.Context) {
+		if policy.AdminToken == "" && policy.OIDC == nil {
+			c.AbortWithStatusJSON(http.StatusForbidden, errResponse{OK: false, Error: "FORBIDDEN", Message: "auth.admin_token is not configured"})
+			return
+		}
+		token := bearerToken(c)
+		if policy.AdminToken != "" && subtle.ConstantTimeCompare([]byte(token), []byte(policy.AdminToken)) == 1 {
+			c.Set(principalKey, &principal{User: adminTokenUser, Role: roleAdmin})
+			c.Next()
+			return
+		}
+		if policy.OIDC == nil {
+			abortUnauthorized(c, "the admin token is missing or wrong")
+			return
+		}
+		if authenticate(c, policy.OIDC, roleAdmin) == nil {
+			return
+		}
+		c.Next()
+	}
+}
@@ -0,0 +1,270 @@
+package main
+
+import (
+	"bytes"
+	"crypto/hmac"
+	"crypto/sha256"
+	"encoding/base64"
+	"encoding/hex"
+	"errors"
+	"fmt"
+	"hash"
+	"io"
+	"net/http"
+	"strconv"
+	"strings"
+	"sync"
+	"time"
+
+	"github.com/gin-gonic/gin"
+)
+
+// hmacConfig is the `auth.hmac` section of config.yaml.
+type hmacConfig struct {
+	// Window is how far the signed timestamp may be from the server clock,
+	// e.g. "5m".
+	Window  string             `yaml:"window"`
+	Secrets []hmacSecretConfig `yaml:"secrets"`
+}
+
+// hmacSecretConfig is one signing secret and the repos it may report for.
+type hmacSecretConfig struct {
+	Repos  []string `yaml:"repos"`
+	Secret string   `yaml:"secret"`
+}
+
+const (
+	authMethodHMAC = "hmac"
+	// Headers of a signed report. The signature is "sha256=" + hex of the
+	// HMAC-SHA256 of method, path, repo, timestamp and body joined by
+	// newlines; see signRequest.
+	signatureRepoHeader      = "X-Signature-Repo"
+	signatureTimestampHeader = "X-Signature-Timestamp"
+	signatureHeader          = "X-Signature"
+	signatureScheme          = "sha256="
+	// contentDigestHeader carries the SHA-256 of a streamed body, as
+	// "sha-256=:<base64>:" (RFC 9530). Streamed reports sign it instead of
+	// the body, which is checked against it as it is read.
+	contentDigestHeader = "Content-Digest"
+	contentDigestPrefix = "sha-256=:"
+	defaultHMACWindow   = 5 * time.Minute
+	// maxHMACWindow bounds the window, and with it how long signatures are
+	// remembered to reject replays.
+	maxHMACWindow      = time.Hour
+	minHMACSecretLen   = 16
+	maxSignedBodyBytes = 32 << 20
+)
+
+// errBodyDigestMismatch is the read error of a streamed body that does not
+// match its Content-Digest.
+var errBodyDigestMismatch = errors.New("the request body does not match its " + contentDigestHeader)
+
+// hmacSecret is a validated hmacSecretConfig.
+type hmacSecret struct {
+	Scope  repoScope
+	Secret []byte
+}
+
+func newHMACSecrets(cfg hmacConfig) (time.Duration, []hmacSecret, error) {
+	window := defaultHMACWindow
+	if cfg.Window != "" {
+		d, err := parseRetentionDuration(cfg.Window)
+		if err != nil || d <= 0 || d > maxHMACWindow {
+			return 0, nil, fmt.Errorf("auth.hmac.window: invalid duration %q (expected at most %s)", cfg.Window, maxHMACWindow)
+		}
+		window = d
+	}
+	if len(cfg.Secrets) == 0 {
+		return 0, nil, fmt.Errorf("auth.hmac.secrets must list at least one secret when auth.ingest includes hmac")
+	}
+	secrets := make([]hmacSecret, 0, len(cfg.Secrets))
+	for i, s := range cfg.Secrets {
+		if errs := validateRepoPatterns("repos", s.Repos); len(errs) > 0 {
+			return 0, nil, fmt.Errorf("auth.hmac.secrets[%d].%s: %s", i, errs[0].Field, errs[0].Message)
+		}
+		if len(s.Secret) < minHMACSecretLen {
+			return 0, nil, fmt.Errorf("auth.hmac.secrets[%d].secret must be at least %d characters", i, minHMACSecretLen)
+		}
+		secrets = append(secrets, hmacSecret{Scope: s.Repos, Secret: []byte(s.Secret)})
+	}
+	return window, secrets, nil
+}
+
+// hmacSecretsFor returns the secrets whose repos include repo, in config
+// order. A repo can have several while its secret is being rotated.
+func (p authPolicy) hmacSecretsFor(repo string) []hmacSecret {
+	var secrets []hmacSecret
+	for _, secret := range p.HMACSecrets {
+		if secret.Scope.allows(repo) {
+			secrets = append(secrets, secret)
+		}
+	}
+	return secrets
+}
+
+// signRequest returns the X-Signature value of a request. Signing the
+// method, path and repo keeps a signature from being replayed against
+// another route or used to pick another repo's secret.
+func signRequest(secret []byte, method, path, repo, timestamp string, body []byte) string {
+	mac := hmac.New(sha256.New, secret)
+	for _, part := range []string{method, path, repo, timestamp} {
+		mac.Write([]byte(part))
+		mac.Write([]byte("\n"))
+	}
+	mac.Write(body)
+	return signatureScheme + hex.EncodeToString(mac.Sum(nil))
+}
+
+// isSigned reports whether the request carries a signature rather than a
+// bearer token.
+func isSigned(c *gin.Context) bool {
+	return c.GetHeader(signatureHeader) != ""
+}
+
+// replayCache remembers the signatures accepted within the window, so a
+// captured request cannot be sent again while its timestamp is still valid.
+// It is per process; instances behind a load balancer do not share it.
+type replayCache struct {
+	mu        sync.Mutex
+	seen      map[string]time.Time
+	nextPrune time.Time
+}
+
+func newReplayCache() *replayCache {
+	return &replayCache{seen: make(map[string]time.Time)}
+}
+
+// remember records signature until expires and reports false when it was
+// already recorded.
+func (r *replayCache) remember(signature string, expires, now time.Time) bool {
+	r.mu.Lock()
+	defer r.mu.Unlock()
+	if !now.Before(r.nextPrune) {
+		for sig, exp := range r.seen {
+			if !exp.After(now) {
+				delete(r.seen, sig)
+			}
+		}
+		r.nextPrune = now.Add(time.Minute)
+	}
+	if exp, ok := r.seen[signature]; ok && exp.After(now) {
+		return false
+	}
+	r.seen[signature] = expires
+	return true
+}
+
+// digestReader passes a streamed body through and fails the read that reaches
+// its end when the body does not hash to want.
+type digestReader struct {
+	r    io.ReadCloser
+	hash hash.Hash
+	want []byte
+}
+
+func (d *digestReader) Read(p []byte) (int, error) {
+	n, err := d.r.Read(p)
+	d.hash.Write(p[:n])
+	if err == io.EOF && !hmac.Equal(d.hash.Sum(nil), d.want) {
+		return n, errBodyDigestMismatch
+	}
+	return n, err
+}
+
+func (d *digestReader) Close() error {
+	return d.r.Close()
+}
+
+// parseContentDigest returns the SHA-256 of a Content-Digest header value.
+func parseContentDigest(value string) ([]byte, bool) {
+	encoded, ok := strings.CutPrefix(value, contentDigestPrefix)
+	if !ok {
+		return nil, false
+	}
+	encoded, ok = strings.CutSuffix(encoded, ":")
+	if !ok {
+		return nil, false
+	}
+	sum, err := base64.StdEncoding.DecodeString(encoded)
+	if err != nil || len(sum) != sha256.Size {
+		return nil, false
+	}
+	return sum, true
+}
+
+// verifySignature authenticates a signed report and returns the repo scope of
+// the secret that signed it; every secret configured for the repo is tried.
+// The body is read in full and put back for the handler. A streamed report
+// signs its Content-Digest header instead, and its body is left unread and
+// checked against the digest as the handler reads it. It writes the error
+// response itself and returns false when the request is refused.
+func verifySignature(c *gin.Context, policy authPolicy, replays *replayCache, now time.Time, streamed bool) (repoScope, bool) {
+	repo := strings.TrimSpace(c.GetHeader(signatureRepoHeader))
+	timestamp := strings.TrimSpace(c.GetHeader(signatureTimestampHeader))
+	signature := strings.TrimSpace(c.GetHeader(signatureHeader))
+	if repo == "" || timestamp == "" {
+		abortUnauthorized(c, fmt.Sprintf("signed reports need the %s and %s headers", signatureRepoHeader, signatureTimestampHeader))
+		return nil, false
+	}
+	unix, err := strconv.ParseInt(timestamp, 10, 64)
+	if err != nil {
+		abortUnauthorized(c, fmt.Sprintf("%s must be a Unix time in seconds", signatureTimestampHeader))
+		return nil, false
+	}
+	signedAt := time.Unix(unix, 0)
+	if skew := now.Sub(signedAt); skew > policy.HMACWindow || skew < -policy.HMACWindow {
+		abortUnauthorized(c, fmt.Sprintf("the signature timestamp is more than %s away from the server time", policy.HMACWindow))
+		return nil, false
+	}
+	secrets := policy.hmacSecretsFor(repo)
+	if len(secrets) == 0 {
+		abortUnauthorized(c, fmt.Sprintf("no signing secret is configured for repo %s", repo))
+		return nil, false
+	}
+
+	// signed is what the signature covers after the headers: the body, or
+	// the Content-Digest of a streamed one.
+	var signed, digest []byte
+	if streamed {
+		value := strings.TrimSpace(c.GetHeader(contentDigestHeader))
+		sum, ok := parseContentDigest(value)
+		if !ok {
+			abortUnauthorized(c, fmt.Sprintf("signed streams need a %s header of the form %s<base64 of the SHA-256 of the body>:", contentDigestHeader, contentDigestPrefix))
+			return nil, false
+		}
+		signed, digest = []byte(value), sum
+	} else {
+		body, err := io.ReadAll(io.LimitReader(c.Request.Body, maxSignedBodyBytes+1))
+		if err != nil {
+			c.AbortWithStatusJSON(http.StatusBadRequest, errResponse{OK: false, Error: "VALIDATION_ERROR", Message: err.Error()})
+			return nil, false
+		}
+		if len(body) > maxSignedBodyBytes {
+			c.AbortWithStatusJSON(http.StatusRequestEntityTooLarge, errResponse{OK: false, Error: "VALIDATION_ERROR", Message: fmt.Sprintf("signed request bodies must be at most %d MiB", maxSignedBodyBytes>>20)})
+			return nil, false
+		}
+		signed = body
+	}
+	var scope repoScope
+	matched := false
+	for _, secret := range secrets {
+		if hmac.Equal([]byte(signature), []byte(signRequest(secret.Secret, c.Request.Method, c.Request.URL.Path, repo, timestamp, signed))) {
+			scope, matched = secret.Scope, true
+			break
+		}
+	}
+	if !matched {
+		abortUnauthorized(c, "the signature does not match the request")
+		return nil, false
+	}
+	if !replays.remember(signature, signedAt.Add(policy.HMACWindow), now) {
+		abortUnauthorized(c, "the signature was already used")
+		return nil, false
+	}
+	if streamed {
+		c.Request.Body = &digestReader{r: c.Request.Body, hash: sha256.New(), want: digest}
+	} else {
+		c.Request.Body = io.NopCloser(bytes.NewReader(signed))
+	}
+	return scope, true
+}
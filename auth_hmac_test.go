@@ -0,0 +1,226 @@
+package main
+
+import (
+	"bytes"
+	"crypto/sha256"
+	"encoding/base64"
+	"encoding/json"
+	"net/http"
+	"strconv"
+	"testing"
+	"time"
+)
+
+const (
+	testHMACSecret = "hmac-secret-0123456789"
+	// testHMACNext is the secret org/a is being rotated to; it also covers
+	// the rest of org/*.
+	testHMACNext = "hmac-secret-next-0123456789"
+)
+
+// signedRequest describes how a test request is signed; zero fields take the
+// values of the request actually sent.
+type signedRequest struct {
+	secret   string
+	method   string
+	path     string
+	repo     string
+	signedAt time.Time
+}
+
+func (s signedRequest) header(sentRepo string, body []byte) http.Header {
+	ts := strconv.FormatInt(s.signedAt.Unix(), 10)
+	return http.Header{
+		signatureRepoHeader:      {sentRepo},
+		signatureTimestampHeader: {ts},
+		signatureHeader:          {signRequest([]byte(s.secret), s.method, s.path, s.repo, ts, body)},
+	}
+}
+
+func testHMACPolicy() authPolicy {
+	return authPolicy{
+		HMAC:       true,
+		HMACWindow: 5 * time.Minute,
+		HMACSecrets: []hmacSecret{
+			{Scope: repoScope{"org/a"}, Secret: []byte(testHMACSecret)},
+			{Scope: repoScope{"org/*"}, Secret: []byte(testHMACNext)},
+		},
+	}
+}
+
+func TestHMACSignedIngest(t *testing.T) {
+	store := newFakeStore()
+	base := newTestServer(t, store, testHMACPolicy(), alertPolicy{})
+	const path = "/v1/metrics/agent-runs"
+	now := time.Now()
+	seq := 0
+	runBody := func(repo string) []byte {
+		seq++
+		raw, err := json.Marshal(testRun(repo, "c1", seq, now.Add(-time.Hour), map[string]uint32{"R1": 1}))
+		if err != nil {
+			t.Fatal(err)
+		}
+		return raw
+	}
+	valid := signedRequest{secret: testHMACSecret, method: http.MethodPost, path: path, repo: "org/a", signedAt: now}
+	with := func(change func(*signedRequest)) signedRequest {
+		s := valid
+		change(&s)
+		return s
+	}
+
+	replayed := runBody("org/a")
+	if status, resp := doRequest(t, http.MethodPost, base+path, replayed, valid.header("org/a", replayed)); status != http.StatusOK {
+		t.Fatalf("first use: %d %s", status, resp)
+	}
+
+	cases := []struct {
+		name     string
+		sign     signedRequest
+		sentRepo string
+		runRepo  string
+		// tamper changes the body after it was signed.
+		tamper bool
+		body   []byte
+		status int
+	}{
+		{name: "valid", sign: valid, status: http.StatusOK},
+		{name: "rotated secret", sign: with(func(s *signedRequest) { s.secret = testHMACNext }), status: http.StatusOK},
+		{name: "expired", sign: with(func(s *signedRequest) { s.signedAt = now.Add(-10 * time.Minute) }), status: http.StatusUnauthorized},
+		{name: "from the future", sign: with(func(s *signedRequest) { s.signedAt = now.Add(10 * time.Minute) }), status: http.StatusUnauthorized},
+		{name: "replayed", sign: valid, body: replayed, status: http.StatusUnauthorized},
+		{name: "tampered body", sign: valid, tamper: true, status: http.StatusUnauthorized},
+		{name: "wrong secret", sign: with(func(s *signedRequest) { s.secret = "some-other-secret-0000" }), status: http.StatusUnauthorized},
+		{name: "signed for another path", sign: with(func(s *signedRequest) { s.path = path + ":batch" }), status: http.StatusUnauthorized},
+		{name: "signed for another method", sign: with(func(s *signedRequest) { s.method = http.MethodPut }), status: http.StatusUnauthorized},
+		{name: "signed for another repo", sign: with(func(s *signedRequest) { s.secret, s.repo = testHMACNext, "org/b" }), status: http.StatusUnauthorized},
+		{name: "secret of another repo", sign: with(func(s *signedRequest) { s.repo = "org/b" }), sentRepo: "org/b", runRepo: "org/b", status: http.StatusUnauthorized},
+		{name: "run outside the secret's repos", sign: with(func(s *signedRequest) { s.secret, s.repo = testHMACNext, "org/b" }), sentRepo: "org/b", runRepo: "other/x", status: http.StatusForbidden},
+	}
+	stored := 1
+	for _, tc := range cases {
+		t.Run(tc.name, func(t *testing.T) {
+			sentRepo, runRepo := tc.sentRepo, tc.runRepo
+			if sentRepo == "" {
+				sentRepo = "org/a"
+			}
+			if runRepo == "" {
+				runRepo = sentRepo
+			}
+			body := tc.body
+			if body == nil {
+				body = runBody(runRepo)
+			}
+			header := tc.sign.header(sentRepo, body)
+			if tc.tamper {
+				body = runBody(runRepo)
+			}
+			if status, resp := doRequest(t, http.MethodPost, base+path, body, header); status != tc.status {
+				t.Fatalf("status %d %s, want %d", status, resp, tc.status)
+			}
+			if tc.status == http.StatusOK {
+				stored++
+			}
+		})
+	}
+	if status, resp := doRequest(t, http.MethodPost, base+path, runBody("org/a"), nil); status != http.StatusUnauthorized {
+		t.Fatalf("unsigned request: %d %s", status, resp)
+	}
+	if n := store.runCount(); n != stored {
+		t.Fatalf("%d runs stored, want %d", n, stored)
+	}
+}
+
+func contentDigest(body []byte) string {
+	sum := sha256.Sum256(body)
+	return contentDigestPrefix + base64.StdEncoding.EncodeToString(sum[:]) + ":"
+}
+
+// TestHMACSignedStream checks that a signed stream signs its Content-Digest
+// rather than the body, so the body is not buffered and a body that does not
+// match the digest fails once it has been read.
+func TestHMACSignedStream(t *testing.T) {
+	store := newFakeStore()
+	base := newTestServer(t, store, testHMACPolicy(), alertPolicy{})
+	const path = "/v1/metrics/agent-runs:stream"
+	now := time.Now()
+	ndjson := func(first, n int) []byte {
+		var body bytes.Buffer
+		for i := first; i < first+n; i++ {
+			raw, err := json.Marshal(testRun("org/a", "c1", i, now.Add(-time.Hour), map[string]uint32{"R1": 1}))
+			if err != nil {
+				t.Fatal(err)
+			}
+			body.Write(append(raw, '\n'))
+		}
+		return body.Bytes()
+	}
+	sign := func(digest string) http.Header {
+		ts := strconv.FormatInt(now.Unix(), 10)
+		return http.Header{
+			signatureRepoHeader:      {"org/a"},
+			signatureTimestampHeader: {ts},
+			contentDigestHeader:      {digest},
+			signatureHeader:          {signRequest([]byte(testHMACSecret), http.MethodPost, path, "org/a", ts, []byte(digest))},
+		}
+	}
+	lastLine := func(t *testing.T, body []byte, header http.Header, query string) map[string]interface{} {
+		t.Helper()
+		status, raw := doRequest(t, http.MethodPost, base+path+query, body, header)
+		if status != http.StatusOK {
+			t.Fatalf("stream: %d %s", status, raw)
+		}
+		lines := readNDJSON(t, raw)
+		return lines[len(lines)-1]
+	}
+
+	body := ndjson(1, 3)
+	if done := lastLine(t, body, sign(contentDigest(body)), ""); done["type"] != "done" || done["inserted"] != 3.0 {
+		t.Fatalf("signed stream: %v", done)
+	}
+
+	// Bodies past the limit of buffered signed requests still stream.
+	large := append(ndjson(4, 1), bytes.Repeat([]byte("\n"), maxSignedBodyBytes)...)
+	if done := lastLine(t, large, sign(contentDigest(large)), ""); done["type"] != "done" || done["inserted"] != 1.0 {
+		t.Fatalf("large stream: %v", done)
+	}
+
+	// The first chunk is committed before the mismatch shows at the end.
+	signedBody := ndjson(5, 3)
+	sent := ndjson(5, 3)
+	sent[len(sent)-3] = ' '
+	errLine := lastLine(t, sent, sign(contentDigest(signedBody)), "?chunk_size=2")
+	if errLine["type"] != "error" || errLine["error"] != "UNAUTHORIZED" {
+		t.Fatalf("tampered stream: %v", errLine)
+	}
+	if tally := errLine["tally"].(map[string]interface{}); tally["inserted"] != 2.0 {
+		t.Fatalf("tampered stream tally: %v", tally)
+	}
+	if n := store.runCount(); n != 6 {
+		t.Fatalf("%d runs stored, want 6", n)
+	}
+
+	refused := []struct {
+		name   string
+		header http.Header
+	}{
+		{name: "no digest", header: func() http.Header {
+			h := sign(contentDigest(body))
+			h.Del(contentDigestHeader)
+			return h
+		}()},
+		{name: "malformed digest", header: sign("sha-256=" + base64.StdEncoding.EncodeToString([]byte("short")))},
+		{name: "body signed instead of the digest", header: func() http.Header {
+			h := sign(contentDigest(body))
+			h.Set(signatureHeader, signRequest([]byte(testHMACSecret), http.MethodPost, path, "org/a", h.Get(signatureTimestampHeader), body))
+			return h
+		}()},
+	}
+	for _, tc := range refused {
+		t.Run(tc.name, func(t *testing.T) {
+			if status, raw := doRequest(t, http.MethodPost, base+path, body, tc.header); status != http.StatusUnauthorized {
+				t.Fatalf("status %d %s, want 401", status, raw)
+			}
+		})
+	}
+}
@@ -0,0 +1,629 @@
+package main
+
+import (
+	"crypto"
+	"crypto/ecdsa"
+	"crypto/elliptic"
+	"crypto/rsa"
+	_ "crypto/sha256"
+	_ "crypto/sha512"
+	"encoding/base64"
+	"encoding/json"
+	"errors"
+	"fmt"
+	"io"
+	"math/big"
+	"net/http"
+	"net/url"
+	"os"
+	"sort"
+	"strings"
+	"sync"
+	"time"
+
+	"github.com/gin-gonic/gin"
+)
+
+// oidcConfig is the `auth.oidc` section of config.yaml. Setting it protects
+// the dashboard, /api and the management routes with JWT bearer tokens, e.g.
+// ID tokens forwarded by an OIDC proxy in front of the server.
+type oidcConfig struct {
+	// Issuer is checked against the iss claim. Without JWKSFile or JWKSURL
+	// the signing keys are discovered from its
+	// /.well-known/openid-configuration.
+	Issuer string `yaml:"issuer"`
+	// Audience, when set, must be listed in the aud claim.
+	Audience string `yaml:"audience"`
+	// JWKSFile reads the signing keys from a local JWKS document instead.
+	JWKSFile string `yaml:"jwks_file"`
+	JWKSURL  string `yaml:"jwks_url"`
+	// UserClaim names the caller, e.g. in the audit log; default sub.
+	UserClaim string `yaml:"user_claim"`
+	// GroupsClaim holds the caller's groups, a string or a list; default
+	// groups.
+	GroupsClaim string `yaml:"groups_claim"`
+	// Roles maps viewer, rule-owner and admin to the groups granted them.
+	Roles map[string][]string `yaml:"roles"`
+	// Repos maps groups to the repos their members may see. When it is set,
+	// every caller below admin only sees the repos of their groups.
+	Repos map[string][]string `yaml:"repos"`
+}
+
+const (
+	roleViewer    = "viewer"
+	roleRuleOwner = "rule-owner"
+	roleAdmin     = "admin"
+
+	defaultUserClaim   = "sub"
+	defaultGroupsClaim = "groups"
+	// jwtLeeway tolerates clock skew between the server and the issuer.
+	jwtLeeway = time.Minute
+	// jwksRefreshInterval is how long fetched keys are used before they are
+	// fetched again; an unknown kid triggers an earlier refresh, at most once
+	// per jwksMinRefresh.
+	jwksRefreshInterval = time.Hour
+	jwksMinRefresh      = time.Minute
+	jwksFetchTimeout    = 10 * time.Second
+	// principalKey holds the *principal of the authenticated caller in the
+	// gin context.
+	principalKey = "principal"
+)
+
+// roleRank orders the roles; each includes the permissions of the ones
+// below it.
+var roleRank = map[string]int{roleViewer: 1, roleRuleOwner: 2, roleAdmin: 3}
+
+// principal is the caller a JWT was issued to.
+type principal struct {
+	User string
+	Role string
+	// Repos are the repos the caller may see; nil means every repo.
+	Repos repoScope
+}
+
+// oidcVerifier checks bearer tokens and maps their claims to a principal.
+type oidcVerifier struct {
+	issuer      string
+	audience    string
+	userClaim   string
+	groupsClaim string
+	// roleGroups maps each group to the highest role it grants.
+	roleGroups map[string]string
+	repoGroups map[string][]string
+	keys       *jwksSource
+}
+
+func newOIDCVerifier(cfg oidcConfig) (*oidcVerifier, error) {
+	v := &oidcVerifier{
+		issuer:      strings.TrimSuffix(cfg.Issuer, "/"),
+		audience:    cfg.Audience,
+		userClaim:   cfg.UserClaim,
+		groupsClaim: cfg.GroupsClaim,
+		roleGroups:  make(map[string]string),
+		repoGroups:  make(map[string][]string, len(cfg.Repos)),
+	}
+	if v.userClaim == "" {
+		v.userClaim = defaultUserClaim
+	}
+	if v.groupsClaim == "" {
+		v.groupsClaim = defaultGroupsClaim
+	}
+	if len(cfg.Roles) == 0 {
+		return nil, fmt.Errorf("auth.oidc.roles must grant at least one role")
+	}
+	for role, groups := range cfg.Roles {
+		if roleRank[role] == 0 {
+			return nil, fmt.Errorf("auth.oidc.roles: unknown role %q (expected viewer, rule-owner or admin)", role)
+		}
+		for _, group := range groups {
+			if group == "" {
+				return nil, fmt.Errorf("auth.oidc.roles.%s: group names must not be empty", role)
+			}
+			if roleRank[role] > roleRank[v.roleGroups[group]] {
+				v.roleGroups[group] = role
+			}
+		}
+	}
+	for group, patterns := range cfg.Repos {
+		if errs := validateRepoPatterns("auth.oidc.repos."+group, patterns); len(errs) > 0 {
+			return nil, fmt.Errorf("%s: %s", errs[0].Field, errs[0].Message)
+		}
+		v.repoGroups[group] = patterns
+	}
+
+	switch {
+	case cfg.JWKSFile != "":
+		keys, err := loadJWKSFile(cfg.JWKSFile)
+		if err != nil {
+			return nil, fmt.Errorf("auth.oidc.jwks_file: %w", err)
+		}
+		v.keys = &jwksSource{keys: keys}
+	case cfg.JWKSURL != "":
+		if !isHTTPURL(cfg.JWKSURL) {
+			return nil, fmt.Errorf("auth.oidc.jwks_url must be an http(s) URL")
+		}
+		v.keys = &jwksSource{url: cfg.JWKSURL}
+	case cfg.Issuer != "":
+		if !isHTTPURL(cfg.Issuer) {
+			return nil, fmt.Errorf("auth.oidc.issuer must be an http(s) URL to discover its keys")
+		}
+		v.keys = &jwksSource{issuer: v.issuer}
+	default:
+		return nil, fmt.Errorf("auth.oidc needs issuer, jwks_url or jwks_file")
+	}
+	return v, nil
+}
+
+func isHTTPURL(raw string) bool {
+	u, err := url.Parse(raw)
+	return err == nil && (u.Scheme == "http" || u.Scheme == "https") && u.Host != ""
+}
+
+// jwtHeader is the decoded JOSE header of a token.
+type jwtHeader struct {
+	Alg string `json:"alg"`
+	Kid string `json:"kid"`
+}
+
+// jwtAlgorithms lists the accepted signature algorithms and their hashes.
+// Symmetric algorithms and "none" are refused.
+var jwtAlgorithms = map[string]crypto.Hash{
+	"RS256": crypto.SHA256, "RS384": crypto.SHA384, "RS512": crypto.SHA512,
+	"PS256": crypto.SHA256, "PS384": crypto.SHA384, "PS512": crypto.SHA512,
+	"ES256": crypto.SHA256, "ES384": crypto.SHA384, "ES512": crypto.SHA512,
+}
+
+// verify checks the signature and the registered claims of token and returns
+// the principal it identifies.
+func (v *oidcVerifier) verify(token string, now time.Time) (*principal, error) {
+	parts := strings.Split(token, ".")
+	if len(parts) != 3 {
+		return nil, errors.New("the token is not a JWT")
+	}
+	var header jwtHeader
+	if err := decodeJWTPart(parts[0], &header); err != nil {
+		return nil, fmt.Errorf("invalid token header: %w", err)
+	}
+	hash, ok := jwtAlgorithms[header.Alg]
+	if !ok {
+		return nil, fmt.Errorf("unsupported token algorithm %q", header.Alg)
+	}
+	signature, err := base64.RawURLEncoding.DecodeString(parts[2])
+	if err != nil {
+		return nil, errors.New("invalid token signature encoding")
+	}
+	key, err := v.keys.lookup(header.Kid, now)
+	if err != nil {
+		return nil, err
+	}
+	h := hash.New()
+	h.Write([]byte(parts[0] + "." + parts[1]))
+	if !verifyJWTSignature(header.Alg, key, h.Sum(nil), hash, signature) {
+		return nil, errors.New("the token signature is invalid")
+	}
+
+	var claims map[string]interface{}
+	if err := decodeJWTPart(parts[1], &claims); err != nil {
+		return nil, fmt.Errorf("invalid token claims: %w", err)
+	}
+	exp, ok := claims["exp"].(float64)
+	if !ok {
+		return nil, errors.New("the token has no exp claim")
+	}
+	if now.After(time.Unix(int64(exp), 0).Add(jwtLeeway)) {
+		return nil, errors.New("the token has expired")
+	}
+	if nbf, ok := claims["nbf"].(float64); ok && now.Add(jwtLeeway).Before(time.Unix(int64(nbf), 0)) {
+		return nil, errors.New("the token is not valid yet")
+	}
+	if v.issuer != "" {
+		if iss, _ := claims["iss"].(string); strings.TrimSuffix(iss, "/") != v.issuer {
+			return nil, fmt.Errorf("the token was not issued by %s", v.issuer)
+		}
+	}
+	if v.audience != "" && !containsString(claimStrings(claims["aud"]), v.audience) {
+		return nil, fmt.Errorf("the token is not meant for audience %s", v.audience)
+	}
+	return v.principalFor(claims), nil
+}
+
+// principalFor maps the groups of claims to a role and a repo scope. The
+// role is empty when no group grants one.
+func (v *oidcVerifier) principalFor(claims map[string]interface{}) *principal {
+	p := &principal{}
+	p.User, _ = claims[v.userClaim].(string)
+	if p.User == "" {
+		p.User, _ = claims["sub"].(string)
+	}
+	groups := claimStrings(claims[v.groupsClaim])
+	for _, group := range groups {
+		if role := v.roleGroups[group]; roleRank[role] > roleRank[p.Role] {
+			p.Role = role
+		}
+	}
+	if p.Role == roleAdmin || len(v.repoGroups) == 0 {
+		return p
+	}
+	seen := make(map[string]bool)
+	p.Repos = repoScope{}
+	for _, group := range groups {
+		for _, pattern := range v.repoGroups[group] {
+			if !seen[pattern] {
+				seen[pattern] = true
+				p.Repos = append(p.Repos, pattern)
+			}
+		}
+	}
+	sort.Strings(p.Repos)
+	return p
+}
+
+func decodeJWTPart(part string, v interface{}) error {
+	raw, err := base64.RawURLEncoding.DecodeString(part)
+	if err != nil {
+		return err
+	}
+	return json.Unmarshal(raw, v)
+}
+
+// claimStrings reads a claim that is either one string or a list of them.
+func claimStrings(value interface{}) []string {
+	switch v := value.(type) {
+	case string:
+		return []string{v}
+	case []interface{}:
+		out := make([]string, 0, len(v))
+		for _, item := range v {
+			if s, ok := item.(string); ok {
+				out = append(out, s)
+			}
+		}
+		return out
+	}
+	return nil
+}
+
+func containsString(values []string, want string) bool {
+	for _, v := range values {
+		if v == want {
+			return true
+		}
+	}
+	return false
+}
+
+func verifyJWTSignature(alg string, key crypto.PublicKey, digest []byte, hash crypto.Hash, signature []byte) bool {
+	switch alg[:2] {
+	case "RS":
+		pub, ok := key.(*rsa.PublicKey)
+		return ok && rsa.VerifyPKCS1v15(pub, hash, digest, signature) == nil
+	case "PS":
+		pub, ok := key.(*rsa.PublicKey)
+		return ok && rsa.VerifyPSS(pub, hash, digest, signature, &rsa.PSSOptions{SaltLength: rsa.PSSSaltLengthEqualsHash}) == nil
+	case "ES":
+		pub, ok := key.(*ecdsa.PublicKey)
+		if !ok {
+			return false
+		}
+		size := (pub.Curve.Params().BitSize + 7) / 8
+		if len(signature) != 2*size {
+			return false
+		}
+		r := new(big.Int).SetBytes(signature[:size])
+		s := new(big.Int).SetBytes(signature[size:])
+		return ecdsa.Verify(pub, digest, r, s)
+	}
+	return false
+}
+
+// jwk is one key of a JWKS document; only the fields of RSA and EC signing
+// keys are read.
+type jwk struct {
+	Kty string `json:"kty"`
+	Kid string `json:"kid"`
+	Use string `json:"use"`
+	N   string `json:"n"`
+	E   string `json:"e"`
+	Crv string `json:"crv"`
+	X   string `json:"x"`
+	Y   string `json:"y"`
+}
+
+type jwksKey struct {
+	Kid string
+	Key crypto.PublicKey
+}
+
+// parseJWKS decodes the signing keys of a JWKS document, skipping
+// encryption keys and key types it does not support.
+func parseJWKS(data []byte) ([]jwksKey, error) {
+	var doc struct {
+		Keys []jwk `json:"keys"`
+	}
+	if err := json.Unmarshal(data, &doc); err != nil {
+		return nil, err
+	}
+	var keys []jwksKey
+	for i, k := range doc.Keys {
+		if k.Use != "" && k.Use != "sig" {
+			continue
+		}
+		key, err := k.publicKey()
+		if err != nil {
+			return nil, fmt.Errorf("keys[%d]: %w", i, err)
+		}
+		if key != nil {
+			keys = append(keys, jwksKey{Kid: k.Kid, Key: key})
+		}
+	}
+	if len(keys) == 0 {
+		return nil, errors.New("no RSA or EC signing keys")
+	}
+	return keys, nil
+}
+
+func (k jwk) publicKey() (crypto.PublicKey, error) {
+	decode := func(field, value string) (*big.Int, error) {
+		raw, err := base64.RawURLEncoding.DecodeString(value)
+		if err != nil || len(raw) == 0 {
+			return nil, fmt.Errorf("invalid %s", field)
+		}
+		return new(big.Int).SetBytes(raw), nil
+	}
+	switch k.Kty {
+	case "RSA":
+		n, err := decode("n", k.N)
+		if err != nil {
+			return nil, err
+		}
+		e, err := decode("e", k.E)
+		if err != nil {
+			return nil, err
+		}
+		if !e.IsInt64() || e.Int64() > 1<<31-1 {
+			return nil, errors.New("invalid e")
+		}
+		return &rsa.PublicKey{N: n, E: int(e.Int64())}, nil
+	case "EC":
+		var curve elliptic.Curve
+		switch k.Crv {
+		case "P-256":
+			curve = elliptic.P256()
+		case "P-384":
+			curve = elliptic.P384()
+		case "P-521":
+			curve = elliptic.P521()
+		default:
+			return nil, fmt.Errorf("unsupported curve %q", k.Crv)
+		}
+		x, err := decode("x", k.X)
+		if err != nil {
+			return nil, err
+		}
+		y, err := decode("y", k.Y)
+		if err != nil {
+			return nil, err
+		}
+		if !curve.IsOnCurve(x, y) {
+			return nil, errors.New("the point is not on the curve")
+		}
+		return &ecdsa.PublicKey{Curve: curve, X: x, Y: y}, nil
+	}
+	return nil, nil
+}
+
+func loadJWKSFile(path string) ([]jwksKey, error) {
+	data, err := os.ReadFile(path)
+	if err != nil {
+		return nil, err
+	}
+	return parseJWKS(data)
+}
+
+// jwksSource holds the signing keys: read once from a file, or fetched from
+// url (or the jwks_uri of issuer) and refreshed. Only one fetch runs at a
+// time and it runs without holding mu, so requests keep using the cached
+// keys while the issuer is slow.
+type jwksSource struct {
+	url    string
+	issuer string
+
+	mu        sync.Mutex
+	keys      []jwksKey
+	fetchedAt time.Time
+	// refreshing is closed when the fetch in flight ends; nil when none is.
+	refreshing chan struct{}
+	fetchErr   error
+}
+
+// lookup returns the key for kid; a token without kid may use the only key.
+// Stale keys are refreshed in the background and used until the refresh
+// ends; only a request without any key, or with an unknown kid, waits.
+func (s *jwksSource) lookup(kid string, now time.Time) (crypto.PublicKey, error) {
+	remote := s.url != "" || s.issuer != ""
+	if remote {
+		s.mu.Lock()
+		cached, stale := s.keys != nil, now.Sub(s.fetchedAt) >= jwksRefreshInterval
+		s.mu.Unlock()
+		if !cached {
+			if err := s.refresh(now, 0); err != nil {
+				return nil, err
+			}
+		} else if stale {
+			go s.refresh(now, jwksRefreshInterval)
+		}
+	}
+	if key := s.find(kid); key != nil {
+		return key, nil
+	}
+	// The issuer may have rotated its keys since the last fetch.
+	if remote {
+		if err := s.refresh(now, jwksMinRefresh); err != nil {
+			return nil, err
+		}
+		if key := s.find(kid); key != nil {
+			return key, nil
+		}
+	}
+	return nil, fmt.Errorf("no signing key %q", kid)
+}
+
+func (s *jwksSource) find(kid string) crypto.PublicKey {
+	s.mu.Lock()
+	defer s.mu.Unlock()
+	if kid == "" {
+		if len(s.keys) == 1 {
+			return s.keys[0].Key
+		}
+		return nil
+	}
+	for _, k := range s.keys {
+		if k.Kid == kid {
+			return k.Key
+		}
+	}
+	return nil
+}
+
+// refresh fetches the keys unless cached keys are younger than minAge. A
+// fetch already in flight is waited for instead of starting another one.
+// Failures are also recorded as a fetch so an unreachable issuer is not asked
+// again on every request.
+func (s *jwksSource) refresh(now time.Time, minAge time.Duration) error {
+	s.mu.Lock()
+	if done := s.refreshing; done != nil {
+		s.mu.Unlock()
+		<-done
+		s.mu.Lock()
+		defer s.mu.Unlock()
+		return s.fetchErr
+	}
+	if s.keys != nil && now.Sub(s.fetchedAt) < minAge {
+		s.mu.Unlock()
+		return nil
+	}
+	done := make(chan struct{})
+	s.refreshing, s.fetchedAt = done, now
+	s.mu.Unlock()
+
+	keys, err := s.fetch()
+
+	s.mu.Lock()
+	defer s.mu.Unlock()
+	if err == nil {
+		s.keys = keys
+	}
+	s.fetchErr, s.refreshing = err, nil
+	close(done)
+	return err
+}
+
+// fetch downloads the keys; it does not touch the cached ones.
+func (s *jwksSource) fetch() ([]jwksKey, error) {
+	jwksURL := s.url
+	if jwksURL == "" {
+		var discovery struct {
+			Issuer  string `json:"issuer"`
+			JWKSURI string `json:"jwks_uri"`
+		}
+		if err := getJSON(s.issuer+"/.well-known/openid-configuration", &discovery); err != nil {
+			return nil, fmt.Errorf("discover the keys of %s: %w", s.issuer, err)
+		}
+		if strings.TrimSuffix(discovery.Issuer, "/") != s.issuer || !isHTTPURL(discovery.JWKSURI) {
+			return nil, fmt.Errorf("discover the keys of %s: unexpected openid-configuration", s.issuer)
+		}
+		jwksURL = discovery.JWKSURI
+	}
+	var raw json.RawMessage
+	if err := getJSON(jwksURL, &raw); err != nil {
+		return nil, fmt.Errorf("fetch %s: %w", jwksURL, err)
+	}
+	keys, err := parseJWKS(raw)
+	if err != nil {
+		return nil, fmt.Errorf("fetch %s: %w", jwksURL, err)
+	}
+	return keys, nil
+}
+
+func getJSON(rawURL string, v interface{}) error {
+	client := http.Client{Timeout: jwksFetchTimeout}
+	resp, err := client.Get(rawURL)
+	if err != nil {
+		return err
+	}
+	defer resp.Body.Close()
+	if resp.StatusCode != http.StatusOK {
+		return fmt.Errorf("unexpected status %s", resp.Status)
+	}
+	return json.NewDecoder(io.LimitReader(resp.Body, 1<<20)).Decode(v)
+}
+
+// authenticate verifies the bearer token of c and requires at least role. It
+// writes the error response itself and returns nil when the request is
+// refused.
+func authenticate(c *gin.Context, v *oidcVerifier, role string) *principal {
+	token := bearerToken(c)
+	if token == "" {
+		abortUnauthorized(c, "a bearer token is required (Authorization: Bearer <jwt>)")
+		return nil
+	}
+	p, err := v.verify(token, time.Now())
+	if err != nil {
+		abortUnauthorized(c, err.Error())
+		return nil
+	}
+	if roleRank[p.Role] < roleRank[role] {
+		c.AbortWithStatusJSON(http.StatusForbidden, errResponse{OK: false, Error: "FORBIDDEN", Message: fmt.Sprintf("this requires the %s role", role)})
+		return nil
+	}
+	c.Set(principalKey, p)
+	return p
+}
+
+// requireRole guards the dashboard, /api and the management routes when
+// auth.oidc is configured; without it they stay open.
+func requireRole(policy authPolicy, role string) gin.HandlerFunc {
+	return func(c *gin.Context) {
+		if policy.OIDC == nil {
+			c.Next()
+			return
+		}
+		if authenticate(c, policy.OIDC, role) == nil {
+			return
+		}
+		c.Next()
+	}
+}
+
+// callerOf returns the principal authenticated by requireRole or
+// requireAdmin, or nil.
+func callerOf(c *gin.Context) *principal {
+	if p, ok := c.Get(principalKey); ok {
+		return p.(*principal)
+	}
+	return nil
+}
+
+// visibleRepos returns the repos the caller may see, or nil for every repo.
+func visibleRepos(c *gin.Context) repoScope {
+	if p := callerOf(c); p != nil {
+		return p.Repos
+	}
+	return nil
+}
+
+// forbidRepo rejects a change to repo, "" meaning every repo, by a caller
+// who may not see it.
+func forbidRepo(c *gin.Context, repo string) bool {
+	scope := visibleRepos(c)
+	if scope == nil || (repo != "" && scope.allows(repo)) {
+		return false
+	}
+	message := fmt.Sprintf("you may not see repo %s", repo)
+	if repo == "" {
+		message = "you may only see some repos, so repo is required"
+	}
+	errs := []fieldError{{Field: "repo", Code: "forbidden", Message: message}}
+	c.AbortWithStatusJSON(http.StatusForbidden, validationErrResponse{OK: false, Error: "FORBIDDEN", Message: validationMessage(errs), Details: errs})
+	return true
+}
@@ -0,0 +1,346 @@
+package main
+
+import (
+	"crypto"
+	"crypto/ecdsa"
+	"crypto/elliptic"
+	"crypto/rand"
+	"crypto/rsa"
+	"encoding/base64"
+	"encoding/json"
+	"math/big"
+	"net/http"
+	"net/http/httptest"
+	"strings"
+	"sync"
+	"sync/atomic"
+	"testing"
+	"time"
+)
+
+// testJWKS encodes public keys as a JWKS document, keyed by kid.
+func testJWKS(t *testing.T, keys map[string]interface{}) []byte {
+	t.Helper()
+	b64 := func(n *big.Int) string { return base64.RawURLEncoding.EncodeToString(n.Bytes()) }
+	var doc struct {
+		Keys []jwk `json:"keys"`
+	}
+	for kid, key := range keys {
+		switch k := key.(type) {
+		case *rsa.PublicKey:
+			doc.Keys = append(doc.Keys, jwk{Kty: "RSA", Kid: kid, Use: "sig", N: b64(k.N), E: b64(big.NewInt(int64(k.E)))})
+		case *ecdsa.PublicKey:
+			doc.Keys = append(doc.Keys, jwk{Kty: "EC", Kid: kid, Crv: k.Curve.Params().Name, X: b64(k.X), Y: b64(k.Y)})
+		default:
+			t.Fatalf("unsupported key %T", key)
+		}
+	}
+	raw, err := json.Marshal(doc)
+	if err != nil {
+		t.Fatal(err)
+	}
+	return raw
+}
+
+func newRSAKey(t *testing.T) *rsa.PrivateKey {
+	t.Helper()
+	key, err := rsa.GenerateKey(rand.Reader, 2048)
+	if err != nil {
+		t.Fatal(err)
+	}
+	return key
+}
+
+func newECKey(t *testing.T) *ecdsa.PrivateKey {
+	t.Helper()
+	key, err := ecdsa.GenerateKey(elliptic.P256(), rand.Reader)
+	if err != nil {
+		t.Fatal(err)
+	}
+	return key
+}
+
+// slowJWKSServer serves doc, holding every request after the first until
+// release is closed. fetches counts the requests.
+func slowJWKSServer(t *testing.T, doc []byte, fetches *int32) (url string, release func()) {
+	t.Helper()
+	gate := make(chan struct{})
+	srv := httptest.NewServer(http.HandlerFunc(func(w http.ResponseWriter, r *http.Request) {
+		if atomic.AddInt32(fetches, 1) > 1 {
+			<-gate
+		}
+		w.Write(doc)
+	}))
+	var once sync.Once
+	release = func() { once.Do(func() { close(gate) }) }
+	t.Cleanup(srv.Close)
+	t.Cleanup(release)
+	return srv.URL, release
+}
+
+func TestJWKSRefreshServesCachedKeys(t *testing.T) {
+	key := newRSAKey(t)
+	var fetches int32
+	url, release := slowJWKSServer(t, testJWKS(t, map[string]interface{}{"k1": &key.PublicKey}), &fetches)
+	src := &jwksSource{url: url}
+	now := time.Now()
+	if _, err := src.lookup("k1", now); err != nil {
+		t.Fatal(err)
+	}
+
+	// The refresh hangs on the server; lookups keep using the cached key.
+	later := now.Add(jwksRefreshInterval + time.Minute)
+	for i := 0; i < 3; i++ {
+		done := make(chan error, 1)
+		go func() {
+			_, err := src.lookup("k1", later)
+			done <- err
+		}()
+		select {
+		case err := <-done:
+			if err != nil {
+				t.Fatal(err)
+			}
+		case <-time.After(5 * time.Second):
+			t.Fatal("lookup waited for the refresh")
+		}
+	}
+	release()
+	deadline := time.Now().Add(5 * time.Second)
+	for atomic.LoadInt32(&fetches) < 2 && time.Now().Before(deadline) {
+		time.Sleep(10 * time.Millisecond)
+	}
+	if n := atomic.LoadInt32(&fetches); n != 2 {
+		t.Fatalf("%d fetches, want 2", n)
+	}
+}
+
+func TestJWKSFetchIsShared(t *testing.T) {
+	key := newECKey(t)
+	var fetches int32
+	url, release := slowJWKSServer(t, testJWKS(t, map[string]interface{}{"k1": &key.PublicKey}), &fetches)
+	// The first request is never held, so count it up front: every lookup
+	// below then waits on one held fetch.
+	atomic.StoreInt32(&fetches, 1)
+	src := &jwksSource{url: url}
+
+	var wg sync.WaitGroup
+	errs := make(chan error, 5)
+	for i := 0; i < 5; i++ {
+		wg.Add(1)
+		go func() {
+			defer wg.Done()
+			_, err := src.lookup("k1", time.Now())
+			errs <- err
+		}()
+	}
+	time.Sleep(50 * time.Millisecond)
+	release()
+	wg.Wait()
+	close(errs)
+	for err := range errs {
+		if err != nil {
+			t.Fatal(err)
+		}
+	}
+	if n := atomic.LoadInt32(&fetches) - 1; n != 1 {
+		t.Fatalf("%d fetches, want 1", n)
+	}
+}
+
+// signJWT signs claims with an RS*, PS* or ES* algorithm; any other alg gets
+// an empty signature.
+func signJWT(t *testing.T, alg, kid string, key crypto.Signer, claims map[string]interface{}) string {
+	t.Helper()
+	encode := func(v interface{}) string {
+		raw, err := json.Marshal(v)
+		if err != nil {
+			t.Fatal(err)
+		}
+		return base64.RawURLEncoding.EncodeToString(raw)
+	}
+	signingInput := encode(jwtHeader{Alg: alg, Kid: kid}) + "." + encode(claims)
+	hash, ok := jwtAlgorithms[alg]
+	if !ok {
+		return signingInput + "."
+	}
+	h := hash.New()
+	h.Write([]byte(signingInput))
+	digest := h.Sum(nil)
+	var sig []byte
+	var err error
+	switch k := key.(type) {
+	case *rsa.PrivateKey:
+		if strings.HasPrefix(alg, "PS") {
+			sig, err = rsa.SignPSS(rand.Reader, k, hash, digest, &rsa.PSSOptions{SaltLength: rsa.PSSSaltLengthEqualsHash})
+		} else {
+			sig, err = rsa.SignPKCS1v15(rand.Reader, k, hash, digest)
+		}
+	case *ecdsa.PrivateKey:
+		var r, s *big.Int
+		r, s, err = ecdsa.Sign(rand.Reader, k, digest)
+		size := (k.Curve.Params().BitSize + 7) / 8
+		sig = make([]byte, 2*size)
+		r.FillBytes(sig[:size])
+		s.FillBytes(sig[size:])
+	}
+	if err != nil {
+		t.Fatal(err)
+	}
+	return signingInput + "." + base64.RawURLEncoding.EncodeToString(sig)
+}
+
+const testIssuer = "https://idp.example.com"
+
+// newTestVerifier trusts rsaKey as "rsa" and ecKey as "ec". Members of
+// "devs" are viewers limited to org-a repos; "ops" are admins.
+func newTestVerifier(t *testing.T, rsaKey *rsa.PrivateKey, ecKey *ecdsa.PrivateKey) *oidcVerifier {
+	t.Helper()
+	srv := httptest.NewServer(http.HandlerFunc(func(w http.ResponseWriter, r *http.Request) {
+		w.Write(testJWKS(t, map[string]interface{}{"rsa": &rsaKey.PublicKey, "ec": &ecKey.PublicKey}))
+	}))
+	t.Cleanup(srv.Close)
+	v, err := newOIDCVerifier(oidcConfig{
+		Issuer:   testIssuer,
+		Audience: "metrics",
+		JWKSURL:  srv.URL,
+		Roles:    map[string][]string{roleViewer: {"devs"}, roleAdmin: {"ops"}},
+		Repos:    map[string][]string{"devs": {"org-a/*"}},
+	})
+	if err != nil {
+		t.Fatal(err)
+	}
+	return v
+}
+
+func testClaims(now time.Time, groups ...string) map[string]interface{} {
+	return map[string]interface{}{
+		"iss":    testIssuer,
+		"aud":    []string{"other", "metrics"},
+		"sub":    "alice",
+		"exp":    now.Add(time.Hour).Unix(),
+		"groups": groups,
+	}
+}
+
+func TestOIDCVerify(t *testing.T) {
+	rsaKey, ecKey := newRSAKey(t), newECKey(t)
+	v := newTestVerifier(t, rsaKey, ecKey)
+	now := time.Now()
+	with := func(key string, value interface{}) map[string]interface{} {
+		claims := testClaims(now, "devs")
+		claims[key] = value
+		return claims
+	}
+
+	cases := []struct {
+		name  string
+		token string
+		err   string
+	}{
+		{name: "RS256", token: signJWT(t, "RS256", "rsa", rsaKey, testClaims(now, "devs"))},
+		{name: "PS384", token: signJWT(t, "PS384", "rsa", rsaKey, testClaims(now, "devs"))},
+		{name: "ES256", token: signJWT(t, "ES256", "ec", ecKey, testClaims(now, "devs"))},
+		{name: "alg none", token: signJWT(t, "none", "rsa", rsaKey, testClaims(now, "devs")), err: "unsupported token algorithm"},
+		{name: "alg HS256", token: signJWT(t, "HS256", "rsa", rsaKey, testClaims(now, "devs")), err: "unsupported token algorithm"},
+		{name: "key of another type", token: signJWT(t, "ES256", "rsa", ecKey, testClaims(now, "devs")), err: "signature is invalid"},
+		{name: "unknown kid", token: signJWT(t, "RS256", "gone", rsaKey, testClaims(now, "devs")), err: "no signing key"},
+		{name: "tampered claims", token: func() string {
+			parts := strings.Split(signJWT(t, "RS256", "rsa", rsaKey, testClaims(now, "devs")), ".")
+			raw, _ := json.Marshal(testClaims(now, "ops"))
+			parts[1] = base64.RawURLEncoding.EncodeToString(raw)
+			return strings.Join(parts, ".")
+		}(), err: "signature is invalid"},
+		{name: "expired", token: signJWT(t, "RS256", "rsa", rsaKey, with("exp", now.Add(-2*jwtLeeway).Unix())), err: "expired"},
+		{name: "within leeway", token: signJWT(t, "RS256", "rsa", rsaKey, with("exp", now.Add(-jwtLeeway/2).Unix()))},
+		{name: "no exp", token: signJWT(t, "RS256", "rsa", rsaKey, with("exp", nil)), err: "no exp claim"},
+		{name: "not yet valid", token: signJWT(t, "RS256", "rsa", rsaKey, with("nbf", now.Add(time.Hour).Unix())), err: "not valid yet"},
+		{name: "wrong issuer", token: signJWT(t, "RS256", "rsa", rsaKey, with("iss", "https://evil.example.com")), err: "not issued by"},
+		{name: "issuer with trailing slash", token: signJWT(t, "RS256", "rsa", rsaKey, with("iss", testIssuer+"/"))},
+		{name: "wrong audience", token: signJWT(t, "RS256", "rsa", rsaKey, with("aud", "other")), err: "not meant for audience"},
+		{name: "not a JWT", token: "abc.def", err: "not a JWT"},
+	}
+	for _, tc := range cases {
+		t.Run(tc.name, func(t *testing.T) {
+			p, err := v.verify(tc.token, now)
+			if tc.err == "" {
+				if err != nil {
+					t.Fatal(err)
+				}
+				if p.User != "alice" || p.Role != roleViewer {
+					t.Fatalf("principal %+v", p)
+				}
+				return
+			}
+			if err == nil || !strings.Contains(err.Error(), tc.err) {
+				t.Fatalf("error %v, want %q", err, tc.err)
+			}
+		})
+	}
+}
+
+func TestOIDCRepoScope(t *testing.T) {
+	rsaKey, ecKey := newRSAKey(t), newECKey(t)
+	v := newTestVerifier(t, rsaKey, ecKey)
+	now := time.Now()
+
+	cases := []struct {
+		groups []string
+		role   string
+		repos  repoScope
+	}{
+		{groups: []string{"devs"}, role: roleViewer, repos: repoScope{"org-a/*"}},
+		// Admins see every repo, whatever their other groups.
+		{groups: []string{"devs", "ops"}, role: roleAdmin, repos: nil},
+		// Without a repo group the scope is empty, not every repo.
+		{groups: []string{"guests"}, role: "", repos: repoScope{}},
+	}
+	for _, tc := range cases {
+		p, err := v.verify(signJWT(t, "RS256", "rsa", rsaKey, testClaims(now, tc.groups...)), now)
+		if err != nil {
+			t.Fatal(err)
+		}
+		if p.Role != tc.role || (p.Repos == nil) != (tc.repos == nil) || len(p.Repos) != len(tc.repos) ||
+			len(p.Repos) > 0 && p.Repos[0] != tc.repos[0] {
+			t.Fatalf("groups %v: principal %+v, want role %q repos %v", tc.groups, p, tc.role, tc.repos)
+		}
+	}
+
+	store := newTestStore(t)
+	for i, repo := range []string{"org-a/x", "org-b/y"} {
+		run := testRun(repo, "c1", i+1, now.Add(-time.Hour), map[string]uint32{"R1": 1})
+		if _, _, err := store.CreateAgentRun(pendingAgentRun{Req: run, DiffLines: *run.DiffLines}); err != nil {
+			t.Fatal(err)
+		}
+	}
+	base := newTestServer(t, store, authPolicy{OIDC: v}, alertPolicy{})
+	recent := func(groups ...string) (int, []string) {
+		header := http.Header{"Authorization": {"Bearer " + signJWT(t, "RS256", "rsa", rsaKey, testClaims(now, groups...))}}
+		status, body := doRequest(t, http.MethodGet, base+"/api/runs/recent", nil, header)
+		var resp struct {
+			Data []struct {
+				Repo string `json:"repo"`
+			} `json:"data"`
+		}
+		if status == http.StatusOK {
+			decodeJSON(t, body, &resp)
+		}
+		var repos []string
+		for _, row := range resp.Data {
+			repos = append(repos, row.Repo)
+		}
+		return status, repos
+	}
+	if status, repos := recent("devs"); status != http.StatusOK || len(repos) != 1 || repos[0] != "org-a/x" {
+		t.Fatalf("viewer: %d %v, want only org-a/x", status, repos)
+	}
+	if status, repos := recent("ops"); status != http.StatusOK || len(repos) != 2 {
+		t.Fatalf("admin: %d %v, want both repos", status, repos)
+	}
+	if status, _ := recent("guests"); status != http.StatusForbidden {
+		t.Fatalf("no role: status %d, want 403", status)
+	}
+	if status, _ := doRequest(t, http.MethodGet, base+"/api/runs/recent", nil, nil); status != http.StatusUnauthorized {
+		t.Fatalf("no token: status %d, want 401", status)
+	}
+}
@@ -0,0 +1,579 @@
+package main
+
+import (
+	"encoding/json"
+	"flag"
+	"fmt"
+	"io"
+	"log"
+	"net/http"
+	"os"
+	"strconv"
+	"strings"
+	"time"
+
+	"gorm.io/gorm"
+)
+
+// runCommand dispatches the maintenance subcommands, e.g. `go run . ingest`.
+func runCommand(name string, args []string) error {
+	switch name {
+	case "ingest":
+		return runIngestCommand(args)
+	case "migrate":
+		return runMigrateCommand(args)
+	case "rebuild-summaries":
+		return runRebuildSummariesCommand(args)
+	case "rebuild-rollups":
+		return runRebuildRollupsCommand(args)
+	case "rebuild-finding-transitions":
+		return runRebuildFindingTransitionsCommand(args)
+	case "import-rule-catalog":
+		return runImportRuleCatalogCommand(args)
+	case "verify":
+		return runVerifyCommand(args)
+	case "retention":
+		return runRetentionCommand(args)
+	case "detect-anomalies":
+		return runDetectAnomaliesCommand(args)
+	case "detect-agent-regressions":
+		return runDetectAgentRegressionsCommand(args)
+	case "evaluate-alerts":
+		return runEvaluateAlertsCommand(args)
+	case "alert-receiver":
+		return runAlertReceiverCommand(args)
+	case "create-api-key":
+		return runCreateAPIKeyCommand(args)
+	default:
+		return fmt.Errorf("unknown command %q (available: ingest, migrate, rebuild-summaries, rebuild-rollups, rebuild-finding-transitions, import-rule-catalog, verify, retention, detect-anomalies, detect-agent-regressions, evaluate-alerts, alert-receiver, create-api-key)", name)
+	}
+}
+
+func openCommandStore(configPath string) (Store, error) {
+	cfg, err := loadConfig(configPath)
+	if err != nil {
+		return nil, err
+	}
+	return openStore(cfg)
+}
+
+func runIngestCommand(args []string) error {
+	fs := flag.NewFlagSet("ingest", flag.ContinueOnError)
+	configPath := fs.String("config", "config.yaml", "path to config.yaml")
+	file := fs.String("file", "", "NDJSON file with one agent run per line, - for stdin")
+	chunkSize := fs.Int("chunk-size", defaultNDJSONChunkSize, "runs committed per transaction")
+	if err := fs.Parse(args); err != nil {
+		return err
+	}
+	if *file == "" {
+		return fmt.Errorf("ingest: -file is required")
+	}
+	if *chunkSize < 1 || *chunkSize > maxBatchRuns {
+		return fmt.Errorf("ingest: -chunk-size must be between 1 and %d", maxBatchRuns)
+	}
+
+	store, err := openCommandStore(*configPath)
+	if err != nil {
+		return err
+	}
+
+	var r io.Reader = os.Stdin
+	if *file != "-" {
+		f, err := os.Open(*file)
+		if err != nil {
+			return err
+		}
+		defer f.Close()
+		r = f
+	}
+
+	tally, err := ingestNDJSON(store, r, *chunkSize, nil, func(progress ndjsonTally) {
+		log.Printf("ingest: %d lines read, %d inserted, %d idempotent, %d rejected",
+			progress.Lines, progress.Inserted, progress.Idempotent, progress.Rejected)
+	})
+	for _, rejected := range tally.RejectedLines {
+		log.Printf("ingest: line %d rejected: %s", rejected.Line, rejected.Message)
+	}
+	if tally.RejectedOmitted > 0 {
+		log.Printf("ingest: %d more rejected lines not listed", tally.RejectedOmitted)
+	}
+	if err != nil {
+		return fmt.Errorf("ingest: %w", err)
+	}
+	log.Printf("ingest: done, %d lines, %d inserted, %d idempotent, %d rejected",
+		tally.Lines, tally.Inserted, tally.Idempotent, tally.Rejected)
+	return nil
+}
+
+// runMigrateCommand handles `migrate up [-to N]`, `migrate down [-steps N]`
+// and `migrate status`.
+func runMigrateCommand(args []string) error {
+	if len(args) == 0 {
+		return fmt.Errorf("migrate: expected up, down or status")
+	}
+	action := args[0]
+	fs := flag.NewFlagSet("migrate "+action, flag.ContinueOnError)
+	configPath := fs.String("config", "config.yaml", "path to config.yaml")
+	var target uint64
+	var steps int
+	switch action {
+	case "up":
+		fs.Uint64Var(&target, "to", 0, "stop after this version, 0 for the latest")
+	case "down":
+		fs.IntVar(&steps, "steps", 1, "number of migrations to revert")
+	case "status":
+	default:
+		return fmt.Errorf("migrate: unknown action %q (expected up, down or status)", action)
+	}
+	if err := fs.Parse(args[1:]); err != nil {
+		return err
+	}
+	if action == "down" && steps < 1 {
+		return fmt.Errorf("migrate down: -steps must be at least 1")
+	}
+
+	cfg, err := loadConfig(*configPath)
+	if err != nil {
+		return err
+	}
+	db, dialect, err := openDatabase(cfg)
+	if err != nil {
+		return err
+	}
+
+	switch action {
+	case "up":
+		applied, err := migrateUp(db, dialect, target)
+		for _, m := range applied {
+			log.Printf("migrate: applied %04d_%s", m.Version, m.Name)
+		}
+		auditMigration(db, dialect, "migration.up", applied, fs, err)
+		if err != nil {
+			return fmt.Errorf("migrate: %w", err)
+		}
+		if len(applied) == 0 {
+			log.Printf("migrate: %s schema is up to date", dialect.name())
+		}
+	case "down":
+		reverted, err := migrateDown(db, dialect, steps)
+		for _, m := range reverted {
+			log.Printf("migrate: reverted %04d_%s", m.Version, m.Name)
+		}
+		auditMigration(db, dialect, "migration.down", reverted, fs, err)
+		if err != nil {
+			return fmt.Errorf("migrate: %w", err)
+		}
+		if len(reverted) == 0 {
+			log.Printf("migrate: nothing to revert")
+		}
+	case "status":
+		statuses, err := loadMigrationStatus(db, dialect)
+		if err != nil {
+			return fmt.Errorf("migrate: %w", err)
+		}
+		for _, status := range statuses {
+			state := "pending"
+			if status.AppliedAt != nil {
+				state = "applied " + status.AppliedAt.UTC().Format(time.RFC3339)
+			}
+			fmt.Printf("%04d_%s\t%s\n", status.Version, status.Name, state)
+		}
+	}
+	return nil
+}
+
+// auditMigration records a migrate run that changed the schema, once the
+// audit table exists; a migrate down that dropped it is not recorded.
+func auditMigration(db *gorm.DB, dialect sqlDialect, action string, migrations []migration, fs *flag.FlagSet, runErr error) {
+	if len(migrations) == 0 && runErr == nil || !db.Migrator().HasTable(&CrAuditLog{}) {
+		return
+	}
+	versions := make([]string, 0, len(migrations))
+	for _, m := range migrations {
+		versions = append(versions, fmt.Sprintf("%04d", m.Version))
+	}
+	auditCommand(newGormStore(db, dialect), action, strings.Join(versions, ","), fs, runErr)
+}
+
+func runRebuildSummariesCommand(args []string) error {
+	fs := flag.NewFlagSet("rebuild-summaries", flag.ContinueOnError)
+	configPath := fs.String("config", "config.yaml", "path to config.yaml")
+	repo := fs.String("repo", "", "only rebuild changes of this repo")
+	codeChangeID := fs.String("code-change-id", "", "only rebuild this code change")
+	fromStr := fs.String("from", "", "only changes with runs at or after this time (RFC3339 or unix seconds)")
+	toStr := fs.String("to", "", "only changes with runs at or before this time (RFC3339 or unix seconds)")
+	dryRun := fs.Bool("dry-run", false, "report the rows that would change without writing")
+	if err := fs.Parse(args); err != nil {
+		return err
+	}
+	from, err := parseTimeParam(*fromStr)
+	if err != nil {
+		return fmt.Errorf("rebuild-summaries: -from: %w", err)
+	}
+	to, err := parseTimeParam(*toStr)
+	if err != nil {
+		return fmt.Errorf("rebuild-summaries: -to: %w", err)
+	}
+	if !from.IsZero() && !to.IsZero() && to.Before(from) {
+		return fmt.Errorf("rebuild-summaries: %w", errInvalidRange)
+	}
+
+	store, err := openCommandStore(*configPath)
+	if err != nil {
+		return err
+	}
+
+	result, err := store.RebuildCodeChangeSummaries(from, to, queryFilter{Repo: *repo, CodeChangeID: *codeChangeID}, *dryRun)
+	if !*dryRun {
+		auditCommand(store, "summaries.rebuild", strings.Trim(*repo+"/"+*codeChangeID, "/"), fs, err)
+	}
+	for _, diff := range result.Diffs {
+		log.Printf("rebuild-summaries: %s %s %s: %s", diff.Action, diff.Repo, diff.CodeChangeID, describeSummaryDiff(diff))
+	}
+	if result.DiffsOmitted > 0 {
+		log.Printf("rebuild-summaries: %d more differences not listed", result.DiffsOmitted)
+	}
+	if err != nil {
+		return fmt.Errorf("rebuild-summaries: %w", err)
+	}
+	mode := "rebuilt"
+	if *dryRun {
+		mode = "dry run"
+	}
+	log.Printf("rebuild-summaries: %s, %d changes scanned, %d unchanged, %d created, %d updated, %d deleted",
+		mode, result.Scanned, result.Unchanged, result.Created, result.Updated, result.Deleted)
+	return nil
+}
+
+// runRebuildRollupsCommand recomputes the rollup tables, e.g. after raw rows
+// were fixed by hand or by `verify -repair`.
+func runRebuildRollupsCommand(args []string) error {
+	fs := flag.NewFlagSet("rebuild-rollups", flag.ContinueOnError)
+	configPath := fs.String("config", "config.yaml", "path to config.yaml")
+	fromStr := fs.String("from", "", "first day to rebuild (RFC3339 or unix seconds, default: oldest run)")
+	toStr := fs.String("to", "", "last day to rebuild (RFC3339 or unix seconds, default: now)")
+	if err := fs.Parse(args); err != nil {
+		return err
+	}
+	from, err := parseTimeParam(*fromStr)
+	if err != nil {
+		return fmt.Errorf("rebuild-rollups: -from: %w", err)
+	}
+	to, err := parseTimeParam(*toStr)
+	if err != nil {
+		return fmt.Errorf("rebuild-rollups: -to: %w", err)
+	}
+	if !from.IsZero() && !to.IsZero() && to.Before(from) {
+		return fmt.Errorf("rebuild-rollups: %w", errInvalidRange)
+	}
+
+	store, err := openCommandStore(*configPath)
+	if err != nil {
+		return err
+	}
+
+	result, err := store.RebuildRollups(from, to)
+	auditCommand(store, "rollups.rebuild", "", fs, err)
+	if err != nil {
+		return fmt.Errorf("rebuild-rollups: %w", err)
+	}
+	if result.Days == 0 {
+		log.Printf("rebuild-rollups: nothing to rebuild")
+		return nil
+	}
+	log.Printf("rebuild-rollups: %d days from %s to %s, %d run rollup rows, %d rule rollup rows",
+		result.Days, result.From.Format("2006-01-02"), result.To.Add(-24*time.Hour).Format("2006-01-02"),
+		result.RunRollupRows, result.RuleRollupRows)
+	return nil
+}
+
+// runRebuildFindingTransitionsCommand recomputes finding fix tracking, e.g.
+// for findings ingested before the tracking table existed.
+func runRebuildFindingTransitionsCommand(args []string) error {
+	fs := flag.NewFlagSet("rebuild-finding-transitions", flag.ContinueOnError)
+	configPath := fs.String("config", "config.yaml", "path to config.yaml")
+	repo := fs.String("repo", "", "only rebuild changes of this repo")
+	codeChangeID := fs.String("code-change-id", "", "only rebuild this code change")
+	if err := fs.Parse(args); err != nil {
+		return err
+	}
+
+	store, err := openCommandStore(*configPath)
+	if err != nil {
+		return err
+	}
+
+	result, err := store.RebuildFindingTransitions(queryFilter{Repo: *repo, CodeChangeID: *codeChangeID})
+	auditCommand(store, "finding_transitions.rebuild", strings.Trim(*repo+"/"+*codeChangeID, "/"), fs, err)
+	if err != nil {
+		return fmt.Errorf("rebuild-finding-transitions: %w", err)
+	}
+	log.Printf("rebuild-finding-transitions: %d changes, %d transition rows", result.Changes, result.Transitions)
+	return nil
+}
+
+// runImportRuleCatalogCommand registers the rules of a YAML catalog file, the
+// same layout as the body of POST /v1/rule-catalog.
+func runImportRuleCatalogCommand(args []string) error {
+	fs := flag.NewFlagSet("import-rule-catalog", flag.ContinueOnError)
+	configPath := fs.String("config", "config.yaml", "path to config.yaml")
+	file := fs.String("file", "", "YAML file with a top-level rules list")
+	if err := fs.Parse(args); err != nil {
+		return err
+	}
+	if *file == "" {
+		return fmt.Errorf("import-rule-catalog: -file is required")
+	}
+
+	rules, err := loadRuleCatalogFile(*file)
+	if err != nil {
+		return fmt.Errorf("import-rule-catalog: %w", err)
+	}
+	if errs := validateRuleCatalog(rules); len(errs) > 0 {
+		for _, e := range errs {
+			log.Printf("import-rule-catalog: %s: %s", e.Field, e.Message)
+		}
+		return fmt.Errorf("import-rule-catalog: %s is invalid", *file)
+	}
+
+	store, err := openCommandStore(*configPath)
+	if err != nil {
+		return err
+	}
+	result, err := store.UpsertRuleCatalog(rules)
+	ruleIDs := make([]string, 0, len(rules))
+	for _, rule := range rules {
+		ruleIDs = append(ruleIDs, rule.RuleID)
+	}
+	auditCommand(store, "rule_catalog.import", strings.Join(ruleIDs, ","), fs, err)
+	if err != nil {
+		return fmt.Errorf("import-rule-catalog: %w", err)
+	}
+	log.Printf("import-rule-catalog: %d rules created, %d updated", result.Created, result.Updated)
+	return nil
+}
+
+// runVerifyCommand reports inconsistencies between the three tables and fails
+// when any are left unrepaired, so it can run from cron or CI.
+func runVerifyCommand(args []string) error {
+	fs := flag.NewFlagSet("verify", flag.ContinueOnError)
+	configPath := fs.String("config", "config.yaml", "path to config.yaml")
+	repair := fs.Bool("repair", false, "fix the problems found")
+	if err := fs.Parse(args); err != nil {
+		return err
+	}
+
+	store, err := openCommandStore(*configPath)
+	if err != nil {
+		return err
+	}
+
+	report, err := store.VerifyData(*repair)
+	if *repair {
+		auditCommand(store, "verify.repair", "", fs, err)
+	}
+	for _, issue := range report.Issues {
+		target := issue.Repo + " " + issue.CodeChangeID
+		if issue.RunID != 0 {
+			target = fmt.Sprintf("%s run %d", target, issue.RunID)
+		}
+		state := ""
+		if issue.Repaired {
+			state = " (repaired)"
+		}
+		log.Printf("verify: %s %s: %s%s", issue.Kind, target, issue.Message, state)
+	}
+	if report.IssuesOmitted > 0 {
+		log.Printf("verify: %d more issues not listed", report.IssuesOmitted)
+	}
+	if err != nil {
+		return fmt.Errorf("verify: %w", err)
+	}
+	log.Printf("verify: %d runs scanned, %d orphan rule rows, %d invalid rule_hits_json, %d rule row mismatches, %d total hits mismatches, %d drifted summaries, %d repaired",
+		report.RunsScanned, report.OrphanRuleRows, report.InvalidRuleHitsJSON, report.RuleRowMismatches,
+		report.TotalHitsMismatches, report.SummaryDrift, report.Repaired)
+	if unrepaired := report.Total() - report.Repaired; unrepaired > 0 {
+		return fmt.Errorf("verify: %d problems left unrepaired", unrepaired)
+	}
+	return nil
+}
+
+// runRetentionCommand runs a single retention pass with the configured
+// policy, whether or not the background job is enabled.
+func runRetentionCommand(args []string) error {
+	fs := flag.NewFlagSet("retention", flag.ContinueOnError)
+	configPath := fs.String("config", "config.yaml", "path to config.yaml")
+	if err := fs.Parse(args); err != nil {
+		return err
+	}
+
+	cfg, err := loadConfig(*configPath)
+	if err != nil {
+		return err
+	}
+	policy, err := newRetentionPolicy(cfg.Retention)
+	if err != nil {
+		return err
+	}
+	store, err := openStore(cfg)
+	if err != nil {
+		return err
+	}
+
+	tally, err := runRetention(store, policy, time.Now())
+	log.Printf("retention: deleted %d rule rows, %d runs, %d summaries", tally.RunRules, tally.Runs, tally.Summaries)
+	if err != nil {
+		return fmt.Errorf("retention: %w", err)
+	}
+	return nil
+}
+
+func runDetectAnomaliesCommand(args []string) error {
+	fs := flag.NewFlagSet("detect-anomalies", flag.ContinueOnError)
+	configPath := fs.String("config", "config.yaml", "path to config.yaml")
+	if err := fs.Parse(args); err != nil {
+		return err
+	}
+
+	cfg, err := loadConfig(*configPath)
+	if err != nil {
+		return err
+	}
+	policy, err := newAnomalyPolicy(cfg.Anomaly)
+	if err != nil {
+		return err
+	}
+	store, err := openStore(cfg)
+	if err != nil {
+		return err
+	}
+
+	tally, err := runAnomalyDetection(store, policy, time.Now())
+	if err != nil {
+		return fmt.Errorf("detect-anomalies: %w", err)
+	}
+	log.Printf("detect-anomalies: %d anomalies over %d points in %d days, %d cleared", tally.Recorded, tally.Points, tally.Days, tally.Cleared)
+	return nil
+}
+
+func runDetectAgentRegressionsCommand(args []string) error {
+	fs := flag.NewFlagSet("detect-agent-regressions", flag.ContinueOnError)
+	configPath := fs.String("config", "config.yaml", "path to config.yaml")
+	if err := fs.Parse(args); err != nil {
+		return err
+	}
+
+	cfg, err := loadConfig(*configPath)
+	if err != nil {
+		return err
+	}
+	policy, err := newAgentRegressionPolicy(cfg.AgentRegression)
+	if err != nil {
+		return err
+	}
+	store, err := openStore(cfg)
+	if err != nil {
+		return err
+	}
+
+	tally, err := runAgentRegressionDetection(store, policy, time.Now())
+	if err != nil {
+		return fmt.Errorf("detect-agent-regressions: %w", err)
+	}
+	log.Printf("detect-agent-regressions: %d of %d versions regressed (new: %s), %d cleared",
+		tally.Recorded, tally.Versions, strings.Join(tally.New, ", "), tally.Cleared)
+	return nil
+}
+
+func runEvaluateAlertsCommand(args []string) error {
+	fs := flag.NewFlagSet("evaluate-alerts", flag.ContinueOnError)
+	configPath := fs.String("config", "config.yaml", "path to config.yaml")
+	if err := fs.Parse(args); err != nil {
+		return err
+	}
+
+	cfg, err := loadConfig(*configPath)
+	if err != nil {
+		return err
+	}
+	policy, err := newAlertPolicy(cfg.Alerting)
+	if err != nil {
+		return err
+	}
+	store, err := openStore(cfg)
+	if err != nil {
+		return err
+	}
+
+	tally, err := runAlertEvaluation(store, policy, time.Now())
+	if err != nil {
+		return fmt.Errorf("evaluate-alerts: %w", err)
+	}
+	log.Printf("evaluate-alerts: %d rules, %d firing, %d pending, %d notifications sent, %d failures", tally.Rules, tally.Firing, tally.Pending, tally.Notified, tally.Failed)
+	return nil
+}
+
+// runAlertReceiverCommand serves a webhook endpoint that logs every alert
+// notification it receives, for trying out alerting.webhooks locally.
+func runAlertReceiverCommand(args []string) error {
+	fs := flag.NewFlagSet("alert-receiver", flag.ContinueOnError)
+	addr := fs.String("addr", "127.0.0.1:9099", "listen address")
+	status := fs.Int("status", http.StatusOK, "HTTP status to answer with, e.g. 500 to exercise retries")
+	if err := fs.Parse(args); err != nil {
+		return err
+	}
+
+	handler := http.HandlerFunc(func(w http.ResponseWriter, r *http.Request) {
+		body, err := io.ReadAll(io.LimitReader(r.Body, 1<<20))
+		if err != nil {
+			http.Error(w, err.Error(), http.StatusBadRequest)
+			return
+		}
+		var n alertNotification
+		if err := json.Unmarshal(body, &n); err != nil {
+			log.Printf("alert-receiver: %s %s: not an alert notification: %s", r.Method, r.URL.Path, body)
+		} else {
+			log.Printf("alert-receiver: %s [%s] %s (dedup_key %s)", n.Status, n.Rule.Severity, n.Summary, n.DedupKey)
+		}
+		w.WriteHeader(*status)
+	})
+	log.Printf("alert-receiver: listening on http://%s/", *addr)
+	return http.ListenAndServe(*addr, handler)
+}
+
+// runCreateAPIKeyCommand issues an ingestion API key without going through
+// the admin API, e.g. before auth.admin_token is set.
+func runCreateAPIKeyCommand(args []string) error {
+	fs := flag.NewFlagSet("create-api-key", flag.ContinueOnError)
+	configPath := fs.String("config", "config.yaml", "path to config.yaml")
+	name := fs.String("name", "", "key name, e.g. the CI system using it")
+	repos := fs.String("repos", "", "comma-separated repos the key may report for; org/* allows a prefix")
+	if err := fs.Parse(args); err != nil {
+		return err
+	}
+	req := apiKeyRequest{Name: *name}
+	if *repos != "" {
+		req.Repos = strings.Split(*repos, ",")
+	}
+	if errs := validateAPIKeyRequest(req); len(errs) > 0 {
+		return fmt.Errorf("create-api-key: %s", validationMessage(errs))
+	}
+
+	store, err := openCommandStore(*configPath)
+	if err != nil {
+		return err
+	}
+	key, display, err := newAPIKeySecret()
+	if err != nil {
+		return err
+	}
+	row, err := store.CreateAPIKey(req.Name, req.Repos, hashAPIKey(key), display)
+	if err != nil {
+		auditCommand(store, "api_key.create", "", fs, err)
+		return fmt.Errorf("create-api-key: %w", err)
+	}
+	auditCommand(store, "api_key.create", strconv.FormatUint(row.ID, 10), fs, nil)
+	log.Printf("create-api-key: created key %d (%s) for %s; it is shown only once:", row.ID, row.Name, strings.Join(row.Repos, ", "))
+	fmt.Println(key)
+	return nil
+}
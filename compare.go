@@ -0,0 +1,199 @@
+package main
+
+import (
+	"database/sql"
+	"sort"
+	"time"
+
+	"gorm.io/gorm"
+)
+
+// rulesetMetrics is what one ruleset version observed in the comparison
+// window.
+type rulesetMetrics struct {
+	RulesetVersion string `json:"ruleset_version"`
+	Runs           uint64 `json:"runs"`
+	// HitDensity is hits per diff line over all runs of the version.
+	HitDensity estimate `json:"hit_density"`
+	// ImprovementRate averages improvement_rate over the changes whose last
+	// run used the version.
+	ImprovementRate estimate `json:"improvement_rate"`
+	// Noise is the share of reviewer verdicts that were false_positive.
+	Noise estimate `json:"noise"`
+}
+
+type rulesetComparisonDiff struct {
+	HitDensity      difference `json:"hit_density"`
+	ImprovementRate difference `json:"improvement_rate"`
+	Noise           difference `json:"noise"`
+}
+
+// ruleComparisonSide is one rule under one version.
+type ruleComparisonSide struct {
+	TotalHits  uint64   `json:"total_hits"`
+	HitsPerRun *float64 `json:"hits_per_run"`
+	FixRate    estimate `json:"fix_rate"`
+	Noise      estimate `json:"noise"`
+}
+
+type ruleComparisonRow struct {
+	RuleID string             `json:"rule_id"`
+	A      ruleComparisonSide `json:"a"`
+	B      ruleComparisonSide `json:"b"`
+	// The differences are B minus A.
+	HitsPerRunDelta *float64   `json:"hits_per_run_delta"`
+	FixRate         difference `json:"fix_rate_diff"`
+	Noise           difference `json:"noise_diff"`
+
+	Catalog *ruleCatalogEntry `json:"catalog"`
+}
+
+type rulesetComparison struct {
+	A     rulesetMetrics
+	B     rulesetMetrics
+	Diff  rulesetComparisonDiff
+	Rules []ruleComparisonRow
+}
+
+// runSums are the per-run sums behind the hit density estimate.
+type runSums struct {
+	Runs        uint64
+	ZeroHitRuns uint64
+	SumHits     float64
+	SumLines    float64
+	SumHitsSq   float64
+	SumLinesSq  float64
+	SumCross    float64
+}
+
+func loadRunSums(runs *gorm.DB) (runSums, error) {
+	var sums runSums
+	err := runs.Select("COUNT(*) AS runs, " +
+		"COALESCE(SUM(CASE WHEN triggered_total_hits = 0 THEN 1 ELSE 0 END),0) AS zero_hit_runs, " +
+		"COALESCE(SUM(triggered_total_hits),0) AS sum_hits, " +
+		"COALESCE(SUM(diff_lines),0) AS sum_lines, " +
+		"COALESCE(SUM(1.0 * triggered_total_hits * triggered_total_hits),0) AS sum_hits_sq, " +
+		"COALESCE(SUM(1.0 * diff_lines * diff_lines),0) AS sum_lines_sq, " +
+		"COALESCE(SUM(1.0 * triggered_total_hits * diff_lines),0) AS sum_cross").Scan(&sums).Error
+	return sums, err
+}
+
+func (r runSums) hitDensity() estimate {
+	return ratioEstimate(r.Runs, r.SumHits, r.SumLines, r.SumHitsSq, r.SumLinesSq, r.SumCross)
+}
+
+type meanSums struct {
+	N     uint64
+	Sum   sql.NullFloat64
+	SumSq sql.NullFloat64
+}
+
+type proportionCounts struct {
+	Total     uint64
+	Successes uint64
+}
+
+// CompareRulesets compares ruleset versions a and b in [from, to] under the
+// remaining filters of f. Changes with fewer than minRuns runs are left out
+// of the improvement rate; rules are ordered by their combined hits and
+// limited to limit.
+func (s *gormStore) CompareRulesets(a, b string, from, to time.Time, f queryFilter, minRuns, limit int) (rulesetComparison, error) {
+	var cmp rulesetComparison
+	var err error
+	if cmp.A, err = s.loadRulesetMetrics(a, from, to, f, minRuns); err != nil {
+		return cmp, err
+	}
+	if cmp.B, err = s.loadRulesetMetrics(b, from, to, f, minRuns); err != nil {
+		return cmp, err
+	}
+	cmp.Diff = rulesetComparisonDiff{
+		HitDensity:      diffEstimate(cmp.A.HitDensity, cmp.B.HitDensity),
+		ImprovementRate: diffEstimate(cmp.A.ImprovementRate, cmp.B.ImprovementRate),
+		Noise:           diffEstimate(cmp.A.Noise, cmp.B.Noise),
+	}
+
+	statsA, runsA, err := s.loadRuleVersionStats(a, from, to, f)
+	if err != nil {
+		return cmp, err
+	}
+	statsB, runsB, err := s.loadRuleVersionStats(b, from, to, f)
+	if err != nil {
+		return cmp, err
+	}
+	ruleIDs := make(map[string]struct{}, len(statsA)+len(statsB))
+	for ruleID := range statsA {
+		ruleIDs[ruleID] = struct{}{}
+	}
+	for ruleID := range statsB {
+		ruleIDs[ruleID] = struct{}{}
+	}
+	for ruleID := range ruleIDs {
+		row := ruleComparisonRow{
+			RuleID: ruleID,
+			A:      ruleComparisonSideFor(statsA, ruleID, runsA),
+			B:      ruleComparisonSideFor(statsB, ruleID, runsB),
+		}
+		row.HitsPerRunDelta = deltaOf(row.A.HitsPerRun, row.B.HitsPerRun)
+		row.FixRate = diffEstimate(row.A.FixRate, row.B.FixRate)
+		row.Noise = diffEstimate(row.A.Noise, row.B.Noise)
+		cmp.Rules = append(cmp.Rules, row)
+	}
+	sort.Slice(cmp.Rules, func(i, j int) bool {
+		hi := cmp.Rules[i].A.TotalHits + cmp.Rules[i].B.TotalHits
+		hj := cmp.Rules[j].A.TotalHits + cmp.Rules[j].B.TotalHits
+		if hi != hj {
+			return hi > hj
+		}
+		return cmp.Rules[i].RuleID < cmp.Rules[j].RuleID
+	})
+	if len(cmp.Rules) > limit {
+		cmp.Rules = cmp.Rules[:limit]
+	}
+	return cmp, nil
+}
+
+func (s *gormStore) loadRulesetMetrics(version string, from, to time.Time, f queryFilter, minRuns int) (rulesetMetrics, error) {
+	metrics := rulesetMetrics{RulesetVersion: version}
+	scope := f
+	scope.RulesetVersion = version
+
+	runs, err := loadRunSums(s.runsInRange(from, to, scope))
+	if err != nil {
+		return metrics, err
+	}
+	metrics.Runs = runs.Runs
+	metrics.HitDensity = runs.hitDensity()
+
+	var changes meanSums
+	if err := s.changesInRange(from, to, scope, minRuns).Where("improvement_rate IS NOT NULL").
+		Select("COUNT(*) AS n, SUM(improvement_rate) AS sum, SUM(improvement_rate * improvement_rate) AS sum_sq").
+		Scan(&changes).Error; err != nil {
+		return metrics, err
+	}
+	metrics.ImprovementRate = meanEstimate(changes.N, changes.Sum.Float64, changes.SumSq.Float64)
+
+	filter, args := ruleFilterSQL("", scope)
+	var verdicts proportionCounts
+	if err := s.db.Raw("SELECT COUNT(*) AS total, "+
+		"COALESCE(SUM(CASE WHEN verdict = 'false_positive' THEN 1 ELSE 0 END),0) AS successes "+
+		"FROM cr_finding_feedback WHERE reported_at BETWEEN ? AND ?"+filter,
+		append([]interface{}{from, to}, args...)...).Scan(&verdicts).Error; err != nil {
+		return metrics, err
+	}
+	metrics.Noise = proportionEstimate(verdicts.Successes, verdicts.Total)
+	return metrics, nil
+}
+
+func ruleComparisonSideFor(stats map[string]ruleQualityAggRow, ruleID string, runs uint64) ruleComparisonSide {
+	row := stats[ruleID]
+	side := ruleComparisonSide{
+		TotalHits: row.TotalHits,
+		FixRate:   proportionEstimate(row.FixCount, row.ChangeCount),
+		Noise:     proportionEstimate(row.FalsePositiveCount, row.FeedbackCount),
+	}
+	if runs > 0 {
+		value := float64(row.TotalHits) / float64(runs)
+		side.HitsPerRun = &value
+	}
+	return side
+}
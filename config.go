@@ -15,7 +15,20 @@ type Config struct {
 		File string `yaml:"file"`
 	} `yaml:"logging"`
 
-	MySQL mysqlConfig `yaml:"mysql"`
+	Storage struct {
+		// Driver selects the backend: mysql (default), postgres or sqlite.
+		Driver string `yaml:"driver"`
+	} `yaml:"storage"`
+
+	MySQL    mysqlConfig    `yaml:"mysql"`
+	Postgres postgresConfig `yaml:"postgres"`
+	SQLite   sqliteConfig   `yaml:"sqlite"`
+
+	Retention       retentionConfig       `yaml:"retention"`
+	Anomaly         anomalyConfig         `yaml:"anomaly"`
+	AgentRegression agentRegressionConfig `yaml:"agent_regression"`
+	Alerting        alertingConfig        `yaml:"alerting"`
+	Auth            authConfig            `yaml:"auth"`
 }
 
 func loadConfig(path string) (Config, error) {
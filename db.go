@@ -36,11 +36,11 @@ func (CrAgentRun) TableName() string {
 }
 
 type CrAgentRunRule struct {
-	ID             uint64    `gorm:"primaryKey;autoIncrement;type:bigint unsigned;comment:自增主键"`
+	ID             uint64    `gorm:"primaryKey;autoIncrement;type:bigint unsigned;index:idx_rule_reported_id,priority:2;comment:自增主键"`
 	RunID          uint64    `gorm:"type:bigint unsigned;not null;uniqueIndex:uk_run_rule,priority:1;comment:关联 cr_agent_run.id"`
 	Repo           string    `gorm:"size:128;not null;index:idx_rule_repo_time,priority:2;index:idx_change_rule,priority:1;comment:仓库标识"`
 	CodeChangeID   string    `gorm:"size:128;not null;index:idx_change_rule,priority:2;comment:代码变更ID"`
-	ReportedAt     time.Time `gorm:"type:datetime(3);not null;index:idx_rule_time,priority:2;index:idx_rule_repo_time,priority:3;comment:上报时间（UTC）"`
+	ReportedAt     time.Time `gorm:"type:datetime(3);not null;index:idx_rule_time,priority:2;index:idx_rule_repo_time,priority:3;index:idx_rule_reported_id,priority:1;comment:上报时间（UTC）"`
 	RulesetVersion string    `gorm:"size:64;not null;index:idx_ruleset_rule,priority:1;comment:规则集版本（冗余自 run）"`
 	RuleID         string    `gorm:"size:128;not null;uniqueIndex:uk_run_rule,priority:2;index:idx_rule_time,priority:1;index:idx_rule_repo_time,priority:1;index:idx_change_rule,priority:3;index:idx_ruleset_rule,priority:2;comment:规则ID"`
 	HitCount       uint32    `gorm:"type:int unsigned;not null;comment:该规则在本次 run 的命中次数"`
@@ -68,6 +68,301 @@ func (CodeChangeSummary) TableName() string {
 	return "code_change_summary"
 }
 
+// CrAgentRunFinding is one reported finding of a run. The per-rule counts of
+// a run's findings equal its rule_hits when the agent sends findings at all.
+type CrAgentRunFinding struct {
+	ID           uint64    `gorm:"primaryKey;autoIncrement;type:bigint unsigned;comment:自增主键"`
+	RunID        uint64    `gorm:"type:bigint unsigned;not null;index:idx_finding_run,priority:1;comment:关联 cr_agent_run.id"`
+	Repo         string    `gorm:"size:128;not null;index:idx_finding_change,priority:1;comment:仓库标识"`
+	CodeChangeID string    `gorm:"size:128;not null;index:idx_finding_change,priority:2;comment:代码变更ID"`
+	ReportedAt   time.Time `gorm:"type:datetime(3);not null;comment:上报时间（UTC，冗余自 run）"`
+	RuleID       string    `gorm:"size:128;not null;index:idx_finding_run,priority:2;comment:规则ID"`
+	FilePath     string    `gorm:"size:512;not null;comment:命中文件路径"`
+	StartLine    uint32    `gorm:"type:int unsigned;not null;comment:起始行号（从 1 开始）"`
+	EndLine      uint32    `gorm:"type:int unsigned;not null;comment:结束行号（含）"`
+	Severity     string    `gorm:"size:16;not null;comment:严重级别 info / warning / error / critical"`
+	Fingerprint  string    `gorm:"size:64;not null;index:idx_finding_change,priority:3;comment:问题指纹，用于跨 run 追踪同一问题"`
+}
+
+func (CrAgentRunFinding) TableName() string {
+	return "cr_agent_run_finding"
+}
+
+// CrFindingTransition classifies the findings of a run against the previous
+// tracked run of the same change: new, persisted or fixed (present before,
+// gone now). Findings are matched on (rule_id, fingerprint); FindingCount
+// covers repeated fingerprints.
+type CrFindingTransition struct {
+	ID             uint64    `gorm:"primaryKey;autoIncrement;type:bigint unsigned;comment:自增主键"`
+	RunID          uint64    `gorm:"type:bigint unsigned;not null;index:idx_transition_run;comment:关联 cr_agent_run.id"`
+	PrevRunID      uint64    `gorm:"type:bigint unsigned;not null;comment:对比的上一次 run，首次 run 为 0"`
+	Repo           string    `gorm:"size:128;not null;index:idx_transition_change,priority:1;comment:仓库标识"`
+	CodeChangeID   string    `gorm:"size:128;not null;index:idx_transition_change,priority:2;comment:代码变更ID"`
+	ReportedAt     time.Time `gorm:"type:datetime(3);not null;index:idx_transition_change,priority:3;index:idx_transition_rule,priority:2;comment:run 上报时间（UTC）"`
+	RulesetVersion string    `gorm:"size:64;not null;comment:规则集版本（冗余自 run）"`
+	RuleID         string    `gorm:"size:128;not null;index:idx_transition_rule,priority:1;comment:规则ID"`
+	Fingerprint    string    `gorm:"size:64;not null;comment:问题指纹"`
+	Status         string    `gorm:"size:16;not null;comment:new / persisted / fixed"`
+	FindingCount   uint32    `gorm:"type:int unsigned;not null;comment:该指纹在此状态下的问题数"`
+	FilePath       string    `gorm:"size:512;not null;comment:文件路径（fixed 取自上一次 run）"`
+	StartLine      uint32    `gorm:"type:int unsigned;not null;comment:起始行号（fixed 取自上一次 run）"`
+}
+
+func (CrFindingTransition) TableName() string {
+	return "cr_finding_transition"
+}
+
+// CrFindingFeedback is a reviewer's verdict on a rule hit of a run, or on one
+// finding of it when Fingerprint is set. Each actor keeps one verdict per
+// target; a later one replaces it.
+type CrFindingFeedback struct {
+	ID             uint64    `gorm:"primaryKey;autoIncrement;type:bigint unsigned;comment:自增主键"`
+	RunID          uint64    `gorm:"type:bigint unsigned;not null;uniqueIndex:uk_feedback_target,priority:1;comment:关联 cr_agent_run.id"`
+	Repo           string    `gorm:"size:128;not null;comment:仓库标识"`
+	CodeChangeID   string    `gorm:"size:128;not null;comment:代码变更ID"`
+	ReportedAt     time.Time `gorm:"type:datetime(3);not null;index:idx_feedback_rule,priority:2;comment:run 上报时间（UTC，冗余自 run）"`
+	RulesetVersion string    `gorm:"size:64;not null;comment:规则集版本（冗余自 run）"`
+	RuleID         string    `gorm:"size:128;not null;uniqueIndex:uk_feedback_target,priority:2;index:idx_feedback_rule,priority:1;comment:规则ID"`
+	FindingID      uint64    `gorm:"type:bigint unsigned;not null;comment:关联 cr_agent_run_finding.id，针对整条规则时为 0"`
+	Fingerprint    string    `gorm:"size:64;not null;uniqueIndex:uk_feedback_target,priority:3;comment:问题指纹，针对整条规则时为空"`
+	Actor          string    `gorm:"size:128;not null;uniqueIndex:uk_feedback_target,priority:4;comment:反馈人"`
+	Verdict        string    `gorm:"size:16;not null;comment:accepted / dismissed / false_positive"`
+	Comment        string    `gorm:"size:1024;not null;comment:反馈说明"`
+	CreatedAt      time.Time `gorm:"type:datetime(3);not null;comment:反馈时间（UTC）"`
+}
+
+func (CrFindingFeedback) TableName() string {
+	return "cr_finding_feedback"
+}
+
+// CrRuleCatalog is the registered metadata of one rule_id.
+type CrRuleCatalog struct {
+	ID        uint64    `gorm:"primaryKey;autoIncrement;type:bigint unsigned;comment:自增主键"`
+	RuleID    string    `gorm:"size:128;not null;uniqueIndex:uk_rule_catalog_rule;comment:规则ID"`
+	Title     string    `gorm:"size:256;not null;comment:规则标题"`
+	Category  string    `gorm:"size:64;not null;index:idx_rule_catalog_category;comment:规则分类"`
+	Severity  string    `gorm:"size:16;not null;comment:默认严重级别 info / warning / error / critical，可为空"`
+	Owner     string    `gorm:"size:128;not null;index:idx_rule_catalog_owner;comment:负责团队"`
+	DocsURL   string    `gorm:"column:docs_url;size:512;not null;comment:规则文档链接"`
+	CreatedAt time.Time `gorm:"type:datetime(3);not null;comment:首次登记时间（UTC）"`
+	UpdatedAt time.Time `gorm:"type:datetime(3);not null;comment:最近更新时间（UTC）"`
+}
+
+func (CrRuleCatalog) TableName() string {
+	return "cr_rule_catalog"
+}
+
+// CrRuleCatalogVersion lists the ruleset versions that include a catalog rule.
+type CrRuleCatalogVersion struct {
+	ID             uint64 `gorm:"primaryKey;autoIncrement;type:bigint unsigned;comment:自增主键"`
+	RuleID         string `gorm:"size:128;not null;uniqueIndex:uk_rule_catalog_version,priority:1;comment:规则ID"`
+	RulesetVersion string `gorm:"size:64;not null;uniqueIndex:uk_rule_catalog_version,priority:2;index:idx_rule_catalog_version;comment:包含该规则的规则集版本"`
+}
+
+func (CrRuleCatalogVersion) TableName() string {
+	return "cr_rule_catalog_version"
+}
+
+// CrRulesetManifest lists the rules, with their config hashes, that make up
+// one published ruleset version.
+type CrRulesetManifest struct {
+	ID             uint64    `gorm:"primaryKey;autoIncrement;type:bigint unsigned;comment:自增主键"`
+	RulesetVersion string    `gorm:"size:64;not null;uniqueIndex:uk_manifest_rule,priority:1;comment:规则集版本"`
+	RuleID         string    `gorm:"size:128;not null;uniqueIndex:uk_manifest_rule,priority:2;comment:规则ID"`
+	ConfigHash     string    `gorm:"size:128;not null;comment:规则配置哈希，用于判断规则是否被修改"`
+	UploadedAt     time.Time `gorm:"type:datetime(3);not null;comment:清单上传时间（UTC）"`
+}
+
+func (CrRulesetManifest) TableName() string {
+	return "cr_ruleset_manifest"
+}
+
+// CrAnomaly is one day of one repo metric that the anomaly job found far from
+// its day-of-week baseline.
+type CrAnomaly struct {
+	ID           uint64    `gorm:"primaryKey;autoIncrement;type:bigint unsigned;comment:自增主键"`
+	Repo         string    `gorm:"size:128;not null;uniqueIndex:uk_anomaly_point,priority:1;comment:仓库标识"`
+	Metric       string    `gorm:"size:16;not null;uniqueIndex:uk_anomaly_point,priority:2;comment:指标：runs / hits / density"`
+	BucketStart  time.Time `gorm:"type:datetime(3);not null;uniqueIndex:uk_anomaly_point,priority:3;index:idx_anomaly_bucket;comment:异常所在的天（UTC 零点）"`
+	Value        float64   `gorm:"not null;comment:当天的实际值"`
+	Expected     float64   `gorm:"not null;comment:基线期望值（前几周同一星期几的均值）"`
+	Score        float64   `gorm:"not null;comment:偏离基线的标准差倍数，正数为偏高"`
+	Severity     string    `gorm:"size:16;not null;comment:严重程度：warning / critical"`
+	Direction    string    `gorm:"size:8;not null;comment:方向：spike / drop"`
+	BaselineDays uint32    `gorm:"type:int unsigned;not null;comment:参与基线的天数"`
+	DetectedAt   time.Time `gorm:"type:datetime(3);not null;comment:首次检测到的时间（UTC）"`
+	UpdatedAt    time.Time `gorm:"type:datetime(3);not null;comment:最近一次检测更新的时间（UTC）"`
+}
+
+func (CrAnomaly) TableName() string {
+	return "cr_anomaly"
+}
+
+// CrAgentRegression is an agent version the regression job found
+// significantly worse than the version before it; versions that are no longer
+// regressed are deleted by the next pass.
+type CrAgentRegression struct {
+	ID              uint64    `gorm:"primaryKey;autoIncrement;type:bigint unsigned;comment:自增主键"`
+	AgentVersion    string    `gorm:"size:64;not null;uniqueIndex:uk_agent_regression_version;comment:有退化的 agent 版本"`
+	BaselineVersion string    `gorm:"size:64;not null;comment:对比的上一个版本"`
+	FirstSeenAt     time.Time `gorm:"type:datetime(3);not null;comment:该版本首次上报时间（UTC）"`
+	MatchedRepos    uint64    `gorm:"type:bigint unsigned;not null;comment:两个版本都运行过的仓库数"`
+	BaselineRuns    uint64    `gorm:"type:bigint unsigned;not null;comment:上一个版本在这些仓库上的 run 数"`
+	CurrentRuns     uint64    `gorm:"type:bigint unsigned;not null;comment:该版本在这些仓库上的 run 数"`
+	Regressions     string    `gorm:"size:128;not null;comment:退化的指标，逗号分隔"`
+	DetectedAt      time.Time `gorm:"type:datetime(3);not null;comment:首次检测到的时间（UTC）"`
+	UpdatedAt       time.Time `gorm:"type:datetime(3);not null;comment:最近一次检测更新的时间（UTC）"`
+}
+
+func (CrAgentRegression) TableName() string {
+	return "cr_agent_regression"
+}
+
+// CrAlertRule is an alert rule defined through the API; rules from
+// config.yaml are not stored.
+type CrAlertRule struct {
+	ID             uint64    `gorm:"primaryKey;autoIncrement;type:bigint unsigned;comment:自增主键"`
+	Name           string    `gorm:"size:64;not null;uniqueIndex:uk_alert_rule_name;comment:规则名称"`
+	Metric         string    `gorm:"size:32;not null;comment:指标：runs / hits / hit_density / improvement_rate / fix_rate / false_positive_rate"`
+	Operator       string    `gorm:"size:2;not null;comment:比较运算符：> / >= / < / <="`
+	Threshold      float64   `gorm:"not null;comment:阈值"`
+	EvalWindow     string    `gorm:"size:16;not null;comment:统计窗口，如 2h / 7d"`
+	ForDuration    string    `gorm:"size:16;not null;comment:条件需持续满足的时长，空表示立即触发"`
+	RepeatInterval string    `gorm:"size:16;not null;comment:持续触发时重复通知的间隔，空表示不重复"`
+	MinRuns        uint32    `gorm:"type:int unsigned;not null;comment:窗口内 run 数少于该值时视为无数据"`
+	Repo           string    `gorm:"size:128;not null;comment:仓库过滤，空表示全部"`
+	RulesetVersion string    `gorm:"size:64;not null;comment:规则集版本过滤，空表示全部"`
+	AgentVersion   string    `gorm:"size:64;not null;comment:agent 版本过滤，空表示全部"`
+	RuleID         string    `gorm:"size:128;not null;comment:代码评审规则ID过滤，只用于规则指标"`
+	Severity       string    `gorm:"size:16;not null;comment:告警级别：warning / critical"`
+	Webhooks       string    `gorm:"size:512;not null;comment:通知的 webhook 名称，逗号分隔，空表示全部"`
+	Disabled       bool      `gorm:"not null;comment:是否停用"`
+	CreatedAt      time.Time `gorm:"type:datetime(3);not null;comment:创建时间（UTC）"`
+	UpdatedAt      time.Time `gorm:"type:datetime(3);not null;comment:最近更新时间（UTC）"`
+}
+
+func (CrAlertRule) TableName() string {
+	return "cr_alert_rule"
+}
+
+// CrAlertState is the evaluation state of one alert rule, including which
+// notification of the current firing episode was delivered last.
+type CrAlertState struct {
+	RuleName    string     `gorm:"size:64;primaryKey;comment:告警规则名称"`
+	State       string     `gorm:"size:16;not null;comment:状态：ok / pending / firing"`
+	Value       *float64   `gorm:"comment:最近一次计算的指标值，无数据时为 NULL"`
+	ActiveSince *time.Time `gorm:"type:datetime(3);comment:条件开始持续满足的时间（UTC）"`
+	FiredAt     *time.Time `gorm:"type:datetime(3);comment:本轮告警开始触发的时间（UTC）"`
+	ResolvedAt  *time.Time `gorm:"type:datetime(3);comment:本轮告警恢复的时间（UTC）"`
+	Notified    string     `gorm:"size:16;not null;comment:本轮告警已送达的通知：空 / firing / resolved"`
+	NotifiedAt  *time.Time `gorm:"type:datetime(3);comment:最近一次送达通知的时间（UTC）"`
+	LastError   string     `gorm:"size:512;not null;comment:最近一次计算或通知的错误"`
+	EvaluatedAt time.Time  `gorm:"type:datetime(3);not null;comment:最近一次计算的时间（UTC）"`
+}
+
+func (CrAlertState) TableName() string {
+	return "cr_alert_state"
+}
+
+// CrAlertSilence suppresses the notifications of matching alert rules between
+// StartsAt and EndsAt.
+type CrAlertSilence struct {
+	ID        uint64    `gorm:"primaryKey;autoIncrement;type:bigint unsigned;comment:自增主键"`
+	RuleName  string    `gorm:"size:64;not null;comment:匹配的告警规则名称，空表示全部"`
+	Repo      string    `gorm:"size:128;not null;comment:匹配的告警规则仓库，空表示全部"`
+	StartsAt  time.Time `gorm:"type:datetime(3);not null;comment:静默开始时间（UTC）"`
+	EndsAt    time.Time `gorm:"type:datetime(3);not null;index:idx_alert_silence_ends;comment:静默结束时间（UTC）"`
+	Comment   string    `gorm:"size:512;not null;comment:静默原因"`
+	CreatedBy string    `gorm:"size:128;not null;comment:创建人"`
+	CreatedAt time.Time `gorm:"type:datetime(3);not null;comment:创建时间（UTC）"`
+}
+
+func (CrAlertSilence) TableName() string {
+	return "cr_alert_silence"
+}
+
+// CrAPIKey is an ingestion API key. Only the SHA-256 of the key is stored.
+type CrAPIKey struct {
+	ID                uint64     `gorm:"primaryKey;autoIncrement;type:bigint unsigned;comment:自增主键"`
+	Name              string     `gorm:"size:128;not null;comment:密钥名称，如使用方"`
+	KeyPrefix         string     `gorm:"size:16;not null;comment:密钥开头几位，用于辨认"`
+	KeyHash           string     `gorm:"type:char(64);not null;uniqueIndex:uk_api_key_hash;comment:密钥的 SHA-256（十六进制）"`
+	PreviousKeyHash   string     `gorm:"size:64;not null;index:idx_api_key_previous_hash;comment:轮换前密钥的 SHA-256，宽限期内仍可使用"`
+	PreviousExpiresAt *time.Time `gorm:"type:datetime(3);comment:轮换前密钥失效时间（UTC）"`
+	CreatedAt         time.Time  `gorm:"type:datetime(3);not null;comment:创建时间（UTC）"`
+	RotatedAt         *time.Time `gorm:"type:datetime(3);comment:最近一次轮换时间（UTC）"`
+	RevokedAt         *time.Time `gorm:"type:datetime(3);comment:吊销时间（UTC），为空表示有效"`
+	LastUsedAt        *time.Time `gorm:"type:datetime(3);comment:最近一次使用时间（UTC），按分钟更新"`
+}
+
+func (CrAPIKey) TableName() string {
+	return "cr_api_key"
+}
+
+// CrAPIKeyRepo lists the repos an API key may report for.
+type CrAPIKeyRepo struct {
+	ID          uint64 `gorm:"primaryKey;autoIncrement;type:bigint unsigned;comment:自增主键"`
+	KeyID       uint64 `gorm:"type:bigint unsigned;not null;uniqueIndex:uk_api_key_repo,priority:1;comment:关联 cr_api_key.id"`
+	RepoPattern string `gorm:"size:128;not null;uniqueIndex:uk_api_key_repo,priority:2;comment:仓库标识，或以 /* 结尾的仓库前缀"`
+}
+
+func (CrAPIKeyRepo) TableName() string {
+	return "cr_api_key_repo"
+}
+
+// CrRunRollup pre-aggregates cr_agent_run per hour and per day so dashboard
+// queries over long ranges do not scan raw runs.
+type CrRunRollup struct {
+	Granularity    string    `gorm:"size:8;primaryKey;index:idx_run_rollup_repo,priority:1;comment:聚合粒度 hour / day"`
+	BucketStart    time.Time `gorm:"type:datetime(3);primaryKey;index:idx_run_rollup_repo,priority:3;comment:桶起始时间（UTC）"`
+	Repo           string    `gorm:"size:128;primaryKey;index:idx_run_rollup_repo,priority:2;comment:仓库标识"`
+	RulesetVersion string    `gorm:"size:64;primaryKey;comment:规则集版本"`
+	AgentVersion   string    `gorm:"size:64;primaryKey;comment:agent 版本"`
+	RunCount       uint64    `gorm:"type:bigint unsigned;not null;comment:run 数"`
+	TotalHits      uint64    `gorm:"type:bigint unsigned;not null;comment:规则命中总数"`
+	TotalDiffLines uint64    `gorm:"type:bigint unsigned;not null;comment:diff 行数之和"`
+}
+
+func (CrRunRollup) TableName() string {
+	return "cr_run_rollup"
+}
+
+// CrRuleRollup pre-aggregates cr_agent_run_rule per hour and per day.
+type CrRuleRollup struct {
+	Granularity    string    `gorm:"size:8;primaryKey;index:idx_rule_rollup_repo,priority:1;comment:聚合粒度 hour / day"`
+	BucketStart    time.Time `gorm:"type:datetime(3);primaryKey;index:idx_rule_rollup_repo,priority:3;comment:桶起始时间（UTC）"`
+	Repo           string    `gorm:"size:128;primaryKey;index:idx_rule_rollup_repo,priority:2;comment:仓库标识"`
+	RulesetVersion string    `gorm:"size:64;primaryKey;comment:规则集版本"`
+	AgentVersion   string    `gorm:"size:64;primaryKey;comment:agent 版本"`
+	RuleID         string    `gorm:"size:128;primaryKey;comment:规则ID"`
+	HitCount       uint64    `gorm:"type:bigint unsigned;not null;comment:命中次数之和"`
+	RunCount       uint64    `gorm:"type:bigint unsigned;not null;comment:命中该规则的 run 数"`
+}
+
+func (CrRuleRollup) TableName() string {
+	return "cr_rule_rollup"
+}
+
+// CrAuditLog is the append-only record of the mutating and administrative
+// requests; rows are never updated or deleted by the server.
+type CrAuditLog struct {
+	ID         uint64         `gorm:"primaryKey;autoIncrement;type:bigint unsigned;comment:自增主键"`
+	CreatedAt  time.Time      `gorm:"type:datetime(3);not null;index:idx_audit_created;index:idx_audit_actor_created,priority:2;index:idx_audit_action_created,priority:2;comment:请求时间（UTC）"`
+	Actor      string         `gorm:"size:128;not null;index:idx_audit_actor_created,priority:1;comment:操作者，未鉴权时为空"`
+	Action     string         `gorm:"size:64;not null;index:idx_audit_action_created,priority:1;comment:操作，如 alert_rule.upsert"`
+	Target     string         `gorm:"size:255;not null;comment:操作对象，如告警规则名"`
+	ParamsJSON datatypes.JSON `gorm:"type:json;not null;comment:请求参数（query 与请求体）"`
+	Status     int            `gorm:"not null;comment:HTTP 状态码"`
+	Result     string         `gorm:"size:16;not null;comment:结果：success / failure"`
+	Error      string         `gorm:"size:64;not null;comment:失败时的错误码"`
+	Message    string         `gorm:"size:1024;not null;comment:失败时的错误信息"`
+	RemoteAddr string         `gorm:"size:64;not null;comment:客户端地址"`
+}
+
+func (CrAuditLog) TableName() string {
+	return "cr_audit_log"
+}
+
 func openDB(cfg mysqlConfig) (*gorm.DB, error) {
 	dsn := fmt.Sprintf(
 		"%s:%s@tcp(%s:%d)/%s?charset=utf8mb4&parseTime=True&loc=Local",
@@ -98,3 +393,40 @@ func openDB(cfg mysqlConfig) (*gorm.DB, error) {
 
 	return db, nil
 }
+
+// openDatabase connects to the database selected by storage.driver without
+// checking its schema; the migrate command uses it directly.
+func openDatabase(cfg Config) (*gorm.DB, sqlDialect, error) {
+	switch cfg.Storage.Driver {
+	case "", "mysql":
+		db, err := openDB(cfg.MySQL)
+		return db, mysqlDialect{}, err
+	case "sqlite":
+		db, err := openSQLiteDB(cfg.SQLite)
+		return db, sqliteDialect{}, err
+	case "postgres":
+		db, err := openPostgresDB(cfg.Postgres)
+		return db, postgresDialect{}, err
+	default:
+		return nil, nil, fmt.Errorf("unknown storage.driver %q (expected mysql, postgres or sqlite)", cfg.Storage.Driver)
+	}
+}
+
+// openStore connects to the configured database, makes sure its schema is up
+// to date and wraps it in a Store.
+func openStore(cfg Config) (Store, error) {
+	policy, err := newRetentionPolicy(cfg.Retention)
+	if err != nil {
+		return nil, err
+	}
+	db, dialect, err := openDatabase(cfg)
+	if err != nil {
+		return nil, err
+	}
+	if err := checkSchemaVersion(db, dialect); err != nil {
+		return nil, err
+	}
+	store := newGormStore(db, dialect)
+	store.retention = policy
+	return store, nil
+}
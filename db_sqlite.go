@@ -0,0 +1,42 @@
+package main
+
+import (
+	"os"
+	"path/filepath"
+
+	"gorm.io/driver/sqlite"
+	"gorm.io/gorm"
+)
+
+type sqliteConfig struct {
+	Path string `yaml:"path"`
+}
+
+// openSQLiteDB opens (creating if needed) a local database file. SQLite allows
+// a single writer, so the pool is kept to one connection to avoid "database is
+// locked" errors under concurrent ingestion.
+func openSQLiteDB(cfg sqliteConfig) (*gorm.DB, error) {
+	path := cfg.Path
+	if path == "" {
+		path = "cr-agent.db"
+	}
+	if dir := filepath.Dir(path); dir != "." && dir != "" {
+		if err := os.MkdirAll(dir, 0o755); err != nil {
+			return nil, err
+		}
+	}
+
+	dsn := "file:" + path + "?_busy_timeout=5000&_journal_mode=WAL&_foreign_keys=on"
+	db, err := gorm.Open(sqlite.Open(dsn), &gorm.Config{TranslateError: true})
+	if err != nil {
+		return nil, err
+	}
+
+	sqlDB, err := db.DB()
+	if err != nil {
+		return nil, err
+	}
+	sqlDB.SetMaxOpenConns(1)
+
+	return db, nil
+}
@@ -0,0 +1,101 @@
+package main
+
+import (
+	"gorm.io/gorm"
+	"gorm.io/gorm/clause"
+)
+
+// sqlDialect isolates the SQL that differs between database backends. Every
+// other query in gormStore is written in the portable subset.
+type sqlDialect interface {
+	// name is the storage.driver value and the migrations/ directory of the
+	// backend.
+	name() string
+	// bucketExpr truncates a datetime column to the start of its "hour" or
+	// "day" bucket.
+	bucketExpr(column, bucket string) string
+	// ratioExpr divides two numeric expressions, yielding NULL when den is 0.
+	ratioExpr(num, den string) string
+	// summaryUpsert merges a partial code_change_summary row into the stored
+	// one; see gormStore.upsertCodeChangeSummaries.
+	summaryUpsert() clause.OnConflict
+	// bucketStartExpr truncates a datetime column to its "hour" or "day"
+	// bucket as a value that can be stored in a datetime column and compares
+	// equal to the same instant bound from Go.
+	bucketStartExpr(column, bucket string) string
+	// counterUpsert adds the counters of an incoming row to the stored row of
+	// table that has the same keys.
+	counterUpsert(table string, keys, counters []string) clause.OnConflict
+}
+
+// counterConflict builds the ON CONFLICT clause shared by every dialect's
+// counterUpsert; addExpr renders "stored + incoming" for one column.
+func counterConflict(keys, counters []string, addExpr func(column string) string) clause.OnConflict {
+	conflict := clause.OnConflict{}
+	for _, key := range keys {
+		conflict.Columns = append(conflict.Columns, clause.Column{Name: key})
+	}
+	updates := make(map[string]interface{}, len(counters))
+	for _, counter := range counters {
+		updates[counter] = gorm.Expr(addExpr(counter))
+	}
+	conflict.DoUpdates = clause.Assignments(updates)
+	return conflict
+}
+
+type mysqlDialect struct{}
+
+func (mysqlDialect) name() string { return "mysql" }
+
+func (mysqlDialect) bucketExpr(column, bucket string) string {
+	if bucket == "hour" {
+		return "DATE_FORMAT(" + column + ", '%Y-%m-%d %H:00:00')"
+	}
+	return "DATE(" + column + ")"
+}
+
+func (mysqlDialect) ratioExpr(num, den string) string {
+	return "(" + num + " / NULLIF(" + den + ",0))"
+}
+
+// summaryUpsert relies on MySQL evaluating ON DUPLICATE KEY UPDATE assignments
+// left to right against the partially updated row. clause.Assignments sorts
+// the columns, so improvement_rate, max_run_id and min_run_id still see the
+// old counters they compare against. last_ruleset_version comes after
+// last_reported_at and sees GREATEST(old, new); comparing VALUES(last_reported_at)
+// against that gives the same result as comparing it against the old value.
+func (mysqlDialect) summaryUpsert() clause.OnConflict {
+	return clause.OnConflict{
+		Columns: []clause.Column{
+			{Name: "repo"},
+			{Name: "code_change_id"},
+		},
+		DoUpdates: clause.Assignments(map[string]interface{}{
+			"run_count":            gorm.Expr("run_count + VALUES(run_count)"),
+			"first_reported_at":    gorm.Expr("LEAST(first_reported_at, VALUES(first_reported_at))"),
+			"last_reported_at":     gorm.Expr("GREATEST(last_reported_at, VALUES(last_reported_at))"),
+			"max_total_hits":       gorm.Expr("GREATEST(max_total_hits, VALUES(max_total_hits))"),
+			"max_run_id":           gorm.Expr("IF(VALUES(max_total_hits) > max_total_hits, VALUES(max_run_id), max_run_id)"),
+			"min_total_hits":       gorm.Expr("LEAST(min_total_hits, VALUES(min_total_hits))"),
+			"min_run_id":           gorm.Expr("IF(VALUES(min_total_hits) < min_total_hits, VALUES(min_run_id), min_run_id)"),
+			"last_ruleset_version": gorm.Expr("IF(VALUES(last_reported_at) >= last_reported_at, VALUES(last_ruleset_version), last_ruleset_version)"),
+			"improvement_rate": gorm.Expr(
+				"IF((run_count + VALUES(run_count)) >= 2 AND GREATEST(max_total_hits, VALUES(max_total_hits)) > 0," +
+					" (GREATEST(max_total_hits, VALUES(max_total_hits)) - LEAST(min_total_hits, VALUES(min_total_hits))) / GREATEST(max_total_hits, VALUES(max_total_hits))," +
+					" NULL)",
+			),
+		}),
+	}
+}
+
+// bucketStartExpr reuses bucketExpr: MySQL converts both the DATE_FORMAT text
+// and DATE values implicitly when they are stored in a DATETIME column.
+func (d mysqlDialect) bucketStartExpr(column, bucket string) string {
+	return d.bucketExpr(column, bucket)
+}
+
+func (mysqlDialect) counterUpsert(table string, keys, counters []string) clause.OnConflict {
+	return counterConflict(keys, counters, func(column string) string {
+		return column + " + VALUES(" + column + ")"
+	})
+}
@@ -0,0 +1,61 @@
+package main
+
+import (
+	"gorm.io/gorm"
+	"gorm.io/gorm/clause"
+)
+
+type postgresDialect struct{}
+
+func (postgresDialect) name() string { return "postgres" }
+
+// bucketExpr returns the same shapes as the MySQL dialect: day buckets are
+// timestamps (rendered as RFC3339 midnight), hour buckets are formatted text.
+func (postgresDialect) bucketExpr(column, bucket string) string {
+	if bucket == "hour" {
+		return "to_char(date_trunc('hour', " + column + "), 'YYYY-MM-DD HH24:00:00')"
+	}
+	return "date_trunc('day', " + column + ")"
+}
+
+func (postgresDialect) ratioExpr(num, den string) string {
+	return "(CAST(" + num + " AS DOUBLE PRECISION) / NULLIF(" + den + ",0))"
+}
+
+// summaryUpsert uses ON CONFLICT DO UPDATE. Stored columns are qualified with
+// the table name because EXCLUDED is in scope too; all expressions see the row
+// as it was before the update.
+func (postgresDialect) summaryUpsert() clause.OnConflict {
+	return clause.OnConflict{
+		Columns: []clause.Column{
+			{Name: "repo"},
+			{Name: "code_change_id"},
+		},
+		DoUpdates: clause.Assignments(map[string]interface{}{
+			"run_count":            gorm.Expr("code_change_summary.run_count + EXCLUDED.run_count"),
+			"first_reported_at":    gorm.Expr("LEAST(code_change_summary.first_reported_at, EXCLUDED.first_reported_at)"),
+			"last_reported_at":     gorm.Expr("GREATEST(code_change_summary.last_reported_at, EXCLUDED.last_reported_at)"),
+			"max_total_hits":       gorm.Expr("GREATEST(code_change_summary.max_total_hits, EXCLUDED.max_total_hits)"),
+			"max_run_id":           gorm.Expr("CASE WHEN EXCLUDED.max_total_hits > code_change_summary.max_total_hits THEN EXCLUDED.max_run_id ELSE code_change_summary.max_run_id END"),
+			"min_total_hits":       gorm.Expr("LEAST(code_change_summary.min_total_hits, EXCLUDED.min_total_hits)"),
+			"min_run_id":           gorm.Expr("CASE WHEN EXCLUDED.min_total_hits < code_change_summary.min_total_hits THEN EXCLUDED.min_run_id ELSE code_change_summary.min_run_id END"),
+			"last_ruleset_version": gorm.Expr("CASE WHEN EXCLUDED.last_reported_at >= code_change_summary.last_reported_at THEN EXCLUDED.last_ruleset_version ELSE code_change_summary.last_ruleset_version END"),
+			"improvement_rate": gorm.Expr(
+				"CASE WHEN (code_change_summary.run_count + EXCLUDED.run_count) >= 2 AND GREATEST(code_change_summary.max_total_hits, EXCLUDED.max_total_hits) > 0" +
+					" THEN CAST(GREATEST(code_change_summary.max_total_hits, EXCLUDED.max_total_hits) - LEAST(code_change_summary.min_total_hits, EXCLUDED.min_total_hits) AS DOUBLE PRECISION)" +
+					" / GREATEST(code_change_summary.max_total_hits, EXCLUDED.max_total_hits)" +
+					" ELSE NULL END",
+			),
+		}),
+	}
+}
+
+func (postgresDialect) bucketStartExpr(column, bucket string) string {
+	return "date_trunc('" + bucket + "', " + column + ")"
+}
+
+func (postgresDialect) counterUpsert(table string, keys, counters []string) clause.OnConflict {
+	return counterConflict(keys, counters, func(column string) string {
+		return table + "." + column + " + EXCLUDED." + column
+	})
+}
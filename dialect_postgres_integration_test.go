@@ -0,0 +1,171 @@
+//go:build postgres
+
+package main
+
+import (
+	"fmt"
+	"os"
+	"reflect"
+	"testing"
+	"time"
+
+	"gorm.io/driver/postgres"
+	"gorm.io/gorm"
+)
+
+// postgresDSNEnv names the keyword/value DSN of a scratch Postgres database,
+// e.g. "host=127.0.0.1 user=postgres password=postgres dbname=cr_test
+// sslmode=disable". Run with: go test -tags postgres ./...
+const postgresDSNEnv = "CR_TEST_POSTGRES_DSN"
+
+// newPostgresTestStore migrates a fresh schema in the database named by
+// CR_TEST_POSTGRES_DSN and drops it when the test ends.
+func newPostgresTestStore(t *testing.T) *gormStore {
+	t.Helper()
+	dsn := os.Getenv(postgresDSNEnv)
+	if dsn == "" {
+		t.Skipf("%s is not set", postgresDSNEnv)
+	}
+	admin, err := gorm.Open(postgres.Open(dsn), &gorm.Config{TranslateError: true})
+	if err != nil {
+		t.Fatalf("open postgres: %v", err)
+	}
+	schema := fmt.Sprintf("cr_test_%d", time.Now().UnixNano())
+	if err := admin.Exec("CREATE SCHEMA " + schema).Error; err != nil {
+		t.Fatalf("create schema: %v", err)
+	}
+	t.Cleanup(func() {
+		admin.Exec("DROP SCHEMA " + schema + " CASCADE")
+		if sqlDB, err := admin.DB(); err == nil {
+			sqlDB.Close()
+		}
+	})
+
+	db, err := gorm.Open(postgres.Open(dsn+" search_path="+schema+" TimeZone=UTC"), &gorm.Config{TranslateError: true})
+	if err != nil {
+		t.Fatalf("open schema %s: %v", schema, err)
+	}
+	t.Cleanup(func() {
+		if sqlDB, err := db.DB(); err == nil {
+			sqlDB.Close()
+		}
+	})
+	if _, err := migrateUp(db, postgresDialect{}, 0); err != nil {
+		t.Fatalf("migrate: %v", err)
+	}
+	if err := checkSchemaVersion(db, postgresDialect{}); err != nil {
+		t.Fatal(err)
+	}
+	return newGormStore(db, postgresDialect{})
+}
+
+func TestPostgresMigrationsRoundTrip(t *testing.T) {
+	store := newPostgresTestStore(t)
+	migrations, err := loadMigrations("postgres")
+	if err != nil {
+		t.Fatal(err)
+	}
+	reverted, err := migrateDown(store.db, postgresDialect{}, len(migrations))
+	if err != nil {
+		t.Fatalf("migrate down: %v", err)
+	}
+	if len(reverted) != len(migrations) {
+		t.Fatalf("reverted %d migrations, want %d", len(reverted), len(migrations))
+	}
+	if _, err := migrateUp(store.db, postgresDialect{}, 0); err != nil {
+		t.Fatalf("migrate up again: %v", err)
+	}
+}
+
+func TestPostgresSummaryUpsert(t *testing.T) {
+	store := newPostgresTestStore(t)
+
+	var ids []uint64
+	for _, run := range summaryRuns(t, "c1", 1) {
+		id, _, err := store.CreateAgentRun(pendingAgentRun{Req: run, DiffLines: *run.DiffLines})
+		if err != nil {
+			t.Fatal(err)
+		}
+		ids = append(ids, id)
+	}
+	checkSummary(t, loadSummary(t, store, "org/a", "c1"), ids)
+
+	runs := summaryRuns(t, "c2", 10)
+	pending := make([]pendingAgentRun, 0, len(runs))
+	for _, run := range runs {
+		pending = append(pending, pendingAgentRun{Req: run, DiffLines: *run.DiffLines})
+	}
+	results, err := store.CreateAgentRunBatch(pending)
+	if err != nil {
+		t.Fatal(err)
+	}
+	ids = ids[:0]
+	for _, res := range results {
+		ids = append(ids, res.RunPrimaryID)
+	}
+	checkSummary(t, loadSummary(t, store, "org/a", "c2"), ids)
+}
+
+func TestPostgresBuckets(t *testing.T) {
+	store := newPostgresTestStore(t)
+	bucketRuns(t, store)
+
+	// from/to cut into the first and last hour, so both the rollups written
+	// through counterUpsert and the raw bucketExpr path are read.
+	cases := []struct {
+		name     string
+		from, to string
+		metric   string
+		bucket   string
+		want     []timeSeriesPoint
+	}{
+		{
+			name: "hour", from: "2026-10-01T00:00:00Z", to: "2026-10-03T00:00:00Z", metric: "runs", bucket: "hour",
+			want: []timeSeriesPoint{{"2026-10-01 01:00:00", 2}, {"2026-10-01 02:00:00", 1}, {"2026-10-02 05:00:00", 1}},
+		},
+		{
+			name: "day", from: "2026-10-01T00:00:00Z", to: "2026-10-03T00:00:00Z", metric: "hits", bucket: "day",
+			want: []timeSeriesPoint{{"2026-10-01T00:00:00Z", 6}, {"2026-10-02T00:00:00Z", 4}},
+		},
+		{
+			name: "partial edges", from: "2026-10-01T01:30:00Z", to: "2026-10-02T05:30:00Z", metric: "runs", bucket: "hour",
+			want: []timeSeriesPoint{{"2026-10-01 01:00:00", 1}, {"2026-10-01 02:00:00", 1}, {"2026-10-02 05:00:00", 1}},
+		},
+	}
+	for _, tc := range cases {
+		t.Run(tc.name, func(t *testing.T) {
+			got, err := store.LoadTimeseries(mustTime(t, tc.from), mustTime(t, tc.to), queryFilter{}, tc.metric, tc.bucket)
+			if err != nil {
+				t.Fatal(err)
+			}
+			if !reflect.DeepEqual(got, tc.want) {
+				t.Fatalf("got %v, want %v", got, tc.want)
+			}
+		})
+	}
+
+	from, to := mustTime(t, "2026-10-01T00:00:00Z"), mustTime(t, "2026-10-03T00:00:00Z")
+	if _, err := store.RebuildRollups(from, to); err != nil {
+		t.Fatalf("rebuild rollups: %v", err)
+	}
+	got, err := store.LoadTimeseries(from, to, queryFilter{}, "hits", "day")
+	if err != nil {
+		t.Fatal(err)
+	}
+	if want := cases[1].want; !reflect.DeepEqual(got, want) {
+		t.Fatalf("after rebuild: got %v, want %v", got, want)
+	}
+}
+
+func TestPostgresRuleQualityRatios(t *testing.T) {
+	store := newPostgresTestStore(t)
+	bucketRuns(t, store)
+
+	stats, err := store.LoadRuleQualityStats(mustTime(t, "2026-10-01T00:00:00Z"), mustTime(t, "2026-10-03T00:00:00Z"), queryFilter{}, 1, 1)
+	if err != nil {
+		t.Fatal(err)
+	}
+	if stats.TotalRules != 1 || stats.TotalHitCount != 10 {
+		t.Fatalf("stats %+v, want one rule with 10 hits", stats)
+	}
+}
@@ -0,0 +1,66 @@
+package main
+
+import (
+	"gorm.io/gorm"
+	"gorm.io/gorm/clause"
+)
+
+// sqliteDialect stores datetimes as UTC text, so bucketing and comparisons
+// work on the string form written by the driver.
+type sqliteDialect struct{}
+
+func (sqliteDialect) name() string { return "sqlite" }
+
+// bucketExpr mirrors what the MySQL driver returns for the same buckets: day
+// buckets come back as RFC3339 midnight, hour buckets as plain datetime text.
+func (sqliteDialect) bucketExpr(column, bucket string) string {
+	if bucket == "hour" {
+		return "strftime('%Y-%m-%d %H:00:00', " + column + ")"
+	}
+	return "strftime('%Y-%m-%dT00:00:00Z', " + column + ")"
+}
+
+func (sqliteDialect) ratioExpr(num, den string) string {
+	return "(CAST(" + num + " AS REAL) / NULLIF(" + den + ",0))"
+}
+
+// summaryUpsert uses ON CONFLICT DO UPDATE, where every unqualified column
+// refers to the stored row and excluded.* to the incoming one.
+func (sqliteDialect) summaryUpsert() clause.OnConflict {
+	return clause.OnConflict{
+		Columns: []clause.Column{
+			{Name: "repo"},
+			{Name: "code_change_id"},
+		},
+		DoUpdates: clause.Assignments(map[string]interface{}{
+			"run_count":            gorm.Expr("run_count + excluded.run_count"),
+			"first_reported_at":    gorm.Expr("MIN(first_reported_at, excluded.first_reported_at)"),
+			"last_reported_at":     gorm.Expr("MAX(last_reported_at, excluded.last_reported_at)"),
+			"max_total_hits":       gorm.Expr("MAX(max_total_hits, excluded.max_total_hits)"),
+			"max_run_id":           gorm.Expr("CASE WHEN excluded.max_total_hits > max_total_hits THEN excluded.max_run_id ELSE max_run_id END"),
+			"min_total_hits":       gorm.Expr("MIN(min_total_hits, excluded.min_total_hits)"),
+			"min_run_id":           gorm.Expr("CASE WHEN excluded.min_total_hits < min_total_hits THEN excluded.min_run_id ELSE min_run_id END"),
+			"last_ruleset_version": gorm.Expr("CASE WHEN excluded.last_reported_at >= last_reported_at THEN excluded.last_ruleset_version ELSE last_ruleset_version END"),
+			"improvement_rate": gorm.Expr(
+				"CASE WHEN (run_count + excluded.run_count) >= 2 AND MAX(max_total_hits, excluded.max_total_hits) > 0" +
+					" THEN CAST(MAX(max_total_hits, excluded.max_total_hits) - MIN(min_total_hits, excluded.min_total_hits) AS REAL) / MAX(max_total_hits, excluded.max_total_hits)" +
+					" ELSE NULL END",
+			),
+		}),
+	}
+}
+
+// bucketStartExpr renders the text the driver writes for a UTC time.Time, so
+// rollup buckets computed in SQL match the ones written from Go.
+func (sqliteDialect) bucketStartExpr(column, bucket string) string {
+	if bucket == "hour" {
+		return "strftime('%Y-%m-%d %H:00:00+00:00', " + column + ")"
+	}
+	return "strftime('%Y-%m-%d 00:00:00+00:00', " + column + ")"
+}
+
+func (sqliteDialect) counterUpsert(table string, keys, counters []string) clause.OnConflict {
+	return counterConflict(keys, counters, func(column string) string {
+		return column + " + excluded." + column
+	})
+}
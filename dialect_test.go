@@ -0,0 +1,207 @@
+package main
+
+import (
+	"regexp"
+	"strings"
+	"testing"
+	"time"
+
+	"gorm.io/driver/postgres"
+	"gorm.io/gorm"
+	"gorm.io/gorm/clause"
+)
+
+func TestDialectExpressions(t *testing.T) {
+	cases := []struct {
+		dialect sqlDialect
+		day     string
+		hour    string
+		ratio   string
+	}{
+		{
+			dialect: mysqlDialect{},
+			day:     "DATE(reported_at)",
+			hour:    "DATE_FORMAT(reported_at, '%Y-%m-%d %H:00:00')",
+			ratio:   "(SUM(hits) / NULLIF(SUM(runs),0))",
+		},
+		{
+			dialect: postgresDialect{},
+			day:     "date_trunc('day', reported_at)",
+			hour:    "to_char(date_trunc('hour', reported_at), 'YYYY-MM-DD HH24:00:00')",
+			ratio:   "(CAST(SUM(hits) AS DOUBLE PRECISION) / NULLIF(SUM(runs),0))",
+		},
+		{
+			dialect: sqliteDialect{},
+			day:     "strftime('%Y-%m-%dT00:00:00Z', reported_at)",
+			hour:    "strftime('%Y-%m-%d %H:00:00', reported_at)",
+			ratio:   "(CAST(SUM(hits) AS REAL) / NULLIF(SUM(runs),0))",
+		},
+	}
+	for _, tc := range cases {
+		t.Run(tc.dialect.name(), func(t *testing.T) {
+			if got := tc.dialect.bucketExpr("reported_at", "day"); got != tc.day {
+				t.Errorf("day bucket %q, want %q", got, tc.day)
+			}
+			if got := tc.dialect.bucketExpr("reported_at", "hour"); got != tc.hour {
+				t.Errorf("hour bucket %q, want %q", got, tc.hour)
+			}
+			if got := tc.dialect.ratioExpr("SUM(hits)", "SUM(runs)"); got != tc.ratio {
+				t.Errorf("ratio %q, want %q", got, tc.ratio)
+			}
+		})
+	}
+}
+
+// newDryRunPostgres returns a Postgres session that renders statements
+// without connecting.
+func newDryRunPostgres(t *testing.T) *gorm.DB {
+	t.Helper()
+	db, err := gorm.Open(postgres.New(postgres.Config{DSN: "host=127.0.0.1 sslmode=disable"}), &gorm.Config{
+		DryRun:                 true,
+		SkipDefaultTransaction: true,
+		DisableAutomaticPing:   true,
+	})
+	if err != nil {
+		t.Fatal(err)
+	}
+	return db
+}
+
+// upsertUpdates returns the DO UPDATE SET part of an INSERT statement.
+func upsertUpdates(t *testing.T, sql, conflict string) string {
+	t.Helper()
+	head := conflict + " DO UPDATE SET "
+	i := strings.Index(sql, head)
+	if i < 0 {
+		t.Fatalf("no %q in %s", head, sql)
+	}
+	updates := sql[i+len(head):]
+	if j := strings.Index(updates, " RETURNING "); j >= 0 {
+		updates = updates[:j]
+	}
+	return updates
+}
+
+// unqualifiedColumns lists the columns that updates reads without a table or
+// EXCLUDED prefix. Postgres rejects those as ambiguous once EXCLUDED is in
+// scope; the quoted assignment targets are not reads.
+func unqualifiedColumns(updates, table string, columns []string) []string {
+	var bare []string
+	for _, column := range columns {
+		rest := updates
+		for _, ref := range []string{table + "." + column, "EXCLUDED." + column, `"` + column + `"`} {
+			rest = strings.ReplaceAll(rest, ref, "")
+		}
+		if regexp.MustCompile(`\b` + column + `\b`).MatchString(rest) {
+			bare = append(bare, column)
+		}
+	}
+	return bare
+}
+
+func TestPostgresSummaryUpsertSQL(t *testing.T) {
+	at := time.Date(2026, 10, 1, 10, 0, 0, 0, time.UTC)
+	summaries := []CodeChangeSummary{
+		{Repo: "org/a", CodeChangeID: "c1", RunCount: 1, FirstReportedAt: at, LastReportedAt: at, MaxTotalHits: 3, MinTotalHits: 3, MaxRunID: 1, MinRunID: 1, LastRulesetVersion: "r1"},
+	}
+	stmt := newDryRunPostgres(t).Clauses(postgresDialect{}.summaryUpsert()).Create(&summaries).Statement
+	sql := stmt.SQL.String()
+
+	if !strings.HasPrefix(sql, `INSERT INTO "code_change_summary"`) {
+		t.Fatalf("not an insert into code_change_summary: %s", sql)
+	}
+	updates := upsertUpdates(t, sql, `ON CONFLICT ("repo","code_change_id")`)
+
+	columns := []string{
+		"run_count", "first_reported_at", "last_reported_at", "max_total_hits", "max_run_id",
+		"min_total_hits", "min_run_id", "last_ruleset_version", "improvement_rate",
+	}
+	for _, column := range columns {
+		if !strings.Contains(updates, `"`+column+`"=`) {
+			t.Errorf("%s is not updated: %s", column, updates)
+		}
+	}
+	if bare := unqualifiedColumns(updates, "code_change_summary", columns); len(bare) > 0 {
+		t.Errorf("unqualified columns %v in %s", bare, updates)
+	}
+	for _, want := range []string{
+		`"run_count"=code_change_summary.run_count + EXCLUDED.run_count`,
+		`"max_run_id"=CASE WHEN EXCLUDED.max_total_hits > code_change_summary.max_total_hits THEN EXCLUDED.max_run_id ELSE code_change_summary.max_run_id END`,
+		`"last_ruleset_version"=CASE WHEN EXCLUDED.last_reported_at >= code_change_summary.last_reported_at`,
+		"AS DOUBLE PRECISION)",
+	} {
+		if !strings.Contains(updates, want) {
+			t.Errorf("missing %q in %s", want, updates)
+		}
+	}
+}
+
+func TestPostgresCounterUpsertSQL(t *testing.T) {
+	at := time.Date(2026, 10, 1, 10, 0, 0, 0, time.UTC)
+	cases := []struct {
+		table    string
+		keys     []string
+		counters []string
+		rows     interface{}
+	}{
+		{
+			table: "cr_run_rollup", keys: runRollupKeys, counters: runRollupCounters,
+			rows: &[]CrRunRollup{{Granularity: "hour", BucketStart: at, Repo: "org/a", RunCount: 1}},
+		},
+		{
+			table: "cr_rule_rollup", keys: ruleRollupKeys, counters: ruleRollupCounters,
+			rows: &[]CrRuleRollup{{Granularity: "hour", BucketStart: at, Repo: "org/a", RuleID: "R1", HitCount: 2, RunCount: 1}},
+		},
+	}
+	for _, tc := range cases {
+		t.Run(tc.table, func(t *testing.T) {
+			sql := newDryRunPostgres(t).Clauses(postgresDialect{}.counterUpsert(tc.table, tc.keys, tc.counters)).
+				Create(tc.rows).Statement.SQL.String()
+
+			quoted := make([]string, 0, len(tc.keys))
+			for _, key := range tc.keys {
+				quoted = append(quoted, `"`+key+`"`)
+			}
+			updates := upsertUpdates(t, sql, "ON CONFLICT ("+strings.Join(quoted, ",")+")")
+			for _, counter := range tc.counters {
+				want := `"` + counter + `"=` + tc.table + "." + counter + " + EXCLUDED." + counter
+				if !strings.Contains(updates, want) {
+					t.Errorf("missing %q in %s", want, updates)
+				}
+			}
+			if bare := unqualifiedColumns(updates, tc.table, tc.counters); len(bare) > 0 {
+				t.Errorf("unqualified columns %v in %s", bare, updates)
+			}
+			// Keys identify the row and must never be overwritten.
+			for _, key := range tc.keys {
+				if strings.Contains(updates, `"`+key+`"=`) {
+					t.Errorf("key %s is updated: %s", key, updates)
+				}
+			}
+		})
+	}
+}
+
+// TestCounterConflictSharedShape checks the parts of counterConflict that do
+// not depend on the dialect.
+func TestCounterConflictSharedShape(t *testing.T) {
+	for _, dialect := range []sqlDialect{mysqlDialect{}, postgresDialect{}, sqliteDialect{}} {
+		conflict := dialect.counterUpsert("cr_run_rollup", runRollupKeys, runRollupCounters)
+		if len(conflict.Columns) != len(runRollupKeys) {
+			t.Fatalf("%s: %d conflict columns, want %d", dialect.name(), len(conflict.Columns), len(runRollupKeys))
+		}
+		for i, key := range runRollupKeys {
+			if conflict.Columns[i].Name != key {
+				t.Errorf("%s: conflict column %d is %s, want %s", dialect.name(), i, conflict.Columns[i].Name, key)
+			}
+		}
+		if len(conflict.DoUpdates) != len(runRollupCounters) {
+			t.Errorf("%s: %d updates, want %d", dialect.name(), len(conflict.DoUpdates), len(runRollupCounters))
+		}
+		for _, update := range conflict.DoUpdates {
+			if _, ok := update.Value.(clause.Expr); !ok {
+				t.Errorf("%s: %s is assigned %T, want an expression", dialect.name(), update.Column.Name, update.Value)
+			}
+		}
+	}
+}
@@ -0,0 +1,227 @@
+package main
+
+import (
+	"encoding/json"
+	"errors"
+	"fmt"
+	"strings"
+	"time"
+	"unicode/utf8"
+
+	"gorm.io/gorm"
+)
+
+// Feedback verdicts stored in cr_finding_feedback.
+const (
+	verdictAccepted      = "accepted"
+	verdictDismissed     = "dismissed"
+	verdictFalsePositive = "false_positive"
+)
+
+var feedbackVerdicts = map[string]bool{verdictAccepted: true, verdictDismissed: true, verdictFalsePositive: true}
+
+const (
+	maxActorLen   = 128
+	maxCommentLen = 1024
+)
+
+// feedbackRequest is a reviewer's verdict on a rule hit of a run, or on one
+// of its findings. The run is given either by RunID or by the
+// (repo, code_change_id, agent_run_id) triple; the finding by FindingID or
+// Fingerprint.
+type feedbackRequest struct {
+	RunID        uint64 `json:"run_id"`
+	Repo         string `json:"repo"`
+	CodeChangeID string `json:"code_change_id"`
+	AgentRunID   string `json:"agent_run_id"`
+	RuleID       string `json:"rule_id"`
+	FindingID    uint64 `json:"finding_id"`
+	Fingerprint  string `json:"fingerprint"`
+	Verdict      string `json:"verdict"`
+	Actor        string `json:"actor"`
+	Comment      string `json:"comment"`
+	// CreatedAt defaults to the time the feedback is received.
+	CreatedAt time.Time `json:"created_at"`
+	// Repos limits the runs feedback may be given on to the repos the caller
+	// may see; nil means every repo.
+	Repos repoScope `json:"-"`
+}
+
+type feedbackResponse struct {
+	OK         bool   `json:"ok"`
+	FeedbackID uint64 `json:"feedback_id"`
+	RunID      uint64 `json:"run_id"`
+	// Replaced reports that an earlier verdict of the same actor on the same
+	// target was overwritten.
+	Replaced bool `json:"replaced"`
+}
+
+// errRunNotFound is returned by RecordFeedback when the referenced run does
+// not exist.
+var errRunNotFound = errors.New("run not found")
+
+// feedbackTargetError reports a rule or finding that does not belong to the
+// referenced run.
+type feedbackTargetError struct {
+	fieldError
+}
+
+func (e *feedbackTargetError) Error() string {
+	return e.Message
+}
+
+// validateFeedback checks a decoded feedback request; whether the run, rule
+// and finding exist is checked by RecordFeedback.
+func validateFeedback(req feedbackRequest, now time.Time) []fieldError {
+	var errs []fieldError
+	add := func(field, code, message string) {
+		errs = append(errs, fieldError{Field: field, Code: code, Message: message})
+	}
+
+	if req.RunID == 0 {
+		if req.Repo == "" && req.CodeChangeID == "" && req.AgentRunID == "" {
+			add("run_id", "required", "run_id or repo + code_change_id + agent_run_id is required")
+		} else {
+			if strings.TrimSpace(req.Repo) == "" {
+				add("repo", "required", "repo is required without run_id")
+			}
+			if strings.TrimSpace(req.CodeChangeID) == "" {
+				add("code_change_id", "required", "code_change_id is required without run_id")
+			}
+			if strings.TrimSpace(req.AgentRunID) == "" {
+				add("agent_run_id", "required", "agent_run_id is required without run_id")
+			}
+		}
+	}
+
+	switch {
+	case req.RuleID == "":
+		add("rule_id", "required", "rule_id is required")
+	case utf8.RuneCountInString(req.RuleID) > maxRuleIDLen:
+		add("rule_id", "too_long", fmt.Sprintf("rule_id must be at most %d characters", maxRuleIDLen))
+	case !isValidRuleID(req.RuleID):
+		add("rule_id", "invalid_format", "rule_id may only contain letters, digits and . _ - : /")
+	}
+	if utf8.RuneCountInString(req.Fingerprint) > maxFingerprintLen {
+		add("fingerprint", "too_long", fmt.Sprintf("fingerprint must be at most %d characters", maxFingerprintLen))
+	}
+
+	if req.Verdict == "" {
+		add("verdict", "required", "verdict is required")
+	} else if !feedbackVerdicts[req.Verdict] {
+		add("verdict", "invalid_format", "verdict must be accepted|dismissed|false_positive")
+	}
+	if strings.TrimSpace(req.Actor) == "" {
+		add("actor", "required", "actor is required")
+	} else if utf8.RuneCountInString(req.Actor) > maxActorLen {
+		add("actor", "too_long", fmt.Sprintf("actor must be at most %d characters", maxActorLen))
+	}
+	if utf8.RuneCountInString(req.Comment) > maxCommentLen {
+		add("comment", "too_long", fmt.Sprintf("comment must be at most %d characters", maxCommentLen))
+	}
+	if req.CreatedAt.After(now.Add(maxReportedAtSkew)) {
+		add("created_at", "in_future", fmt.Sprintf("created_at must not be more than %s in the future", maxReportedAtSkew))
+	}
+	return errs
+}
+
+// RecordFeedback stores req, replacing the earlier verdict of the same actor
+// on the same run, rule and fingerprint.
+func (s *gormStore) RecordFeedback(req feedbackRequest) (feedbackResponse, error) {
+	var run CrAgentRun
+	query := applyRepoScope(s.db.Select("id, repo, code_change_id, reported_at, ruleset_version, rule_hits_json"), "repo", req.Repos)
+	if req.RunID != 0 {
+		query = query.Where("id = ?", req.RunID)
+	} else {
+		query = query.Where("repo = ? AND code_change_id = ? AND agent_run_id = ?", req.Repo, req.CodeChangeID, req.AgentRunID)
+	}
+	if err := query.First(&run).Error; err != nil {
+		if errors.Is(err, gorm.ErrRecordNotFound) {
+			return feedbackResponse{}, errRunNotFound
+		}
+		return feedbackResponse{}, err
+	}
+
+	var ruleHits map[string]uint32
+	if err := json.Unmarshal(run.RuleHitsJSON, &ruleHits); err != nil {
+		return feedbackResponse{}, err
+	}
+	if ruleHits[req.RuleID] == 0 {
+		return feedbackResponse{}, &feedbackTargetError{fieldError{Field: "rule_id", Code: "not_found", Message: fmt.Sprintf("run %d has no hit of %s", run.ID, req.RuleID)}}
+	}
+
+	// A finding given by fingerprint alone resolves to its first occurrence
+	// in the run.
+	findingID, fingerprint := req.FindingID, req.Fingerprint
+	if findingID != 0 || fingerprint != "" {
+		var finding CrAgentRunFinding
+		query := s.db.Select("id, fingerprint").Where("run_id = ? AND rule_id = ?", run.ID, req.RuleID)
+		if findingID != 0 {
+			query = query.Where("id = ?", findingID)
+		} else {
+			query = query.Where("fingerprint = ?", fingerprint)
+		}
+		err := query.First(&finding).Error
+		switch {
+		case errors.Is(err, gorm.ErrRecordNotFound) && findingID != 0:
+			return feedbackResponse{}, &feedbackTargetError{fieldError{Field: "finding_id", Code: "not_found", Message: fmt.Sprintf("finding %d is not a %s finding of run %d", findingID, req.RuleID, run.ID)}}
+		case errors.Is(err, gorm.ErrRecordNotFound):
+			return feedbackResponse{}, &feedbackTargetError{fieldError{Field: "fingerprint", Code: "not_found", Message: fmt.Sprintf("run %d has no %s finding with this fingerprint", run.ID, req.RuleID)}}
+		case err != nil:
+			return feedbackResponse{}, err
+		}
+		if fingerprint != "" && fingerprint != finding.Fingerprint {
+			return feedbackResponse{}, &feedbackTargetError{fieldError{Field: "fingerprint", Code: "mismatch", Message: "fingerprint does not match finding_id"}}
+		}
+		findingID, fingerprint = finding.ID, finding.Fingerprint
+	}
+
+	createdAt := req.CreatedAt.UTC()
+	if req.CreatedAt.IsZero() {
+		createdAt = time.Now().UTC()
+	}
+	feedback := CrFindingFeedback{
+		RunID:          run.ID,
+		Repo:           run.Repo,
+		CodeChangeID:   run.CodeChangeID,
+		ReportedAt:     run.ReportedAt,
+		RulesetVersion: run.RulesetVersion,
+		RuleID:         req.RuleID,
+		FindingID:      findingID,
+		Fingerprint:    fingerprint,
+		Actor:          req.Actor,
+		Verdict:        req.Verdict,
+		Comment:        req.Comment,
+		CreatedAt:      createdAt,
+	}
+	findTarget := func(existing *CrFindingFeedback) error {
+		return s.db.Where("run_id = ? AND rule_id = ? AND fingerprint = ? AND actor = ?", run.ID, req.RuleID, fingerprint, req.Actor).First(existing).Error
+	}
+
+	replace := func(existing CrFindingFeedback) (feedbackResponse, error) {
+		err := s.db.Model(&CrFindingFeedback{}).Where("id = ?", existing.ID).Updates(map[string]interface{}{
+			"finding_id": feedback.FindingID,
+			"verdict":    feedback.Verdict,
+			"comment":    feedback.Comment,
+			"created_at": feedback.CreatedAt,
+		}).Error
+		return feedbackResponse{OK: true, FeedbackID: existing.ID, RunID: run.ID, Replaced: true}, err
+	}
+
+	var existing CrFindingFeedback
+	if err := findTarget(&existing); err == nil {
+		return replace(existing)
+	} else if !errors.Is(err, gorm.ErrRecordNotFound) {
+		return feedbackResponse{}, err
+	}
+	if err := s.db.Create(&feedback).Error; err != nil {
+		// A concurrent request of the same actor created the row first.
+		if errors.Is(err, gorm.ErrDuplicatedKey) {
+			if err := findTarget(&existing); err == nil {
+				return replace(existing)
+			}
+		}
+		return feedbackResponse{}, err
+	}
+	return feedbackResponse{OK: true, FeedbackID: feedback.ID, RunID: run.ID}, nil
+}
@@ -0,0 +1,336 @@
+package main
+
+import (
+	"sort"
+	"time"
+
+	"gorm.io/gorm"
+)
+
+// Transition statuses stored in cr_finding_transition.
+const (
+	findingNew       = "new"
+	findingPersisted = "persisted"
+	findingFixed     = "fixed"
+)
+
+// findingTrackedRunSQL selects the runs that take part in fix tracking: runs
+// that reported findings, plus runs without any hit, whose (empty) findings
+// are known even when the agent omitted the array. Runs with hits but no
+// findings are skipped, so tracking compares the neighbouring tracked runs.
+const findingTrackedRunSQL = "(triggered_total_hits = 0 OR EXISTS (SELECT 1 FROM cr_agent_run_finding f WHERE f.run_id = cr_agent_run.id))"
+
+// findingTrackingPageSize is the number of changes recomputed per transaction
+// by RebuildFindingTransitions.
+const findingTrackingPageSize = 200
+
+type findingKey struct {
+	RuleID      string
+	Fingerprint string
+}
+
+// classifyFindings matches the findings of cur against prev on (rule_id,
+// fingerprint). Repeated fingerprints are matched as a multiset: the overlap
+// persists, the surplus of cur is new and the surplus of prev is fixed.
+func classifyFindings(run, prev CrAgentRun, cur, before []CrAgentRunFinding) []CrFindingTransition {
+	type tally struct {
+		cur, prev     uint32
+		curAt, prevAt *CrAgentRunFinding
+	}
+	tallies := make(map[findingKey]*tally)
+	get := func(f *CrAgentRunFinding) *tally {
+		key := findingKey{f.RuleID, f.Fingerprint}
+		t := tallies[key]
+		if t == nil {
+			t = &tally{}
+			tallies[key] = t
+		}
+		return t
+	}
+	for i := range cur {
+		t := get(&cur[i])
+		t.cur++
+		if t.curAt == nil || findingBefore(&cur[i], t.curAt) {
+			t.curAt = &cur[i]
+		}
+	}
+	for i := range before {
+		t := get(&before[i])
+		t.prev++
+		if t.prevAt == nil || findingBefore(&before[i], t.prevAt) {
+			t.prevAt = &before[i]
+		}
+	}
+
+	keys := make([]findingKey, 0, len(tallies))
+	for key := range tallies {
+		keys = append(keys, key)
+	}
+	sort.Slice(keys, func(a, b int) bool {
+		if keys[a].RuleID != keys[b].RuleID {
+			return keys[a].RuleID < keys[b].RuleID
+		}
+		return keys[a].Fingerprint < keys[b].Fingerprint
+	})
+
+	var rows []CrFindingTransition
+	add := func(key findingKey, status string, count uint32, at *CrAgentRunFinding) {
+		if count == 0 {
+			return
+		}
+		rows = append(rows, CrFindingTransition{
+			RunID:          run.ID,
+			PrevRunID:      prev.ID,
+			Repo:           run.Repo,
+			CodeChangeID:   run.CodeChangeID,
+			ReportedAt:     run.ReportedAt,
+			RulesetVersion: run.RulesetVersion,
+			RuleID:         key.RuleID,
+			Fingerprint:    key.Fingerprint,
+			Status:         status,
+			FindingCount:   count,
+			FilePath:       at.FilePath,
+			StartLine:      at.StartLine,
+		})
+	}
+	for _, key := range keys {
+		t := tallies[key]
+		kept := t.cur
+		if t.prev < kept {
+			kept = t.prev
+		}
+		add(key, findingPersisted, kept, t.curAt)
+		add(key, findingNew, t.cur-kept, t.curAt)
+		add(key, findingFixed, t.prev-kept, t.prevAt)
+	}
+	return rows
+}
+
+func findingBefore(a, b *CrAgentRunFinding) bool {
+	if a.FilePath != b.FilePath {
+		return a.FilePath < b.FilePath
+	}
+	return a.StartLine < b.StartLine
+}
+
+// refreshFindingTransitions recomputes cr_finding_transition for the changes
+// in keys. With runIDs set only those runs and the tracked run following each
+// of them are recomputed, which is all an insert can affect; with nil runIDs
+// every run of the changes is.
+func refreshFindingTransitions(tx *gorm.DB, keys []changeKey, runIDs map[uint64]bool) (int, error) {
+	if len(keys) == 0 {
+		return 0, nil
+	}
+	var tracked []CrAgentRun
+	if err := tx.Select("id, repo, code_change_id, reported_at, ruleset_version").
+		Where("(repo, code_change_id) IN ?", changeKeyArgs(keys)).Where(findingTrackedRunSQL).
+		Order("repo, code_change_id, reported_at, id").Find(&tracked).Error; err != nil {
+		return 0, err
+	}
+
+	type pair struct{ run, prev CrAgentRun }
+	var affected []pair
+	needed := make(map[uint64]bool)
+	for i, run := range tracked {
+		var prev CrAgentRun
+		if i > 0 && tracked[i-1].Repo == run.Repo && tracked[i-1].CodeChangeID == run.CodeChangeID {
+			prev = tracked[i-1]
+		}
+		if runIDs != nil && !runIDs[run.ID] && (prev.ID == 0 || !runIDs[prev.ID]) {
+			continue
+		}
+		affected = append(affected, pair{run, prev})
+		needed[run.ID] = true
+		if prev.ID != 0 {
+			needed[prev.ID] = true
+		}
+	}
+
+	findingsByRun := make(map[uint64][]CrAgentRunFinding, len(needed))
+	ids := make([]uint64, 0, len(needed))
+	for id := range needed {
+		ids = append(ids, id)
+	}
+	for start := 0; start < len(ids); start += batchInsertSize {
+		end := start + batchInsertSize
+		if end > len(ids) {
+			end = len(ids)
+		}
+		var findings []CrAgentRunFinding
+		if err := tx.Select("run_id, rule_id, file_path, start_line, fingerprint").
+			Where("run_id IN ?", ids[start:end]).Find(&findings).Error; err != nil {
+			return 0, err
+		}
+		for _, finding := range findings {
+			findingsByRun[finding.RunID] = append(findingsByRun[finding.RunID], finding)
+		}
+	}
+
+	var rows []CrFindingTransition
+	affectedIDs := make([]uint64, 0, len(affected))
+	for _, p := range affected {
+		affectedIDs = append(affectedIDs, p.run.ID)
+		rows = append(rows, classifyFindings(p.run, p.prev, findingsByRun[p.run.ID], findingsByRun[p.prev.ID])...)
+	}
+
+	var err error
+	if runIDs == nil {
+		err = tx.Where("(repo, code_change_id) IN ?", changeKeyArgs(keys)).Delete(&CrFindingTransition{}).Error
+	} else if len(affectedIDs) > 0 {
+		err = tx.Where("run_id IN ?", affectedIDs).Delete(&CrFindingTransition{}).Error
+	}
+	if err != nil {
+		return 0, err
+	}
+	if len(rows) == 0 {
+		return 0, nil
+	}
+	return len(rows), tx.CreateInBatches(&rows, batchInsertSize).Error
+}
+
+// trackFindings updates fix tracking for freshly inserted runs inside the
+// ingestion transaction. Runs that are not tracked change nothing.
+func trackFindings(tx *gorm.DB, runs []CrAgentRun, findings [][]findingRequest) error {
+	runIDs := make(map[uint64]bool)
+	seen := make(map[changeKey]bool)
+	var keys []changeKey
+	for i, run := range runs {
+		if run.TriggeredTotalHits > 0 && len(findings[i]) == 0 {
+			continue
+		}
+		runIDs[run.ID] = true
+		key := changeKey{run.Repo, run.CodeChangeID}
+		if !seen[key] {
+			seen[key] = true
+			keys = append(keys, key)
+		}
+	}
+	_, err := refreshFindingTransitions(tx, keys, runIDs)
+	return err
+}
+
+// findingTrackingRebuildResult reports a RebuildFindingTransitions run.
+type findingTrackingRebuildResult struct {
+	Changes     uint64 `json:"changes"`
+	Transitions uint64 `json:"transitions"`
+}
+
+// RebuildFindingTransitions recomputes fix tracking for every change matching
+// f.Repo and f.CodeChangeID, e.g. for findings ingested before tracking
+// existed.
+func (s *gormStore) RebuildFindingTransitions(f queryFilter) (findingTrackingRebuildResult, error) {
+	var result findingTrackingRebuildResult
+	scope := queryFilter{Repo: f.Repo, CodeChangeID: f.CodeChangeID}
+	var after *changeKey
+	for {
+		var keys []changeKey
+		query := applyRunFilters(s.db.Model(&CrAgentRun{}), scope)
+		if err := afterChangeKey(query, after).Distinct("repo", "code_change_id").
+			Order("repo, code_change_id").Limit(findingTrackingPageSize).Scan(&keys).Error; err != nil {
+			return result, err
+		}
+		if len(keys) == 0 {
+			return result, nil
+		}
+		err := s.db.Transaction(func(tx *gorm.DB) error {
+			n, err := refreshFindingTransitions(tx, keys, nil)
+			result.Transitions += uint64(n)
+			return err
+		})
+		if err != nil {
+			return result, err
+		}
+		result.Changes += uint64(len(keys))
+		after = &keys[len(keys)-1]
+	}
+}
+
+// findingTimelineRun is one tracked run of a change with its findings
+// classified against the previous tracked run.
+type findingTimelineRun struct {
+	RunID      uint64                 `json:"run_id"`
+	AgentRunID string                 `json:"agent_run_id"`
+	ReportedAt time.Time              `json:"reported_at"`
+	PrevRunID  uint64                 `json:"prev_run_id"`
+	New        uint64                 `json:"new"`
+	Persisted  uint64                 `json:"persisted"`
+	Fixed      uint64                 `json:"fixed"`
+	Findings   []findingTimelineEntry `json:"findings"`
+}
+
+type findingTimelineEntry struct {
+	RuleID      string `json:"rule_id"`
+	Fingerprint string `json:"fingerprint"`
+	Status      string `json:"status"`
+	Count       uint32 `json:"count"`
+	FilePath    string `json:"file_path"`
+	StartLine   uint32 `json:"start_line"`
+}
+
+// LoadFindingTimeline returns the newest limit tracked runs of one change
+// (f.Repo and f.CodeChangeID), oldest first.
+func (s *gormStore) LoadFindingTimeline(f queryFilter, limit int) ([]findingTimelineRun, error) {
+	var runs []struct {
+		ID         uint64
+		AgentRunID string
+		ReportedAt time.Time
+	}
+	// One extra run supplies prev_run_id for the oldest run returned.
+	if err := applyRepoScope(s.db.Model(&CrAgentRun{}), "repo", f.Repos).Select("id, agent_run_id, reported_at").
+		Where("repo = ? AND code_change_id = ?", f.Repo, f.CodeChangeID).Where(findingTrackedRunSQL).
+		Order("reported_at DESC, id DESC").Limit(limit + 1).Find(&runs).Error; err != nil {
+		return nil, err
+	}
+	var oldestPrev uint64
+	if len(runs) > limit {
+		oldestPrev = runs[limit].ID
+		runs = runs[:limit]
+	}
+	if len(runs) == 0 {
+		return nil, nil
+	}
+
+	timeline := make([]findingTimelineRun, len(runs))
+	index := make(map[uint64]int, len(runs))
+	ids := make([]uint64, 0, len(runs))
+	for i, run := range runs {
+		// runs is newest first; the timeline is chronological.
+		j := len(runs) - 1 - i
+		timeline[j] = findingTimelineRun{RunID: run.ID, AgentRunID: run.AgentRunID, ReportedAt: run.ReportedAt, Findings: []findingTimelineEntry{}}
+		index[run.ID] = j
+		ids = append(ids, run.ID)
+	}
+	timeline[0].PrevRunID = oldestPrev
+	for j := 1; j < len(timeline); j++ {
+		timeline[j].PrevRunID = timeline[j-1].RunID
+	}
+
+	query := s.db.Where("run_id IN ?", ids)
+	if f.RuleID != "" {
+		query = query.Where("rule_id = ?", f.RuleID)
+	}
+	var rows []CrFindingTransition
+	if err := query.Order("run_id, rule_id, fingerprint, status").Find(&rows).Error; err != nil {
+		return nil, err
+	}
+	for _, row := range rows {
+		entry := &timeline[index[row.RunID]]
+		switch row.Status {
+		case findingNew:
+			entry.New += uint64(row.FindingCount)
+		case findingPersisted:
+			entry.Persisted += uint64(row.FindingCount)
+		case findingFixed:
+			entry.Fixed += uint64(row.FindingCount)
+		}
+		entry.Findings = append(entry.Findings, findingTimelineEntry{
+			RuleID:      row.RuleID,
+			Fingerprint: row.Fingerprint,
+			Status:      row.Status,
+			Count:       row.FindingCount,
+			FilePath:    row.FilePath,
+			StartLine:   row.StartLine,
+		})
+	}
+	return timeline, nil
+}
@@ -0,0 +1,221 @@
+package main
+
+import (
+	"fmt"
+	"net/http"
+	"reflect"
+	"strings"
+	"testing"
+	"time"
+)
+
+// trackedRun returns a run whose findings are given as "rule:fingerprint";
+// rule_hits follows from them. No findings means a run without hits.
+func trackedRun(codeChangeID string, seq int, at time.Time, findings ...string) agentRunRequest {
+	run := testRun("org/a", codeChangeID, seq, at, map[string]uint32{})
+	run.Findings = []findingRequest{}
+	for i, finding := range findings {
+		ruleID, fingerprint, _ := strings.Cut(finding, ":")
+		run.RuleHits[ruleID]++
+		run.TriggeredTotalHits++
+		run.Findings = append(run.Findings, findingRequest{
+			RuleID: ruleID, FilePath: "main.go", StartLine: uint32(i + 1), Severity: "warning", Fingerprint: fingerprint,
+		})
+	}
+	return run
+}
+
+func storeRuns(t *testing.T, store *gormStore, runs ...agentRunRequest) []uint64 {
+	t.Helper()
+	ids := make([]uint64, 0, len(runs))
+	for _, run := range runs {
+		id, _, err := store.CreateAgentRun(pendingAgentRun{Req: run, DiffLines: *run.DiffLines})
+		if err != nil {
+			t.Fatal(err)
+		}
+		ids = append(ids, id)
+	}
+	return ids
+}
+
+// transitionSummary renders the transitions of runID as sorted
+// "status rule:fingerprint xcount" strings.
+func transitionSummary(t *testing.T, store *gormStore, runID uint64) []string {
+	t.Helper()
+	var rows []CrFindingTransition
+	if err := store.db.Where("run_id = ?", runID).Order("rule_id, fingerprint, status").Find(&rows).Error; err != nil {
+		t.Fatal(err)
+	}
+	out := make([]string, 0, len(rows))
+	for _, row := range rows {
+		out = append(out, fmt.Sprintf("%s %s:%s x%d", row.Status, row.RuleID, row.Fingerprint, row.FindingCount))
+	}
+	return out
+}
+
+func TestClassifyFindings(t *testing.T) {
+	finding := func(ruleID, fingerprint, file string, line uint32) CrAgentRunFinding {
+		return CrAgentRunFinding{RuleID: ruleID, Fingerprint: fingerprint, FilePath: file, StartLine: line}
+	}
+	run := CrAgentRun{ID: 2, Repo: "org/a", CodeChangeID: "c1"}
+	prev := CrAgentRun{ID: 1}
+	cur := []CrAgentRunFinding{
+		finding("R1", "a", "b.go", 9),
+		finding("R1", "a", "a.go", 4),
+		finding("R1", "a", "a.go", 2),
+		finding("R2", "b", "a.go", 1),
+	}
+	before := []CrAgentRunFinding{
+		finding("R1", "a", "c.go", 1),
+		finding("R3", "c", "d.go", 5),
+		finding("R3", "c", "d.go", 3),
+	}
+
+	got := classifyFindings(run, prev, cur, before)
+	type row struct {
+		Key, Status string
+		Count       uint32
+		At          string
+	}
+	var rows []row
+	for _, tr := range got {
+		if tr.RunID != 2 || tr.PrevRunID != 1 || tr.Repo != "org/a" {
+			t.Fatalf("transition %+v not tied to the run", tr)
+		}
+		rows = append(rows, row{tr.RuleID + ":" + tr.Fingerprint, tr.Status, tr.FindingCount, fmt.Sprintf("%s:%d", tr.FilePath, tr.StartLine)})
+	}
+	// Repeated fingerprints match as a multiset and are located at their
+	// first occurrence in the run they come from.
+	want := []row{
+		{"R1:a", findingPersisted, 1, "a.go:2"},
+		{"R1:a", findingNew, 2, "a.go:2"},
+		{"R2:b", findingNew, 1, "a.go:1"},
+		{"R3:c", findingFixed, 2, "d.go:3"},
+	}
+	if !reflect.DeepEqual(rows, want) {
+		t.Fatalf("got %+v, want %+v", rows, want)
+	}
+
+	if got := classifyFindings(run, CrAgentRun{}, nil, nil); len(got) != 0 {
+		t.Fatalf("no findings on either side: %+v", got)
+	}
+}
+
+// TestFindingTrackingOnIngest checks the transitions maintained while runs
+// arrive out of order against a full rebuild.
+func TestFindingTrackingOnIngest(t *testing.T) {
+	store := newTestStore(t)
+	at := mustTime(t, "2026-10-01T10:00:00Z")
+
+	ids := storeRuns(t, store,
+		trackedRun("c1", 1, at, "R1:a", "R1:b"),
+		trackedRun("c1", 3, at.Add(3*time.Hour), "R1:b", "R2:c"),
+	)
+	// Hits without findings: not tracked, so run 3 still follows run 1.
+	untracked := testRun("org/a", "c1", 2, at.Add(time.Hour), map[string]uint32{"R1": 1})
+	untracked.Findings = nil
+	ids = append(ids, storeRuns(t, store, untracked)...)
+	if got, want := transitionSummary(t, store, ids[1]), []string{"fixed R1:a x1", "persisted R1:b x1", "new R2:c x1"}; !reflect.DeepEqual(got, want) {
+		t.Fatalf("run 3: %v, want %v", got, want)
+	}
+	if got := transitionSummary(t, store, ids[2]); len(got) != 0 {
+		t.Fatalf("untracked run has transitions %v", got)
+	}
+
+	// A late run between runs 1 and 3 becomes the predecessor of run 3, and a
+	// clean run at the end fixes everything.
+	ids = append(ids, storeRuns(t, store,
+		trackedRun("c1", 4, at.Add(2*time.Hour), "R1:b", "R1:b"),
+		trackedRun("c1", 5, at.Add(4*time.Hour)),
+	)...)
+	cases := []struct {
+		run  uint64
+		want []string
+	}{
+		{ids[0], []string{"new R1:a x1", "new R1:b x1"}},
+		{ids[3], []string{"fixed R1:a x1", "new R1:b x1", "persisted R1:b x1"}},
+		{ids[1], []string{"fixed R1:b x1", "persisted R1:b x1", "new R2:c x1"}},
+		{ids[4], []string{"fixed R1:b x1", "fixed R2:c x1"}},
+	}
+	for _, tc := range cases {
+		if got := transitionSummary(t, store, tc.run); !reflect.DeepEqual(got, tc.want) {
+			t.Errorf("run id %d: %v, want %v", tc.run, got, tc.want)
+		}
+	}
+	var prev CrFindingTransition
+	store.db.Where("run_id = ?", ids[1]).First(&prev)
+	if prev.PrevRunID != ids[3] {
+		t.Fatalf("run 3 compared with %d, want the late run %d", prev.PrevRunID, ids[3])
+	}
+
+	before := loadDerivedState(t, store).Transitions
+	result, err := store.RebuildFindingTransitions(queryFilter{Repo: "org/a"})
+	if err != nil {
+		t.Fatal(err)
+	}
+	if result.Changes != 1 || result.Transitions != uint64(len(before)) {
+		t.Fatalf("rebuild: %+v, want 1 change and %d transitions", result, len(before))
+	}
+	if after := loadDerivedState(t, store).Transitions; !reflect.DeepEqual(stripTransitionIDs(after), stripTransitionIDs(before)) {
+		t.Fatalf("rebuild changed transitions:\n%+v\nincremental:\n%+v", after, before)
+	}
+}
+
+func stripTransitionIDs(rows []CrFindingTransition) []CrFindingTransition {
+	out := make([]CrFindingTransition, len(rows))
+	for i, row := range rows {
+		row.ID = 0
+		out[i] = row
+	}
+	return out
+}
+
+func TestFindingTimelineEndpoint(t *testing.T) {
+	store := newTestStore(t)
+	base := newTestServer(t, store, authPolicy{}, alertPolicy{})
+	at := time.Now().Add(-time.Hour).Truncate(time.Second)
+	ids := storeRuns(t, store,
+		trackedRun("c1", 1, at, "R1:a"),
+		trackedRun("c1", 2, at.Add(time.Minute), "R1:a", "R2:b"),
+		trackedRun("c1", 3, at.Add(2*time.Minute), "R2:b"),
+	)
+
+	type timeline struct {
+		Data []findingTimelineRun `json:"data"`
+	}
+	load := func(query string) timeline {
+		t.Helper()
+		status, body := doRequest(t, http.MethodGet, base+"/api/findings/timeline?repo=org/a&code_change_id=c1"+query, nil, nil)
+		if status != http.StatusOK {
+			t.Fatalf("timeline%s: %d %s", query, status, body)
+		}
+		var tl timeline
+		decodeJSON(t, body, &tl)
+		return tl
+	}
+
+	full := load("")
+	if len(full.Data) != 3 || full.Data[0].RunID != ids[0] || full.Data[0].PrevRunID != 0 || full.Data[0].New != 1 {
+		t.Fatalf("timeline: %+v", full.Data)
+	}
+	if last := full.Data[2]; last.PrevRunID != ids[1] || last.Fixed != 1 || last.Persisted != 1 || last.New != 0 || len(last.Findings) != 2 {
+		t.Fatalf("last run: %+v", last)
+	}
+
+	// The oldest run returned still names the run it was compared with.
+	newest := load("&limit=2")
+	if len(newest.Data) != 2 || newest.Data[0].RunID != ids[1] || newest.Data[0].PrevRunID != ids[0] {
+		t.Fatalf("limited timeline: %+v", newest.Data)
+	}
+
+	byRule := load("&rule_id=R2")
+	if byRule.Data[1].New != 1 || byRule.Data[1].Persisted != 0 || len(byRule.Data[0].Findings) != 0 {
+		t.Fatalf("R2 timeline: %+v", byRule.Data)
+	}
+
+	for _, query := range []string{"?repo=org/a", "?code_change_id=c1"} {
+		if status, body := doRequest(t, http.MethodGet, base+"/api/findings/timeline"+query, nil, nil); status != http.StatusBadRequest {
+			t.Errorf("timeline%s: %d %s, want 400", query, status, body)
+		}
+	}
+}
@@ -0,0 +1,187 @@
+package main
+
+import (
+	"fmt"
+	"sort"
+	"strings"
+	"time"
+	"unicode/utf8"
+
+	"gorm.io/gorm"
+)
+
+// findingRequest is one entry of the optional findings array of a run.
+type findingRequest struct {
+	RuleID    string `json:"rule_id"`
+	FilePath  string `json:"file_path"`
+	StartLine uint32 `json:"start_line"`
+	// EndLine defaults to StartLine.
+	EndLine     uint32 `json:"end_line"`
+	Severity    string `json:"severity"`
+	Fingerprint string `json:"fingerprint"`
+}
+
+var findingSeverities = map[string]bool{"info": true, "warning": true, "error": true, "critical": true}
+
+// validateFindings checks each finding and that the findings of every rule
+// add up to its rule_hits count. A nil slice means the run carries no
+// findings and is always valid.
+func validateFindings(findings []findingRequest, ruleHits map[string]uint32) []fieldError {
+	if findings == nil {
+		return nil
+	}
+	var errs []fieldError
+	add := func(field, code, message string) {
+		errs = append(errs, fieldError{Field: field, Code: code, Message: message})
+	}
+	if len(findings) > maxFindingsPerRun {
+		add("findings", "too_long", fmt.Sprintf("findings must contain at most %d entries", maxFindingsPerRun))
+		return errs
+	}
+
+	counts := make(map[string]uint32)
+	for i, finding := range findings {
+		prefix := fmt.Sprintf("findings[%d].", i)
+		switch {
+		case finding.RuleID == "":
+			add(prefix+"rule_id", "required", "rule_id is required")
+		case utf8.RuneCountInString(finding.RuleID) > maxRuleIDLen:
+			add(prefix+"rule_id", "too_long", fmt.Sprintf("rule_id must be at most %d characters", maxRuleIDLen))
+		case !isValidRuleID(finding.RuleID):
+			add(prefix+"rule_id", "invalid_format", "rule_id may only contain letters, digits and . _ - : /")
+		default:
+			counts[finding.RuleID]++
+		}
+		if strings.TrimSpace(finding.FilePath) == "" {
+			add(prefix+"file_path", "required", "file_path is required")
+		} else if utf8.RuneCountInString(finding.FilePath) > maxFilePathLen {
+			add(prefix+"file_path", "too_long", fmt.Sprintf("file_path must be at most %d characters", maxFilePathLen))
+		}
+		if finding.StartLine == 0 {
+			add(prefix+"start_line", "required", "start_line is required and starts at 1")
+		} else if finding.EndLine != 0 && finding.EndLine < finding.StartLine {
+			add(prefix+"end_line", "invalid_format", "end_line must not be before start_line")
+		}
+		if finding.Severity == "" {
+			add(prefix+"severity", "required", "severity is required")
+		} else if !findingSeverities[finding.Severity] {
+			add(prefix+"severity", "invalid_format", "severity must be info|warning|error|critical")
+		}
+		if strings.TrimSpace(finding.Fingerprint) == "" {
+			add(prefix+"fingerprint", "required", "fingerprint is required")
+		} else if utf8.RuneCountInString(finding.Fingerprint) > maxFingerprintLen {
+			add(prefix+"fingerprint", "too_long", fmt.Sprintf("fingerprint must be at most %d characters", maxFingerprintLen))
+		}
+	}
+
+	ruleIDs := make([]string, 0, len(ruleHits)+len(counts))
+	for ruleID := range ruleHits {
+		ruleIDs = append(ruleIDs, ruleID)
+	}
+	for ruleID := range counts {
+		if _, ok := ruleHits[ruleID]; !ok {
+			ruleIDs = append(ruleIDs, ruleID)
+		}
+	}
+	sort.Strings(ruleIDs)
+	for _, ruleID := range ruleIDs {
+		if counts[ruleID] != ruleHits[ruleID] {
+			add("findings", "mismatch", fmt.Sprintf("%s has %d findings but rule_hits reports %d", ruleID, counts[ruleID], ruleHits[ruleID]))
+		}
+	}
+	return errs
+}
+
+func buildFindingRecords(run CrAgentRun, findings []findingRequest) []CrAgentRunFinding {
+	if len(findings) == 0 {
+		return nil
+	}
+	records := make([]CrAgentRunFinding, 0, len(findings))
+	for _, finding := range findings {
+		endLine := finding.EndLine
+		if endLine == 0 {
+			endLine = finding.StartLine
+		}
+		records = append(records, CrAgentRunFinding{
+			RunID:        run.ID,
+			Repo:         run.Repo,
+			CodeChangeID: run.CodeChangeID,
+			ReportedAt:   run.ReportedAt,
+			RuleID:       finding.RuleID,
+			FilePath:     finding.FilePath,
+			StartLine:    finding.StartLine,
+			EndLine:      endLine,
+			Severity:     finding.Severity,
+			Fingerprint:  finding.Fingerprint,
+		})
+	}
+	return records
+}
+
+// findingQuery selects the findings of one run (RunID) or of every run of one
+// change (CodeChangeID, optionally Repo).
+type findingQuery struct {
+	RunID        uint64
+	Repo         string
+	CodeChangeID string
+	RuleID       string
+	Severity     string
+	// Repos limits the findings to the repos the caller may see; nil means
+	// every repo.
+	Repos  repoScope
+	Limit  int
+	Offset int
+}
+
+type findingRow struct {
+	ID           uint64    `json:"id"`
+	RunID        uint64    `json:"run_id"`
+	AgentRunID   string    `json:"agent_run_id"`
+	Repo         string    `json:"repo"`
+	CodeChangeID string    `json:"code_change_id"`
+	ReportedAt   time.Time `json:"reported_at"`
+	RuleID       string    `json:"rule_id"`
+	FilePath     string    `json:"file_path"`
+	StartLine    uint32    `json:"start_line"`
+	EndLine      uint32    `json:"end_line"`
+	Severity     string    `json:"severity"`
+	Fingerprint  string    `json:"fingerprint"`
+}
+
+func (s *gormStore) findingsMatching(q findingQuery) *gorm.DB {
+	query := s.db.Table("cr_agent_run_finding f").Joins("JOIN cr_agent_run r ON r.id = f.run_id")
+	if q.RunID != 0 {
+		query = query.Where("f.run_id = ?", q.RunID)
+	}
+	if q.Repo != "" {
+		query = query.Where("f.repo = ?", q.Repo)
+	}
+	query = applyRepoScope(query, "f.repo", q.Repos)
+	if q.CodeChangeID != "" {
+		query = query.Where("f.code_change_id = ?", q.CodeChangeID)
+	}
+	if q.RuleID != "" {
+		query = query.Where("f.rule_id = ?", q.RuleID)
+	}
+	if q.Severity != "" {
+		query = query.Where("f.severity = ?", q.Severity)
+	}
+	return query
+}
+
+// ListFindings returns one page of findings ordered by run, then file and
+// line, together with the number of findings matching q.
+func (s *gormStore) ListFindings(q findingQuery) ([]findingRow, uint64, error) {
+	var total uint64
+	if err := s.findingsMatching(q).Select("COUNT(*)").Scan(&total).Error; err != nil {
+		return nil, 0, err
+	}
+	var rows []findingRow
+	if err := s.findingsMatching(q).
+		Select("f.id, f.run_id, r.agent_run_id, f.repo, f.code_change_id, f.reported_at, f.rule_id, f.file_path, f.start_line, f.end_line, f.severity, f.fingerprint").
+		Order("f.run_id, f.file_path, f.start_line, f.id").
+		Limit(q.Limit).Offset(q.Offset).Scan(&rows).Error; err != nil {
+		return nil, 0, err
+	}
+	return rows, total, nil
+}
@@ -0,0 +1,178 @@
+package main
+
+import (
+	"fmt"
+	"net/http"
+	"strings"
+	"testing"
+	"time"
+)
+
+func TestValidateFindings(t *testing.T) {
+	valid := findingRequest{RuleID: "R1", FilePath: "main.go", StartLine: 3, Severity: "error", Fingerprint: "fp"}
+	with := func(edit func(*findingRequest)) []findingRequest {
+		f := valid
+		edit(&f)
+		return []findingRequest{f}
+	}
+	cases := []struct {
+		name     string
+		findings []findingRequest
+		ruleHits map[string]uint32
+		want     []string // field:code
+	}{
+		{name: "no findings", findings: nil, ruleHits: map[string]uint32{"R1": 5}},
+		{name: "valid", findings: []findingRequest{valid}, ruleHits: map[string]uint32{"R1": 1}},
+		{name: "empty array counts", findings: []findingRequest{}, ruleHits: map[string]uint32{"R1": 1}, want: []string{"findings:mismatch"}},
+		{name: "too few", findings: []findingRequest{valid}, ruleHits: map[string]uint32{"R1": 2}, want: []string{"findings:mismatch"}},
+		{name: "rule without hits", findings: with(func(f *findingRequest) { f.RuleID = "R2" }), ruleHits: map[string]uint32{"R1": 1},
+			want: []string{"findings:mismatch", "findings:mismatch"}},
+		{name: "missing fields", findings: []findingRequest{{}}, ruleHits: map[string]uint32{},
+			want: []string{"findings[0].rule_id:required", "findings[0].file_path:required", "findings[0].start_line:required", "findings[0].severity:required", "findings[0].fingerprint:required"}},
+		{name: "bad rule id", findings: with(func(f *findingRequest) { f.RuleID = "R 1" }), ruleHits: map[string]uint32{},
+			want: []string{"findings[0].rule_id:invalid_format"}},
+		{name: "end before start", findings: with(func(f *findingRequest) { f.EndLine = 2 }), ruleHits: map[string]uint32{"R1": 1},
+			want: []string{"findings[0].end_line:invalid_format"}},
+		{name: "unknown severity", findings: with(func(f *findingRequest) { f.Severity = "fatal" }), ruleHits: map[string]uint32{"R1": 1},
+			want: []string{"findings[0].severity:invalid_format"}},
+		{name: "long fingerprint", findings: with(func(f *findingRequest) { f.Fingerprint = strings.Repeat("x", maxFingerprintLen+1) }), ruleHits: map[string]uint32{"R1": 1},
+			want: []string{"findings[0].fingerprint:too_long"}},
+		{name: "too many", findings: make([]findingRequest, maxFindingsPerRun+1), ruleHits: map[string]uint32{},
+			want: []string{"findings:too_long"}},
+	}
+	for _, tc := range cases {
+		t.Run(tc.name, func(t *testing.T) {
+			errs := validateFindings(tc.findings, tc.ruleHits)
+			got := make([]string, 0, len(errs))
+			for _, e := range errs {
+				got = append(got, e.Field+":"+e.Code)
+			}
+			if strings.Join(got, ",") != strings.Join(tc.want, ",") {
+				t.Fatalf("errors %v, want %v", got, tc.want)
+			}
+		})
+	}
+}
+
+func TestIngestRejectsMismatchedFindings(t *testing.T) {
+	store := newTestStore(t)
+	base := newTestServer(t, store, authPolicy{}, alertPolicy{})
+	run := testRun("org/a", "c1", 1, time.Now().Add(-time.Hour), map[string]uint32{"R1": 2})
+	run.Findings = run.Findings[:1]
+
+	status, body := doRequest(t, http.MethodPost, base+"/v1/metrics/agent-runs", run, nil)
+	var resp struct {
+		Error   string       `json:"error"`
+		Details []fieldError `json:"details"`
+	}
+	decodeJSON(t, body, &resp)
+	if status != http.StatusBadRequest || resp.Error != "VALIDATION_ERROR" || len(resp.Details) != 1 || resp.Details[0].Code != "mismatch" {
+		t.Fatalf("mismatched findings: %d %s", status, body)
+	}
+	if n := countRows(t, store, &CrAgentRun{}); n != 0 {
+		t.Fatalf("%d runs stored, want 0", n)
+	}
+}
+
+func TestFindingsEndpoint(t *testing.T) {
+	store := newTestStore(t)
+	base := newTestServer(t, store, authPolicy{}, alertPolicy{})
+	now := time.Now().Add(-time.Hour)
+
+	first := testRun("org/a", "c1", 1, now, map[string]uint32{"R1": 2, "R2": 1})
+	first.Findings[len(first.Findings)-1].Severity = "critical"
+	var ids []uint64
+	for _, run := range []agentRunRequest{
+		first,
+		testRun("org/a", "c1", 2, now.Add(time.Minute), map[string]uint32{"R1": 1}),
+		testRun("org/b", "c1", 3, now, map[string]uint32{"R1": 1}),
+	} {
+		status, body := doRequest(t, http.MethodPost, base+"/v1/metrics/agent-runs", run, nil)
+		if status != http.StatusOK {
+			t.Fatalf("ingest: %d %s", status, body)
+		}
+		var ok okResponse
+		decodeJSON(t, body, &ok)
+		ids = append(ids, ok.RunPrimaryID)
+	}
+
+	type page struct {
+		Data  []findingRow `json:"data"`
+		Total uint64       `json:"total"`
+	}
+	list := func(query string) page {
+		t.Helper()
+		status, body := doRequest(t, http.MethodGet, base+"/api/findings?"+query, nil, nil)
+		if status != http.StatusOK {
+			t.Fatalf("findings?%s: %d %s", query, status, body)
+		}
+		var p page
+		decodeJSON(t, body, &p)
+		return p
+	}
+
+	byRun := list(fmt.Sprintf("run_id=%d", ids[0]))
+	if byRun.Total != 3 || len(byRun.Data) != 3 {
+		t.Fatalf("run findings: %+v", byRun)
+	}
+	for _, row := range byRun.Data {
+		if row.RunID != ids[0] || row.AgentRunID != first.AgentRunID || row.EndLine < row.StartLine {
+			t.Fatalf("run finding %+v", row)
+		}
+	}
+	// testRun leaves end_line out.
+	if d := byRun.Data[0]; d.StartLine != 1 || d.EndLine != 1 {
+		t.Fatalf("end_line of %+v, want it to default to start_line", d)
+	}
+
+	cases := []struct {
+		query string
+		total uint64
+	}{
+		{"code_change_id=c1", 5},
+		{"code_change_id=c1&repo=org/a", 4},
+		{"code_change_id=c1&rule_id=R2", 1},
+		{"code_change_id=c1&severity=CRITICAL", 1},
+		{"code_change_id=c1&repo=org/c", 0},
+	}
+	for _, tc := range cases {
+		if p := list(tc.query); p.Total != tc.total || len(p.Data) != int(tc.total) {
+			t.Errorf("%s: %d findings (total %d), want %d", tc.query, len(p.Data), p.Total, tc.total)
+		}
+	}
+
+	paged := list("code_change_id=c1&repo=org/a&limit=3&offset=2")
+	if paged.Total != 4 || len(paged.Data) != 2 || paged.Data[1].RunID != ids[1] {
+		t.Fatalf("second page: %+v", paged)
+	}
+
+	for _, query := range []string{"", "repo=org/a", "run_id=abc", "run_id=0", "code_change_id=c1&severity=fatal"} {
+		if status, body := doRequest(t, http.MethodGet, base+"/api/findings?"+query, nil, nil); status != http.StatusBadRequest {
+			t.Errorf("findings?%s: %d %s, want 400", query, status, body)
+		}
+	}
+}
+
+func TestListFindingsRepoScope(t *testing.T) {
+	store := newTestStore(t)
+	at := mustTime(t, "2026-10-01T10:00:00Z")
+	for i, repo := range []string{"org/a", "org/b", "other/c"} {
+		run := testRun(repo, "c1", i+1, at, map[string]uint32{"R1": 1})
+		if _, _, err := store.CreateAgentRun(pendingAgentRun{Req: run, DiffLines: *run.DiffLines}); err != nil {
+			t.Fatal(err)
+		}
+	}
+
+	rows, total, err := store.ListFindings(findingQuery{CodeChangeID: "c1", Repos: repoScope{"org/*"}, Limit: 10})
+	if err != nil {
+		t.Fatal(err)
+	}
+	if total != 2 || len(rows) != 2 {
+		t.Fatalf("scoped findings: %d of %d", len(rows), total)
+	}
+	for _, row := range rows {
+		if !strings.HasPrefix(row.Repo, "org/") {
+			t.Fatalf("finding of %s outside the scope", row.Repo)
+		}
+	}
+}
@@ -0,0 +1,47 @@
+package main
+
+import (
+	"net/http"
+	"strconv"
+	"strings"
+
+	"github.com/gin-gonic/gin"
+)
+
+// handleRebuildSummaries recomputes code_change_summary for the changes in the
+// optional repo / code_change_id / from / to scope. With dry_run=true it only
+// reports which rows would change.
+func handleRebuildSummaries(store Store) gin.HandlerFunc {
+	return func(c *gin.Context) {
+		from, to, err := parseOpenTimeRange(c)
+		if err != nil {
+			c.JSON(http.StatusBadRequest, errResponse{OK: false, Error: "VALIDATION_ERROR", Message: err.Error()})
+			return
+		}
+
+		dryRun := false
+		if v := strings.TrimSpace(c.Query("dry_run")); v != "" {
+			dryRun, err = strconv.ParseBool(v)
+			if err != nil {
+				c.JSON(http.StatusBadRequest, errResponse{OK: false, Error: "VALIDATION_ERROR", Message: "dry_run must be true or false"})
+				return
+			}
+		}
+
+		filter := queryFilter{
+			Repo:         strings.TrimSpace(c.Query("repo")),
+			CodeChangeID: strings.TrimSpace(c.Query("code_change_id")),
+		}
+		auditTarget(c, strings.Trim(filter.Repo+"/"+filter.CodeChangeID, "/"))
+		result, err := store.RebuildCodeChangeSummaries(from, to, filter, dryRun)
+		if err != nil {
+			c.JSON(http.StatusInternalServerError, errResponse{OK: false, Error: "INTERNAL_ERROR", Message: err.Error()})
+			return
+		}
+
+		c.JSON(http.StatusOK, gin.H{
+			"ok":   true,
+			"data": result,
+		})
+	}
+}
@@ -0,0 +1,30 @@
+package main
+
+import (
+	"net/http"
+	"testing"
+)
+
+func TestRebuildSummariesNeedsAdmin(t *testing.T) {
+	store := newTestStore(t)
+	const path = "/v1/admin/code-change-summaries:rebuild?dry_run=true"
+
+	open := newTestServer(t, store, authPolicy{}, alertPolicy{})
+	if status, body := doRequest(t, http.MethodPost, open+path, nil, nil); status != http.StatusForbidden {
+		t.Fatalf("unconfigured: %d %s, want 403", status, body)
+	}
+
+	guarded := newTestServer(t, store, authPolicy{AdminToken: testAdminToken}, alertPolicy{})
+	if status, body := doRequest(t, http.MethodPost, guarded+path, nil, nil); status != http.StatusUnauthorized {
+		t.Fatalf("no token: %d %s, want 401", status, body)
+	}
+	header := http.Header{"Authorization": {"Bearer " + testAdminToken}}
+	status, body := doRequest(t, http.MethodPost, guarded+path, nil, header)
+	var resp struct {
+		Data summaryRebuildResult `json:"data"`
+	}
+	decodeJSON(t, body, &resp)
+	if status != http.StatusOK || !resp.Data.DryRun {
+		t.Fatalf("admin: %d %s", status, body)
+	}
+}
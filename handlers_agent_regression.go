@@ -0,0 +1,83 @@
+package main
+
+import (
+	"net/http"
+	"strings"
+
+	"github.com/gin-gonic/gin"
+)
+
+func handleAgentRegressions(store Store) gin.HandlerFunc {
+	return func(c *gin.Context) {
+		from, to, err := parseTimeRange(c)
+		if err != nil {
+			c.JSON(http.StatusBadRequest, errResponse{OK: false, Error: "VALIDATION_ERROR", Message: err.Error()})
+			return
+		}
+
+		filter := queryFilter{
+			Repo:           strings.TrimSpace(c.Query("repo")),
+			RulesetVersion: strings.TrimSpace(c.Query("ruleset_version")),
+			Repos:          visibleRepos(c),
+		}
+		q := agentRegressionQuery{
+			AgentVersion:  strings.TrimSpace(c.Query("agent_version")),
+			MinRuns:       parseLimit(c.Query("min_runs"), 30, 1, 100000),
+			Limit:         parseLimit(c.Query("limit"), 5, 1, 50),
+			RuleLimit:     parseLimit(c.Query("rule_limit"), 20, 1, 200),
+			RegressedOnly: c.Query("regressed_only") == "true",
+		}
+
+		results, err := store.DetectAgentRegressions(from, to, filter, q)
+		if err != nil {
+			c.JSON(http.StatusInternalServerError, errResponse{OK: false, Error: "INTERNAL_ERROR", Message: err.Error()})
+			return
+		}
+		if results == nil {
+			results = []agentVersionRegression{}
+		}
+
+		var ruleIDs []string
+		for _, result := range results {
+			for _, rule := range result.Rules {
+				ruleIDs = append(ruleIDs, rule.RuleID)
+			}
+		}
+		catalog, err := store.LookupRuleCatalog(ruleIDs)
+		if err != nil {
+			c.JSON(http.StatusInternalServerError, errResponse{OK: false, Error: "INTERNAL_ERROR", Message: err.Error()})
+			return
+		}
+		for i := range results {
+			for j := range results[i].Rules {
+				results[i].Rules[j].Catalog = catalog[results[i].Rules[j].RuleID]
+			}
+		}
+
+		c.JSON(http.StatusOK, gin.H{
+			"ok":       true,
+			"from":     from,
+			"to":       to,
+			"min_runs": q.MinRuns,
+			"data":     results,
+		})
+	}
+}
+
+// handleRecordedAgentRegressions lists the versions the regression job found
+// regressed. The job compares every repo, so callers limited to some repos
+// are refused.
+func handleRecordedAgentRegressions(store Store) gin.HandlerFunc {
+	return func(c *gin.Context) {
+		if visibleRepos(c) != nil {
+			c.JSON(http.StatusForbidden, errResponse{OK: false, Error: "FORBIDDEN", Message: "recorded regressions cover every repo; use /api/agent-versions/regressions instead"})
+			return
+		}
+		rows, err := store.ListAgentRegressions()
+		if err != nil {
+			c.JSON(http.StatusInternalServerError, errResponse{OK: false, Error: "INTERNAL_ERROR", Message: err.Error()})
+			return
+		}
+		c.JSON(http.StatusOK, gin.H{"ok": true, "data": rows})
+	}
+}
@@ -0,0 +1,182 @@
+package main
+
+import (
+	"errors"
+	"net/http"
+	"strconv"
+	"strings"
+	"time"
+
+	"github.com/gin-gonic/gin"
+)
+
+func handleAlerts(store Store, policy alertPolicy) gin.HandlerFunc {
+	return func(c *gin.Context) {
+		state := strings.ToLower(strings.TrimSpace(c.Query("state")))
+		switch state {
+		case "", alertStateOK, alertStatePending, alertStateFiring, "disabled":
+		default:
+			c.JSON(http.StatusBadRequest, errResponse{OK: false, Error: "VALIDATION_ERROR", Message: "state must be ok|pending|firing|disabled"})
+			return
+		}
+
+		rows, err := listAlertStatuses(store, policy, time.Now().UTC())
+		if err != nil {
+			c.JSON(http.StatusInternalServerError, errResponse{OK: false, Error: "INTERNAL_ERROR", Message: err.Error()})
+			return
+		}
+		// Rules without a repo cover every repo, so only callers who see
+		// every repo see them.
+		scope := visibleRepos(c)
+		data := make([]alertStatusRow, 0, len(rows))
+		for _, row := range rows {
+			if scope != nil && (row.Rule.Repo == "" || !scope.allows(row.Rule.Repo)) {
+				continue
+			}
+			if state == "" || row.State == state {
+				data = append(data, row)
+			}
+		}
+
+		c.JSON(http.StatusOK, gin.H{
+			"ok":      true,
+			"enabled": policy.Enabled,
+			"data":    data,
+		})
+	}
+}
+
+func handleAlertRuleUpsert(store Store, policy alertPolicy) gin.HandlerFunc {
+	return func(c *gin.Context) {
+		var req alertRuleSpec
+		if err := c.ShouldBindJSON(&req); err != nil {
+			c.JSON(http.StatusBadRequest, errResponse{OK: false, Error: "VALIDATION_ERROR", Message: err.Error()})
+			return
+		}
+		auditTarget(c, req.Name)
+		rule, errs := policy.parseAlertRule(req, "api")
+		if _, ok := policy.configRule(req.Name); ok {
+			errs = append(errs, fieldError{Field: "name", Code: "conflict", Message: "name is defined in config.yaml and cannot be changed through the API"})
+		}
+		if len(errs) > 0 {
+			c.JSON(http.StatusBadRequest, validationErrResponse{OK: false, Error: "VALIDATION_ERROR", Message: validationMessage(errs), Details: errs})
+			return
+		}
+		if forbidRepo(c, rule.Repo) {
+			return
+		}
+		if rule.Webhooks == nil {
+			rule.Webhooks = []string{}
+		}
+
+		created, err := store.UpsertAlertRule(rule.alertRuleSpec)
+		if err != nil {
+			c.JSON(http.StatusInternalServerError, errResponse{OK: false, Error: "INTERNAL_ERROR", Message: err.Error()})
+			return
+		}
+
+		c.JSON(http.StatusOK, gin.H{
+			"ok":      true,
+			"created": created,
+			"rule":    rule.alertRuleSpec,
+		})
+	}
+}
+
+func handleAlertRuleDelete(store Store, policy alertPolicy) gin.HandlerFunc {
+	return func(c *gin.Context) {
+		name := strings.TrimSpace(c.Query("name"))
+		auditTarget(c, name)
+		if name == "" {
+			c.JSON(http.StatusBadRequest, errResponse{OK: false, Error: "VALIDATION_ERROR", Message: "name is required"})
+			return
+		}
+		if _, ok := policy.configRule(name); ok {
+			c.JSON(http.StatusBadRequest, errResponse{OK: false, Error: "VALIDATION_ERROR", Message: "name is defined in config.yaml and cannot be deleted through the API"})
+			return
+		}
+
+		deleted, err := store.DeleteAlertRule(name)
+		if err != nil {
+			c.JSON(http.StatusInternalServerError, errResponse{OK: false, Error: "INTERNAL_ERROR", Message: err.Error()})
+			return
+		}
+		if !deleted {
+			c.JSON(http.StatusNotFound, errResponse{OK: false, Error: "NOT_FOUND", Message: "no alert rule with this name"})
+			return
+		}
+
+		c.JSON(http.StatusOK, gin.H{"ok": true, "name": name})
+	}
+}
+
+func handleAlertSilences(store Store) gin.HandlerFunc {
+	return func(c *gin.Context) {
+		q := alertSilenceQuery{Repos: visibleRepos(c), Limit: parseLimit(c.Query("limit"), 100, 1, 1000)}
+		if active, _ := strconv.ParseBool(c.Query("active")); active {
+			q.ActiveAt = time.Now().UTC()
+		}
+
+		rows, err := store.ListAlertSilences(q)
+		if err != nil {
+			c.JSON(http.StatusInternalServerError, errResponse{OK: false, Error: "INTERNAL_ERROR", Message: err.Error()})
+			return
+		}
+
+		c.JSON(http.StatusOK, gin.H{
+			"ok":    true,
+			"data":  rows,
+			"limit": q.Limit,
+		})
+	}
+}
+
+func handleAlertSilenceCreate(store Store) gin.HandlerFunc {
+	return func(c *gin.Context) {
+		var req alertSilenceRequest
+		if err := c.ShouldBindJSON(&req); err != nil {
+			c.JSON(http.StatusBadRequest, errResponse{OK: false, Error: "VALIDATION_ERROR", Message: err.Error()})
+			return
+		}
+		silence, errs := validateAlertSilence(req, time.Now().UTC())
+		if len(errs) > 0 {
+			c.JSON(http.StatusBadRequest, validationErrResponse{OK: false, Error: "VALIDATION_ERROR", Message: validationMessage(errs), Details: errs})
+			return
+		}
+		if forbidRepo(c, silence.Repo) {
+			return
+		}
+
+		row, err := store.CreateAlertSilence(silence)
+		if err != nil {
+			c.JSON(http.StatusInternalServerError, errResponse{OK: false, Error: "INTERNAL_ERROR", Message: err.Error()})
+			return
+		}
+		auditTarget(c, strconv.FormatUint(row.ID, 10))
+
+		c.JSON(http.StatusOK, gin.H{"ok": true, "silence": row})
+	}
+}
+
+func handleAlertSilenceExpire(store Store) gin.HandlerFunc {
+	return func(c *gin.Context) {
+		auditTarget(c, c.Query("id"))
+		id, err := strconv.ParseUint(c.Query("id"), 10, 64)
+		if err != nil || id == 0 {
+			c.JSON(http.StatusBadRequest, errResponse{OK: false, Error: "VALIDATION_ERROR", Message: "id must be a positive integer"})
+			return
+		}
+
+		row, err := store.ExpireAlertSilence(id, time.Now().UTC())
+		if errors.Is(err, errSilenceNotFound) {
+			c.JSON(http.StatusNotFound, errResponse{OK: false, Error: "NOT_FOUND", Message: err.Error()})
+			return
+		}
+		if err != nil {
+			c.JSON(http.StatusInternalServerError, errResponse{OK: false, Error: "INTERNAL_ERROR", Message: err.Error()})
+			return
+		}
+
+		c.JSON(http.StatusOK, gin.H{"ok": true, "silence": row})
+	}
+}
@@ -0,0 +1,55 @@
+package main
+
+import (
+	"net/http"
+	"strings"
+	"time"
+
+	"github.com/gin-gonic/gin"
+)
+
+func handleAnomalies(store Store) gin.HandlerFunc {
+	return func(c *gin.Context) {
+		from, to, err := parseTimeRange(c)
+		if err != nil {
+			c.JSON(http.StatusBadRequest, errResponse{OK: false, Error: "VALIDATION_ERROR", Message: err.Error()})
+			return
+		}
+		q := anomalyQuery{
+			// Anomalies are recorded per UTC day, so the day containing from
+			// is included.
+			From:     from.UTC().Truncate(24 * time.Hour),
+			To:       to,
+			Repo:     strings.TrimSpace(c.Query("repo")),
+			Metric:   strings.ToLower(strings.TrimSpace(c.Query("metric"))),
+			Severity: strings.ToLower(strings.TrimSpace(c.Query("severity"))),
+			Repos:    visibleRepos(c),
+			Limit:    parseLimit(c.Query("limit"), 100, 1, 1000),
+			Offset:   parseLimit(c.Query("offset"), 0, 0, 1000000),
+		}
+		if q.Metric != "" && q.Metric != "runs" && q.Metric != "hits" && q.Metric != "density" {
+			c.JSON(http.StatusBadRequest, errResponse{OK: false, Error: "VALIDATION_ERROR", Message: "metric must be runs|hits|density"})
+			return
+		}
+		if q.Severity != "" && q.Severity != "warning" && q.Severity != "critical" {
+			c.JSON(http.StatusBadRequest, errResponse{OK: false, Error: "VALIDATION_ERROR", Message: "severity must be warning|critical"})
+			return
+		}
+
+		rows, total, err := store.ListAnomalies(q)
+		if err != nil {
+			c.JSON(http.StatusInternalServerError, errResponse{OK: false, Error: "INTERNAL_ERROR", Message: err.Error()})
+			return
+		}
+
+		c.JSON(http.StatusOK, gin.H{
+			"ok":     true,
+			"from":   from,
+			"to":     to,
+			"data":   rows,
+			"total":  total,
+			"limit":  q.Limit,
+			"offset": q.Offset,
+		})
+	}
+}
@@ -0,0 +1,119 @@
+package main
+
+import (
+	"errors"
+	"net/http"
+	"strconv"
+	"time"
+
+	"github.com/gin-gonic/gin"
+)
+
+func handleAPIKeyCreate(store Store) gin.HandlerFunc {
+	return func(c *gin.Context) {
+		var req apiKeyRequest
+		if err := c.ShouldBindJSON(&req); err != nil {
+			c.JSON(http.StatusBadRequest, errResponse{OK: false, Error: "VALIDATION_ERROR", Message: err.Error()})
+			return
+		}
+		if errs := validateAPIKeyRequest(req); len(errs) > 0 {
+			c.JSON(http.StatusBadRequest, validationErrResponse{OK: false, Error: "VALIDATION_ERROR", Message: validationMessage(errs), Details: errs})
+			return
+		}
+
+		key, display, err := newAPIKeySecret()
+		if err != nil {
+			c.JSON(http.StatusInternalServerError, errResponse{OK: false, Error: "INTERNAL_ERROR", Message: err.Error()})
+			return
+		}
+		row, err := store.CreateAPIKey(req.Name, req.Repos, hashAPIKey(key), display)
+		if err != nil {
+			c.JSON(http.StatusInternalServerError, errResponse{OK: false, Error: "INTERNAL_ERROR", Message: err.Error()})
+			return
+		}
+		auditTarget(c, strconv.FormatUint(row.ID, 10))
+
+		c.JSON(http.StatusOK, gin.H{"ok": true, "key": key, "data": row})
+	}
+}
+
+func handleAPIKeyList(store Store) gin.HandlerFunc {
+	return func(c *gin.Context) {
+		includeRevoked, _ := strconv.ParseBool(c.Query("include_revoked"))
+		rows, err := store.ListAPIKeys(includeRevoked)
+		if err != nil {
+			c.JSON(http.StatusInternalServerError, errResponse{OK: false, Error: "INTERNAL_ERROR", Message: err.Error()})
+			return
+		}
+
+		c.JSON(http.StatusOK, gin.H{"ok": true, "data": rows})
+	}
+}
+
+// parseAPIKeyID reads the id query parameter of the key routes, answering
+// 400 itself when it is missing or malformed.
+func parseAPIKeyID(c *gin.Context) (uint64, bool) {
+	auditTarget(c, c.Query("id"))
+	id, err := strconv.ParseUint(c.Query("id"), 10, 64)
+	if err != nil || id == 0 {
+		c.JSON(http.StatusBadRequest, errResponse{OK: false, Error: "VALIDATION_ERROR", Message: "id must be a positive integer"})
+		return 0, false
+	}
+	return id, true
+}
+
+func writeAPIKeyError(c *gin.Context, err error) {
+	if errors.Is(err, errAPIKeyNotFound) {
+		c.JSON(http.StatusNotFound, errResponse{OK: false, Error: "NOT_FOUND", Message: err.Error()})
+		return
+	}
+	c.JSON(http.StatusInternalServerError, errResponse{OK: false, Error: "INTERNAL_ERROR", Message: err.Error()})
+}
+
+func handleAPIKeyRotate(store Store) gin.HandlerFunc {
+	return func(c *gin.Context) {
+		id, ok := parseAPIKeyID(c)
+		if !ok {
+			return
+		}
+		var grace time.Duration
+		if raw := c.Query("grace"); raw != "" {
+			var err error
+			grace, err = parseRetentionDuration(raw)
+			if err != nil || grace < 0 || grace > maxAPIKeyGrace {
+				c.JSON(http.StatusBadRequest, errResponse{OK: false, Error: "VALIDATION_ERROR", Message: "grace must be a duration between 0 and 7d"})
+				return
+			}
+		}
+
+		key, display, err := newAPIKeySecret()
+		if err != nil {
+			c.JSON(http.StatusInternalServerError, errResponse{OK: false, Error: "INTERNAL_ERROR", Message: err.Error()})
+			return
+		}
+		row, err := store.RotateAPIKey(id, hashAPIKey(key), display, grace)
+		if err != nil {
+			writeAPIKeyError(c, err)
+			return
+		}
+
+		c.JSON(http.StatusOK, gin.H{"ok": true, "key": key, "data": row})
+	}
+}
+
+func handleAPIKeyRevoke(store Store) gin.HandlerFunc {
+	return func(c *gin.Context) {
+		id, ok := parseAPIKeyID(c)
+		if !ok {
+			return
+		}
+
+		row, err := store.RevokeAPIKey(id, time.Now().UTC())
+		if err != nil {
+			writeAPIKeyError(c, err)
+			return
+		}
+
+		c.JSON(http.StatusOK, gin.H{"ok": true, "data": row})
+	}
+}
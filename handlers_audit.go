@@ -0,0 +1,48 @@
+package main
+
+import (
+	"net/http"
+	"strings"
+
+	"github.com/gin-gonic/gin"
+)
+
+func handleAudit(store Store) gin.HandlerFunc {
+	return func(c *gin.Context) {
+		from, to, err := parseOpenTimeRange(c)
+		if err != nil {
+			c.JSON(http.StatusBadRequest, errResponse{OK: false, Error: "VALIDATION_ERROR", Message: err.Error()})
+			return
+		}
+		q := auditQuery{
+			From:   from,
+			To:     to,
+			Actor:  strings.TrimSpace(c.Query("actor")),
+			Action: strings.TrimSpace(c.Query("action")),
+			Result: strings.ToLower(strings.TrimSpace(c.Query("result"))),
+			Limit:  parseLimit(c.Query("limit"), 100, 1, 1000),
+			Offset: parseLimit(c.Query("offset"), 0, 0, 1000000),
+		}
+		if q.Result != "" && q.Result != auditResultSuccess && q.Result != auditResultFailure {
+			c.JSON(http.StatusBadRequest, errResponse{OK: false, Error: "VALIDATION_ERROR", Message: "result must be success|failure"})
+			return
+		}
+
+		rows, total, err := store.ListAuditEntries(q)
+		if err != nil {
+			c.JSON(http.StatusInternalServerError, errResponse{OK: false, Error: "INTERNAL_ERROR", Message: err.Error()})
+			return
+		}
+		if rows == nil {
+			rows = []auditRow{}
+		}
+
+		c.JSON(http.StatusOK, gin.H{
+			"ok":     true,
+			"data":   rows,
+			"total":  total,
+			"limit":  q.Limit,
+			"offset": q.Offset,
+		})
+	}
+}
@@ -0,0 +1,22 @@
+package main
+
+import (
+	"net/http"
+	"testing"
+)
+
+func TestAuditNeedsAdmin(t *testing.T) {
+	store := newTestStore(t)
+	open := newTestServer(t, store, authPolicy{}, alertPolicy{})
+	if status, body := doRequest(t, http.MethodGet, open+"/api/audit", nil, nil); status != http.StatusForbidden {
+		t.Fatalf("unconfigured: %d %s, want 403", status, body)
+	}
+	guarded := newTestServer(t, store, authPolicy{AdminToken: testAdminToken}, alertPolicy{})
+	if status, body := doRequest(t, http.MethodGet, guarded+"/api/audit", nil, nil); status != http.StatusUnauthorized {
+		t.Fatalf("no token: %d %s, want 401", status, body)
+	}
+	header := http.Header{"Authorization": {"Bearer " + testAdminToken}}
+	if status, body := doRequest(t, http.MethodGet, guarded+"/api/audit", nil, header); status != http.StatusOK {
+		t.Fatalf("admin: %d %s", status, body)
+	}
+}
@@ -3,13 +3,11 @@ package main
 import (
 	"net/http"
 	"strings"
-	"time"
 
 	"github.com/gin-gonic/gin"
-	"gorm.io/gorm"
 )
 
-func handleChangeEffectivenessSummary(db *gorm.DB) gin.HandlerFunc {
+func handleChangeEffectivenessSummary(store Store) gin.HandlerFunc {
 	return func(c *gin.Context) {
 		from, to, err := parseTimeRange(c)
 		if err != nil {
@@ -18,30 +16,8 @@ func handleChangeEffectivenessSummary(db *gorm.DB) gin.HandlerFunc {
 		}
 
 		minRuns := parseLimit(c.Query("min_runs"), 2, 1, 1000)
-		filtered := applyChangeFilters(db.Model(&CodeChangeSummary{}), c).
-			Where("last_reported_at BETWEEN ? AND ?", from, to).
-			Where("run_count >= ?", minRuns)
-
-		var totalChanges uint64
-		if err := filtered.Select("COUNT(*)").Scan(&totalChanges).Error; err != nil {
-			c.JSON(http.StatusInternalServerError, errResponse{OK: false, Error: "INTERNAL_ERROR", Message: err.Error()})
-			return
-		}
-
-		var improvingChanges uint64
-		if err := filtered.Where("max_total_hits > min_total_hits").Select("COUNT(*)").Scan(&improvingChanges).Error; err != nil {
-			c.JSON(http.StatusInternalServerError, errResponse{OK: false, Error: "INTERNAL_ERROR", Message: err.Error()})
-			return
-		}
-
-		var stableChanges uint64
-		if err := filtered.Where("max_total_hits = min_total_hits").Select("COUNT(*)").Scan(&stableChanges).Error; err != nil {
-			c.JSON(http.StatusInternalServerError, errResponse{OK: false, Error: "INTERNAL_ERROR", Message: err.Error()})
-			return
-		}
-
-		var avgRate float64
-		if err := filtered.Select("COALESCE(AVG(improvement_rate),0)").Scan(&avgRate).Error; err != nil {
+		stats, err := store.LoadChangeEffectivenessStats(from, to, parseQueryFilter(c), minRuns)
+		if err != nil {
 			c.JSON(http.StatusInternalServerError, errResponse{OK: false, Error: "INTERNAL_ERROR", Message: err.Error()})
 			return
 		}
@@ -50,15 +26,15 @@ func handleChangeEffectivenessSummary(db *gorm.DB) gin.HandlerFunc {
 			OK:                 true,
 			From:               from,
 			To:                 to,
-			TotalChanges:       totalChanges,
-			ImprovingChanges:   improvingChanges,
-			StableChanges:      stableChanges,
-			AvgImprovementRate: avgRate,
+			TotalChanges:       stats.TotalChanges,
+			ImprovingChanges:   stats.ImprovingChanges,
+			StableChanges:      stats.StableChanges,
+			AvgImprovementRate: stats.AvgImprovementRate,
 		})
 	}
 }
 
-func handleChangeEffectivenessTop(db *gorm.DB) gin.HandlerFunc {
+func handleChangeEffectivenessTop(store Store) gin.HandlerFunc {
 	return func(c *gin.Context) {
 		from, to, err := parseTimeRange(c)
 		if err != nil {
@@ -73,19 +49,14 @@ func handleChangeEffectivenessTop(db *gorm.DB) gin.HandlerFunc {
 			direction = "high"
 		}
 
-		order := "improvement_rate DESC"
-		if direction == "low" {
-			order = "improvement_rate ASC"
-		}
-
-		query := applyChangeFilters(db.Table("code_change_summary"), c).
-			Select("repo, code_change_id, run_count, max_total_hits, min_total_hits, (max_total_hits - min_total_hits) AS delta, improvement_rate, last_reported_at, last_ruleset_version").
-			Where("last_reported_at BETWEEN ? AND ?", from, to).
-			Where("run_count >= ?", minRuns).
-			Where("improvement_rate IS NOT NULL")
-
-		var rows []changeEffectivenessRow
-		if err := query.Order(order).Limit(limit).Scan(&rows).Error; err != nil {
+		rows, err := store.ListChangeEffectiveness(from, to, parseQueryFilter(c), changeListQuery{
+			MinRuns:   minRuns,
+			Sort:      "improvement_rate",
+			Desc:      direction == "high",
+			Limit:     limit,
+			RatedOnly: true,
+		})
+		if err != nil {
 			c.JSON(http.StatusInternalServerError, errResponse{OK: false, Error: "INTERNAL_ERROR", Message: err.Error()})
 			return
 		}
@@ -99,7 +70,7 @@ func handleChangeEffectivenessTop(db *gorm.DB) gin.HandlerFunc {
 	}
 }
 
-func handleChangeEffectivenessList(db *gorm.DB) gin.HandlerFunc {
+func handleChangeEffectivenessList(store Store) gin.HandlerFunc {
 	return func(c *gin.Context) {
 		from, to, err := parseTimeRange(c)
 		if err != nil {
@@ -123,18 +94,14 @@ func handleChangeEffectivenessList(db *gorm.DB) gin.HandlerFunc {
 			order = "desc"
 		}
 
-		orderExpr := sort + " " + strings.ToUpper(order)
-		if sort == "improvement_rate" {
-			orderExpr = "improvement_rate IS NULL, improvement_rate " + strings.ToUpper(order)
-		}
-
-		query := applyChangeFilters(db.Table("code_change_summary"), c).
-			Select("repo, code_change_id, run_count, max_total_hits, min_total_hits, (max_total_hits - min_total_hits) AS delta, improvement_rate, last_reported_at, last_ruleset_version").
-			Where("last_reported_at BETWEEN ? AND ?", from, to).
-			Where("run_count >= ?", minRuns)
-
-		var rows []changeEffectivenessRow
-		if err := query.Order(orderExpr).Order("last_reported_at DESC").Limit(limit).Offset(offset).Scan(&rows).Error; err != nil {
+		rows, err := store.ListChangeEffectiveness(from, to, parseQueryFilter(c), changeListQuery{
+			MinRuns: minRuns,
+			Sort:    sort,
+			Desc:    order == "desc",
+			Limit:   limit,
+			Offset:  offset,
+		})
+		if err != nil {
 			c.JSON(http.StatusInternalServerError, errResponse{OK: false, Error: "INTERNAL_ERROR", Message: err.Error()})
 			return
 		}
@@ -150,7 +117,7 @@ func handleChangeEffectivenessList(db *gorm.DB) gin.HandlerFunc {
 	}
 }
 
-func handleChangeEffectivenessRuns(db *gorm.DB) gin.HandlerFunc {
+func handleChangeEffectivenessRuns(store Store) gin.HandlerFunc {
 	return func(c *gin.Context) {
 		codeChangeID := strings.TrimSpace(c.Query("code_change_id"))
 		if codeChangeID == "" {
@@ -160,46 +127,14 @@ func handleChangeEffectivenessRuns(db *gorm.DB) gin.HandlerFunc {
 
 		limit := parseLimit(c.Query("limit"), 50, 1, 200)
 		repo := strings.TrimSpace(c.Query("repo"))
-		fromStr := strings.TrimSpace(c.Query("from"))
-		toStr := strings.TrimSpace(c.Query("to"))
-
-		var from time.Time
-		var to time.Time
-		var err error
-		if fromStr != "" {
-			from, err = parseTimeParam(fromStr)
-			if err != nil {
-				c.JSON(http.StatusBadRequest, errResponse{OK: false, Error: "VALIDATION_ERROR", Message: err.Error()})
-				return
-			}
-		}
-		if toStr != "" {
-			to, err = parseTimeParam(toStr)
-			if err != nil {
-				c.JSON(http.StatusBadRequest, errResponse{OK: false, Error: "VALIDATION_ERROR", Message: err.Error()})
-				return
-			}
-		}
-		if !to.IsZero() && !from.IsZero() && to.Before(from) {
-			c.JSON(http.StatusBadRequest, errResponse{OK: false, Error: "VALIDATION_ERROR", Message: "to must be >= from"})
+		from, to, err := parseOpenTimeRange(c)
+		if err != nil {
+			c.JSON(http.StatusBadRequest, errResponse{OK: false, Error: "VALIDATION_ERROR", Message: err.Error()})
 			return
 		}
 
-		query := db.Model(&CrAgentRun{}).
-			Select("reported_at, triggered_total_hits, diff_lines").
-			Where("code_change_id = ?", codeChangeID)
-		if repo != "" {
-			query = query.Where("repo = ?", repo)
-		}
-		if !from.IsZero() {
-			query = query.Where("reported_at >= ?", from)
-		}
-		if !to.IsZero() {
-			query = query.Where("reported_at <= ?", to)
-		}
-
-		var rows []changeRunRow
-		if err := query.Order("reported_at DESC").Limit(limit).Find(&rows).Error; err != nil {
+		rows, err := store.ListChangeRuns(from, to, queryFilter{Repo: repo, CodeChangeID: codeChangeID, Repos: visibleRepos(c)}, limit)
+		if err != nil {
 			c.JSON(http.StatusInternalServerError, errResponse{OK: false, Error: "INTERNAL_ERROR", Message: err.Error()})
 			return
 		}
@@ -0,0 +1,67 @@
+package main
+
+import (
+	"net/http"
+	"strings"
+
+	"github.com/gin-gonic/gin"
+)
+
+func handleCompareRuleset(store Store) gin.HandlerFunc {
+	return func(c *gin.Context) {
+		from, to, err := parseTimeRange(c)
+		if err != nil {
+			c.JSON(http.StatusBadRequest, errResponse{OK: false, Error: "VALIDATION_ERROR", Message: err.Error()})
+			return
+		}
+		a := strings.TrimSpace(c.Query("a"))
+		b := strings.TrimSpace(c.Query("b"))
+		if a == "" || b == "" {
+			c.JSON(http.StatusBadRequest, errResponse{OK: false, Error: "VALIDATION_ERROR", Message: "a and b are required"})
+			return
+		}
+		if a == b {
+			c.JSON(http.StatusBadRequest, errResponse{OK: false, Error: "VALIDATION_ERROR", Message: "a and b must be different ruleset versions"})
+			return
+		}
+
+		minRuns := parseLimit(c.Query("min_runs"), 2, 1, 1000)
+		limit := parseLimit(c.Query("limit"), 50, 1, 500)
+		filter := parseQueryFilter(c)
+		filter.RulesetVersion = ""
+		filter.CodeChangeID = ""
+
+		cmp, err := store.CompareRulesets(a, b, from, to, filter, minRuns, limit)
+		if err != nil {
+			c.JSON(http.StatusInternalServerError, errResponse{OK: false, Error: "INTERNAL_ERROR", Message: err.Error()})
+			return
+		}
+
+		ruleIDs := make([]string, 0, len(cmp.Rules))
+		for _, row := range cmp.Rules {
+			ruleIDs = append(ruleIDs, row.RuleID)
+		}
+		catalog, err := store.LookupRuleCatalog(ruleIDs)
+		if err != nil {
+			c.JSON(http.StatusInternalServerError, errResponse{OK: false, Error: "INTERNAL_ERROR", Message: err.Error()})
+			return
+		}
+		rules := cmp.Rules
+		if rules == nil {
+			rules = []ruleComparisonRow{}
+		}
+		for i := range rules {
+			rules[i].Catalog = catalog[rules[i].RuleID]
+		}
+
+		c.JSON(http.StatusOK, gin.H{
+			"ok":    true,
+			"from":  from,
+			"to":    to,
+			"a":     cmp.A,
+			"b":     cmp.B,
+			"diff":  cmp.Diff,
+			"rules": rules,
+		})
+	}
+}
@@ -169,6 +169,15 @@ const dashboardHTML = `<!doctype html>
       color: var(--muted);
       margin-top: 6px;
     }
+    .significant { color: var(--accent); font-weight: 600; }
+    .banner {
+      padding: 10px 14px;
+      border: 1px solid #e0b4a8;
+      border-radius: 10px;
+      background: #fbeee9;
+      color: #8a3b26;
+      font-size: 13px;
+    }
     @media (max-width: 720px) {
       header { padding: 18px; }
       .layout { padding: 18px; }
@@ -189,11 +198,13 @@ const dashboardHTML = `<!doctype html>
       <button class="tab-btn active" data-tab="overview">Overview</button>
       <button class="tab-btn" data-tab="effectiveness">Change Effectiveness</button>
       <button class="tab-btn" data-tab="rule-quality">Rule Quality</button>
+      <button class="tab-btn" data-tab="compare">Ruleset Compare</button>
     </div>
   </header>
 
   <section id="tab-overview" class="tab-content active">
     <div class="layout">
+    <div class="banner" id="regressionBanner" style="display:none"></div>
     <div class="cards">
       <div class="card"><div class="label">Total Runs</div><div class="value" id="totalRuns">-</div></div>
       <div class="card"><div class="label">Total Hits</div><div class="value" id="totalHits">-</div></div>
@@ -205,10 +216,12 @@ const dashboardHTML = `<!doctype html>
       <div class="panel">
         <h3>Runs Over Time</h3>
         <div id="runsChart"></div>
+        <div class="section-note">Shaded days are run count anomalies.</div>
       </div>
       <div class="panel">
         <h3>Hits Over Time</h3>
         <div id="hitsChart"></div>
+        <div class="section-note">Shaded days are hit or hit density anomalies.</div>
       </div>
       <div class="panel">
         <h3>Top Rules</h3>
@@ -378,12 +391,16 @@ const dashboardHTML = `<!doctype html>
         <div class="filters">
           <label>Rule ID <input type="text" id="rqRuleId" placeholder="rule_id"></label>
           <label>Ruleset <input type="text" id="rqRuleset" placeholder="ruleset_version"></label>
+          <label>Category <input type="text" id="rqCategory" placeholder="category"></label>
+          <label>Owner <input type="text" id="rqOwner" placeholder="owner"></label>
           <label>Min Runs <input type="number" id="rqMinRuns" min="1" value="1" style="width:80px"></label>
           <label>Min Changes <input type="number" id="rqMinChanges" min="1" value="2" style="width:90px"></label>
           <label>Sort
             <select id="rqSort">
               <option value="fix_rate">Fix Rate</option>
               <option value="disappear_rate">Disappear Rate</option>
+              <option value="acceptance_rate">Acceptance Rate</option>
+              <option value="false_positive_rate">False Positive Rate</option>
               <option value="total_hits">Total Hits</option>
               <option value="run_count">Run Count</option>
               <option value="last_seen_at">Last Seen</option>
@@ -413,6 +430,8 @@ const dashboardHTML = `<!doctype html>
               <th>Hit Rate</th>
               <th>Fix Rate</th>
               <th>Disappear Rate</th>
+              <th>Acceptance</th>
+              <th>False Positive</th>
               <th>Avg Drop</th>
               <th>Last Seen</th>
               <th>Trend</th>
@@ -429,7 +448,60 @@ const dashboardHTML = `<!doctype html>
     </div>
   </section>
 
-  <script src="https://cdn.jsdelivr.net/npm/echarts@5/dist/echarts.min.js"></script>
+  <section id="tab-compare" class="tab-content">
+    <div class="layout">
+      <div class="panel">
+        <h3>Ruleset Compare</h3>
+        <div class="filters">
+          <label>Version A <input type="text" id="cmpA" placeholder="ruleset_version"></label>
+          <label>Version B <input type="text" id="cmpB" placeholder="ruleset_version"></label>
+          <label>Agent <input type="text" id="cmpAgent" placeholder="agent_version"></label>
+          <label>Category <input type="text" id="cmpCategory" placeholder="category"></label>
+          <label>Min Runs <input type="number" id="cmpMinRuns" min="1" value="2" style="width:80px"></label>
+          <label>Limit <input type="number" id="cmpLimit" min="1" max="500" value="50" style="width:80px"></label>
+          <button id="cmpRefreshBtn">Compare</button>
+        </div>
+        <div class="section-note">Brackets are 95% confidence intervals; bold differences (B − A) exclude zero.</div>
+      </div>
+
+      <div class="panel">
+        <h3>Versions</h3>
+        <table>
+          <thead>
+            <tr>
+              <th>Metric</th>
+              <th id="cmpHeadA">A</th>
+              <th id="cmpHeadB">B</th>
+              <th>B − A</th>
+            </tr>
+          </thead>
+          <tbody id="cmpTable"></tbody>
+        </table>
+      </div>
+
+      <div class="panel">
+        <h3>Rules</h3>
+        <table>
+          <thead>
+            <tr>
+              <th>Rule ID</th>
+              <th>Hits/Run A</th>
+              <th>Hits/Run B</th>
+              <th>Fix Rate A</th>
+              <th>Fix Rate B</th>
+              <th>Fix Rate Δ</th>
+              <th>Noise A</th>
+              <th>Noise B</th>
+              <th>Noise Δ</th>
+            </tr>
+          </thead>
+          <tbody id="cmpRulesTable"></tbody>
+        </table>
+      </div>
+    </div>
+  </section>
+
+  <script src="https://cdn.jsdelivr/npm/echarts@5/dist/echarts.min.js"></script>
   <script>
     const els = {
       from: document.getElementById('fromInput'),
@@ -442,6 +514,7 @@ const dashboardHTML = `<!doctype html>
       avgDensity: document.getElementById('avgDensity'),
       activeRepos: document.getElementById('activeRepos'),
       runsTable: document.getElementById('runsTable'),
+      regressionBanner: document.getElementById('regressionBanner'),
       ceTotal: document.getElementById('ceTotal'),
       ceImproving: document.getElementById('ceImproving'),
       ceStable: document.getElementById('ceStable'),
@@ -465,6 +538,8 @@ const dashboardHTML = `<!doctype html>
       rqLowTable: document.getElementById('rqLowTable'),
       rqRuleId: document.getElementById('rqRuleId'),
       rqRuleset: document.getElementById('rqRuleset'),
+      rqCategory: document.getElementById('rqCategory'),
+      rqOwner: document.getElementById('rqOwner'),
       rqMinRuns: document.getElementById('rqMinRuns'),
       rqMinChanges: document.getElementById('rqMinChanges'),
       rqSort: document.getElementById('rqSort'),
@@ -474,10 +549,22 @@ const dashboardHTML = `<!doctype html>
       rqTable: document.getElementById('rqTable'),
       rqTrendPanel: document.getElementById('rqTrendPanel'),
       rqTrendTitle: document.getElementById('rqTrendTitle'),
+      cmpA: document.getElementById('cmpA'),
+      cmpB: document.getElementById('cmpB'),
+      cmpAgent: document.getElementById('cmpAgent'),
+      cmpCategory: document.getElementById('cmpCategory'),
+      cmpMinRuns: document.getElementById('cmpMinRuns'),
+      cmpLimit: document.getElementById('cmpLimit'),
+      cmpRefreshBtn: document.getElementById('cmpRefreshBtn'),
+      cmpHeadA: document.getElementById('cmpHeadA'),
+      cmpHeadB: document.getElementById('cmpHeadB'),
+      cmpTable: document.getElementById('cmpTable'),
+      cmpRulesTable: document.getElementById('cmpRulesTable'),
       tabButtons: document.querySelectorAll('.tab-btn'),
       overviewTab: document.getElementById('tab-overview'),
       effectivenessTab: document.getElementById('tab-effectiveness'),
-      ruleQualityTab: document.getElementById('tab-rule-quality')
+      ruleQualityTab: document.getElementById('tab-rule-quality'),
+      compareTab: document.getElementById('tab-compare')
     };
 
     const charts = {
@@ -525,14 +612,31 @@ const dashboardHTML = `<!doctype html>
       els.hint.textContent = new Date(data.from).toLocaleString() + ' ~ ' + new Date(data.to).toLocaleString();
     }
 
-    function renderTimeseries(chart, title, data, color) {
+    // anomalyAreas shades the hour buckets of each anomalous day.
+    function anomalyAreas(labels, anomalies) {
+      return anomalies.map(a => {
+        const day = a.day.slice(0, 10);
+        const inDay = labels.filter(l => l.startsWith(day));
+        if (!inDay.length) return null;
+        const color = a.severity === 'critical' ? 'rgba(196, 64, 40, 0.18)' : 'rgba(214, 160, 40, 0.16)';
+        return [
+          { name: a.repo + ' ' + a.metric + ' ' + a.direction + ' (' + a.severity + ', score ' + a.score.toFixed(1) + ')', xAxis: inDay[0], itemStyle: { color } },
+          { xAxis: inDay[inDay.length - 1] }
+        ];
+      }).filter(Boolean);
+    }
+
+    function renderTimeseries(chart, title, data, color, anomalies) {
       const labels = data.map(p => p.bucket);
       const values = data.map(p => p.value || 0);
       chart.setOption({
         tooltip: { trigger: 'axis' },
         xAxis: { type: 'category', data: labels, axisLabel: { color: '#6b6b6b' } },
         yAxis: { type: 'value', axisLabel: { color: '#6b6b6b' } },
-        series: [{ name: title, type: 'line', data: values, smooth: true, areaStyle: { opacity: 0.12 }, lineStyle: { color } }]
+        series: [{
+          name: title, type: 'line', data: values, smooth: true, areaStyle: { opacity: 0.12 }, lineStyle: { color },
+          markArea: { label: { show: false }, emphasis: { label: { show: true, position: 'insideTop' } }, data: anomalyAreas(labels, anomalies || []) }
+        }]
       });
     }
 
@@ -563,6 +667,26 @@ const dashboardHTML = `<!doctype html>
       ).join('');
     }
 
+    const regressionLabels = {
+      hit_density: 'hit density dropped',
+      zero_hit_rate: 'zero-hit run rate rose',
+      improvement_rate: 'improvement rate dropped',
+      rule_hit_share: 'rule hit share shifted'
+    };
+
+    function renderRegressionBanner(rows) {
+      if (!rows.length) {
+        els.regressionBanner.style.display = 'none';
+        return;
+      }
+      els.regressionBanner.innerHTML = rows.map(r =>
+        '<div>Agent <strong>' + r.agent_version + '</strong> regressed vs ' + r.baseline_version +
+          ' on ' + r.matched_repos + ' matched repos: ' +
+          r.regressions.map(name => regressionLabels[name] || name).join(', ') + '</div>'
+      ).join('');
+      els.regressionBanner.style.display = 'block';
+    }
+
     function formatPercent(value) {
       if (value === null || value === undefined) return 'N/A';
       return (value * 100).toFixed(2) + '%';
@@ -577,10 +701,14 @@ const dashboardHTML = `<!doctype html>
       const params = new URLSearchParams(buildQuery());
       const ruleId = els.rqRuleId.value.trim();
       const ruleset = els.rqRuleset.value.trim();
+      const category = els.rqCategory.value.trim();
+      const owner = els.rqOwner.value.trim();
       const minRuns = parseInt(els.rqMinRuns.value, 10);
       const minChanges = parseInt(els.rqMinChanges.value, 10);
       if (includeRuleId && ruleId) params.set('rule_id', ruleId);
       if (ruleset) params.set('ruleset_version', ruleset);
+      if (category) params.set('category', category);
+      if (owner) params.set('owner', owner);
       if (!isNaN(minRuns)) params.set('min_runs', minRuns);
       if (!isNaN(minChanges)) params.set('min_changes', minChanges);
       return params.toString();
@@ -593,10 +721,16 @@ const dashboardHTML = `<!doctype html>
       els.rqAvgHit.textContent = formatRate(data.avg_hit_rate);
     }
 
+    function ruleLabel(r) {
+      if (!r.catalog) return r.rule_id;
+      const meta = [r.catalog.category, r.catalog.owner].filter(Boolean).join(' · ');
+      return '<span title="' + meta + '">' + r.rule_id + '</span><br><small>' + r.catalog.title + '</small>';
+    }
+
     function renderRuleQualityTop(tableEl, rows) {
       tableEl.innerHTML = rows.map(r =>
         '<tr>' +
-          '<td>' + r.rule_id + '</td>' +
+          '<td>' + ruleLabel(r) + '</td>' +
           '<td>' + r.total_hits + '</td>' +
           '<td>' + formatRate(r.fix_rate) + '</td>' +
         '</tr>'
@@ -606,12 +740,14 @@ const dashboardHTML = `<!doctype html>
     function renderRuleQualityList(rows) {
       els.rqTable.innerHTML = rows.map(r =>
         '<tr>' +
-          '<td>' + r.rule_id + '</td>' +
+          '<td>' + ruleLabel(r) + '</td>' +
           '<td>' + r.total_hits + '</td>' +
           '<td>' + r.run_count + '</td>' +
           '<td>' + formatRate(r.hit_rate) + '</td>' +
           '<td>' + formatRate(r.fix_rate) + '</td>' +
           '<td>' + formatRate(r.disappear_rate) + '</td>' +
+          '<td>' + formatRate(r.acceptance_rate) + '</td>' +
+          '<td>' + formatRate(r.false_positive_rate) + '</td>' +
           '<td>' + (r.avg_drop === null || r.avg_drop === undefined ? 'N/A' : r.avg_drop.toFixed(2)) + '</td>' +
           '<td>' + new Date(r.last_seen_at).toLocaleString() + '</td>' +
           '<td><button class="link-btn" data-rule="' + r.rule_id + '">Trend</button></td>' +
@@ -635,6 +771,51 @@ const dashboardHTML = `<!doctype html>
       });
     }
 
+    function formatEstimate(e, format) {
+      if (!e || e.value === null) return 'N/A';
+      let text = format(e.value);
+      if (e.ci_low !== null) text += ' <small class="muted">[' + format(e.ci_low) + ', ' + format(e.ci_high) + ']</small>';
+      return text;
+    }
+
+    function formatDifference(d, format) {
+      if (!d || d.value === null) return 'N/A';
+      let text = format(d.value);
+      if (d.ci_low !== null) text += ' <small>[' + format(d.ci_low) + ', ' + format(d.ci_high) + ']</small>';
+      return d.significant ? '<span class="significant">' + text + '</span>' : text;
+    }
+
+    function formatDensity(value) {
+      return value.toFixed(4);
+    }
+
+    function renderComparison(data) {
+      els.cmpHeadA.textContent = 'A: ' + data.a.ruleset_version;
+      els.cmpHeadB.textContent = 'B: ' + data.b.ruleset_version;
+      const metrics = [
+        ['Runs', String(data.a.runs), String(data.b.runs), String(data.b.runs - data.a.runs)],
+        ['Avg Hit Density', formatEstimate(data.a.hit_density, formatDensity), formatEstimate(data.b.hit_density, formatDensity), formatDifference(data.diff.hit_density, formatDensity)],
+        ['Improvement Rate', formatEstimate(data.a.improvement_rate, formatRate), formatEstimate(data.b.improvement_rate, formatRate), formatDifference(data.diff.improvement_rate, formatRate)],
+        ['Noise (False Positive)', formatEstimate(data.a.noise, formatRate), formatEstimate(data.b.noise, formatRate), formatDifference(data.diff.noise, formatRate)]
+      ];
+      els.cmpTable.innerHTML = metrics.map(m =>
+        '<tr>' + m.map(cell => '<td>' + cell + '</td>').join('') + '</tr>'
+      ).join('');
+      els.cmpRulesTable.innerHTML = data.rules.map(r =>
+        '<tr>' +
+          '<td>' + ruleLabel(r) + '</td>' +
+          '<td>' + (r.a.hits_per_run === null ? 'N/A' : r.a.hits_per_run.toFixed(2)) + '</td>' +
+          '<td>' + (r.b.hits_per_run === null ? 'N/A' : r.b.hits_per_run.toFixed(2)) + '</td>' +
+          '<td>' + formatEstimate(r.a.fix_rate, formatRate) + '</td>' +
+          '<td>' + formatEstimate(r.b.fix_rate, formatRate) + '</td>' +
+          '<td>' + formatDifference(r.fix_rate_diff, formatRate) + '</td>' +
+          '<td>' + formatEstimate(r.a.noise, formatRate) + '</td>' +
+          '<td>' + formatEstimate(r.b.noise, formatRate) + '</td>' +
+          '<td>' + formatDifference(r.noise_diff, formatRate) + '</td>' +
+        '</tr>'
+      ).join('');
+    }
+
     function buildChangeQuery(includeChangeId) {
       const params = new URLSearchParams(buildQuery());
       const minRuns = parseInt(els.ceMinRuns.value, 10);
@@ -702,11 +883,13 @@ const dashboardHTML = `<!doctype html>
       const summary = await fetchJSON('/api/summary' + (qs ? '?' + qs : ''));
       renderSummary(summary);
 
+      const anomalies = (await fetchJSON('/api/anomalies?limit=1000' + (qs ? '&' + qs : ''))).data || [];
+
       const runsSeries = await fetchJSON('/api/timeseries?metric=runs&bucket=hour' + (qs ? '&' + qs : ''));
-      renderTimeseries(charts.runs, 'Runs', runsSeries.data, '#0c3b2e');
+      renderTimeseries(charts.runs, 'Runs', runsSeries.data, '#0c3b2e', anomalies.filter(a => a.metric === 'runs'));
 
       const hitsSeries = await fetchJSON('/api/timeseries?metric=hits&bucket=hour' + (qs ? '&' + qs : ''));
-      renderTimeseries(charts.hits, 'Hits', hitsSeries.data, '#c8a26b');
+      renderTimeseries(charts.hits, 'Hits', hitsSeries.data, '#c8a26b', anomalies.filter(a => a.metric !== 'runs'));
 
       const topRules = await fetchJSON('/api/rules/top?limit=10' + (qs ? '&' + qs : ''));
       renderTopRules(charts.rules, topRules.data);
@@ -714,6 +897,9 @@ const dashboardHTML = `<!doctype html>
       const recent = await fetchJSON('/api/runs/recent?limit=50' + (qs ? '&' + qs : ''));
       renderRunsTable(recent.data);
 
+      const regressions = await fetchJSON('/api/agent-versions/regressions?regressed_only=true&limit=3' + (qs ? '&' + qs : ''));
+      renderRegressionBanner(regressions.data || []);
+
       await loadChangeSnapshot();
       await loadRuleQualitySnapshot();
       if (els.effectivenessTab.classList.contains('active')) {
@@ -722,6 +908,9 @@ const dashboardHTML = `<!doctype html>
       if (els.ruleQualityTab.classList.contains('active')) {
         await loadRuleQualityList();
       }
+      if (els.compareTab.classList.contains('active')) {
+        await loadComparison();
+      }
     }
 
     async function loadChangeSnapshot() {
@@ -783,6 +972,23 @@ const dashboardHTML = `<!doctype html>
       renderRuleTrend(data.data || [], ruleId);
     }
 
+    async function loadComparison() {
+      const a = els.cmpA.value.trim();
+      const b = els.cmpB.value.trim();
+      if (!a || !b) return;
+      const params = new URLSearchParams(buildQuery());
+      const agent = els.cmpAgent.value.trim();
+      const category = els.cmpCategory.value.trim();
+      params.set('a', a);
+      params.set('b', b);
+      if (agent) params.set('agent_version', agent);
+      if (category) params.set('category', category);
+      params.set('min_runs', els.cmpMinRuns.value);
+      params.set('limit', els.cmpLimit.value);
+      const data = await fetchJSON('/api/compare/ruleset?' + params.toString());
+      renderComparison(data);
+    }
+
     function setActiveTab(name) {
       els.tabButtons.forEach(btn => {
         btn.classList.toggle('active', btn.dataset.tab === name);
@@ -790,12 +996,16 @@ const dashboardHTML = `<!doctype html>
       els.overviewTab.classList.toggle('active', name === 'overview');
       els.effectivenessTab.classList.toggle('active', name === 'effectiveness');
       els.ruleQualityTab.classList.toggle('active', name === 'rule-quality');
+      els.compareTab.classList.toggle('active', name === 'compare');
       if (name === 'effectiveness') {
         loadChangeList().catch(console.error);
       }
       if (name === 'rule-quality') {
         loadRuleQualityList().catch(console.error);
       }
+      if (name === 'compare') {
+        loadComparison().catch(console.error);
+      }
     }
 
     function initRange() {
@@ -808,6 +1018,7 @@ const dashboardHTML = `<!doctype html>
     els.refresh.addEventListener('click', () => loadAll().catch(console.error));
     els.ceRefreshBtn.addEventListener('click', () => loadChangeList().catch(console.error));
     els.rqRefreshBtn.addEventListener('click', () => loadRuleQualityList().catch(console.error));
+    els.cmpRefreshBtn.addEventListener('click', () => loadComparison().catch(console.error));
     els.tabButtons.forEach(btn => {
       btn.addEventListener('click', () => {
         setActiveTab(btn.dataset.tab);
@@ -0,0 +1,58 @@
+package main
+
+import (
+	"errors"
+	"fmt"
+	"net/http"
+	"strconv"
+	"time"
+
+	"github.com/gin-gonic/gin"
+)
+
+func handleFeedback(store Store) gin.HandlerFunc {
+	return func(c *gin.Context) {
+		var req feedbackRequest
+		if err := c.ShouldBindJSON(&req); err != nil {
+			c.JSON(http.StatusBadRequest, errResponse{OK: false, Error: "VALIDATION_ERROR", Message: err.Error()})
+			return
+		}
+		// An authenticated caller gives feedback as themselves; the body may
+		// repeat the name but not speak for someone else.
+		if p := callerOf(c); p != nil {
+			if req.Actor != "" && req.Actor != p.User {
+				errs := []fieldError{{Field: "actor", Code: "mismatch", Message: fmt.Sprintf("actor must be the authenticated user %s", p.User)}}
+				c.JSON(http.StatusForbidden, validationErrResponse{OK: false, Error: "FORBIDDEN", Message: validationMessage(errs), Details: errs})
+				return
+			}
+			req.Actor = p.User
+		}
+		req.Repos = visibleRepos(c)
+		if req.RunID != 0 {
+			auditTarget(c, strconv.FormatUint(req.RunID, 10))
+		} else {
+			auditTarget(c, req.Repo+"/"+req.CodeChangeID+"/"+req.AgentRunID)
+		}
+		if errs := validateFeedback(req, time.Now().UTC()); len(errs) > 0 {
+			c.JSON(http.StatusBadRequest, validationErrResponse{OK: false, Error: "VALIDATION_ERROR", Message: validationMessage(errs), Details: errs})
+			return
+		}
+
+		resp, err := store.RecordFeedback(req)
+		if err != nil {
+			var targetErr *feedbackTargetError
+			switch {
+			case errors.Is(err, errRunNotFound):
+				c.JSON(http.StatusNotFound, errResponse{OK: false, Error: "NOT_FOUND", Message: err.Error()})
+			case errors.As(err, &targetErr):
+				errs := []fieldError{targetErr.fieldError}
+				c.JSON(http.StatusBadRequest, validationErrResponse{OK: false, Error: "VALIDATION_ERROR", Message: validationMessage(errs), Details: errs})
+			default:
+				c.JSON(http.StatusInternalServerError, errResponse{OK: false, Error: "INTERNAL_ERROR", Message: err.Error()})
+			}
+			return
+		}
+
+		c.JSON(http.StatusOK, resp)
+	}
+}
@@ -0,0 +1,98 @@
+package main
+
+import (
+	"errors"
+	"net/http"
+	"testing"
+	"time"
+
+	"github.com/gin-gonic/gin"
+)
+
+func TestFeedbackErrorMapping(t *testing.T) {
+	store := newFakeStore()
+	base := newTestServer(t, store, authPolicy{}, alertPolicy{})
+	run := testRun("org/a", "c1", 1, time.Now().Add(-time.Hour), map[string]uint32{"R1": 1})
+	if status, body := doRequest(t, http.MethodPost, base+"/v1/metrics/agent-runs", run, nil); status != http.StatusOK {
+		t.Fatalf("seed run: %d %s", status, body)
+	}
+	feedback := func(agentRunID, ruleID, verdict string) feedbackRequest {
+		return feedbackRequest{Repo: "org/a", CodeChangeID: "c1", AgentRunID: agentRunID, RuleID: ruleID, Verdict: verdict, Actor: "alice"}
+	}
+
+	cases := []struct {
+		name   string
+		body   interface{}
+		err    error
+		status int
+		code   string
+		field  string
+	}{
+		{name: "accepted", body: feedback(run.AgentRunID, "R1", verdictAccepted), status: http.StatusOK},
+		{name: "malformed", body: "{not json", status: http.StatusBadRequest, code: "VALIDATION_ERROR"},
+		{name: "bad verdict", body: feedback(run.AgentRunID, "R1", "maybe"), status: http.StatusBadRequest, code: "VALIDATION_ERROR", field: "verdict"},
+		{name: "unknown run", body: feedback("00000000-0000-4000-8000-000000000099", "R1", verdictAccepted), status: http.StatusNotFound, code: "NOT_FOUND"},
+		{name: "unknown rule", body: feedback(run.AgentRunID, "R2", verdictAccepted), status: http.StatusBadRequest, code: "VALIDATION_ERROR", field: "rule_id"},
+		{name: "store error", body: feedback(run.AgentRunID, "R1", verdictAccepted), err: errors.New("database is down"), status: http.StatusInternalServerError, code: "INTERNAL_ERROR"},
+	}
+	for _, tc := range cases {
+		t.Run(tc.name, func(t *testing.T) {
+			store.setErr(tc.err)
+			defer store.setErr(nil)
+			status, body := doRequest(t, http.MethodPost, base+"/v1/feedback", tc.body, nil)
+			if status != tc.status {
+				t.Fatalf("status %d %s, want %d", status, body, tc.status)
+			}
+			if tc.code == "" {
+				return
+			}
+			var resp validationErrResponse
+			decodeJSON(t, body, &resp)
+			if resp.Error != tc.code {
+				t.Fatalf("error %q, want %q", resp.Error, tc.code)
+			}
+			if tc.field != "" && (len(resp.Details) == 0 || resp.Details[0].Field != tc.field) {
+				t.Fatalf("details %+v, want field %s", resp.Details, tc.field)
+			}
+		})
+	}
+	if len(store.feedback) != 1 {
+		t.Fatalf("stored %d verdicts, want 1", len(store.feedback))
+	}
+}
+
+func TestFeedbackActorFromPrincipal(t *testing.T) {
+	store := newFakeStore()
+	run := testRun("org/a", "c1", 1, time.Now().Add(-time.Hour), map[string]uint32{"R1": 1})
+	if _, _, err := store.CreateAgentRun(pendingAgentRun{Req: run, DiffLines: *run.DiffLines}); err != nil {
+		t.Fatal(err)
+	}
+	r := gin.New()
+	r.POST("/v1/feedback", func(c *gin.Context) {
+		c.Set(principalKey, &principal{User: "alice", Role: roleViewer})
+	}, handleFeedback(store))
+	base := startTestServer(t, r)
+
+	req := feedbackRequest{Repo: "org/a", CodeChangeID: "c1", AgentRunID: run.AgentRunID, RuleID: "R1", Verdict: verdictAccepted}
+	for _, actor := range []string{"", "alice"} {
+		req.Actor = actor
+		if status, body := doRequest(t, http.MethodPost, base+"/v1/feedback", req, nil); status != http.StatusOK {
+			t.Fatalf("actor %q: %d %s", actor, status, body)
+		}
+	}
+	req.Actor = "bob"
+	status, body := doRequest(t, http.MethodPost, base+"/v1/feedback", req, nil)
+	var resp validationErrResponse
+	decodeJSON(t, body, &resp)
+	if status != http.StatusForbidden || len(resp.Details) != 1 || resp.Details[0].Field != "actor" {
+		t.Fatalf("other actor: %d %s, want 403 on actor", status, body)
+	}
+	for _, fb := range store.feedback {
+		if fb.Actor != "alice" {
+			t.Fatalf("stored actor %q, want alice", fb.Actor)
+		}
+	}
+	if len(store.feedback) != 2 {
+		t.Fatalf("stored %d verdicts, want 2", len(store.feedback))
+	}
+}
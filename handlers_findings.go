@@ -0,0 +1,88 @@
+package main
+
+import (
+	"net/http"
+	"strconv"
+	"strings"
+
+	"github.com/gin-gonic/gin"
+)
+
+func handleFindings(store Store) gin.HandlerFunc {
+	return func(c *gin.Context) {
+		q := findingQuery{
+			Repo:         strings.TrimSpace(c.Query("repo")),
+			CodeChangeID: strings.TrimSpace(c.Query("code_change_id")),
+			RuleID:       strings.TrimSpace(c.Query("rule_id")),
+			Severity:     strings.ToLower(strings.TrimSpace(c.Query("severity"))),
+			Repos:        visibleRepos(c),
+			Limit:        parseLimit(c.Query("limit"), 200, 1, 1000),
+			Offset:       parseLimit(c.Query("offset"), 0, 0, 1000000),
+		}
+		if v := strings.TrimSpace(c.Query("run_id")); v != "" {
+			runID, err := strconv.ParseUint(v, 10, 64)
+			if err != nil || runID == 0 {
+				c.JSON(http.StatusBadRequest, errResponse{OK: false, Error: "VALIDATION_ERROR", Message: "run_id must be a positive integer"})
+				return
+			}
+			q.RunID = runID
+		}
+		if q.RunID == 0 && q.CodeChangeID == "" {
+			c.JSON(http.StatusBadRequest, errResponse{OK: false, Error: "VALIDATION_ERROR", Message: "run_id or code_change_id is required"})
+			return
+		}
+		if q.Severity != "" && !findingSeverities[q.Severity] {
+			c.JSON(http.StatusBadRequest, errResponse{OK: false, Error: "VALIDATION_ERROR", Message: "severity must be info|warning|error|critical"})
+			return
+		}
+
+		rows, total, err := store.ListFindings(q)
+		if err != nil {
+			c.JSON(http.StatusInternalServerError, errResponse{OK: false, Error: "INTERNAL_ERROR", Message: err.Error()})
+			return
+		}
+		if rows == nil {
+			rows = []findingRow{}
+		}
+
+		c.JSON(http.StatusOK, gin.H{
+			"ok":     true,
+			"data":   rows,
+			"total":  total,
+			"limit":  q.Limit,
+			"offset": q.Offset,
+		})
+	}
+}
+
+func handleFindingTimeline(store Store) gin.HandlerFunc {
+	return func(c *gin.Context) {
+		filter := queryFilter{
+			Repo:         strings.TrimSpace(c.Query("repo")),
+			CodeChangeID: strings.TrimSpace(c.Query("code_change_id")),
+			RuleID:       strings.TrimSpace(c.Query("rule_id")),
+			Repos:        visibleRepos(c),
+		}
+		if filter.Repo == "" || filter.CodeChangeID == "" {
+			c.JSON(http.StatusBadRequest, errResponse{OK: false, Error: "VALIDATION_ERROR", Message: "repo and code_change_id are required"})
+			return
+		}
+		limit := parseLimit(c.Query("limit"), 50, 1, 200)
+
+		runs, err := store.LoadFindingTimeline(filter, limit)
+		if err != nil {
+			c.JSON(http.StatusInternalServerError, errResponse{OK: false, Error: "INTERNAL_ERROR", Message: err.Error()})
+			return
+		}
+		if runs == nil {
+			runs = []findingTimelineRun{}
+		}
+
+		c.JSON(http.StatusOK, gin.H{
+			"ok":             true,
+			"repo":           filter.Repo,
+			"code_change_id": filter.CodeChangeID,
+			"data":           runs,
+		})
+	}
+}
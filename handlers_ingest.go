@@ -0,0 +1,153 @@
+package main
+
+import (
+	"bufio"
+	"encoding/json"
+	"errors"
+	"fmt"
+	"net/http"
+
+	"github.com/gin-gonic/gin"
+)
+
+const maxBatchRuns = 1000
+
+func handleAgentRun(store Store) gin.HandlerFunc {
+	return func(c *gin.Context) {
+		raw, err := c.GetRawData()
+		if err != nil {
+			c.JSON(http.StatusBadRequest, errResponse{OK: false, Error: "VALIDATION_ERROR", Message: err.Error()})
+			return
+		}
+
+		run, errs := parseAgentRun(raw)
+		if len(errs) > 0 {
+			c.JSON(http.StatusBadRequest, validationErrResponse{OK: false, Error: "VALIDATION_ERROR", Message: validationMessage(errs), Details: errs})
+			return
+		}
+		if errs := scopeErrors(ingestScope(c), run); len(errs) > 0 {
+			c.JSON(http.StatusForbidden, validationErrResponse{OK: false, Error: "FORBIDDEN", Message: validationMessage(errs), Details: errs})
+			return
+		}
+
+		runID, idempotent, err := store.CreateAgentRun(run)
+		if err != nil {
+			c.JSON(http.StatusInternalServerError, errResponse{OK: false, Error: "INTERNAL_ERROR", Message: err.Error()})
+			return
+		}
+
+		c.JSON(http.StatusOK, okResponse{OK: true, RunPrimaryID: runID, Idempotent: idempotent})
+	}
+}
+
+func handleAgentRunBatch(store Store) gin.HandlerFunc {
+	return func(c *gin.Context) {
+		var items []json.RawMessage
+		if err := c.ShouldBindJSON(&items); err != nil {
+			c.JSON(http.StatusBadRequest, errResponse{OK: false, Error: "VALIDATION_ERROR", Message: err.Error()})
+			return
+		}
+		if len(items) == 0 {
+			c.JSON(http.StatusBadRequest, errResponse{OK: false, Error: "VALIDATION_ERROR", Message: "batch must contain at least one run"})
+			return
+		}
+		if len(items) > maxBatchRuns {
+			c.JSON(http.StatusBadRequest, errResponse{OK: false, Error: "VALIDATION_ERROR", Message: fmt.Sprintf("batch must not exceed %d runs", maxBatchRuns)})
+			return
+		}
+
+		scope := ingestScope(c)
+		results := make([]batchItemResult, len(items))
+		pending := make([]pendingAgentRun, 0, len(items))
+		pendingIndex := make([]int, 0, len(items))
+		for i, raw := range items {
+			results[i].Index = i
+			run, errs := parseAgentRun(raw)
+			if len(errs) > 0 {
+				results[i].Error = "VALIDATION_ERROR"
+				results[i].Message = validationMessage(errs)
+				results[i].Details = errs
+				continue
+			}
+			if errs := scopeErrors(scope, run); len(errs) > 0 {
+				results[i].Error = "FORBIDDEN"
+				results[i].Message = validationMessage(errs)
+				results[i].Details = errs
+				continue
+			}
+			pending = append(pending, run)
+			pendingIndex = append(pendingIndex, i)
+		}
+
+		// An error here means none of the valid runs was stored, so the client
+		// can resend the whole batch; runs that failed on their own are
+		// reported per item below.
+		stored, err := store.CreateAgentRunBatch(pending)
+		if err != nil {
+			c.JSON(http.StatusInternalServerError, errResponse{OK: false, Error: "INTERNAL_ERROR", Message: err.Error()})
+			return
+		}
+
+		resp := batchResponse{OK: true, Results: results}
+		for j, res := range stored {
+			item := &results[pendingIndex[j]]
+			if res.Err != nil {
+				item.Error = "INTERNAL_ERROR"
+				item.Message = res.Err.Error()
+				continue
+			}
+			item.OK = true
+			item.RunPrimaryID = res.RunPrimaryID
+			item.Idempotent = res.Idempotent
+		}
+		for _, item := range results {
+			switch {
+			case !item.OK:
+				resp.Rejected++
+			case item.Idempotent:
+				resp.Idempotent++
+			default:
+				resp.Inserted++
+			}
+		}
+
+		c.JSON(http.StatusOK, resp)
+	}
+}
+
+func handleAgentRunStream(store Store) gin.HandlerFunc {
+	return func(c *gin.Context) {
+		chunkSize := parseLimit(c.Query("chunk_size"), defaultNDJSONChunkSize, 1, maxBatchRuns)
+
+		// Progress lines are written while the body is still being read. By
+		// default the HTTP/1 server discards the unread body on the first write,
+		// which would cut the upload short.
+		if err := http.NewResponseController(c.Writer).EnableFullDuplex(); err != nil {
+			c.JSON(http.StatusInternalServerError, errResponse{OK: false, Error: "INTERNAL_ERROR", Message: err.Error()})
+			return
+		}
+		c.Header("Content-Type", "application/x-ndjson")
+		c.Status(http.StatusOK)
+		enc := json.NewEncoder(c.Writer)
+		writeLine := func(v interface{}) {
+			_ = enc.Encode(v)
+			c.Writer.Flush()
+		}
+
+		tally, err := ingestNDJSON(store, c.Request.Body, chunkSize, ingestScope(c), func(progress ndjsonTally) {
+			writeLine(ndjsonProgressLine{Type: "progress", Lines: progress.Lines, Inserted: progress.Inserted, Idempotent: progress.Idempotent, Rejected: progress.Rejected})
+		})
+		if err != nil {
+			code := "INTERNAL_ERROR"
+			switch {
+			case errors.Is(err, bufio.ErrTooLong):
+				code = "VALIDATION_ERROR"
+			case errors.Is(err, errBodyDigestMismatch):
+				code = "UNAUTHORIZED"
+			}
+			writeLine(ndjsonErrorLine{Type: "error", Error: code, Message: err.Error(), Tally: tally})
+			return
+		}
+		writeLine(ndjsonDoneLine{Type: "done", ndjsonTally: tally})
+	}
+}
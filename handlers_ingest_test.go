@@ -0,0 +1,271 @@
+package main
+
+import (
+	"bufio"
+	"bytes"
+	"encoding/json"
+	"errors"
+	"io"
+	"net/http"
+	"strings"
+	"testing"
+	"time"
+)
+
+func TestIngestSingleRun(t *testing.T) {
+	store := newTestStore(t)
+	base := newTestServer(t, store, authPolicy{}, alertPolicy{})
+	run := testRun("org/a", "c1", 1, time.Now().Add(-time.Hour), map[string]uint32{"R1": 2})
+
+	status, body := doRequest(t, http.MethodPost, base+"/v1/metrics/agent-runs", run, nil)
+	if status != http.StatusOK {
+		t.Fatalf("first report: %d %s", status, body)
+	}
+	var first okResponse
+	decodeJSON(t, body, &first)
+	if !first.OK || first.Idempotent || first.RunPrimaryID == 0 {
+		t.Fatalf("first report: %+v", first)
+	}
+
+	status, body = doRequest(t, http.MethodPost, base+"/v1/metrics/agent-runs", run, nil)
+	var again okResponse
+	decodeJSON(t, body, &again)
+	if status != http.StatusOK || !again.Idempotent || again.RunPrimaryID != first.RunPrimaryID {
+		t.Fatalf("repeated report: %d %+v, want idempotent id %d", status, again, first.RunPrimaryID)
+	}
+
+	var rules, findings int64
+	store.db.Model(&CrAgentRunRule{}).Where("run_id = ?", first.RunPrimaryID).Count(&rules)
+	store.db.Model(&CrAgentRunFinding{}).Where("run_id = ?", first.RunPrimaryID).Count(&findings)
+	if rules != 1 || findings != 2 {
+		t.Fatalf("stored %d rule rows and %d findings, want 1 and 2", rules, findings)
+	}
+}
+
+func TestIngestSingleRunValidation(t *testing.T) {
+	store := newTestStore(t)
+	base := newTestServer(t, store, authPolicy{}, alertPolicy{})
+	run := testRun("org/a", "c1", 1, time.Now(), map[string]uint32{"R1": 2})
+	run.TriggeredTotalHits = 3
+	run.DiffLines = nil
+
+	status, body := doRequest(t, http.MethodPost, base+"/v1/metrics/agent-runs", run, nil)
+	if status != http.StatusBadRequest {
+		t.Fatalf("status %d %s, want 400", status, body)
+	}
+	var resp validationErrResponse
+	decodeJSON(t, body, &resp)
+	fields := map[string]bool{}
+	for _, e := range resp.Details {
+		fields[e.Field] = true
+	}
+	if resp.Error != "VALIDATION_ERROR" || !fields["triggered_total_hits"] || !fields["diff_lines"] {
+		t.Fatalf("unexpected errors: %+v", resp)
+	}
+
+	status, _ = doRequest(t, http.MethodPost, base+"/v1/metrics/agent-runs", "{not json", nil)
+	if status != http.StatusBadRequest {
+		t.Fatalf("malformed JSON: status %d, want 400", status)
+	}
+}
+
+func TestIngestBatch(t *testing.T) {
+	store := newTestStore(t)
+	base := newTestServer(t, store, authPolicy{}, alertPolicy{})
+	now := time.Now().Add(-time.Hour)
+	stored := testRun("org/a", "c1", 1, now, map[string]uint32{"R1": 1})
+	if status, body := doRequest(t, http.MethodPost, base+"/v1/metrics/agent-runs", stored, nil); status != http.StatusOK {
+		t.Fatalf("seed run: %d %s", status, body)
+	}
+
+	fresh := testRun("org/a", "c1", 2, now.Add(time.Minute), map[string]uint32{})
+	invalid := testRun("org/a", "c1", 3, now, map[string]uint32{"R1": 1})
+	invalid.AgentRunID = "not-a-uuid"
+	batch := []agentRunRequest{stored, fresh, invalid, fresh}
+
+	status, body := doRequest(t, http.MethodPost, base+"/v1/metrics/agent-runs:batch", batch, nil)
+	if status != http.StatusOK {
+		t.Fatalf("batch: %d %s", status, body)
+	}
+	var resp batchResponse
+	decodeJSON(t, body, &resp)
+	if resp.Inserted != 1 || resp.Idempotent != 2 || resp.Rejected != 1 {
+		t.Fatalf("tally: %+v", resp)
+	}
+	if r := resp.Results; !r[0].Idempotent || r[1].Idempotent || !r[1].OK || r[2].OK || r[2].Error != "VALIDATION_ERROR" ||
+		!r[3].Idempotent || r[3].RunPrimaryID != r[1].RunPrimaryID {
+		t.Fatalf("results: %+v", resp.Results)
+	}
+
+	status, _ = doRequest(t, http.MethodPost, base+"/v1/metrics/agent-runs:batch", "[]", nil)
+	if status != http.StatusBadRequest {
+		t.Fatalf("empty batch: status %d, want 400", status)
+	}
+}
+
+// TestIngestReportsRunsThatFailAlone fails the inserts of one change: its
+// runs are reported per item and the other runs are stored.
+func TestIngestReportsRunsThatFailAlone(t *testing.T) {
+	store := newTestStore(t)
+	base := newTestServer(t, store, authPolicy{}, alertPolicy{})
+	failFindingsOf(t, store, "bad")
+	now := time.Now().Add(-time.Hour)
+
+	batch := []agentRunRequest{
+		testRun("org/a", "c1", 1, now, map[string]uint32{"R1": 1}),
+		testRun("org/a", "bad", 2, now, map[string]uint32{"R1": 1}),
+	}
+	status, body := doRequest(t, http.MethodPost, base+"/v1/metrics/agent-runs:batch", batch, nil)
+	if status != http.StatusOK {
+		t.Fatalf("batch: %d %s", status, body)
+	}
+	var resp batchResponse
+	decodeJSON(t, body, &resp)
+	if resp.Inserted != 1 || resp.Rejected != 1 || !resp.Results[0].OK || resp.Results[1].OK || resp.Results[1].Error != "INTERNAL_ERROR" {
+		t.Fatalf("batch response: %+v", resp)
+	}
+
+	var stream strings.Builder
+	for i, change := range []string{"c2", "bad", "c3"} {
+		raw, _ := json.Marshal(testRun("org/a", change, 10+i, now, map[string]uint32{"R1": 1}))
+		stream.Write(raw)
+		stream.WriteString("\n")
+	}
+	status, raw := doRequest(t, http.MethodPost, base+"/v1/metrics/agent-runs:stream", stream.String(), nil)
+	if status != http.StatusOK {
+		t.Fatalf("stream: %d %s", status, raw)
+	}
+	lines := readNDJSON(t, raw)
+	done := lines[len(lines)-1]
+	if done["type"] != "done" || done["inserted"] != 2.0 || done["rejected"] != 1.0 {
+		t.Fatalf("done line: %v", done)
+	}
+	rejected := done["rejected_lines"].([]interface{})[0].(map[string]interface{})
+	if rejected["line"] != 2.0 || rejected["error"] != "INTERNAL_ERROR" {
+		t.Fatalf("rejected line: %v", rejected)
+	}
+
+	if n := countRows(t, store, &CrAgentRun{}); n != 3 {
+		t.Fatalf("%d runs stored, want 3", n)
+	}
+}
+
+// readNDJSON decodes every line of a stream response.
+func readNDJSON(t *testing.T, body []byte) []map[string]interface{} {
+	t.Helper()
+	var lines []map[string]interface{}
+	scanner := bufio.NewScanner(bytes.NewReader(body))
+	for scanner.Scan() {
+		var line map[string]interface{}
+		decodeJSON(t, scanner.Bytes(), &line)
+		lines = append(lines, line)
+	}
+	return lines
+}
+
+func TestIngestStream(t *testing.T) {
+	store := newTestStore(t)
+	base := newTestServer(t, store, authPolicy{}, alertPolicy{})
+	now := time.Now().Add(-time.Hour)
+
+	var body strings.Builder
+	for i := 1; i <= 3; i++ {
+		raw, _ := json.Marshal(testRun("org/a", "c1", i, now.Add(time.Duration(i)*time.Minute), map[string]uint32{"R1": 1}))
+		body.Write(raw)
+		body.WriteString("\n")
+	}
+	body.WriteString("\n{\"repo\":\"org/a\"}\n")
+
+	status, raw := doRequest(t, http.MethodPost, base+"/v1/metrics/agent-runs:stream", body.String(), nil)
+	if status != http.StatusOK {
+		t.Fatalf("stream: %d %s", status, raw)
+	}
+	lines := readNDJSON(t, raw)
+	done := lines[len(lines)-1]
+	if done["type"] != "done" || done["lines"] != 5.0 || done["inserted"] != 3.0 || done["rejected"] != 1.0 {
+		t.Fatalf("done line: %v", done)
+	}
+	rejected := done["rejected_lines"].([]interface{})
+	if len(rejected) != 1 || rejected[0].(map[string]interface{})["line"] != 5.0 {
+		t.Fatalf("rejected lines: %v", rejected)
+	}
+
+	var summary CodeChangeSummary
+	if err := store.db.Where("repo = ? AND code_change_id = ?", "org/a", "c1").First(&summary).Error; err != nil {
+		t.Fatal(err)
+	}
+	if summary.RunCount != 3 {
+		t.Fatalf("summary run_count %d, want 3", summary.RunCount)
+	}
+}
+
+// TestIngestStreamManyChunks streams more lines than fit in one chunk. The
+// progress lines are written while the request body is still being read,
+// which must not cut the upload short.
+func TestIngestStreamManyChunks(t *testing.T) {
+	store := newTestStore(t)
+	base := newTestServer(t, store, authPolicy{}, alertPolicy{})
+	now := time.Now().Add(-time.Hour)
+
+	const total = 150
+	pr, pw := io.Pipe()
+	go func() {
+		for i := 1; i <= total; i++ {
+			raw, _ := json.Marshal(testRun("org/a", "c1", i, now.Add(time.Duration(i)*time.Second), map[string]uint32{"R1": 8}))
+			if _, err := pw.Write(append(raw, '\n')); err != nil {
+				pw.CloseWithError(err)
+				return
+			}
+		}
+		pw.Close()
+	}()
+
+	status, raw := doRequest(t, http.MethodPost, base+"/v1/metrics/agent-runs:stream?chunk_size=10", pr, nil)
+	if status != http.StatusOK {
+		t.Fatalf("stream: %d %s", status, raw)
+	}
+	lines := readNDJSON(t, raw)
+	done := lines[len(lines)-1]
+	if done["type"] != "done" || done["lines"] != float64(total) || done["inserted"] != float64(total) {
+		t.Fatalf("last line: %v", done)
+	}
+	if progress := len(lines) - 1; progress < total/10 {
+		t.Fatalf("%d progress lines, want at least %d", progress, total/10)
+	}
+	var runs int64
+	store.db.Model(&CrAgentRun{}).Count(&runs)
+	if runs != total {
+		t.Fatalf("stored %d runs, want %d", runs, total)
+	}
+}
+
+func TestIngestErrorsWithFakeStore(t *testing.T) {
+	store := newFakeStore()
+	base := newTestServer(t, store, authPolicy{}, alertPolicy{})
+	run := testRun("org/a", "c1", 1, time.Now(), map[string]uint32{"R1": 1})
+
+	invalid := run
+	invalid.Repo = ""
+	if status, body := doRequest(t, http.MethodPost, base+"/v1/metrics/agent-runs", invalid, nil); status != http.StatusBadRequest {
+		t.Fatalf("invalid run: %d %s, want 400", status, body)
+	}
+	if n := store.runCount(); n != 0 {
+		t.Fatalf("invalid run reached the store: %d runs", n)
+	}
+
+	store.setErr(errors.New("database is down"))
+	status, body := doRequest(t, http.MethodPost, base+"/v1/metrics/agent-runs", run, nil)
+	var resp errResponse
+	decodeJSON(t, body, &resp)
+	if status != http.StatusInternalServerError || resp.Error != "INTERNAL_ERROR" {
+		t.Fatalf("store error: %d %+v, want 500 INTERNAL_ERROR", status, resp)
+	}
+	if status, body := doRequest(t, http.MethodPost, base+"/v1/metrics/agent-runs:batch", []agentRunRequest{run}, nil); status != http.StatusInternalServerError {
+		t.Fatalf("batch store error: %d %s, want 500", status, body)
+	}
+
+	store.setErr(nil)
+	if status, body := doRequest(t, http.MethodPost, base+"/v1/metrics/agent-runs", run, nil); status != http.StatusOK {
+		t.Fatalf("recovered store: %d %s", status, body)
+	}
+}
@@ -5,10 +5,9 @@ import (
 	"strings"
 
 	"github.com/gin-gonic/gin"
-	"gorm.io/gorm"
 )
 
-func handleSummary(db *gorm.DB) gin.HandlerFunc {
+func handleSummary(store Store) gin.HandlerFunc {
 	return func(c *gin.Context) {
 		from, to, err := parseTimeRange(c)
 		if err != nil {
@@ -16,32 +15,7 @@ func handleSummary(db *gorm.DB) gin.HandlerFunc {
 			return
 		}
 
-		filtered := applyRunFilters(db.Model(&CrAgentRun{}), c)
-		filtered = filtered.Where("reported_at BETWEEN ? AND ?", from, to)
-
-		var totals struct {
-			TotalRuns      uint64
-			TotalHits      uint64
-			TotalDiffLines uint64
-		}
-		if err := filtered.Select("COUNT(*) AS total_runs, COALESCE(SUM(triggered_total_hits),0) AS total_hits, COALESCE(SUM(diff_lines),0) AS total_diff_lines").Scan(&totals).Error; err != nil {
-			c.JSON(http.StatusInternalServerError, errResponse{OK: false, Error: "INTERNAL_ERROR", Message: err.Error()})
-			return
-		}
-
-		var activeRepos uint64
-		if err := filtered.Select("COUNT(DISTINCT repo)").Scan(&activeRepos).Error; err != nil {
-			c.JSON(http.StatusInternalServerError, errResponse{OK: false, Error: "INTERNAL_ERROR", Message: err.Error()})
-			return
-		}
-
-		topRuleset, err := loadTopVersions(filtered, "ruleset_version")
-		if err != nil {
-			c.JSON(http.StatusInternalServerError, errResponse{OK: false, Error: "INTERNAL_ERROR", Message: err.Error()})
-			return
-		}
-
-		topAgent, err := loadTopVersions(filtered, "agent_version")
+		totals, err := store.LoadRunTotals(from, to, parseQueryFilter(c))
 		if err != nil {
 			c.JSON(http.StatusInternalServerError, errResponse{OK: false, Error: "INTERNAL_ERROR", Message: err.Error()})
 			return
@@ -60,14 +34,14 @@ func handleSummary(db *gorm.DB) gin.HandlerFunc {
 			TotalHits:         totals.TotalHits,
 			TotalDiffLines:    totals.TotalDiffLines,
 			AvgHitDensity:     avgDensity,
-			ActiveRepos:       activeRepos,
-			TopRulesetVersion: topRuleset,
-			TopAgentVersion:   topAgent,
+			ActiveRepos:       totals.ActiveRepos,
+			TopRulesetVersion: totals.TopRulesetVersions,
+			TopAgentVersion:   totals.TopAgentVersions,
 		})
 	}
 }
 
-func handleTimeseries(db *gorm.DB) gin.HandlerFunc {
+func handleTimeseries(store Store) gin.HandlerFunc {
 	return func(c *gin.Context) {
 		from, to, err := parseTimeRange(c)
 		if err != nil {
@@ -93,25 +67,8 @@ func handleTimeseries(db *gorm.DB) gin.HandlerFunc {
 			return
 		}
 
-		bucketExpr := "DATE(reported_at)"
-		if bucket == "hour" {
-			bucketExpr = "DATE_FORMAT(reported_at, '%Y-%m-%d %H:00:00')"
-		}
-
-		valueExpr := "COUNT(*)"
-		switch metric {
-		case "hits":
-			valueExpr = "COALESCE(SUM(triggered_total_hits),0)"
-		case "density":
-			valueExpr = "COALESCE(SUM(triggered_total_hits) / NULLIF(SUM(diff_lines),0), 0)"
-		}
-
-		var rows []timeSeriesPoint
-		raw := "SELECT " + bucketExpr + " AS bucket, " + valueExpr + " AS value FROM cr_agent_run WHERE reported_at BETWEEN ? AND ?"
-		raw = applyRunFilterSQL(raw, c)
-		raw += " GROUP BY bucket ORDER BY bucket ASC"
-		args := append([]interface{}{from, to}, buildRunFilterArgs(c)...)
-		if err := db.Raw(raw, args...).Scan(&rows).Error; err != nil {
+		rows, err := store.LoadTimeseries(from, to, parseQueryFilter(c), metric, bucket)
+		if err != nil {
 			c.JSON(http.StatusInternalServerError, errResponse{OK: false, Error: "INTERNAL_ERROR", Message: err.Error()})
 			return
 		}
@@ -127,7 +84,7 @@ func handleTimeseries(db *gorm.DB) gin.HandlerFunc {
 	}
 }
 
-func handleRecentRuns(db *gorm.DB) gin.HandlerFunc {
+func handleRecentRuns(store Store) gin.HandlerFunc {
 	return func(c *gin.Context) {
 		from, to, err := parseTimeRange(c)
 		if err != nil {
@@ -136,12 +93,8 @@ func handleRecentRuns(db *gorm.DB) gin.HandlerFunc {
 		}
 
 		limit := parseLimit(c.Query("limit"), 50, 1, 200)
-		filtered := applyRunFilters(db.Model(&CrAgentRun{}), c).
-			Where("reported_at BETWEEN ? AND ?", from, to)
-
-		var rows []recentRunRow
-		if err := filtered.Select("id, repo, code_change_id, agent_run_id, reported_at, diff_lines, triggered_total_hits, agent_version, ruleset_version").
-			Order("reported_at DESC").Limit(limit).Find(&rows).Error; err != nil {
+		rows, err := store.ListRecentRuns(from, to, parseQueryFilter(c), limit)
+		if err != nil {
 			c.JSON(http.StatusInternalServerError, errResponse{OK: false, Error: "INTERNAL_ERROR", Message: err.Error()})
 			return
 		}
@@ -161,7 +114,7 @@ func handleRecentRuns(db *gorm.DB) gin.HandlerFunc {
 	}
 }
 
-func handleTopRules(db *gorm.DB) gin.HandlerFunc {
+func handleTopRules(store Store) gin.HandlerFunc {
 	return func(c *gin.Context) {
 		from, to, err := parseTimeRange(c)
 		if err != nil {
@@ -170,20 +123,31 @@ func handleTopRules(db *gorm.DB) gin.HandlerFunc {
 		}
 
 		limit := parseLimit(c.Query("limit"), 10, 1, 50)
-		repo := strings.TrimSpace(c.Query("repo"))
-
-		query := db.Table("cr_agent_run_rule").
-			Select("rule_id, COALESCE(SUM(hit_count),0) AS total_hits, COUNT(*) AS run_count").
-			Where("reported_at BETWEEN ? AND ?", from, to)
-		if repo != "" {
-			query = query.Where("repo = ?", repo)
+		filter := queryFilter{
+			Repo:     strings.TrimSpace(c.Query("repo")),
+			Category: strings.TrimSpace(c.Query("category")),
+			Owner:    strings.TrimSpace(c.Query("owner")),
+			Severity: strings.ToLower(strings.TrimSpace(c.Query("severity"))),
+			Repos:    visibleRepos(c),
 		}
 
-		var rows []topRuleRow
-		if err := query.Group("rule_id").Order("total_hits DESC").Limit(limit).Scan(&rows).Error; err != nil {
+		rows, err := store.ListTopRules(from, to, filter, limit)
+		if err != nil {
 			c.JSON(http.StatusInternalServerError, errResponse{OK: false, Error: "INTERNAL_ERROR", Message: err.Error()})
 			return
 		}
+		ruleIDs := make([]string, 0, len(rows))
+		for _, row := range rows {
+			ruleIDs = append(ruleIDs, row.RuleID)
+		}
+		catalog, err := store.LookupRuleCatalog(ruleIDs)
+		if err != nil {
+			c.JSON(http.StatusInternalServerError, errResponse{OK: false, Error: "INTERNAL_ERROR", Message: err.Error()})
+			return
+		}
+		for i := range rows {
+			rows[i].Catalog = catalog[rows[i].RuleID]
+		}
 
 		c.JSON(http.StatusOK, gin.H{
 			"ok":   true,
@@ -0,0 +1,97 @@
+package main
+
+import (
+	"net/http"
+	"strings"
+
+	"github.com/gin-gonic/gin"
+)
+
+func handleRuleCatalogUpsert(store Store) gin.HandlerFunc {
+	return func(c *gin.Context) {
+		var req ruleCatalogFile
+		if err := c.ShouldBindJSON(&req); err != nil {
+			c.JSON(http.StatusBadRequest, errResponse{OK: false, Error: "VALIDATION_ERROR", Message: err.Error()})
+			return
+		}
+		ruleIDs := make([]string, 0, len(req.Rules))
+		for _, rule := range req.Rules {
+			ruleIDs = append(ruleIDs, rule.RuleID)
+		}
+		auditTarget(c, strings.Join(ruleIDs, ","))
+		if errs := validateRuleCatalog(req.Rules); len(errs) > 0 {
+			c.JSON(http.StatusBadRequest, validationErrResponse{OK: false, Error: "VALIDATION_ERROR", Message: validationMessage(errs), Details: errs})
+			return
+		}
+
+		result, err := store.UpsertRuleCatalog(req.Rules)
+		if err != nil {
+			c.JSON(http.StatusInternalServerError, errResponse{OK: false, Error: "INTERNAL_ERROR", Message: err.Error()})
+			return
+		}
+
+		c.JSON(http.StatusOK, gin.H{
+			"ok":      true,
+			"created": result.Created,
+			"updated": result.Updated,
+		})
+	}
+}
+
+func handleRuleCatalogDelete(store Store) gin.HandlerFunc {
+	return func(c *gin.Context) {
+		ruleID := strings.TrimSpace(c.Query("rule_id"))
+		auditTarget(c, ruleID)
+		if ruleID == "" {
+			c.JSON(http.StatusBadRequest, errResponse{OK: false, Error: "VALIDATION_ERROR", Message: "rule_id is required"})
+			return
+		}
+
+		deleted, err := store.DeleteRuleCatalog(ruleID)
+		if err != nil {
+			c.JSON(http.StatusInternalServerError, errResponse{OK: false, Error: "INTERNAL_ERROR", Message: err.Error()})
+			return
+		}
+		if !deleted {
+			c.JSON(http.StatusNotFound, errResponse{OK: false, Error: "NOT_FOUND", Message: "rule_id is not in the catalog"})
+			return
+		}
+
+		c.JSON(http.StatusOK, gin.H{"ok": true, "rule_id": ruleID})
+	}
+}
+
+func handleRuleCatalogList(store Store) gin.HandlerFunc {
+	return func(c *gin.Context) {
+		q := ruleCatalogQuery{
+			RuleID:         strings.TrimSpace(c.Query("rule_id")),
+			Category:       strings.TrimSpace(c.Query("category")),
+			Owner:          strings.TrimSpace(c.Query("owner")),
+			Severity:       strings.ToLower(strings.TrimSpace(c.Query("severity"))),
+			RulesetVersion: strings.TrimSpace(c.Query("ruleset_version")),
+			Limit:          parseLimit(c.Query("limit"), 200, 1, 1000),
+			Offset:         parseLimit(c.Query("offset"), 0, 0, 1000000),
+		}
+		if q.Severity != "" && !findingSeverities[q.Severity] {
+			c.JSON(http.StatusBadRequest, errResponse{OK: false, Error: "VALIDATION_ERROR", Message: "severity must be info|warning|error|critical"})
+			return
+		}
+
+		rows, total, err := store.ListRuleCatalog(q)
+		if err != nil {
+			c.JSON(http.StatusInternalServerError, errResponse{OK: false, Error: "INTERNAL_ERROR", Message: err.Error()})
+			return
+		}
+		if rows == nil {
+			rows = []ruleCatalogEntry{}
+		}
+
+		c.JSON(http.StatusOK, gin.H{
+			"ok":     true,
+			"data":   rows,
+			"total":  total,
+			"limit":  q.Limit,
+			"offset": q.Offset,
+		})
+	}
+}
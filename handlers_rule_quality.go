@@ -5,10 +5,9 @@ import (
 	"strings"
 
 	"github.com/gin-gonic/gin"
-	"gorm.io/gorm"
 )
 
-func handleRuleQualitySummary(db *gorm.DB) gin.HandlerFunc {
+func handleRuleQualitySummary(store Store) gin.HandlerFunc {
 	return func(c *gin.Context) {
 		from, to, err := parseTimeRange(c)
 		if err != nil {
@@ -19,32 +18,15 @@ func handleRuleQualitySummary(db *gorm.DB) gin.HandlerFunc {
 		minRuns := parseLimit(c.Query("min_runs"), 1, 1, 1000)
 		minChanges := parseLimit(c.Query("min_changes"), 2, 1, 1000)
 
-		totalRuns, err := loadTotalRuns(db, from, to, c)
+		filter := parseQueryFilter(c)
+		totalRuns, err := store.CountRuns(from, to, filter)
 		if err != nil {
 			c.JSON(http.StatusInternalServerError, errResponse{OK: false, Error: "INTERNAL_ERROR", Message: err.Error()})
 			return
 		}
 
-		baseSQL, args := buildRuleQualityBaseSQL(c, from, to)
-		summarySQL := "SELECT COUNT(*) AS total_rules, " +
-			"COALESCE(AVG(fix_rate),0) AS avg_fix_rate, " +
-			"COALESCE(AVG(disappear_rate),0) AS avg_disappear_rate, " +
-			"COALESCE(AVG(run_count),0) AS avg_run_count, " +
-			"COALESCE(SUM(total_hits),0) AS total_hit_count, " +
-			"COALESCE(SUM(run_count),0) AS total_rule_run_count " +
-			"FROM (" + baseSQL + ") q WHERE run_count >= ? AND change_count >= ?"
-
-		args = append(args, minRuns, minChanges)
-
-		var summary struct {
-			TotalRules        uint64
-			AvgFixRate        float64
-			AvgDisappearRate  float64
-			AvgRunCount       float64
-			TotalHitCount     uint64
-			TotalRuleRunCount uint64
-		}
-		if err := db.Raw(summarySQL, args...).Scan(&summary).Error; err != nil {
+		summary, err := store.LoadRuleQualityStats(from, to, filter, minRuns, minChanges)
+		if err != nil {
 			c.JSON(http.StatusInternalServerError, errResponse{OK: false, Error: "INTERNAL_ERROR", Message: err.Error()})
 			return
 		}
@@ -55,22 +37,27 @@ func handleRuleQualitySummary(db *gorm.DB) gin.HandlerFunc {
 		}
 
 		c.JSON(http.StatusOK, ruleQualitySummary{
-			OK:                true,
-			From:              from,
-			To:                to,
-			TotalRules:        summary.TotalRules,
-			AvgFixRate:        summary.AvgFixRate,
-			AvgDisappearRate:  summary.AvgDisappearRate,
-			AvgHitRate:        avgHitRate,
-			TotalRunsInRange:  totalRuns,
-			TotalActiveRules:  summary.TotalRules,
-			TotalHitCount:     summary.TotalHitCount,
-			TotalRuleRunCount: summary.TotalRuleRunCount,
+			OK:                 true,
+			From:               from,
+			To:                 to,
+			TotalRules:         summary.TotalRules,
+			AvgFixRate:         summary.AvgFixRate,
+			AvgDisappearRate:   summary.AvgDisappearRate,
+			AvgHitRate:         avgHitRate,
+			TotalRunsInRange:   totalRuns,
+			TotalActiveRules:   summary.TotalRules,
+			TotalHitCount:      summary.TotalHitCount,
+			TotalRuleRunCount:  summary.TotalRuleRunCount,
+			TotalFixedFindings: summary.TotalFixedFindings,
+
+			AvgAcceptanceRate:    summary.AvgAcceptanceRate,
+			AvgFalsePositiveRate: summary.AvgFalsePositiveRate,
+			TotalFeedback:        summary.TotalFeedback,
 		})
 	}
 }
 
-func handleRuleQualityTop(db *gorm.DB) gin.HandlerFunc {
+func handleRuleQualityTop(store Store) gin.HandlerFunc {
 	return func(c *gin.Context) {
 		from, to, err := parseTimeRange(c)
 		if err != nil {
@@ -86,30 +73,30 @@ func handleRuleQualityTop(db *gorm.DB) gin.HandlerFunc {
 			direction = "high"
 		}
 
-		order := "fix_rate DESC"
-		if direction == "low" {
-			order = "fix_rate ASC"
-		}
-
-		baseSQL, args := buildRuleQualityBaseSQL(c, from, to)
-		topSQL := "SELECT rule_id, total_hits, run_count, last_seen_at, change_count, fix_rate, disappear_rate, avg_drop FROM (" + baseSQL + ") q " +
-			"WHERE run_count >= ? AND change_count >= ? ORDER BY " + order + " LIMIT ?"
-
-		args = append(args, minRuns, minChanges, limit)
-
-		var rows []ruleQualityAggRow
-		if err := db.Raw(topSQL, args...).Scan(&rows).Error; err != nil {
+		filter := parseQueryFilter(c)
+		rows, err := store.ListRuleQuality(from, to, filter, ruleQualityListQuery{
+			MinRuns:    minRuns,
+			MinChanges: minChanges,
+			Sort:       "fix_rate",
+			Desc:       direction == "high",
+			Limit:      limit,
+		})
+		if err != nil {
 			c.JSON(http.StatusInternalServerError, errResponse{OK: false, Error: "INTERNAL_ERROR", Message: err.Error()})
 			return
 		}
 
-		totalRuns, err := loadTotalRuns(db, from, to, c)
+		totalRuns, err := store.CountRuns(from, to, filter)
 		if err != nil {
 			c.JSON(http.StatusInternalServerError, errResponse{OK: false, Error: "INTERNAL_ERROR", Message: err.Error()})
 			return
 		}
 
 		resp := buildRuleQualityRows(rows, totalRuns)
+		if err := attachRuleQualityCatalog(store, resp); err != nil {
+			c.JSON(http.StatusInternalServerError, errResponse{OK: false, Error: "INTERNAL_ERROR", Message: err.Error()})
+			return
+		}
 		c.JSON(http.StatusOK, gin.H{
 			"ok":   true,
 			"from": from,
@@ -119,7 +106,7 @@ func handleRuleQualityTop(db *gorm.DB) gin.HandlerFunc {
 	}
 }
 
-func handleRuleQualityList(db *gorm.DB) gin.HandlerFunc {
+func handleRuleQualityList(store Store) gin.HandlerFunc {
 	return func(c *gin.Context) {
 		from, to, err := parseTimeRange(c)
 		if err != nil {
@@ -134,7 +121,9 @@ func handleRuleQualityList(db *gorm.DB) gin.HandlerFunc {
 
 		sort := strings.ToLower(strings.TrimSpace(c.Query("sort")))
 		switch sort {
-		case "fix_rate", "disappear_rate", "total_hits", "run_count", "last_seen_at", "avg_drop", "change_count":
+		case "fix_rate", "disappear_rate", "total_hits", "run_count", "last_seen_at", "avg_drop", "change_count",
+			"fixed_findings", "introduced_findings", "persisted_findings",
+			"feedback_count", "acceptance_rate", "false_positive_rate":
 		default:
 			sort = "fix_rate"
 		}
@@ -144,30 +133,31 @@ func handleRuleQualityList(db *gorm.DB) gin.HandlerFunc {
 			order = "desc"
 		}
 
-		orderExpr := sort + " " + strings.ToUpper(order)
-		if sort == "fix_rate" || sort == "disappear_rate" {
-			orderExpr = sort + " IS NULL, " + sort + " " + strings.ToUpper(order)
-		}
-
-		baseSQL, args := buildRuleQualityBaseSQL(c, from, to)
-		listSQL := "SELECT rule_id, total_hits, run_count, last_seen_at, change_count, fix_rate, disappear_rate, avg_drop FROM (" + baseSQL + ") q " +
-			"WHERE run_count >= ? AND change_count >= ? ORDER BY " + orderExpr + " LIMIT ? OFFSET ?"
-
-		args = append(args, minRuns, minChanges, limit, offset)
-
-		var rows []ruleQualityAggRow
-		if err := db.Raw(listSQL, args...).Scan(&rows).Error; err != nil {
+		filter := parseQueryFilter(c)
+		rows, err := store.ListRuleQuality(from, to, filter, ruleQualityListQuery{
+			MinRuns:    minRuns,
+			MinChanges: minChanges,
+			Sort:       sort,
+			Desc:       order == "desc",
+			Limit:      limit,
+			Offset:     offset,
+		})
+		if err != nil {
 			c.JSON(http.StatusInternalServerError, errResponse{OK: false, Error: "INTERNAL_ERROR", Message: err.Error()})
 			return
 		}
 
-		totalRuns, err := loadTotalRuns(db, from, to, c)
+		totalRuns, err := store.CountRuns(from, to, filter)
 		if err != nil {
 			c.JSON(http.StatusInternalServerError, errResponse{OK: false, Error: "INTERNAL_ERROR", Message: err.Error()})
 			return
 		}
 
 		resp := buildRuleQualityRows(rows, totalRuns)
+		if err := attachRuleQualityCatalog(store, resp); err != nil {
+			c.JSON(http.StatusInternalServerError, errResponse{OK: false, Error: "INTERNAL_ERROR", Message: err.Error()})
+			return
+		}
 		c.JSON(http.StatusOK, gin.H{
 			"ok":     true,
 			"from":   from,
@@ -179,7 +169,7 @@ func handleRuleQualityList(db *gorm.DB) gin.HandlerFunc {
 	}
 }
 
-func handleRuleQualityTrend(db *gorm.DB) gin.HandlerFunc {
+func handleRuleQualityTrend(store Store) gin.HandlerFunc {
 	return func(c *gin.Context) {
 		from, to, err := parseTimeRange(c)
 		if err != nil {
@@ -202,34 +192,43 @@ func handleRuleQualityTrend(db *gorm.DB) gin.HandlerFunc {
 			return
 		}
 
-		bucketExpr := "DATE(reported_at)"
-		if bucket == "hour" {
-			bucketExpr = "DATE_FORMAT(reported_at, '%Y-%m-%d %H:00:00')"
-		}
-
-		filterSQL, args := ruleFilterSQL("r", c)
-		trendSQL := "SELECT " + bucketExpr + " AS bucket, COALESCE(SUM(hit_count),0) AS value FROM cr_agent_run_rule r " +
-			"WHERE r.reported_at BETWEEN ? AND ? AND r.rule_id = ?"
-		if filterSQL != "" {
-			trendSQL += filterSQL
+		filter := parseQueryFilter(c)
+		filter.RuleID = ruleID
+		rows, err := store.LoadRuleQualityTrend(from, to, filter, bucket)
+		if err != nil {
+			c.JSON(http.StatusInternalServerError, errResponse{OK: false, Error: "INTERNAL_ERROR", Message: err.Error()})
+			return
 		}
-		trendSQL += " GROUP BY bucket ORDER BY bucket ASC"
-
-		allArgs := []interface{}{from, to, ruleID}
-		allArgs = append(allArgs, args...)
 
-		var rows []ruleQualityTrendPoint
-		if err := db.Raw(trendSQL, allArgs...).Scan(&rows).Error; err != nil {
+		catalog, err := store.LookupRuleCatalog([]string{ruleID})
+		if err != nil {
 			c.JSON(http.StatusInternalServerError, errResponse{OK: false, Error: "INTERNAL_ERROR", Message: err.Error()})
 			return
 		}
 
 		c.JSON(http.StatusOK, gin.H{
-			"ok":     true,
-			"from":   from,
-			"to":     to,
-			"bucket": bucket,
-			"data":   rows,
+			"ok":      true,
+			"from":    from,
+			"to":      to,
+			"bucket":  bucket,
+			"data":    rows,
+			"catalog": catalog[ruleID],
 		})
 	}
 }
+
+// attachRuleQualityCatalog fills the catalog metadata of rows.
+func attachRuleQualityCatalog(store Store, rows []ruleQualityRow) error {
+	ruleIDs := make([]string, 0, len(rows))
+	for _, row := range rows {
+		ruleIDs = append(ruleIDs, row.RuleID)
+	}
+	catalog, err := store.LookupRuleCatalog(ruleIDs)
+	if err != nil {
+		return err
+	}
+	for i := range rows {
+		rows[i].Catalog = catalog[rows[i].RuleID]
+	}
+	return nil
+}
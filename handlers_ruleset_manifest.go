@@ -0,0 +1,133 @@
+package main
+
+import (
+	"errors"
+	"net/http"
+	"strings"
+
+	"github.com/gin-gonic/gin"
+)
+
+func handleRulesetManifestUpload(store Store) gin.HandlerFunc {
+	return func(c *gin.Context) {
+		var req rulesetManifestRequest
+		if err := c.ShouldBindJSON(&req); err != nil {
+			c.JSON(http.StatusBadRequest, errResponse{OK: false, Error: "VALIDATION_ERROR", Message: err.Error()})
+			return
+		}
+		auditTarget(c, req.RulesetVersion)
+		if errs := validateRulesetManifest(req); len(errs) > 0 {
+			c.JSON(http.StatusBadRequest, validationErrResponse{OK: false, Error: "VALIDATION_ERROR", Message: validationMessage(errs), Details: errs})
+			return
+		}
+
+		replaced, err := store.ReplaceRulesetManifest(req)
+		if err != nil {
+			c.JSON(http.StatusInternalServerError, errResponse{OK: false, Error: "INTERNAL_ERROR", Message: err.Error()})
+			return
+		}
+
+		c.JSON(http.StatusOK, gin.H{
+			"ok":              true,
+			"ruleset_version": req.RulesetVersion,
+			"rule_count":      len(req.Rules),
+			"replaced":        replaced,
+		})
+	}
+}
+
+func handleRulesetManifests(store Store) gin.HandlerFunc {
+	return func(c *gin.Context) {
+		manifests, err := store.ListRulesetManifests()
+		if err != nil {
+			c.JSON(http.StatusInternalServerError, errResponse{OK: false, Error: "INTERNAL_ERROR", Message: err.Error()})
+			return
+		}
+		if manifests == nil {
+			manifests = []rulesetManifestSummary{}
+		}
+
+		c.JSON(http.StatusOK, gin.H{"ok": true, "data": manifests})
+	}
+}
+
+func handleRulesetManifestRules(store Store) gin.HandlerFunc {
+	return func(c *gin.Context) {
+		version := strings.TrimSpace(c.Query("ruleset_version"))
+		if version == "" {
+			c.JSON(http.StatusBadRequest, errResponse{OK: false, Error: "VALIDATION_ERROR", Message: "ruleset_version is required"})
+			return
+		}
+
+		rules, err := store.LoadRulesetManifest(version)
+		if err != nil {
+			if errors.Is(err, errManifestNotFound) {
+				c.JSON(http.StatusNotFound, errResponse{OK: false, Error: "NOT_FOUND", Message: err.Error()})
+				return
+			}
+			c.JSON(http.StatusInternalServerError, errResponse{OK: false, Error: "INTERNAL_ERROR", Message: err.Error()})
+			return
+		}
+
+		c.JSON(http.StatusOK, gin.H{
+			"ok":              true,
+			"ruleset_version": version,
+			"data":            rules,
+		})
+	}
+}
+
+func handleRulesetDiff(store Store) gin.HandlerFunc {
+	return func(c *gin.Context) {
+		from, to, err := parseTimeRange(c)
+		if err != nil {
+			c.JSON(http.StatusBadRequest, errResponse{OK: false, Error: "VALIDATION_ERROR", Message: err.Error()})
+			return
+		}
+		base := strings.TrimSpace(c.Query("base"))
+		target := strings.TrimSpace(c.Query("target"))
+		if base == "" || target == "" {
+			c.JSON(http.StatusBadRequest, errResponse{OK: false, Error: "VALIDATION_ERROR", Message: "base and target are required"})
+			return
+		}
+		includeUnchanged := c.Query("include_unchanged") == "true"
+		filter := queryFilter{Repo: strings.TrimSpace(c.Query("repo")), Repos: visibleRepos(c)}
+
+		diff, err := store.DiffRulesetManifests(base, target, from, to, filter, includeUnchanged)
+		if err != nil {
+			if errors.Is(err, errManifestNotFound) {
+				c.JSON(http.StatusNotFound, errResponse{OK: false, Error: "NOT_FOUND", Message: err.Error()})
+				return
+			}
+			c.JSON(http.StatusInternalServerError, errResponse{OK: false, Error: "INTERNAL_ERROR", Message: err.Error()})
+			return
+		}
+
+		ruleIDs := make([]string, 0, len(diff.Rows))
+		for _, row := range diff.Rows {
+			ruleIDs = append(ruleIDs, row.RuleID)
+		}
+		catalog, err := store.LookupRuleCatalog(ruleIDs)
+		if err != nil {
+			c.JSON(http.StatusInternalServerError, errResponse{OK: false, Error: "INTERNAL_ERROR", Message: err.Error()})
+			return
+		}
+		rows := diff.Rows
+		if rows == nil {
+			rows = []rulesetDiffRow{}
+		}
+		for i := range rows {
+			rows[i].Catalog = catalog[rows[i].RuleID]
+		}
+
+		c.JSON(http.StatusOK, gin.H{
+			"ok":      true,
+			"from":    from,
+			"to":      to,
+			"base":    base,
+			"target":  target,
+			"summary": diff.Summary,
+			"data":    rows,
+		})
+	}
+}
@@ -0,0 +1,116 @@
+package main
+
+import (
+	"errors"
+	"net/http"
+	"net/url"
+	"strconv"
+	"strings"
+
+	"github.com/gin-gonic/gin"
+)
+
+const agentRunsPath = "/v1/metrics/agent-runs/"
+
+// parseRunPath splits {repo}/{code_change_id}/{agent_run_id} off the escaped
+// request path. The repo may span several segments; a code_change_id with a
+// slash must send it as %2F.
+func parseRunPath(c *gin.Context) (repo, codeChangeID, agentRunID string, ok bool) {
+	segments := strings.Split(strings.TrimPrefix(c.Request.URL.EscapedPath(), agentRunsPath), "/")
+	if len(segments) < 3 {
+		return "", "", "", false
+	}
+	for i, segment := range segments {
+		unescaped, err := url.PathUnescape(segment)
+		if err != nil || unescaped == "" {
+			return "", "", "", false
+		}
+		segments[i] = unescaped
+	}
+	n := len(segments)
+	return strings.Join(segments[:n-2], "/"), segments[n-2], segments[n-1], true
+}
+
+// handleAgentRunDelete removes one run reported by mistake.
+func handleAgentRunDelete(store Store) gin.HandlerFunc {
+	return func(c *gin.Context) {
+		repo, codeChangeID, agentRunID, ok := parseRunPath(c)
+		if !ok {
+			c.JSON(http.StatusBadRequest, errResponse{OK: false, Error: "VALIDATION_ERROR", Message: "the path must be /v1/metrics/agent-runs/{repo}/{code_change_id}/{agent_run_id}"})
+			return
+		}
+		auditTarget(c, repo+"/"+codeChangeID+"/"+agentRunID)
+		if !isUUID(agentRunID) {
+			c.JSON(http.StatusBadRequest, errResponse{OK: false, Error: "VALIDATION_ERROR", Message: "agent_run_id must be a UUID like xxxxxxxx-xxxx-xxxx-xxxx-xxxxxxxxxxxx"})
+			return
+		}
+
+		result, err := store.DeleteAgentRun(repo, codeChangeID, agentRunID)
+		if err != nil {
+			if errors.Is(err, errRunNotFound) {
+				c.JSON(http.StatusNotFound, errResponse{OK: false, Error: "NOT_FOUND", Message: err.Error()})
+				return
+			}
+			c.JSON(http.StatusInternalServerError, errResponse{OK: false, Error: "INTERNAL_ERROR", Message: err.Error()})
+			return
+		}
+
+		c.JSON(http.StatusOK, gin.H{"ok": true, "data": result})
+	}
+}
+
+// handleAgentRunBulkDelete removes every run matching the repo /
+// code_change_id / agent_version / ruleset_version / from / to filter. At
+// least one of the first four is required so a typo cannot empty the table.
+func handleAgentRunBulkDelete(store Store) gin.HandlerFunc {
+	return func(c *gin.Context) {
+		from, to, err := parseOpenTimeRange(c)
+		if err != nil {
+			c.JSON(http.StatusBadRequest, errResponse{OK: false, Error: "VALIDATION_ERROR", Message: err.Error()})
+			return
+		}
+
+		dryRun := false
+		if v := strings.TrimSpace(c.Query("dry_run")); v != "" {
+			dryRun, err = strconv.ParseBool(v)
+			if err != nil {
+				c.JSON(http.StatusBadRequest, errResponse{OK: false, Error: "VALIDATION_ERROR", Message: "dry_run must be true or false"})
+				return
+			}
+		}
+
+		filter := runDeleteFilter{
+			Repo:           strings.TrimSpace(c.Query("repo")),
+			CodeChangeID:   strings.TrimSpace(c.Query("code_change_id")),
+			AgentVersion:   strings.TrimSpace(c.Query("agent_version")),
+			RulesetVersion: strings.TrimSpace(c.Query("ruleset_version")),
+			From:           from,
+			To:             to,
+		}
+		var scope []string
+		for _, p := range []struct{ name, value string }{
+			{"repo", filter.Repo},
+			{"code_change_id", filter.CodeChangeID},
+			{"agent_version", filter.AgentVersion},
+			{"ruleset_version", filter.RulesetVersion},
+		} {
+			if p.value != "" {
+				scope = append(scope, p.name+"="+p.value)
+			}
+		}
+		auditTarget(c, strings.Join(scope, ","))
+		if len(scope) == 0 {
+			c.JSON(http.StatusBadRequest, errResponse{OK: false, Error: "VALIDATION_ERROR", Message: "repo, code_change_id, agent_version or ruleset_version is required"})
+			return
+		}
+
+		result, err := store.DeleteAgentRuns(filter, dryRun)
+		if err != nil {
+			// The changes finished before the error stay deleted.
+			c.JSON(http.StatusInternalServerError, gin.H{"ok": false, "error": "INTERNAL_ERROR", "message": err.Error(), "data": result})
+			return
+		}
+
+		c.JSON(http.StatusOK, gin.H{"ok": true, "data": result})
+	}
+}
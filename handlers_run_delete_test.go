@@ -0,0 +1,64 @@
+package main
+
+import (
+	"errors"
+	"net/http"
+	"testing"
+	"time"
+)
+
+const testAdminToken = "test-admin-token-0123456789"
+
+func TestAgentRunDeleteErrorMapping(t *testing.T) {
+	store := newFakeStore()
+	base := newTestServer(t, store, authPolicy{AdminToken: testAdminToken}, alertPolicy{})
+	run := testRun("org/a", "c1", 1, time.Now().Add(-time.Hour), map[string]uint32{"R1": 1})
+	if status, body := doRequest(t, http.MethodPost, base+"/v1/metrics/agent-runs", run, nil); status != http.StatusOK {
+		t.Fatalf("seed run: %d %s", status, body)
+	}
+	url := base + "/v1/metrics/agent-runs/org/a/c1/" + run.AgentRunID
+	admin := http.Header{"Authorization": {"Bearer " + testAdminToken}}
+
+	cases := []struct {
+		name   string
+		url    string
+		header http.Header
+		err    error
+		status int
+	}{
+		{name: "no token", url: url, status: http.StatusUnauthorized},
+		{name: "not a uuid", url: base + "/v1/metrics/agent-runs/org/a/c1/not-a-uuid", header: admin, status: http.StatusBadRequest},
+		{name: "store error", url: url, header: admin, err: errors.New("database is down"), status: http.StatusInternalServerError},
+		{name: "deleted", url: url, header: admin, status: http.StatusOK},
+		{name: "already deleted", url: url, header: admin, status: http.StatusNotFound},
+	}
+	for _, tc := range cases {
+		t.Run(tc.name, func(t *testing.T) {
+			store.setErr(tc.err)
+			defer store.setErr(nil)
+			if status, body := doRequest(t, http.MethodDelete, tc.url, nil, tc.header); status != tc.status {
+				t.Fatalf("status %d %s, want %d", status, body, tc.status)
+			}
+		})
+	}
+}
+
+// Deleting runs is refused, not open, when no admin credential is configured.
+func TestAgentRunDeleteNeedsAdminConfigured(t *testing.T) {
+	store := newFakeStore()
+	base := newTestServer(t, store, authPolicy{}, alertPolicy{})
+	run := testRun("org/a", "c1", 1, time.Now().Add(-time.Hour), map[string]uint32{"R1": 1})
+	if status, body := doRequest(t, http.MethodPost, base+"/v1/metrics/agent-runs", run, nil); status != http.StatusOK {
+		t.Fatalf("seed run: %d %s", status, body)
+	}
+	if status, body := doRequest(t, http.MethodDelete, base+"/v1/metrics/agent-runs/org/a/c1/"+run.AgentRunID, nil, nil); status != http.StatusForbidden {
+		t.Fatalf("delete: %d %s, want 403", status, body)
+	}
+	filter := map[string]string{"repo": "org/a", "code_change_id": "c1"}
+	if status, body := doRequest(t, http.MethodPost, base+"/v1/metrics/agent-runs:delete", filter, nil); status != http.StatusForbidden {
+		t.Fatalf("bulk delete: %d %s, want 403", status, body)
+	}
+	if store.runCount() != 1 {
+		t.Fatalf("%d runs left, want 1", store.runCount())
+	}
+}
@@ -3,17 +3,17 @@ package main
 import (
 	"encoding/json"
 	"errors"
+	"fmt"
+	"io"
 	"log"
-	"net/http"
 	"os"
 	"path/filepath"
+	"sort"
 	"strings"
 	"time"
+	"unicode/utf8"
 
 	"github.com/gin-gonic/gin"
-	"gorm.io/datatypes"
-	"gorm.io/gorm"
-	"gorm.io/gorm/clause"
 )
 
 type agentRunRequest struct {
@@ -26,6 +26,8 @@ type agentRunRequest struct {
 	RulesetVersion     string            `json:"ruleset_version"`
 	TriggeredTotalHits uint32            `json:"triggered_total_hits"`
 	RuleHits           map[string]uint32 `json:"rule_hits"`
+	// Findings is optional; when present it must account for every rule hit.
+	Findings []findingRequest `json:"findings"`
 }
 
 type okResponse struct {
@@ -34,13 +36,46 @@ type okResponse struct {
 	Idempotent   bool   `json:"idempotent"`
 }
 
+// pendingAgentRun is a run that passed request validation and is ready to be
+// stored.
+type pendingAgentRun struct {
+	Req       agentRunRequest
+	DiffLines uint32
+}
+
+type agentRunKey struct {
+	Repo         string
+	CodeChangeID string
+	AgentRunID   string
+}
+
+const batchInsertSize = 500
+
+// maxBatchAttempts bounds how often CreateAgentRunBatch retries a batch that
+// lost a race with a concurrent writer.
+const maxBatchAttempts = 3
+
 type errResponse struct {
 	OK      bool   `json:"ok"`
 	Error   string `json:"error"`
 	Message string `json:"message"`
 }
 
+type validationErrResponse struct {
+	OK      bool         `json:"ok"`
+	Error   string       `json:"error"`
+	Message string       `json:"message"`
+	Details []fieldError `json:"details"`
+}
+
 func main() {
+	if len(os.Args) > 1 {
+		if err := runCommand(os.Args[1], os.Args[2:]); err != nil {
+			log.Fatal(err)
+		}
+		return
+	}
+
 	cfg, err := loadConfig("config.yaml")
 	if err != nil {
 		panic(err)
@@ -57,48 +92,45 @@ func main() {
 	}
 	log.SetOutput(logWriter)
 
-	db, err := openDB(cfg.MySQL)
+	store, err := openStore(cfg)
 	if err != nil {
 		panic(err)
 	}
 
-	r := gin.New()
-	r.Use(gin.LoggerWithWriter(logWriter))
-	r.Use(gin.Recovery())
-	r.GET("/", serveDashboard)
-	r.GET("/api/summary", handleSummary(db))
-	r.GET("/api/timeseries", handleTimeseries(db))
-	r.GET("/api/runs/recent", handleRecentRuns(db))
-	r.GET("/api/rules/top", handleTopRules(db))
-	r.GET("/api/change-effectiveness/summary", handleChangeEffectivenessSummary(db))
-	r.GET("/api/change-effectiveness/top", handleChangeEffectivenessTop(db))
-	r.GET("/api/change-effectiveness/list", handleChangeEffectivenessList(db))
-	r.GET("/api/change-effectiveness/runs", handleChangeEffectivenessRuns(db))
-	r.GET("/api/rule-quality/summary", handleRuleQualitySummary(db))
-	r.GET("/api/rule-quality/top", handleRuleQualityTop(db))
-	r.GET("/api/rule-quality/list", handleRuleQualityList(db))
-	r.GET("/api/rule-quality/trend", handleRuleQualityTrend(db))
-	r.POST("/v1/metrics/agent-runs", func(c *gin.Context) {
-		var req agentRunRequest
-		if err := c.ShouldBindJSON(&req); err != nil {
-			c.JSON(http.StatusBadRequest, errResponse{OK: false, Error: "VALIDATION_ERROR", Message: err.Error()})
-			return
+	if cfg.Retention.Enabled {
+		policy, err := newRetentionPolicy(cfg.Retention)
+		if err != nil {
+			panic(err)
 		}
-
-		diffLines, msg := normalizeDiffLines(req.DiffLines)
-		if msg != "" {
-			c.JSON(http.StatusBadRequest, errResponse{OK: false, Error: "VALIDATION_ERROR", Message: msg})
-			return
+		startRetentionJob(store, policy)
+	}
+	if cfg.Anomaly.Enabled {
+		policy, err := newAnomalyPolicy(cfg.Anomaly)
+		if err != nil {
+			panic(err)
 		}
-
-		runID, idempotent, err := createAgentRun(db, req, diffLines)
+		startAnomalyJob(store, policy)
+	}
+	if cfg.AgentRegression.Enabled {
+		policy, err := newAgentRegressionPolicy(cfg.AgentRegression)
 		if err != nil {
-			c.JSON(http.StatusInternalServerError, errResponse{OK: false, Error: "INTERNAL_ERROR", Message: err.Error()})
-			return
+			panic(err)
 		}
+		startAgentRegressionJob(store, policy)
+	}
+	auth, err := newAuthPolicy(cfg.Auth)
+	if err != nil {
+		panic(err)
+	}
+	alerts, err := newAlertPolicy(cfg.Alerting)
+	if err != nil {
+		panic(err)
+	}
+	if alerts.Enabled {
+		startAlertJob(store, alerts)
+	}
 
-		c.JSON(http.StatusOK, okResponse{OK: true, RunPrimaryID: runID, Idempotent: idempotent})
-	})
+	r := newRouter(store, auth, alerts, logWriter)
 
 	addr := cfg.Server.Addr
 	if addr == "" {
@@ -109,6 +141,65 @@ func main() {
 	}
 }
 
+// newRouter registers every route of the service. Routes with an escaped
+// colon, such as agent-runs\:batch, only match once the engine has been
+// started with Run.
+func newRouter(store Store, auth authPolicy, alerts alertPolicy, logWriter io.Writer) *gin.Engine {
+	r := gin.New()
+	r.Use(gin.LoggerWithWriter(logWriter))
+	r.Use(gin.Recovery())
+	viewer := requireRole(auth, roleViewer)
+	ruleOwner := requireRole(auth, roleRuleOwner)
+	admin := requireAdmin(auth)
+	audit := newAuditLog(store)
+	r.GET("/", viewer, serveDashboard)
+	r.GET("/api/summary", viewer, handleSummary(store))
+	r.GET("/api/timeseries", viewer, handleTimeseries(store))
+	r.GET("/api/runs/recent", viewer, handleRecentRuns(store))
+	r.GET("/api/rules/top", viewer, handleTopRules(store))
+	r.GET("/api/change-effectiveness/summary", viewer, handleChangeEffectivenessSummary(store))
+	r.GET("/api/change-effectiveness/top", viewer, handleChangeEffectivenessTop(store))
+	r.GET("/api/change-effectiveness/list", viewer, handleChangeEffectivenessList(store))
+	r.GET("/api/change-effectiveness/runs", viewer, handleChangeEffectivenessRuns(store))
+	r.GET("/api/rule-quality/summary", viewer, handleRuleQualitySummary(store))
+	r.GET("/api/rule-quality/top", viewer, handleRuleQualityTop(store))
+	r.GET("/api/rule-quality/list", viewer, handleRuleQualityList(store))
+	r.GET("/api/rule-quality/trend", viewer, handleRuleQualityTrend(store))
+	r.GET("/api/findings", viewer, handleFindings(store))
+	r.GET("/api/findings/timeline", viewer, handleFindingTimeline(store))
+	r.GET("/api/rule-catalog", viewer, handleRuleCatalogList(store))
+	r.GET("/api/ruleset-manifests", viewer, handleRulesetManifests(store))
+	r.GET("/api/ruleset-manifests/rules", viewer, handleRulesetManifestRules(store))
+	r.GET("/api/ruleset-manifests/diff", viewer, handleRulesetDiff(store))
+	r.GET("/api/compare/ruleset", viewer, handleCompareRuleset(store))
+	r.GET("/api/agent-versions/regressions", viewer, handleAgentRegressions(store))
+	r.GET("/api/agent-versions/regressions/recorded", viewer, handleRecordedAgentRegressions(store))
+	r.GET("/api/anomalies", viewer, handleAnomalies(store))
+	r.GET("/api/alerts", viewer, handleAlerts(store, alerts))
+	r.GET("/api/alert-silences", viewer, handleAlertSilences(store))
+	r.GET("/api/audit", admin, handleAudit(store))
+	ingestAuth := requireIngestAuth(store, auth, false)
+	r.POST("/v1/metrics/agent-runs", ingestAuth, handleAgentRun(store))
+	r.POST("/v1/metrics/agent-runs\\:batch", ingestAuth, handleAgentRunBatch(store))
+	r.POST("/v1/metrics/agent-runs\\:stream", requireIngestAuth(store, auth, true), handleAgentRunStream(store))
+	r.POST("/v1/feedback", audit.record("feedback.record"), viewer, handleFeedback(store))
+	r.POST("/v1/rule-catalog", audit.record("rule_catalog.upsert"), ruleOwner, handleRuleCatalogUpsert(store))
+	r.DELETE("/v1/rule-catalog", audit.record("rule_catalog.delete"), ruleOwner, handleRuleCatalogDelete(store))
+	r.POST("/v1/ruleset-manifests", audit.record("ruleset_manifest.upload"), ruleOwner, handleRulesetManifestUpload(store))
+	r.POST("/v1/alert-rules", audit.record("alert_rule.upsert"), ruleOwner, handleAlertRuleUpsert(store, alerts))
+	r.DELETE("/v1/alert-rules", audit.record("alert_rule.delete"), ruleOwner, handleAlertRuleDelete(store, alerts))
+	r.POST("/v1/alert-silences", audit.record("alert_silence.create"), ruleOwner, handleAlertSilenceCreate(store))
+	r.DELETE("/v1/alert-silences", audit.record("alert_silence.expire"), ruleOwner, handleAlertSilenceExpire(store))
+	r.DELETE("/v1/metrics/agent-runs/*path", audit.record("agent_run.delete"), admin, handleAgentRunDelete(store))
+	r.POST("/v1/metrics/agent-runs\\:delete", audit.record("agent_run.bulk_delete"), admin, handleAgentRunBulkDelete(store))
+	r.POST("/v1/admin/code-change-summaries\\:rebuild", audit.record("summaries.rebuild"), admin, handleRebuildSummaries(store))
+	r.POST("/v1/admin/api-keys", audit.record("api_key.create"), admin, handleAPIKeyCreate(store))
+	r.GET("/v1/admin/api-keys", admin, handleAPIKeyList(store))
+	r.POST("/v1/admin/api-keys\\:rotate", audit.record("api_key.rotate"), admin, handleAPIKeyRotate(store))
+	r.DELETE("/v1/admin/api-keys", audit.record("api_key.revoke"), admin, handleAPIKeyRevoke(store))
+	return r
+}
+
 func openLogWriter(path string) (*os.File, error) {
 	dir := filepath.Dir(path)
 	if dir != "." && dir != "" {
@@ -119,149 +210,171 @@ func openLogWriter(path string) (*os.File, error) {
 	return os.OpenFile(path, os.O_CREATE|os.O_APPEND|os.O_WRONLY, 0o644)
 }
 
-func normalizeDiffLines(diffLines *uint32) (uint32, string) {
+const (
+	maxRepoLen         = 128
+	maxCodeChangeIDLen = 128
+	maxVersionLen      = 64
+	maxRuleIDLen       = 128
+	maxFilePathLen     = 512
+	maxFingerprintLen  = 64
+	// maxFindingsPerRun bounds the findings array of one run.
+	maxFindingsPerRun = 5000
+	// maxReportedAtSkew tolerates agent clocks running slightly ahead of ours.
+	maxReportedAtSkew = 10 * time.Minute
+)
+
+// fieldError describes one validation failure of an agent run payload.
+type fieldError struct {
+	Field   string `json:"field"`
+	Code    string `json:"code"`
+	Message string `json:"message"`
+}
+
+func normalizeDiffLines(diffLines *uint32) (uint32, *fieldError) {
 	if diffLines == nil {
-		return 0, "diff_lines is required"
+		return 0, &fieldError{Field: "diff_lines", Code: "required", Message: "diff_lines is required"}
 	}
-	return *diffLines, ""
+	return *diffLines, nil
 }
 
-func validateAgentRun(req agentRunRequest) string {
-	if strings.TrimSpace(req.Repo) == "" {
-		return "repo is required"
+// parseAgentRun decodes and validates one JSON-encoded run. A non-empty error
+// list means the run must be rejected.
+func parseAgentRun(raw []byte) (pendingAgentRun, []fieldError) {
+	var req agentRunRequest
+	if err := json.Unmarshal(raw, &req); err != nil {
+		return pendingAgentRun{}, []fieldError{decodeFieldError(err)}
 	}
-	if strings.TrimSpace(req.CodeChangeID) == "" {
-		return "code_change_id is required"
+	errs := validateAgentRun(req, time.Now().UTC())
+	diffLines, diffErr := normalizeDiffLines(req.DiffLines)
+	if diffErr != nil {
+		errs = append(errs, *diffErr)
 	}
-	if strings.TrimSpace(req.AgentRunID) == "" {
-		return "agent_run_id is required"
+	if len(errs) > 0 {
+		return pendingAgentRun{}, errs
+	}
+	return pendingAgentRun{Req: req, DiffLines: diffLines}, nil
+}
+
+func decodeFieldError(err error) fieldError {
+	var typeErr *json.UnmarshalTypeError
+	if errors.As(err, &typeErr) && typeErr.Field != "" {
+		return fieldError{Field: typeErr.Field, Code: "invalid_type", Message: typeErr.Field + " must be " + typeErr.Type.String()}
+	}
+	var timeErr *time.ParseError
+	if errors.As(err, &timeErr) {
+		return fieldError{Field: "reported_at", Code: "invalid_format", Message: "reported_at must be an RFC3339 timestamp"}
+	}
+	if typeErr != nil {
+		return fieldError{Code: "invalid_json", Message: "agent run must be a JSON object"}
+	}
+	return fieldError{Code: "invalid_json", Message: err.Error()}
+}
+
+// validationMessage summarizes errs for clients that only read message.
+func validationMessage(errs []fieldError) string {
+	if len(errs) == 1 {
+		return errs[0].Message
 	}
-	if strings.TrimSpace(req.AgentVersion) == "" {
-		return "agent_version is required"
+	return fmt.Sprintf("%s (and %d more errors)", errs[0].Message, len(errs)-1)
+}
+
+// validateAgentRun checks a decoded run against the column sizes of
+// cr_agent_run / cr_agent_run_rule and the hit-count invariants. diff_lines is
+// checked separately by normalizeDiffLines.
+func validateAgentRun(req agentRunRequest, now time.Time) []fieldError {
+	var errs []fieldError
+	add := func(field, code, message string) {
+		errs = append(errs, fieldError{Field: field, Code: code, Message: message})
 	}
-	if strings.TrimSpace(req.RulesetVersion) == "" {
-		return "ruleset_version is required"
+	checkString := func(field, value string, maxLen int) {
+		if strings.TrimSpace(value) == "" {
+			add(field, "required", field+" is required")
+		} else if utf8.RuneCountInString(value) > maxLen {
+			add(field, "too_long", fmt.Sprintf("%s must be at most %d characters", field, maxLen))
+		}
 	}
+
+	checkString("repo", req.Repo, maxRepoLen)
+	checkString("code_change_id", req.CodeChangeID, maxCodeChangeIDLen)
+	if strings.TrimSpace(req.AgentRunID) == "" {
+		add("agent_run_id", "required", "agent_run_id is required")
+	} else if !isUUID(req.AgentRunID) {
+		add("agent_run_id", "invalid_format", "agent_run_id must be a UUID like xxxxxxxx-xxxx-xxxx-xxxx-xxxxxxxxxxxx")
+	}
+	checkString("agent_version", req.AgentVersion, maxVersionLen)
+	checkString("ruleset_version", req.RulesetVersion, maxVersionLen)
+
 	if req.ReportedAt.IsZero() {
-		return "reported_at is required"
+		add("reported_at", "required", "reported_at is required")
+	} else if req.ReportedAt.After(now.Add(maxReportedAtSkew)) {
+		add("reported_at", "in_future", fmt.Sprintf("reported_at must not be more than %s in the future", maxReportedAtSkew))
 	}
+
 	if req.RuleHits == nil {
-		return "rule_hits is required"
+		add("rule_hits", "required", "rule_hits is required")
+		return errs
 	}
 	if req.TriggeredTotalHits > 0 && len(req.RuleHits) == 0 {
-		return "rule_hits cannot be empty when triggered_total_hits > 0"
+		add("rule_hits", "required", "rule_hits cannot be empty when triggered_total_hits > 0")
 	}
 
+	ruleIDs := make([]string, 0, len(req.RuleHits))
 	var sum uint64
-	for _, v := range req.RuleHits {
-		sum += uint64(v)
+	for ruleID, hits := range req.RuleHits {
+		ruleIDs = append(ruleIDs, ruleID)
+		sum += uint64(hits)
+	}
+	sort.Strings(ruleIDs)
+	for _, ruleID := range ruleIDs {
+		field := "rule_hits." + ruleID
+		switch {
+		case ruleID == "":
+			add(field, "required", "rule_hits keys must not be empty")
+		case utf8.RuneCountInString(ruleID) > maxRuleIDLen:
+			add(field, "too_long", fmt.Sprintf("rule id must be at most %d characters", maxRuleIDLen))
+		case !isValidRuleID(ruleID):
+			add(field, "invalid_format", "rule id may only contain letters, digits and . _ - : /")
+		}
 	}
 	if sum != uint64(req.TriggeredTotalHits) {
-		return "triggered_total_hits must equal sum(rule_hits)"
+		add("triggered_total_hits", "mismatch", fmt.Sprintf("triggered_total_hits must equal sum(rule_hits) = %d", sum))
 	}
 
-	return ""
+	return append(errs, validateFindings(req.Findings, req.RuleHits)...)
 }
 
-func createAgentRun(db *gorm.DB, req agentRunRequest, diffLines uint32) (uint64, bool, error) {
-	var existing CrAgentRun
-	query := db.Where("repo = ? AND code_change_id = ? AND agent_run_id = ?", req.Repo, req.CodeChangeID, req.AgentRunID)
-	if err := query.First(&existing).Error; err == nil {
-		return existing.ID, true, nil
-	} else if !errors.Is(err, gorm.ErrRecordNotFound) {
-		return 0, false, err
+func isUUID(value string) bool {
+	if len(value) != 36 {
+		return false
 	}
-
-	ruleHitsJSON, err := json.Marshal(req.RuleHits)
-	if err != nil {
-		return 0, false, err
-	}
-
-	var runID uint64
-	err = db.Transaction(func(tx *gorm.DB) error {
-		run := CrAgentRun{
-			Repo:               req.Repo,
-			CodeChangeID:       req.CodeChangeID,
-			AgentRunID:         req.AgentRunID,
-			AgentVersion:       req.AgentVersion,
-			RulesetVersion:     req.RulesetVersion,
-			ReportedAt:         req.ReportedAt.UTC(),
-			DiffLines:          diffLines,
-			TriggeredTotalHits: req.TriggeredTotalHits,
-			RuleHitsJSON:       datatypes.JSON(ruleHitsJSON),
-		}
-
-		if err := tx.Create(&run).Error; err != nil {
-			return err
-		}
-
-		runID = run.ID
-		if len(req.RuleHits) > 0 {
-			rules := make([]CrAgentRunRule, 0, len(req.RuleHits))
-			for ruleID, count := range req.RuleHits {
-				rules = append(rules, CrAgentRunRule{
-					RunID:          run.ID,
-					Repo:           req.Repo,
-					CodeChangeID:   req.CodeChangeID,
-					ReportedAt:     req.ReportedAt.UTC(),
-					RulesetVersion: req.RulesetVersion,
-					RuleID:         ruleID,
-					HitCount:       count,
-				})
+	for i := 0; i < len(value); i++ {
+		ch := value[i]
+		switch i {
+		case 8, 13, 18, 23:
+			if ch != '-' {
+				return false
 			}
-			if err := tx.Create(&rules).Error; err != nil {
-				return err
+		default:
+			if !isHexDigit(ch) {
+				return false
 			}
 		}
+	}
+	return true
+}
 
-		summary := CodeChangeSummary{
-			Repo:               req.Repo,
-			CodeChangeID:       req.CodeChangeID,
-			RunCount:           1,
-			FirstReportedAt:    req.ReportedAt.UTC(),
-			LastReportedAt:     req.ReportedAt.UTC(),
-			MaxTotalHits:       req.TriggeredTotalHits,
-			MaxRunID:           run.ID,
-			MinTotalHits:       req.TriggeredTotalHits,
-			MinRunID:           run.ID,
-			LastRulesetVersion: req.RulesetVersion,
-			ImprovementRate:    nil,
-		}
-
-		if err := tx.Clauses(clause.OnConflict{
-			Columns: []clause.Column{
-				{Name: "repo"},
-				{Name: "code_change_id"},
-			},
-			DoUpdates: clause.Assignments(map[string]interface{}{
-				"run_count":            gorm.Expr("run_count + 1"),
-				"first_reported_at":    gorm.Expr("LEAST(first_reported_at, VALUES(first_reported_at))"),
-				"last_reported_at":     gorm.Expr("GREATEST(last_reported_at, VALUES(last_reported_at))"),
-				"max_total_hits":       gorm.Expr("GREATEST(max_total_hits, VALUES(max_total_hits))"),
-				"max_run_id":           gorm.Expr("IF(VALUES(max_total_hits) > max_total_hits, VALUES(max_run_id), max_run_id)"),
-				"min_total_hits":       gorm.Expr("LEAST(min_total_hits, VALUES(min_total_hits))"),
-				"min_run_id":           gorm.Expr("IF(VALUES(min_total_hits) < min_total_hits, VALUES(min_run_id), min_run_id)"),
-				"last_ruleset_version": gorm.Expr("IF(VALUES(last_reported_at) >= last_reported_at, VALUES(last_ruleset_version), last_ruleset_version)"),
-				"improvement_rate": gorm.Expr(
-					"IF((run_count + 1) >= 2 AND GREATEST(max_total_hits, VALUES(max_total_hits)) > 0," +
-						" (GREATEST(max_total_hits, VALUES(max_total_hits)) - LEAST(min_total_hits, VALUES(min_total_hits))) / GREATEST(max_total_hits, VALUES(max_total_hits))," +
-						" NULL)",
-				),
-			}),
-		}).Create(&summary).Error; err != nil {
-			return err
-		}
+func isHexDigit(ch byte) bool {
+	return (ch >= '0' && ch <= '9') || (ch >= 'a' && ch <= 'f') || (ch >= 'A' && ch <= 'F')
+}
 
-		return nil
-	})
-	if err != nil {
-		if errors.Is(err, gorm.ErrDuplicatedKey) {
-			if err := query.First(&existing).Error; err == nil {
-				return existing.ID, true, nil
-			}
+func isValidRuleID(ruleID string) bool {
+	for _, r := range ruleID {
+		switch {
+		case r >= 'a' && r <= 'z', r >= 'A' && r <= 'Z', r >= '0' && r <= '9':
+		case r == '.', r == '_', r == '-', r == ':', r == '/':
+		default:
+			return false
 		}
-		return 0, false, err
 	}
-
-	return runID, false, nil
+	return true
 }
@@ -0,0 +1,160 @@
+package main
+
+import (
+	"bytes"
+	"encoding/json"
+	"fmt"
+	"io"
+	"net/http"
+	"net/http/httptest"
+	"os"
+	"path/filepath"
+	"testing"
+	"time"
+
+	"github.com/gin-gonic/gin"
+)
+
+func TestMain(m *testing.M) {
+	gin.SetMode(gin.TestMode)
+	os.Exit(m.Run())
+}
+
+// newTestStore opens a freshly migrated SQLite database in a temporary
+// directory.
+func newTestStore(t *testing.T) *gormStore {
+	t.Helper()
+	var cfg Config
+	cfg.Storage.Driver = "sqlite"
+	cfg.SQLite.Path = filepath.Join(t.TempDir(), "test.db")
+
+	db, dialect, err := openDatabase(cfg)
+	if err != nil {
+		t.Fatalf("open database: %v", err)
+	}
+	if _, err := migrateUp(db, dialect, 0); err != nil {
+		t.Fatalf("migrate: %v", err)
+	}
+	if sqlDB, err := db.DB(); err == nil {
+		sqlDB.Close()
+	}
+
+	store, err := openStore(cfg)
+	if err != nil {
+		t.Fatalf("open store: %v", err)
+	}
+	gs := store.(*gormStore)
+	t.Cleanup(func() {
+		if sqlDB, err := gs.db.DB(); err == nil {
+			sqlDB.Close()
+		}
+	})
+	return gs
+}
+
+// startTestServer serves r on a loopback port and returns its base URL.
+// Routes with an escaped colon such as agent-runs\:batch only match after
+// Engine.Run has rewritten the route trees, so Run is called first with an
+// address it cannot listen on, which makes it return right after the rewrite.
+func startTestServer(t *testing.T, r *gin.Engine) string {
+	t.Helper()
+	if err := r.Run("127.0.0.1:-1"); err == nil {
+		t.Fatal("Run with an invalid address did not fail")
+	}
+	srv := httptest.NewServer(r)
+	t.Cleanup(srv.Close)
+	return srv.URL
+}
+
+// newTestServer serves the full router over store with the given auth and
+// alerting settings.
+func newTestServer(t *testing.T, store Store, auth authPolicy, alerts alertPolicy) string {
+	t.Helper()
+	return startTestServer(t, newRouter(store, auth, alerts, io.Discard))
+}
+
+// doRequest sends body (nil, a string, []byte or a value encoded as JSON) and
+// returns the status code and response body.
+func doRequest(t *testing.T, method, url string, body interface{}, header http.Header) (int, []byte) {
+	t.Helper()
+	var reader io.Reader
+	switch b := body.(type) {
+	case nil:
+	case string:
+		reader = bytes.NewBufferString(b)
+	case []byte:
+		reader = bytes.NewReader(b)
+	case io.Reader:
+		reader = b
+	default:
+		raw, err := json.Marshal(b)
+		if err != nil {
+			t.Fatalf("encode body: %v", err)
+		}
+		reader = bytes.NewReader(raw)
+	}
+	req, err := http.NewRequest(method, url, reader)
+	if err != nil {
+		t.Fatalf("new request: %v", err)
+	}
+	for key, values := range header {
+		req.Header[key] = values
+	}
+	resp, err := http.DefaultClient.Do(req)
+	if err != nil {
+		t.Fatalf("%s %s: %v", method, url, err)
+	}
+	defer resp.Body.Close()
+	raw, err := io.ReadAll(resp.Body)
+	if err != nil {
+		t.Fatalf("read response: %v", err)
+	}
+	return resp.StatusCode, raw
+}
+
+// decodeJSON unmarshals raw into v, failing the test on error.
+func decodeJSON(t *testing.T, raw []byte, v interface{}) {
+	t.Helper()
+	if err := json.Unmarshal(raw, v); err != nil {
+		t.Fatalf("decode %s: %v", raw, err)
+	}
+}
+
+// testRun builds a valid run; seq makes agent_run_id unique. Each hit gets a
+// finding so fix tracking has something to compare.
+func testRun(repo, codeChangeID string, seq int, reportedAt time.Time, ruleHits map[string]uint32) agentRunRequest {
+	diffLines := uint32(10)
+	req := agentRunRequest{
+		Repo:           repo,
+		CodeChangeID:   codeChangeID,
+		AgentRunID:     fmt.Sprintf("00000000-0000-4000-8000-%012d", seq),
+		ReportedAt:     reportedAt.UTC(),
+		DiffLines:      &diffLines,
+		AgentVersion:   "v1",
+		RulesetVersion: "r1",
+		RuleHits:       ruleHits,
+	}
+	for ruleID, hits := range ruleHits {
+		req.TriggeredTotalHits += hits
+		for i := uint32(0); i < hits; i++ {
+			req.Findings = append(req.Findings, findingRequest{
+				RuleID:      ruleID,
+				FilePath:    "main.go",
+				StartLine:   i + 1,
+				Severity:    "warning",
+				Fingerprint: fmt.Sprintf("%s-%d", ruleID, i),
+			})
+		}
+	}
+	return req
+}
+
+// mustTime parses an RFC 3339 timestamp.
+func mustTime(t *testing.T, value string) time.Time {
+	t.Helper()
+	ts, err := time.Parse(time.RFC3339, value)
+	if err != nil {
+		t.Fatalf("parse %q: %v", value, err)
+	}
+	return ts
+}
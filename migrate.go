@@ -0,0 +1,282 @@
+package main
+
+import (
+	"embed"
+	"fmt"
+	"io/fs"
+	"path"
+	"sort"
+	"strconv"
+	"strings"
+	"time"
+
+	"gorm.io/gorm"
+)
+
+// migrationFiles holds one directory per dialect name with files named
+// NNNN_description.up.sql / NNNN_description.down.sql.
+//
+//go:embed migrations
+var migrationFiles embed.FS
+
+type migration struct {
+	Version uint64
+	Name    string
+	Up      string
+	Down    string
+}
+
+// schemaMigration records an applied migration in schema_migrations.
+type schemaMigration struct {
+	Version   uint64    `gorm:"primaryKey"`
+	Name      string    `gorm:"size:255;not null"`
+	AppliedAt time.Time `gorm:"not null"`
+}
+
+func (schemaMigration) TableName() string {
+	return "schema_migrations"
+}
+
+// migrationStatus pairs an embedded migration with the time it was applied,
+// nil when still pending.
+type migrationStatus struct {
+	migration
+	AppliedAt *time.Time
+}
+
+// loadMigrations reads the embedded migrations of one dialect, ordered by
+// version. Every version must have both an up and a down file.
+func loadMigrations(dialect string) ([]migration, error) {
+	dir := path.Join("migrations", dialect)
+	entries, err := fs.ReadDir(migrationFiles, dir)
+	if err != nil {
+		return nil, fmt.Errorf("no migrations for %s: %w", dialect, err)
+	}
+
+	byVersion := make(map[uint64]*migration)
+	for _, entry := range entries {
+		fileName := entry.Name()
+		var direction string
+		switch {
+		case strings.HasSuffix(fileName, ".up.sql"):
+			direction = "up"
+		case strings.HasSuffix(fileName, ".down.sql"):
+			direction = "down"
+		default:
+			continue
+		}
+		base := strings.TrimSuffix(fileName, "."+direction+".sql")
+		versionPart, name, ok := strings.Cut(base, "_")
+		if !ok {
+			return nil, fmt.Errorf("migration %s: name must look like NNNN_description.%s.sql", fileName, direction)
+		}
+		version, err := strconv.ParseUint(versionPart, 10, 64)
+		if err != nil || version == 0 {
+			return nil, fmt.Errorf("migration %s: invalid version %q", fileName, versionPart)
+		}
+		body, err := fs.ReadFile(migrationFiles, path.Join(dir, fileName))
+		if err != nil {
+			return nil, err
+		}
+
+		m := byVersion[version]
+		if m == nil {
+			m = &migration{Version: version, Name: name}
+			byVersion[version] = m
+		} else if m.Name != name {
+			return nil, fmt.Errorf("migration %d has conflicting names %q and %q", version, m.Name, name)
+		}
+		if direction == "up" {
+			m.Up = string(body)
+		} else {
+			m.Down = string(body)
+		}
+	}
+
+	migrations := make([]migration, 0, len(byVersion))
+	for _, m := range byVersion {
+		if m.Up == "" || m.Down == "" {
+			return nil, fmt.Errorf("migration %04d_%s must have both up and down files", m.Version, m.Name)
+		}
+		migrations = append(migrations, *m)
+	}
+	sort.Slice(migrations, func(i, j int) bool { return migrations[i].Version < migrations[j].Version })
+	return migrations, nil
+}
+
+// splitSQLStatements splits a migration file on statements that end a line
+// with ";". Lines starting with "--" are dropped. Drivers differ on whether
+// they accept several statements per Exec, so each one is sent separately.
+func splitSQLStatements(script string) []string {
+	var statements []string
+	var current strings.Builder
+	for _, line := range strings.Split(script, "\n") {
+		trimmed := strings.TrimSpace(line)
+		if trimmed == "" || strings.HasPrefix(trimmed, "--") {
+			continue
+		}
+		current.WriteString(line)
+		current.WriteString("\n")
+		if strings.HasSuffix(trimmed, ";") {
+			statements = append(statements, strings.TrimSpace(current.String()))
+			current.Reset()
+		}
+	}
+	if rest := strings.TrimSpace(current.String()); rest != "" {
+		statements = append(statements, rest)
+	}
+	return statements
+}
+
+func ensureMigrationsTable(db *gorm.DB) error {
+	return db.Exec("CREATE TABLE IF NOT EXISTS schema_migrations (" +
+		"version BIGINT NOT NULL PRIMARY KEY, " +
+		"name VARCHAR(255) NOT NULL, " +
+		"applied_at TIMESTAMP NOT NULL)").Error
+}
+
+func loadAppliedMigrations(db *gorm.DB) (map[uint64]schemaMigration, error) {
+	var rows []schemaMigration
+	if err := db.Order("version").Find(&rows).Error; err != nil {
+		return nil, err
+	}
+	applied := make(map[uint64]schemaMigration, len(rows))
+	for _, row := range rows {
+		applied[row.Version] = row
+	}
+	return applied, nil
+}
+
+// applyMigration runs one migration script and records (or forgets) its
+// version in the same transaction. MySQL commits DDL implicitly, so a failure
+// halfway through a MySQL migration has to be cleaned up by hand.
+func applyMigration(db *gorm.DB, m migration, up bool) error {
+	script := m.Down
+	if up {
+		script = m.Up
+	}
+	return db.Transaction(func(tx *gorm.DB) error {
+		for _, stmt := range splitSQLStatements(script) {
+			if err := tx.Exec(stmt).Error; err != nil {
+				return err
+			}
+		}
+		if up {
+			return tx.Create(&schemaMigration{Version: m.Version, Name: m.Name, AppliedAt: time.Now().UTC()}).Error
+		}
+		return tx.Where("version = ?", m.Version).Delete(&schemaMigration{}).Error
+	})
+}
+
+// migrateUp applies pending migrations in order, up to and including target
+// (0 means the latest). It returns the migrations that were applied.
+func migrateUp(db *gorm.DB, dialect sqlDialect, target uint64) ([]migration, error) {
+	migrations, err := loadMigrations(dialect.name())
+	if err != nil {
+		return nil, err
+	}
+	if err := ensureMigrationsTable(db); err != nil {
+		return nil, err
+	}
+	applied, err := loadAppliedMigrations(db)
+	if err != nil {
+		return nil, err
+	}
+
+	var done []migration
+	for _, m := range migrations {
+		if target > 0 && m.Version > target {
+			break
+		}
+		if _, ok := applied[m.Version]; ok {
+			continue
+		}
+		if err := applyMigration(db, m, true); err != nil {
+			return done, fmt.Errorf("migration %04d_%s up: %w", m.Version, m.Name, err)
+		}
+		done = append(done, m)
+	}
+	return done, nil
+}
+
+// migrateDown reverts the newest steps applied migrations. It returns the
+// migrations that were reverted.
+func migrateDown(db *gorm.DB, dialect sqlDialect, steps int) ([]migration, error) {
+	migrations, err := loadMigrations(dialect.name())
+	if err != nil {
+		return nil, err
+	}
+	if err := ensureMigrationsTable(db); err != nil {
+		return nil, err
+	}
+	applied, err := loadAppliedMigrations(db)
+	if err != nil {
+		return nil, err
+	}
+
+	var done []migration
+	for i := len(migrations) - 1; i >= 0 && len(done) < steps; i-- {
+		m := migrations[i]
+		if _, ok := applied[m.Version]; !ok {
+			continue
+		}
+		if err := applyMigration(db, m, false); err != nil {
+			return done, fmt.Errorf("migration %04d_%s down: %w", m.Version, m.Name, err)
+		}
+		done = append(done, m)
+	}
+	return done, nil
+}
+
+func loadMigrationStatus(db *gorm.DB, dialect sqlDialect) ([]migrationStatus, error) {
+	migrations, err := loadMigrations(dialect.name())
+	if err != nil {
+		return nil, err
+	}
+	if err := ensureMigrationsTable(db); err != nil {
+		return nil, err
+	}
+	applied, err := loadAppliedMigrations(db)
+	if err != nil {
+		return nil, err
+	}
+
+	statuses := make([]migrationStatus, 0, len(migrations))
+	for _, m := range migrations {
+		status := migrationStatus{migration: m}
+		if row, ok := applied[m.Version]; ok {
+			appliedAt := row.AppliedAt
+			status.AppliedAt = &appliedAt
+		}
+		statuses = append(statuses, status)
+	}
+	return statuses, nil
+}
+
+// checkSchemaVersion refuses to serve from a database that is missing any of
+// the migrations embedded in this binary. A database ahead of the binary is
+// accepted so an older build can still run during a rollback.
+func checkSchemaVersion(db *gorm.DB, dialect sqlDialect) error {
+	migrations, err := loadMigrations(dialect.name())
+	if err != nil {
+		return err
+	}
+	if !db.Migrator().HasTable(&schemaMigration{}) {
+		return fmt.Errorf("database has no schema_migrations table; run `migrate up` first")
+	}
+	applied, err := loadAppliedMigrations(db)
+	if err != nil {
+		return err
+	}
+
+	var pending []string
+	for _, m := range migrations {
+		if _, ok := applied[m.Version]; !ok {
+			pending = append(pending, fmt.Sprintf("%04d_%s", m.Version, m.Name))
+		}
+	}
+	if len(pending) > 0 {
+		return fmt.Errorf("database schema is behind this binary, pending migrations: %s; run `migrate up` first", strings.Join(pending, ", "))
+	}
+	return nil
+}
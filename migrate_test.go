@@ -0,0 +1,27 @@
+package main
+
+import (
+	"testing"
+)
+
+func TestRulePurgeIndexMigration(t *testing.T) {
+	store := newTestStore(t)
+	hasIndex := func() bool {
+		return store.db.Migrator().HasIndex(&CrAgentRunRule{}, "idx_rule_reported_id")
+	}
+	if !hasIndex() {
+		t.Fatal("idx_rule_reported_id is missing after migrate up")
+	}
+
+	// Revert down to, and including, 0012.
+	reverted, err := migrateDown(store.db, store.dialect, 2)
+	if err != nil || len(reverted) != 2 || reverted[1].Version != 12 {
+		t.Fatalf("migrate down: %v %v", reverted, err)
+	}
+	if hasIndex() {
+		t.Fatal("idx_rule_reported_id is still present after migrate down")
+	}
+	if applied, err := migrateUp(store.db, store.dialect, 0); err != nil || len(applied) != 2 || !hasIndex() {
+		t.Fatalf("migrate up again: %v %v", applied, err)
+	}
+}
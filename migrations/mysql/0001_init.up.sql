@@ -0,0 +1,52 @@
+CREATE TABLE IF NOT EXISTS `cr_agent_run` (
+    `id`                   BIGINT UNSIGNED NOT NULL AUTO_INCREMENT COMMENT '自增主键',
+    `repo`                 VARCHAR(128)    NOT NULL COMMENT '代码仓库标识，如 org/name',
+    `code_change_id`       VARCHAR(128)    NOT NULL COMMENT '代码变更ID（PR / Change-Id / Commit 等）',
+    `agent_run_id`         CHAR(36)        NOT NULL COMMENT '一次 agent 运行的全局唯一ID(UUID)',
+    `agent_version`        VARCHAR(64)     NOT NULL COMMENT 'agent 版本',
+    `ruleset_version`      VARCHAR(64)     NOT NULL COMMENT '规则集版本',
+    `reported_at`          DATETIME(3)     NOT NULL COMMENT 'agent 实际完成并上报时间（UTC）',
+    `diff_lines`           INT UNSIGNED    NOT NULL COMMENT '本次变更涉及的 diff 行数',
+    `triggered_total_hits` INT UNSIGNED    NOT NULL COMMENT '本次运行命中的规则总数',
+    `rule_hits_json`       JSON            NOT NULL COMMENT '各规则命中次数快照，如 {"RULE-1":3}',
+    `created_at`           DATETIME(3)     NULL COMMENT '记录入库时间',
+    PRIMARY KEY (`id`),
+    UNIQUE KEY `uk_repo_change_run` (`repo`, `code_change_id`, `agent_run_id`),
+    KEY `idx_repo_change_reported` (`repo`, `code_change_id`, `reported_at`),
+    KEY `idx_repo_reported` (`repo`, `reported_at`),
+    KEY `idx_reported_at` (`reported_at`)
+) ENGINE = InnoDB DEFAULT CHARSET = utf8mb4;
+
+CREATE TABLE IF NOT EXISTS `cr_agent_run_rule` (
+    `id`              BIGINT UNSIGNED NOT NULL AUTO_INCREMENT COMMENT '自增主键',
+    `run_id`          BIGINT UNSIGNED NOT NULL COMMENT '关联 cr_agent_run.id',
+    `repo`            VARCHAR(128)    NOT NULL COMMENT '仓库标识',
+    `code_change_id`  VARCHAR(128)    NOT NULL COMMENT '代码变更ID',
+    `reported_at`     DATETIME(3)     NOT NULL COMMENT '上报时间（UTC）',
+    `ruleset_version` VARCHAR(64)     NOT NULL COMMENT '规则集版本（冗余自 run）',
+    `rule_id`         VARCHAR(128)    NOT NULL COMMENT '规则ID',
+    `hit_count`       INT UNSIGNED    NOT NULL COMMENT '该规则在本次 run 的命中次数',
+    PRIMARY KEY (`id`),
+    UNIQUE KEY `uk_run_rule` (`run_id`, `rule_id`),
+    KEY `idx_rule_time` (`rule_id`, `reported_at`),
+    KEY `idx_rule_repo_time` (`rule_id`, `repo`, `reported_at`),
+    KEY `idx_change_rule` (`repo`, `code_change_id`, `rule_id`),
+    KEY `idx_ruleset_rule` (`ruleset_version`, `rule_id`)
+) ENGINE = InnoDB DEFAULT CHARSET = utf8mb4;
+
+CREATE TABLE IF NOT EXISTS `code_change_summary` (
+    `repo`                 VARCHAR(128)    NOT NULL COMMENT '仓库标识',
+    `code_change_id`       VARCHAR(128)    NOT NULL COMMENT '代码变更ID（PR / Change-Id 等）',
+    `run_count`            INT UNSIGNED    NOT NULL COMMENT '该 code change 被 agent 扫描的次数',
+    `first_reported_at`    DATETIME(3)     NOT NULL COMMENT '首次扫描时间（UTC）',
+    `last_reported_at`     DATETIME(3)     NOT NULL COMMENT '最近一次扫描时间（UTC）',
+    `max_total_hits`       INT UNSIGNED    NOT NULL COMMENT '历史最大规则命中总数',
+    `max_run_id`           BIGINT UNSIGNED NOT NULL COMMENT '产生最大命中数的 run_id',
+    `min_total_hits`       INT UNSIGNED    NOT NULL COMMENT '历史最小规则命中总数',
+    `min_run_id`           BIGINT UNSIGNED NOT NULL COMMENT '产生最小命中数的 run_id',
+    `last_ruleset_version` VARCHAR(64)     NOT NULL COMMENT '最近一次运行使用的规则集版本',
+    `improvement_rate`     DECIMAL(6,5)    NULL COMMENT '规则命中改进率，范围 [0,1]，单次 run 时为 NULL',
+    PRIMARY KEY (`repo`, `code_change_id`),
+    KEY `idx_repo_last_reported` (`repo`, `last_reported_at`),
+    KEY `idx_repo_run_count` (`repo`, `run_count`)
+) ENGINE = InnoDB DEFAULT CHARSET = utf8mb4;
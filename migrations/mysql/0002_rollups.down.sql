@@ -0,0 +1,2 @@
+DROP TABLE IF EXISTS `cr_rule_rollup`;
+DROP TABLE IF EXISTS `cr_run_rollup`;
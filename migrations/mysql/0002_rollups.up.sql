@@ -0,0 +1,45 @@
+CREATE TABLE IF NOT EXISTS `cr_run_rollup` (
+    `granularity`      VARCHAR(8)      NOT NULL COMMENT '聚合粒度 hour / day',
+    `bucket_start`     DATETIME(3)     NOT NULL COMMENT '桶起始时间（UTC）',
+    `repo`             VARCHAR(128)    NOT NULL COMMENT '仓库标识',
+    `ruleset_version`  VARCHAR(64)     NOT NULL COMMENT '规则集版本',
+    `agent_version`    VARCHAR(64)     NOT NULL COMMENT 'agent 版本',
+    `run_count`        BIGINT UNSIGNED NOT NULL COMMENT 'run 数',
+    `total_hits`       BIGINT UNSIGNED NOT NULL COMMENT '规则命中总数',
+    `total_diff_lines` BIGINT UNSIGNED NOT NULL COMMENT 'diff 行数之和',
+    PRIMARY KEY (`granularity`, `bucket_start`, `repo`, `ruleset_version`, `agent_version`),
+    KEY `idx_run_rollup_repo` (`granularity`, `repo`, `bucket_start`)
+) ENGINE = InnoDB DEFAULT CHARSET = utf8mb4;
+
+CREATE TABLE IF NOT EXISTS `cr_rule_rollup` (
+    `granularity`     VARCHAR(8)      NOT NULL COMMENT '聚合粒度 hour / day',
+    `bucket_start`    DATETIME(3)     NOT NULL COMMENT '桶起始时间（UTC）',
+    `repo`            VARCHAR(128)    NOT NULL COMMENT '仓库标识',
+    `ruleset_version` VARCHAR(64)     NOT NULL COMMENT '规则集版本',
+    `agent_version`   VARCHAR(64)     NOT NULL COMMENT 'agent 版本',
+    `rule_id`         VARCHAR(128)    NOT NULL COMMENT '规则ID',
+    `hit_count`       BIGINT UNSIGNED NOT NULL COMMENT '命中次数之和',
+    `run_count`       BIGINT UNSIGNED NOT NULL COMMENT '命中该规则的 run 数',
+    PRIMARY KEY (`granularity`, `bucket_start`, `repo`, `ruleset_version`, `agent_version`, `rule_id`),
+    KEY `idx_rule_rollup_repo` (`granularity`, `repo`, `bucket_start`)
+) ENGINE = InnoDB DEFAULT CHARSET = utf8mb4;
+
+INSERT INTO `cr_run_rollup` (`granularity`, `bucket_start`, `repo`, `ruleset_version`, `agent_version`, `run_count`, `total_hits`, `total_diff_lines`)
+SELECT 'hour', DATE_FORMAT(`reported_at`, '%Y-%m-%d %H:00:00'), `repo`, `ruleset_version`, `agent_version`, COUNT(*), SUM(`triggered_total_hits`), SUM(`diff_lines`)
+FROM `cr_agent_run`
+GROUP BY 2, `repo`, `ruleset_version`, `agent_version`;
+
+INSERT INTO `cr_run_rollup` (`granularity`, `bucket_start`, `repo`, `ruleset_version`, `agent_version`, `run_count`, `total_hits`, `total_diff_lines`)
+SELECT 'day', DATE(`reported_at`), `repo`, `ruleset_version`, `agent_version`, COUNT(*), SUM(`triggered_total_hits`), SUM(`diff_lines`)
+FROM `cr_agent_run`
+GROUP BY 2, `repo`, `ruleset_version`, `agent_version`;
+
+INSERT INTO `cr_rule_rollup` (`granularity`, `bucket_start`, `repo`, `ruleset_version`, `agent_version`, `rule_id`, `hit_count`, `run_count`)
+SELECT 'hour', DATE_FORMAT(rr.`reported_at`, '%Y-%m-%d %H:00:00'), rr.`repo`, rr.`ruleset_version`, r.`agent_version`, rr.`rule_id`, SUM(rr.`hit_count`), COUNT(*)
+FROM `cr_agent_run_rule` rr JOIN `cr_agent_run` r ON r.`id` = rr.`run_id`
+GROUP BY 2, rr.`repo`, rr.`ruleset_version`, r.`agent_version`, rr.`rule_id`;
+
+INSERT INTO `cr_rule_rollup` (`granularity`, `bucket_start`, `repo`, `ruleset_version`, `agent_version`, `rule_id`, `hit_count`, `run_count`)
+SELECT 'day', DATE(rr.`reported_at`), rr.`repo`, rr.`ruleset_version`, r.`agent_version`, rr.`rule_id`, SUM(rr.`hit_count`), COUNT(*)
+FROM `cr_agent_run_rule` rr JOIN `cr_agent_run` r ON r.`id` = rr.`run_id`
+GROUP BY 2, rr.`repo`, rr.`ruleset_version`, r.`agent_version`, rr.`rule_id`;
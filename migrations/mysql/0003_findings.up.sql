@@ -0,0 +1,16 @@
+CREATE TABLE IF NOT EXISTS `cr_agent_run_finding` (
+    `id`             BIGINT UNSIGNED NOT NULL AUTO_INCREMENT COMMENT '自增主键',
+    `run_id`         BIGINT UNSIGNED NOT NULL COMMENT '关联 cr_agent_run.id',
+    `repo`           VARCHAR(128)    NOT NULL COMMENT '仓库标识',
+    `code_change_id` VARCHAR(128)    NOT NULL COMMENT '代码变更ID',
+    `reported_at`    DATETIME(3)     NOT NULL COMMENT '上报时间（UTC，冗余自 run）',
+    `rule_id`        VARCHAR(128)    NOT NULL COMMENT '规则ID',
+    `file_path`      VARCHAR(512)    NOT NULL COMMENT '命中文件路径',
+    `start_line`     INT UNSIGNED    NOT NULL COMMENT '起始行号（从 1 开始）',
+    `end_line`       INT UNSIGNED    NOT NULL COMMENT '结束行号（含）',
+    `severity`       VARCHAR(16)     NOT NULL COMMENT '严重级别 info / warning / error / critical',
+    `fingerprint`    VARCHAR(64)     NOT NULL COMMENT '问题指纹，用于跨 run 追踪同一问题',
+    PRIMARY KEY (`id`),
+    KEY `idx_finding_run` (`run_id`, `rule_id`),
+    KEY `idx_finding_change` (`repo`, `code_change_id`, `fingerprint`)
+) ENGINE = InnoDB DEFAULT CHARSET = utf8mb4;
@@ -0,0 +1,19 @@
+CREATE TABLE IF NOT EXISTS `cr_finding_transition` (
+    `id`              BIGINT UNSIGNED NOT NULL AUTO_INCREMENT COMMENT '自增主键',
+    `run_id`          BIGINT UNSIGNED NOT NULL COMMENT '关联 cr_agent_run.id',
+    `prev_run_id`     BIGINT UNSIGNED NOT NULL COMMENT '对比的上一次 run，首次 run 为 0',
+    `repo`            VARCHAR(128)    NOT NULL COMMENT '仓库标识',
+    `code_change_id`  VARCHAR(128)    NOT NULL COMMENT '代码变更ID',
+    `reported_at`     DATETIME(3)     NOT NULL COMMENT 'run 上报时间（UTC）',
+    `ruleset_version` VARCHAR(64)     NOT NULL COMMENT '规则集版本（冗余自 run）',
+    `rule_id`         VARCHAR(128)    NOT NULL COMMENT '规则ID',
+    `fingerprint`     VARCHAR(64)     NOT NULL COMMENT '问题指纹',
+    `status`          VARCHAR(16)     NOT NULL COMMENT 'new / persisted / fixed',
+    `finding_count`   INT UNSIGNED    NOT NULL COMMENT '该指纹在此状态下的问题数',
+    `file_path`       VARCHAR(512)    NOT NULL COMMENT '文件路径（fixed 取自上一次 run）',
+    `start_line`      INT UNSIGNED    NOT NULL COMMENT '起始行号（fixed 取自上一次 run）',
+    PRIMARY KEY (`id`),
+    KEY `idx_transition_run` (`run_id`),
+    KEY `idx_transition_change` (`repo`, `code_change_id`, `reported_at`),
+    KEY `idx_transition_rule` (`rule_id`, `reported_at`)
+) ENGINE = InnoDB DEFAULT CHARSET = utf8mb4;
@@ -0,0 +1,18 @@
+CREATE TABLE IF NOT EXISTS `cr_finding_feedback` (
+    `id`              BIGINT UNSIGNED NOT NULL AUTO_INCREMENT COMMENT '自增主键',
+    `run_id`          BIGINT UNSIGNED NOT NULL COMMENT '关联 cr_agent_run.id',
+    `repo`            VARCHAR(128)    NOT NULL COMMENT '仓库标识',
+    `code_change_id`  VARCHAR(128)    NOT NULL COMMENT '代码变更ID',
+    `reported_at`     DATETIME(3)     NOT NULL COMMENT 'run 上报时间（UTC，冗余自 run）',
+    `ruleset_version` VARCHAR(64)     NOT NULL COMMENT '规则集版本（冗余自 run）',
+    `rule_id`         VARCHAR(128)    NOT NULL COMMENT '规则ID',
+    `finding_id`      BIGINT UNSIGNED NOT NULL COMMENT '关联 cr_agent_run_finding.id，针对整条规则时为 0',
+    `fingerprint`     VARCHAR(64)     NOT NULL COMMENT '问题指纹，针对整条规则时为空',
+    `actor`           VARCHAR(128)    NOT NULL COMMENT '反馈人',
+    `verdict`         VARCHAR(16)     NOT NULL COMMENT 'accepted / dismissed / false_positive',
+    `comment`         VARCHAR(1024)   NOT NULL COMMENT '反馈说明',
+    `created_at`      DATETIME(3)     NOT NULL COMMENT '反馈时间（UTC）',
+    PRIMARY KEY (`id`),
+    UNIQUE KEY `uk_feedback_target` (`run_id`, `rule_id`, `fingerprint`, `actor`),
+    KEY `idx_feedback_rule` (`rule_id`, `reported_at`)
+) ENGINE = InnoDB DEFAULT CHARSET = utf8mb4;
@@ -0,0 +1,24 @@
+CREATE TABLE IF NOT EXISTS `cr_rule_catalog` (
+    `id`         BIGINT UNSIGNED NOT NULL AUTO_INCREMENT COMMENT '自增主键',
+    `rule_id`    VARCHAR(128)    NOT NULL COMMENT '规则ID',
+    `title`      VARCHAR(256)    NOT NULL COMMENT '规则标题',
+    `category`   VARCHAR(64)     NOT NULL COMMENT '规则分类',
+    `severity`   VARCHAR(16)     NOT NULL COMMENT '默认严重级别 info / warning / error / critical，可为空',
+    `owner`      VARCHAR(128)    NOT NULL COMMENT '负责团队',
+    `docs_url`   VARCHAR(512)    NOT NULL COMMENT '规则文档链接',
+    `created_at` DATETIME(3)     NOT NULL COMMENT '首次登记时间（UTC）',
+    `updated_at` DATETIME(3)     NOT NULL COMMENT '最近更新时间（UTC）',
+    PRIMARY KEY (`id`),
+    UNIQUE KEY `uk_rule_catalog_rule` (`rule_id`),
+    KEY `idx_rule_catalog_category` (`category`),
+    KEY `idx_rule_catalog_owner` (`owner`)
+) ENGINE = InnoDB DEFAULT CHARSET = utf8mb4;
+
+CREATE TABLE IF NOT EXISTS `cr_rule_catalog_version` (
+    `id`              BIGINT UNSIGNED NOT NULL AUTO_INCREMENT COMMENT '自增主键',
+    `rule_id`         VARCHAR(128)    NOT NULL COMMENT '规则ID',
+    `ruleset_version` VARCHAR(64)     NOT NULL COMMENT '包含该规则的规则集版本',
+    PRIMARY KEY (`id`),
+    UNIQUE KEY `uk_rule_catalog_version` (`rule_id`, `ruleset_version`),
+    KEY `idx_rule_catalog_version` (`ruleset_version`)
+) ENGINE = InnoDB DEFAULT CHARSET = utf8mb4;
@@ -0,0 +1 @@
+DROP TABLE IF EXISTS `cr_ruleset_manifest`;
@@ -0,0 +1,9 @@
+CREATE TABLE IF NOT EXISTS `cr_ruleset_manifest` (
+    `id`              BIGINT UNSIGNED NOT NULL AUTO_INCREMENT COMMENT '自增主键',
+    `ruleset_version` VARCHAR(64)     NOT NULL COMMENT '规则集版本',
+    `rule_id`         VARCHAR(128)    NOT NULL COMMENT '规则ID',
+    `config_hash`     VARCHAR(128)    NOT NULL COMMENT '规则配置哈希，用于判断规则是否被修改',
+    `uploaded_at`     DATETIME(3)     NOT NULL COMMENT '清单上传时间（UTC）',
+    PRIMARY KEY (`id`),
+    UNIQUE KEY `uk_manifest_rule` (`ruleset_version`, `rule_id`)
+) ENGINE = InnoDB DEFAULT CHARSET = utf8mb4;
@@ -0,0 +1,17 @@
+CREATE TABLE IF NOT EXISTS `cr_anomaly` (
+    `id`            BIGINT UNSIGNED NOT NULL AUTO_INCREMENT COMMENT '自增主键',
+    `repo`          VARCHAR(128)    NOT NULL COMMENT '仓库标识',
+    `metric`        VARCHAR(16)     NOT NULL COMMENT '指标：runs / hits / density',
+    `bucket_start`  DATETIME(3)     NOT NULL COMMENT '异常所在的天（UTC 零点）',
+    `value`         DOUBLE          NOT NULL COMMENT '当天的实际值',
+    `expected`      DOUBLE          NOT NULL COMMENT '基线期望值（前几周同一星期几的均值）',
+    `score`         DOUBLE          NOT NULL COMMENT '偏离基线的标准差倍数，正数为偏高',
+    `severity`      VARCHAR(16)     NOT NULL COMMENT '严重程度：warning / critical',
+    `direction`     VARCHAR(8)      NOT NULL COMMENT '方向：spike / drop',
+    `baseline_days` INT UNSIGNED    NOT NULL COMMENT '参与基线的天数',
+    `detected_at`   DATETIME(3)     NOT NULL COMMENT '首次检测到的时间（UTC）',
+    `updated_at`    DATETIME(3)     NOT NULL COMMENT '最近一次检测更新的时间（UTC）',
+    PRIMARY KEY (`id`),
+    UNIQUE KEY `uk_anomaly_point` (`repo`, `metric`, `bucket_start`),
+    KEY `idx_anomaly_bucket` (`bucket_start`)
+) ENGINE = InnoDB DEFAULT CHARSET = utf8mb4;
@@ -0,0 +1,3 @@
+DROP TABLE IF EXISTS `cr_alert_silence`;
+DROP TABLE IF EXISTS `cr_alert_state`;
+DROP TABLE IF EXISTS `cr_alert_rule`;
@@ -0,0 +1,49 @@
+CREATE TABLE IF NOT EXISTS `cr_alert_rule` (
+    `id`              BIGINT UNSIGNED NOT NULL AUTO_INCREMENT COMMENT '自增主键',
+    `name`            VARCHAR(64)     NOT NULL COMMENT '规则名称',
+    `metric`          VARCHAR(32)     NOT NULL COMMENT '指标：runs / hits / hit_density / improvement_rate / fix_rate / false_positive_rate',
+    `operator`        VARCHAR(2)      NOT NULL COMMENT '比较运算符：> / >= / < / <=',
+    `threshold`       DOUBLE          NOT NULL COMMENT '阈值',
+    `eval_window`     VARCHAR(16)     NOT NULL COMMENT '统计窗口，如 2h / 7d',
+    `for_duration`    VARCHAR(16)     NOT NULL COMMENT '条件需持续满足的时长，空表示立即触发',
+    `repeat_interval` VARCHAR(16)     NOT NULL COMMENT '持续触发时重复通知的间隔，空表示不重复',
+    `min_runs`        INT UNSIGNED    NOT NULL COMMENT '窗口内 run 数少于该值时视为无数据',
+    `repo`            VARCHAR(128)    NOT NULL COMMENT '仓库过滤，空表示全部',
+    `ruleset_version` VARCHAR(64)     NOT NULL COMMENT '规则集版本过滤，空表示全部',
+    `agent_version`   VARCHAR(64)     NOT NULL COMMENT 'agent 版本过滤，空表示全部',
+    `rule_id`         VARCHAR(128)    NOT NULL COMMENT '代码评审规则ID过滤，只用于规则指标',
+    `severity`        VARCHAR(16)     NOT NULL COMMENT '告警级别：warning / critical',
+    `webhooks`        VARCHAR(512)    NOT NULL COMMENT '通知的 webhook 名称，逗号分隔，空表示全部',
+    `disabled`        TINYINT(1)      NOT NULL COMMENT '是否停用',
+    `created_at`      DATETIME(3)     NOT NULL COMMENT '创建时间（UTC）',
+    `updated_at`      DATETIME(3)     NOT NULL COMMENT '最近更新时间（UTC）',
+    PRIMARY KEY (`id`),
+    UNIQUE KEY `uk_alert_rule_name` (`name`)
+) ENGINE = InnoDB DEFAULT CHARSET = utf8mb4;
+
+CREATE TABLE IF NOT EXISTS `cr_alert_state` (
+    `rule_name`    VARCHAR(64)  NOT NULL COMMENT '告警规则名称',
+    `state`        VARCHAR(16)  NOT NULL COMMENT '状态：ok / pending / firing',
+    `value`        DOUBLE       NULL COMMENT '最近一次计算的指标值，无数据时为 NULL',
+    `active_since` DATETIME(3)  NULL COMMENT '条件开始持续满足的时间（UTC）',
+    `fired_at`     DATETIME(3)  NULL COMMENT '本轮告警开始触发的时间（UTC）',
+    `resolved_at`  DATETIME(3)  NULL COMMENT '本轮告警恢复的时间（UTC）',
+    `notified`     VARCHAR(16)  NOT NULL COMMENT '本轮告警已送达的通知：空 / firing / resolved',
+    `notified_at`  DATETIME(3)  NULL COMMENT '最近一次送达通知的时间（UTC）',
+    `last_error`   VARCHAR(512) NOT NULL COMMENT '最近一次计算或通知的错误',
+    `evaluated_at` DATETIME(3)  NOT NULL COMMENT '最近一次计算的时间（UTC）',
+    PRIMARY KEY (`rule_name`)
+) ENGINE = InnoDB DEFAULT CHARSET = utf8mb4;
+
+CREATE TABLE IF NOT EXISTS `cr_alert_silence` (
+    `id`         BIGINT UNSIGNED NOT NULL AUTO_INCREMENT COMMENT '自增主键',
+    `rule_name`  VARCHAR(64)     NOT NULL COMMENT '匹配的告警规则名称，空表示全部',
+    `repo`       VARCHAR(128)    NOT NULL COMMENT '匹配的告警规则仓库，空表示全部',
+    `starts_at`  DATETIME(3)     NOT NULL COMMENT '静默开始时间（UTC）',
+    `ends_at`    DATETIME(3)     NOT NULL COMMENT '静默结束时间（UTC）',
+    `comment`    VARCHAR(512)    NOT NULL COMMENT '静默原因',
+    `created_by` VARCHAR(128)    NOT NULL COMMENT '创建人',
+    `created_at` DATETIME(3)     NOT NULL COMMENT '创建时间（UTC）',
+    PRIMARY KEY (`id`),
+    KEY `idx_alert_silence_ends` (`ends_at`)
+) ENGINE = InnoDB DEFAULT CHARSET = utf8mb4;
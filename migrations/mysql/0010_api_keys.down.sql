@@ -0,0 +1,2 @@
+DROP TABLE IF EXISTS `cr_api_key_repo`;
+DROP TABLE IF EXISTS `cr_api_key`;
@@ -0,0 +1,23 @@
+CREATE TABLE IF NOT EXISTS `cr_api_key` (
+    `id`                  BIGINT UNSIGNED NOT NULL AUTO_INCREMENT COMMENT '自增主键',
+    `name`                VARCHAR(128)    NOT NULL COMMENT '密钥名称，如使用方',
+    `key_prefix`          VARCHAR(16)     NOT NULL COMMENT '密钥开头几位，用于辨认',
+    `key_hash`            CHAR(64)        NOT NULL COMMENT '密钥的 SHA-256（十六进制）',
+    `previous_key_hash`   VARCHAR(64)     NOT NULL COMMENT '轮换前密钥的 SHA-256，宽限期内仍可使用',
+    `previous_expires_at` DATETIME(3)     NULL COMMENT '轮换前密钥失效时间（UTC）',
+    `created_at`          DATETIME(3)     NOT NULL COMMENT '创建时间（UTC）',
+    `rotated_at`          DATETIME(3)     NULL COMMENT '最近一次轮换时间（UTC）',
+    `revoked_at`          DATETIME(3)     NULL COMMENT '吊销时间（UTC），为空表示有效',
+    `last_used_at`        DATETIME(3)     NULL COMMENT '最近一次使用时间（UTC），按分钟更新',
+    PRIMARY KEY (`id`),
+    UNIQUE KEY `uk_api_key_hash` (`key_hash`),
+    KEY `idx_api_key_previous_hash` (`previous_key_hash`)
+) ENGINE = InnoDB DEFAULT CHARSET = utf8mb4;
+
+CREATE TABLE IF NOT EXISTS `cr_api_key_repo` (
+    `id`           BIGINT UNSIGNED NOT NULL AUTO_INCREMENT COMMENT '自增主键',
+    `key_id`       BIGINT UNSIGNED NOT NULL COMMENT '关联 cr_api_key.id',
+    `repo_pattern` VARCHAR(128)    NOT NULL COMMENT '仓库标识，或以 /* 结尾的仓库前缀',
+    PRIMARY KEY (`id`),
+    UNIQUE KEY `uk_api_key_repo` (`key_id`, `repo_pattern`)
+) ENGINE = InnoDB DEFAULT CHARSET = utf8mb4;
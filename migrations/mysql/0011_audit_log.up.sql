@@ -0,0 +1,17 @@
+CREATE TABLE IF NOT EXISTS `cr_audit_log` (
+    `id`          BIGINT UNSIGNED NOT NULL AUTO_INCREMENT COMMENT '自增主键',
+    `created_at`  DATETIME(3)     NOT NULL COMMENT '请求时间（UTC）',
+    `actor`       VARCHAR(128)    NOT NULL COMMENT '操作者，未鉴权时为空',
+    `action`      VARCHAR(64)     NOT NULL COMMENT '操作，如 alert_rule.upsert',
+    `target`      VARCHAR(255)    NOT NULL COMMENT '操作对象，如告警规则名',
+    `params_json` JSON            NOT NULL COMMENT '请求参数（query 与请求体）',
+    `status`      INT             NOT NULL COMMENT 'HTTP 状态码',
+    `result`      VARCHAR(16)     NOT NULL COMMENT '结果：success / failure',
+    `error`       VARCHAR(64)     NOT NULL COMMENT '失败时的错误码',
+    `message`     VARCHAR(1024)   NOT NULL COMMENT '失败时的错误信息',
+    `remote_addr` VARCHAR(64)     NOT NULL COMMENT '客户端地址',
+    PRIMARY KEY (`id`),
+    KEY `idx_audit_created` (`created_at`),
+    KEY `idx_audit_actor_created` (`actor`, `created_at`),
+    KEY `idx_audit_action_created` (`action`, `created_at`)
+) ENGINE = InnoDB DEFAULT CHARSET = utf8mb4;
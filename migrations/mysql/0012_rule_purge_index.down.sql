@@ -0,0 +1 @@
+ALTER TABLE `cr_agent_run_rule` DROP KEY `idx_rule_reported_id`;
@@ -0,0 +1 @@
+ALTER TABLE `cr_agent_run_rule` ADD KEY `idx_rule_reported_id` (`reported_at`, `id`);
@@ -0,0 +1,14 @@
+CREATE TABLE IF NOT EXISTS `cr_agent_regression` (
+    `id`               BIGINT UNSIGNED NOT NULL AUTO_INCREMENT COMMENT '自增主键',
+    `agent_version`    VARCHAR(64)     NOT NULL COMMENT '有退化的 agent 版本',
+    `baseline_version` VARCHAR(64)     NOT NULL COMMENT '对比的上一个版本',
+    `first_seen_at`    DATETIME(3)     NOT NULL COMMENT '该版本首次上报时间（UTC）',
+    `matched_repos`    BIGINT UNSIGNED NOT NULL COMMENT '两个版本都运行过的仓库数',
+    `baseline_runs`    BIGINT UNSIGNED NOT NULL COMMENT '上一个版本在这些仓库上的 run 数',
+    `current_runs`     BIGINT UNSIGNED NOT NULL COMMENT '该版本在这些仓库上的 run 数',
+    `regressions`      VARCHAR(128)    NOT NULL COMMENT '退化的指标，逗号分隔',
+    `detected_at`      DATETIME(3)     NOT NULL COMMENT '首次检测到的时间（UTC）',
+    `updated_at`       DATETIME(3)     NOT NULL COMMENT '最近一次检测更新的时间（UTC）',
+    PRIMARY KEY (`id`),
+    UNIQUE KEY `uk_agent_regression_version` (`agent_version`)
+) ENGINE = InnoDB DEFAULT CHARSET = utf8mb4;
@@ -0,0 +1,50 @@
+CREATE TABLE IF NOT EXISTS cr_agent_run (
+    id                   BIGSERIAL PRIMARY KEY,
+    repo                 VARCHAR(128) NOT NULL,
+    code_change_id       VARCHAR(128) NOT NULL,
+    agent_run_id         CHAR(36)     NOT NULL,
+    agent_version        VARCHAR(64)  NOT NULL,
+    ruleset_version      VARCHAR(64)  NOT NULL,
+    reported_at          TIMESTAMP(3) NOT NULL,
+    diff_lines           BIGINT       NOT NULL,
+    triggered_total_hits BIGINT       NOT NULL,
+    rule_hits_json       JSONB        NOT NULL,
+    created_at           TIMESTAMP(3)
+);
+CREATE UNIQUE INDEX IF NOT EXISTS uk_repo_change_run ON cr_agent_run (repo, code_change_id, agent_run_id);
+CREATE INDEX IF NOT EXISTS idx_repo_change_reported ON cr_agent_run (repo, code_change_id, reported_at);
+CREATE INDEX IF NOT EXISTS idx_repo_reported ON cr_agent_run (repo, reported_at);
+CREATE INDEX IF NOT EXISTS idx_reported_at ON cr_agent_run (reported_at);
+
+CREATE TABLE IF NOT EXISTS cr_agent_run_rule (
+    id              BIGSERIAL PRIMARY KEY,
+    run_id          BIGINT       NOT NULL,
+    repo            VARCHAR(128) NOT NULL,
+    code_change_id  VARCHAR(128) NOT NULL,
+    reported_at     TIMESTAMP(3) NOT NULL,
+    ruleset_version VARCHAR(64)  NOT NULL,
+    rule_id         VARCHAR(128) NOT NULL,
+    hit_count       BIGINT       NOT NULL
+);
+CREATE UNIQUE INDEX IF NOT EXISTS uk_run_rule ON cr_agent_run_rule (run_id, rule_id);
+CREATE INDEX IF NOT EXISTS idx_rule_time ON cr_agent_run_rule (rule_id, reported_at);
+CREATE INDEX IF NOT EXISTS idx_rule_repo_time ON cr_agent_run_rule (rule_id, repo, reported_at);
+CREATE INDEX IF NOT EXISTS idx_change_rule ON cr_agent_run_rule (repo, code_change_id, rule_id);
+CREATE INDEX IF NOT EXISTS idx_ruleset_rule ON cr_agent_run_rule (ruleset_version, rule_id);
+
+CREATE TABLE IF NOT EXISTS code_change_summary (
+    repo                 VARCHAR(128) NOT NULL,
+    code_change_id       VARCHAR(128) NOT NULL,
+    run_count            BIGINT       NOT NULL,
+    first_reported_at    TIMESTAMP(3) NOT NULL,
+    last_reported_at     TIMESTAMP(3) NOT NULL,
+    max_total_hits       BIGINT       NOT NULL,
+    max_run_id           BIGINT       NOT NULL,
+    min_total_hits       BIGINT       NOT NULL,
+    min_run_id           BIGINT       NOT NULL,
+    last_ruleset_version VARCHAR(64)  NOT NULL,
+    improvement_rate     NUMERIC(6,5),
+    PRIMARY KEY (repo, code_change_id)
+);
+CREATE INDEX IF NOT EXISTS idx_repo_last_reported ON code_change_summary (repo, last_reported_at);
+CREATE INDEX IF NOT EXISTS idx_repo_run_count ON code_change_summary (repo, run_count);
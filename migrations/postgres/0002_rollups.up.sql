@@ -0,0 +1,45 @@
+CREATE TABLE IF NOT EXISTS cr_run_rollup (
+    granularity      VARCHAR(8)   NOT NULL,
+    bucket_start     TIMESTAMP(3) NOT NULL,
+    repo             VARCHAR(128) NOT NULL,
+    ruleset_version  VARCHAR(64)  NOT NULL,
+    agent_version    VARCHAR(64)  NOT NULL,
+    run_count        BIGINT       NOT NULL,
+    total_hits       BIGINT       NOT NULL,
+    total_diff_lines BIGINT       NOT NULL,
+    PRIMARY KEY (granularity, bucket_start, repo, ruleset_version, agent_version)
+);
+CREATE INDEX IF NOT EXISTS idx_run_rollup_repo ON cr_run_rollup (granularity, repo, bucket_start);
+
+CREATE TABLE IF NOT EXISTS cr_rule_rollup (
+    granularity     VARCHAR(8)   NOT NULL,
+    bucket_start    TIMESTAMP(3) NOT NULL,
+    repo            VARCHAR(128) NOT NULL,
+    ruleset_version VARCHAR(64)  NOT NULL,
+    agent_version   VARCHAR(64)  NOT NULL,
+    rule_id         VARCHAR(128) NOT NULL,
+    hit_count       BIGINT       NOT NULL,
+    run_count       BIGINT       NOT NULL,
+    PRIMARY KEY (granularity, bucket_start, repo, ruleset_version, agent_version, rule_id)
+);
+CREATE INDEX IF NOT EXISTS idx_rule_rollup_repo ON cr_rule_rollup (granularity, repo, bucket_start);
+
+INSERT INTO cr_run_rollup (granularity, bucket_start, repo, ruleset_version, agent_version, run_count, total_hits, total_diff_lines)
+SELECT 'hour', date_trunc('hour', reported_at), repo, ruleset_version, agent_version, COUNT(*), SUM(triggered_total_hits), SUM(diff_lines)
+FROM cr_agent_run
+GROUP BY 2, repo, ruleset_version, agent_version;
+
+INSERT INTO cr_run_rollup (granularity, bucket_start, repo, ruleset_version, agent_version, run_count, total_hits, total_diff_lines)
+SELECT 'day', date_trunc('day', reported_at), repo, ruleset_version, agent_version, COUNT(*), SUM(triggered_total_hits), SUM(diff_lines)
+FROM cr_agent_run
+GROUP BY 2, repo, ruleset_version, agent_version;
+
+INSERT INTO cr_rule_rollup (granularity, bucket_start, repo, ruleset_version, agent_version, rule_id, hit_count, run_count)
+SELECT 'hour', date_trunc('hour', rr.reported_at), rr.repo, rr.ruleset_version, r.agent_version, rr.rule_id, SUM(rr.hit_count), COUNT(*)
+FROM cr_agent_run_rule rr JOIN cr_agent_run r ON r.id = rr.run_id
+GROUP BY 2, rr.repo, rr.ruleset_version, r.agent_version, rr.rule_id;
+
+INSERT INTO cr_rule_rollup (granularity, bucket_start, repo, ruleset_version, agent_version, rule_id, hit_count, run_count)
+SELECT 'day', date_trunc('day', rr.reported_at), rr.repo, rr.ruleset_version, r.agent_version, rr.rule_id, SUM(rr.hit_count), COUNT(*)
+FROM cr_agent_run_rule rr JOIN cr_agent_run r ON r.id = rr.run_id
+GROUP BY 2, rr.repo, rr.ruleset_version, r.agent_version, rr.rule_id;
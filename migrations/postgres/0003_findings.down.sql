@@ -0,0 +1 @@
+DROP TABLE IF EXISTS cr_agent_run_finding;
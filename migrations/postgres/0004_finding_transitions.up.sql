@@ -0,0 +1,18 @@
+CREATE TABLE IF NOT EXISTS cr_finding_transition (
+    id              BIGSERIAL    PRIMARY KEY,
+    run_id          BIGINT       NOT NULL,
+    prev_run_id     BIGINT       NOT NULL,
+    repo            VARCHAR(128) NOT NULL,
+    code_change_id  VARCHAR(128) NOT NULL,
+    reported_at     TIMESTAMP(3) NOT NULL,
+    ruleset_version VARCHAR(64)  NOT NULL,
+    rule_id         VARCHAR(128) NOT NULL,
+    fingerprint     VARCHAR(64)  NOT NULL,
+    status          VARCHAR(16)  NOT NULL,
+    finding_count   BIGINT       NOT NULL,
+    file_path       VARCHAR(512) NOT NULL,
+    start_line      BIGINT       NOT NULL
+);
+CREATE INDEX IF NOT EXISTS idx_transition_run ON cr_finding_transition (run_id);
+CREATE INDEX IF NOT EXISTS idx_transition_change ON cr_finding_transition (repo, code_change_id, reported_at);
+CREATE INDEX IF NOT EXISTS idx_transition_rule ON cr_finding_transition (rule_id, reported_at);
@@ -0,0 +1,22 @@
+CREATE TABLE IF NOT EXISTS cr_rule_catalog (
+    id         BIGSERIAL    PRIMARY KEY,
+    rule_id    VARCHAR(128) NOT NULL,
+    title      VARCHAR(256) NOT NULL,
+    category   VARCHAR(64)  NOT NULL,
+    severity   VARCHAR(16)  NOT NULL,
+    owner      VARCHAR(128) NOT NULL,
+    docs_url   VARCHAR(512) NOT NULL,
+    created_at TIMESTAMP(3) NOT NULL,
+    updated_at TIMESTAMP(3) NOT NULL
+);
+CREATE UNIQUE INDEX IF NOT EXISTS uk_rule_catalog_rule ON cr_rule_catalog (rule_id);
+CREATE INDEX IF NOT EXISTS idx_rule_catalog_category ON cr_rule_catalog (category);
+CREATE INDEX IF NOT EXISTS idx_rule_catalog_owner ON cr_rule_catalog (owner);
+
+CREATE TABLE IF NOT EXISTS cr_rule_catalog_version (
+    id              BIGSERIAL    PRIMARY KEY,
+    rule_id         VARCHAR(128) NOT NULL,
+    ruleset_version VARCHAR(64)  NOT NULL
+);
+CREATE UNIQUE INDEX IF NOT EXISTS uk_rule_catalog_version ON cr_rule_catalog_version (rule_id, ruleset_version);
+CREATE INDEX IF NOT EXISTS idx_rule_catalog_version ON cr_rule_catalog_version (ruleset_version);
@@ -0,0 +1,8 @@
+CREATE TABLE IF NOT EXISTS cr_ruleset_manifest (
+    id              BIGSERIAL    PRIMARY KEY,
+    ruleset_version VARCHAR(64)  NOT NULL,
+    rule_id         VARCHAR(128) NOT NULL,
+    config_hash     VARCHAR(128) NOT NULL,
+    uploaded_at     TIMESTAMP(3) NOT NULL
+);
+CREATE UNIQUE INDEX IF NOT EXISTS uk_manifest_rule ON cr_ruleset_manifest (ruleset_version, rule_id);
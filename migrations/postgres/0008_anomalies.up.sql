@@ -0,0 +1,16 @@
+CREATE TABLE IF NOT EXISTS cr_anomaly (
+    id            BIGSERIAL        PRIMARY KEY,
+    repo          VARCHAR(128)     NOT NULL,
+    metric        VARCHAR(16)      NOT NULL,
+    bucket_start  TIMESTAMP(3)     NOT NULL,
+    value         DOUBLE PRECISION NOT NULL,
+    expected      DOUBLE PRECISION NOT NULL,
+    score         DOUBLE PRECISION NOT NULL,
+    severity      VARCHAR(16)      NOT NULL,
+    direction     VARCHAR(8)       NOT NULL,
+    baseline_days INTEGER          NOT NULL,
+    detected_at   TIMESTAMP(3)     NOT NULL,
+    updated_at    TIMESTAMP(3)     NOT NULL
+);
+CREATE UNIQUE INDEX IF NOT EXISTS uk_anomaly_point ON cr_anomaly (repo, metric, bucket_start);
+CREATE INDEX IF NOT EXISTS idx_anomaly_bucket ON cr_anomaly (bucket_start);
@@ -0,0 +1,21 @@
+CREATE TABLE IF NOT EXISTS cr_api_key (
+    id                  BIGSERIAL    PRIMARY KEY,
+    name                VARCHAR(128) NOT NULL,
+    key_prefix          VARCHAR(16)  NOT NULL,
+    key_hash            CHAR(64)     NOT NULL,
+    previous_key_hash   VARCHAR(64)  NOT NULL,
+    previous_expires_at TIMESTAMP(3) NULL,
+    created_at          TIMESTAMP(3) NOT NULL,
+    rotated_at          TIMESTAMP(3) NULL,
+    revoked_at          TIMESTAMP(3) NULL,
+    last_used_at        TIMESTAMP(3) NULL
+);
+CREATE UNIQUE INDEX IF NOT EXISTS uk_api_key_hash ON cr_api_key (key_hash);
+CREATE INDEX IF NOT EXISTS idx_api_key_previous_hash ON cr_api_key (previous_key_hash);
+
+CREATE TABLE IF NOT EXISTS cr_api_key_repo (
+    id           BIGSERIAL    PRIMARY KEY,
+    key_id       BIGINT       NOT NULL,
+    repo_pattern VARCHAR(128) NOT NULL
+);
+CREATE UNIQUE INDEX IF NOT EXISTS uk_api_key_repo ON cr_api_key_repo (key_id, repo_pattern);
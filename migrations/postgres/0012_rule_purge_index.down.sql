@@ -0,0 +1 @@
+DROP INDEX IF EXISTS idx_rule_reported_id;
@@ -0,0 +1 @@
+CREATE INDEX IF NOT EXISTS idx_rule_reported_id ON cr_agent_run_rule (reported_at, id);
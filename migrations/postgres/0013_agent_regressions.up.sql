@@ -0,0 +1,13 @@
+CREATE TABLE IF NOT EXISTS cr_agent_regression (
+    id               BIGSERIAL    PRIMARY KEY,
+    agent_version    VARCHAR(64)  NOT NULL,
+    baseline_version VARCHAR(64)  NOT NULL,
+    first_seen_at    TIMESTAMP(3) NOT NULL,
+    matched_repos    BIGINT       NOT NULL,
+    baseline_runs    BIGINT       NOT NULL,
+    current_runs     BIGINT       NOT NULL,
+    regressions      VARCHAR(128) NOT NULL,
+    detected_at      TIMESTAMP(3) NOT NULL,
+    updated_at       TIMESTAMP(3) NOT NULL
+);
+CREATE UNIQUE INDEX IF NOT EXISTS uk_agent_regression_version ON cr_agent_regression (agent_version);
@@ -0,0 +1,3 @@
+DROP TABLE IF EXISTS code_change_summary;
+DROP TABLE IF EXISTS cr_agent_run_rule;
+DROP TABLE IF EXISTS cr_agent_run;
@@ -0,0 +1,45 @@
+CREATE TABLE IF NOT EXISTS cr_run_rollup (
+    granularity      VARCHAR(8)   NOT NULL,
+    bucket_start     DATETIME     NOT NULL,
+    repo             VARCHAR(128) NOT NULL,
+    ruleset_version  VARCHAR(64)  NOT NULL,
+    agent_version    VARCHAR(64)  NOT NULL,
+    run_count        INTEGER      NOT NULL,
+    total_hits       INTEGER      NOT NULL,
+    total_diff_lines INTEGER      NOT NULL,
+    PRIMARY KEY (granularity, bucket_start, repo, ruleset_version, agent_version)
+);
+CREATE INDEX IF NOT EXISTS idx_run_rollup_repo ON cr_run_rollup (granularity, repo, bucket_start);
+
+CREATE TABLE IF NOT EXISTS cr_rule_rollup (
+    granularity     VARCHAR(8)   NOT NULL,
+    bucket_start    DATETIME     NOT NULL,
+    repo            VARCHAR(128) NOT NULL,
+    ruleset_version VARCHAR(64)  NOT NULL,
+    agent_version   VARCHAR(64)  NOT NULL,
+    rule_id         VARCHAR(128) NOT NULL,
+    hit_count       INTEGER      NOT NULL,
+    run_count       INTEGER      NOT NULL,
+    PRIMARY KEY (granularity, bucket_start, repo, ruleset_version, agent_version, rule_id)
+);
+CREATE INDEX IF NOT EXISTS idx_rule_rollup_repo ON cr_rule_rollup (granularity, repo, bucket_start);
+
+INSERT INTO cr_run_rollup (granularity, bucket_start, repo, ruleset_version, agent_version, run_count, total_hits, total_diff_lines)
+SELECT 'hour', strftime('%Y-%m-%d %H:00:00+00:00', reported_at), repo, ruleset_version, agent_version, COUNT(*), SUM(triggered_total_hits), SUM(diff_lines)
+FROM cr_agent_run
+GROUP BY 2, repo, ruleset_version, agent_version;
+
+INSERT INTO cr_run_rollup (granularity, bucket_start, repo, ruleset_version, agent_version, run_count, total_hits, total_diff_lines)
+SELECT 'day', strftime('%Y-%m-%d 00:00:00+00:00', reported_at), repo, ruleset_version, agent_version, COUNT(*), SUM(triggered_total_hits), SUM(diff_lines)
+FROM cr_agent_run
+GROUP BY 2, repo, ruleset_version, agent_version;
+
+INSERT INTO cr_rule_rollup (granularity, bucket_start, repo, ruleset_version, agent_version, rule_id, hit_count, run_count)
+SELECT 'hour', strftime('%Y-%m-%d %H:00:00+00:00', rr.reported_at), rr.repo, rr.ruleset_version, r.agent_version, rr.rule_id, SUM(rr.hit_count), COUNT(*)
+FROM cr_agent_run_rule rr JOIN cr_agent_run r ON r.id = rr.run_id
+GROUP BY 2, rr.repo, rr.ruleset_version, r.agent_version, rr.rule_id;
+
+INSERT INTO cr_rule_rollup (granularity, bucket_start, repo, ruleset_version, agent_version, rule_id, hit_count, run_count)
+SELECT 'day', strftime('%Y-%m-%d 00:00:00+00:00', rr.reported_at), rr.repo, rr.ruleset_version, r.agent_version, rr.rule_id, SUM(rr.hit_count), COUNT(*)
+FROM cr_agent_run_rule rr JOIN cr_agent_run r ON r.id = rr.run_id
+GROUP BY 2, rr.repo, rr.ruleset_version, r.agent_version, rr.rule_id;
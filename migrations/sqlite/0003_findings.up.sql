@@ -0,0 +1,15 @@
+CREATE TABLE IF NOT EXISTS cr_agent_run_finding (
+    id             INTEGER PRIMARY KEY AUTOINCREMENT,
+    run_id         INTEGER      NOT NULL,
+    repo           VARCHAR(128) NOT NULL,
+    code_change_id VARCHAR(128) NOT NULL,
+    reported_at    DATETIME     NOT NULL,
+    rule_id        VARCHAR(128) NOT NULL,
+    file_path      VARCHAR(512) NOT NULL,
+    start_line     INTEGER      NOT NULL,
+    end_line       INTEGER      NOT NULL,
+    severity       VARCHAR(16)  NOT NULL,
+    fingerprint    VARCHAR(64)  NOT NULL
+);
+CREATE INDEX IF NOT EXISTS idx_finding_run ON cr_agent_run_finding (run_id, rule_id);
+CREATE INDEX IF NOT EXISTS idx_finding_change ON cr_agent_run_finding (repo, code_change_id, fingerprint);
@@ -0,0 +1,17 @@
+CREATE TABLE IF NOT EXISTS cr_finding_feedback (
+    id              INTEGER PRIMARY KEY AUTOINCREMENT,
+    run_id          INTEGER       NOT NULL,
+    repo            VARCHAR(128)  NOT NULL,
+    code_change_id  VARCHAR(128)  NOT NULL,
+    reported_at     DATETIME      NOT NULL,
+    ruleset_version VARCHAR(64)   NOT NULL,
+    rule_id         VARCHAR(128)  NOT NULL,
+    finding_id      INTEGER       NOT NULL,
+    fingerprint     VARCHAR(64)   NOT NULL,
+    actor           VARCHAR(128)  NOT NULL,
+    verdict         VARCHAR(16)   NOT NULL,
+    comment         VARCHAR(1024) NOT NULL,
+    created_at      DATETIME      NOT NULL
+);
+CREATE UNIQUE INDEX IF NOT EXISTS uk_feedback_target ON cr_finding_feedback (run_id, rule_id, fingerprint, actor);
+CREATE INDEX IF NOT EXISTS idx_feedback_rule ON cr_finding_feedback (rule_id, reported_at);
@@ -0,0 +1,2 @@
+DROP TABLE IF EXISTS cr_rule_catalog_version;
+DROP TABLE IF EXISTS cr_rule_catalog;
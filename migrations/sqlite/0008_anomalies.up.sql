@@ -0,0 +1,16 @@
+CREATE TABLE IF NOT EXISTS cr_anomaly (
+    id            INTEGER PRIMARY KEY AUTOINCREMENT,
+    repo          VARCHAR(128) NOT NULL,
+    metric        VARCHAR(16)  NOT NULL,
+    bucket_start  DATETIME     NOT NULL,
+    value         REAL         NOT NULL,
+    expected      REAL         NOT NULL,
+    score         REAL         NOT NULL,
+    severity      VARCHAR(16)  NOT NULL,
+    direction     VARCHAR(8)   NOT NULL,
+    baseline_days INTEGER      NOT NULL,
+    detected_at   DATETIME     NOT NULL,
+    updated_at    DATETIME     NOT NULL
+);
+CREATE UNIQUE INDEX IF NOT EXISTS uk_anomaly_point ON cr_anomaly (repo, metric, bucket_start);
+CREATE INDEX IF NOT EXISTS idx_anomaly_bucket ON cr_anomaly (bucket_start);
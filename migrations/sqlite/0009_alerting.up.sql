@@ -0,0 +1,46 @@
+CREATE TABLE IF NOT EXISTS cr_alert_rule (
+    id              INTEGER PRIMARY KEY AUTOINCREMENT,
+    name            VARCHAR(64)  NOT NULL,
+    metric          VARCHAR(32)  NOT NULL,
+    operator        VARCHAR(2)   NOT NULL,
+    threshold       REAL         NOT NULL,
+    eval_window     VARCHAR(16)  NOT NULL,
+    for_duration    VARCHAR(16)  NOT NULL,
+    repeat_interval VARCHAR(16)  NOT NULL,
+    min_runs        INTEGER      NOT NULL,
+    repo            VARCHAR(128) NOT NULL,
+    ruleset_version VARCHAR(64)  NOT NULL,
+    agent_version   VARCHAR(64)  NOT NULL,
+    rule_id         VARCHAR(128) NOT NULL,
+    severity        VARCHAR(16)  NOT NULL,
+    webhooks        VARCHAR(512) NOT NULL,
+    disabled        BOOLEAN      NOT NULL,
+    created_at      DATETIME     NOT NULL,
+    updated_at      DATETIME     NOT NULL
+);
+CREATE UNIQUE INDEX IF NOT EXISTS uk_alert_rule_name ON cr_alert_rule (name);
+
+CREATE TABLE IF NOT EXISTS cr_alert_state (
+    rule_name    VARCHAR(64)  PRIMARY KEY,
+    state        VARCHAR(16)  NOT NULL,
+    value        REAL         NULL,
+    active_since DATETIME     NULL,
+    fired_at     DATETIME     NULL,
+    resolved_at  DATETIME     NULL,
+    notified     VARCHAR(16)  NOT NULL,
+    notified_at  DATETIME     NULL,
+    last_error   VARCHAR(512) NOT NULL,
+    evaluated_at DATETIME     NOT NULL
+);
+
+CREATE TABLE IF NOT EXISTS cr_alert_silence (
+    id         INTEGER PRIMARY KEY AUTOINCREMENT,
+    rule_name  VARCHAR(64)  NOT NULL,
+    repo       VARCHAR(128) NOT NULL,
+    starts_at  DATETIME     NOT NULL,
+    ends_at    DATETIME     NOT NULL,
+    comment    VARCHAR(512) NOT NULL,
+    created_by VARCHAR(128) NOT NULL,
+    created_at DATETIME     NOT NULL
+);
+CREATE INDEX IF NOT EXISTS idx_alert_silence_ends ON cr_alert_silence (ends_at);
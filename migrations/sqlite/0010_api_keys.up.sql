@@ -0,0 +1,21 @@
+CREATE TABLE IF NOT EXISTS cr_api_key (
+    id                  INTEGER PRIMARY KEY AUTOINCREMENT,
+    name                VARCHAR(128) NOT NULL,
+    key_prefix          VARCHAR(16)  NOT NULL,
+    key_hash            CHAR(64)     NOT NULL,
+    previous_key_hash   VARCHAR(64)  NOT NULL,
+    previous_expires_at DATETIME     NULL,
+    created_at          DATETIME     NOT NULL,
+    rotated_at          DATETIME     NULL,
+    revoked_at          DATETIME     NULL,
+    last_used_at        DATETIME     NULL
+);
+CREATE UNIQUE INDEX IF NOT EXISTS uk_api_key_hash ON cr_api_key (key_hash);
+CREATE INDEX IF NOT EXISTS idx_api_key_previous_hash ON cr_api_key (previous_key_hash);
+
+CREATE TABLE IF NOT EXISTS cr_api_key_repo (
+    id           INTEGER PRIMARY KEY AUTOINCREMENT,
+    key_id       INTEGER      NOT NULL,
+    repo_pattern VARCHAR(128) NOT NULL
+);
+CREATE UNIQUE INDEX IF NOT EXISTS uk_api_key_repo ON cr_api_key_repo (key_id, repo_pattern);
@@ -0,0 +1,16 @@
+CREATE TABLE IF NOT EXISTS cr_audit_log (
+    id          INTEGER PRIMARY KEY AUTOINCREMENT,
+    created_at  DATETIME      NOT NULL,
+    actor       VARCHAR(128)  NOT NULL,
+    action      VARCHAR(64)   NOT NULL,
+    target      VARCHAR(255)  NOT NULL,
+    params_json JSON          NOT NULL,
+    status      INTEGER       NOT NULL,
+    result      VARCHAR(16)   NOT NULL,
+    error       VARCHAR(64)   NOT NULL,
+    message     VARCHAR(1024) NOT NULL,
+    remote_addr VARCHAR(64)   NOT NULL
+);
+CREATE INDEX IF NOT EXISTS idx_audit_created ON cr_audit_log (created_at);
+CREATE INDEX IF NOT EXISTS idx_audit_actor_created ON cr_audit_log (actor, created_at);
+CREATE INDEX IF NOT EXISTS idx_audit_action_created ON cr_audit_log (action, created_at);
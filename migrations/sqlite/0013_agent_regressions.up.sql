@@ -0,0 +1,13 @@
+CREATE TABLE IF NOT EXISTS cr_agent_regression (
+    id               INTEGER PRIMARY KEY AUTOINCREMENT,
+    agent_version    VARCHAR(64)  NOT NULL,
+    baseline_version VARCHAR(64)  NOT NULL,
+    first_seen_at    DATETIME     NOT NULL,
+    matched_repos    INTEGER      NOT NULL,
+    baseline_runs    INTEGER      NOT NULL,
+    current_runs     INTEGER      NOT NULL,
+    regressions      VARCHAR(128) NOT NULL,
+    detected_at      DATETIME     NOT NULL,
+    updated_at       DATETIME     NOT NULL
+);
+CREATE UNIQUE INDEX IF NOT EXISTS uk_agent_regression_version ON cr_agent_regression (agent_version);
@@ -0,0 +1,135 @@
+package main
+
+import (
+	"bufio"
+	"bytes"
+	"fmt"
+	"io"
+)
+
+const (
+	defaultNDJSONChunkSize = 500
+	maxNDJSONLineBytes     = 4 << 20
+	// maxNDJSONRejectedLines caps how many rejected lines are reported back in
+	// detail, so a file full of bad records cannot grow the tally unbounded.
+	maxNDJSONRejectedLines = 1000
+)
+
+type ndjsonLineError struct {
+	Line    int          `json:"line"`
+	Error   string       `json:"error"`
+	Message string       `json:"message"`
+	Details []fieldError `json:"details"`
+}
+
+type ndjsonTally struct {
+	Lines           int               `json:"lines"`
+	Inserted        int               `json:"inserted"`
+	Idempotent      int               `json:"idempotent"`
+	Rejected        int               `json:"rejected"`
+	RejectedLines   []ndjsonLineError `json:"rejected_lines"`
+	RejectedOmitted int               `json:"rejected_lines_omitted"`
+}
+
+type ndjsonProgressLine struct {
+	Type       string `json:"type"`
+	Lines      int    `json:"lines"`
+	Inserted   int    `json:"inserted"`
+	Idempotent int    `json:"idempotent"`
+	Rejected   int    `json:"rejected"`
+}
+
+type ndjsonDoneLine struct {
+	Type string `json:"type"`
+	ndjsonTally
+}
+
+type ndjsonErrorLine struct {
+	Type    string      `json:"type"`
+	Error   string      `json:"error"`
+	Message string      `json:"message"`
+	Tally   ndjsonTally `json:"tally"`
+}
+
+// ingestNDJSON reads one agent run per line from r and stores them in chunks of
+// chunkSize, each chunk in its own transaction. progress is called after every
+// committed chunk. Blank lines are skipped but still count towards line numbers.
+// On error the returned tally covers the chunks committed so far, and Lines is
+// the last line that made it into the database. Runs for repos outside a
+// non-nil scope are rejected, and so are runs the store could not store on
+// their own while the rest of their chunk was stored.
+func ingestNDJSON(store Store, r io.Reader, chunkSize int, scope repoScope, progress func(ndjsonTally)) (ndjsonTally, error) {
+	tally := ndjsonTally{RejectedLines: []ndjsonLineError{}}
+
+	scanner := bufio.NewScanner(r)
+	scanner.Buffer(make([]byte, 64*1024), maxNDJSONLineBytes)
+
+	pending := make([]pendingAgentRun, 0, chunkSize)
+	pendingLines := make([]int, 0, chunkSize)
+	lineNo := 0
+	flush := func() error {
+		if len(pending) > 0 {
+			stored, err := store.CreateAgentRunBatch(pending)
+			if err != nil {
+				return err
+			}
+			for j, res := range stored {
+				switch {
+				case res.Err != nil:
+					tally.reject(ndjsonLineError{Line: pendingLines[j], Error: "INTERNAL_ERROR", Message: res.Err.Error()})
+				case res.Idempotent:
+					tally.Idempotent++
+				default:
+					tally.Inserted++
+				}
+			}
+			pending = pending[:0]
+			pendingLines = pendingLines[:0]
+		}
+		tally.Lines = lineNo
+		if progress != nil {
+			progress(tally)
+		}
+		return nil
+	}
+
+	for scanner.Scan() {
+		lineNo++
+		line := bytes.TrimSpace(scanner.Bytes())
+		if len(line) == 0 {
+			continue
+		}
+		run, errs := parseAgentRun(line)
+		if len(errs) > 0 {
+			tally.reject(ndjsonLineError{Line: lineNo, Error: "VALIDATION_ERROR", Message: validationMessage(errs), Details: errs})
+			continue
+		}
+		if errs := scopeErrors(scope, run); len(errs) > 0 {
+			tally.reject(ndjsonLineError{Line: lineNo, Error: "FORBIDDEN", Message: validationMessage(errs), Details: errs})
+			continue
+		}
+		pending = append(pending, run)
+		pendingLines = append(pendingLines, lineNo)
+		if len(pending) >= chunkSize {
+			if err := flush(); err != nil {
+				return tally, fmt.Errorf("line %d: %w", lineNo, err)
+			}
+		}
+	}
+	if err := scanner.Err(); err != nil {
+		return tally, fmt.Errorf("line %d: %w", lineNo+1, err)
+	}
+	if err := flush(); err != nil {
+		return tally, fmt.Errorf("line %d: %w", lineNo, err)
+	}
+	return tally, nil
+}
+
+func (t *ndjsonTally) reject(e ndjsonLineError) {
+	t.Rejected++
+	if len(t.RejectedLines) < maxNDJSONRejectedLines {
+		t.RejectedLines = append(t.RejectedLines, e)
+		return
+	}
+	t.RejectedOmitted++
+}
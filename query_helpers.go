@@ -2,9 +2,11 @@ package main
 
 import (
 	"errors"
+	"fmt"
 	"strconv"
 	"strings"
 	"time"
+	"unicode/utf8"
 
 	"github.com/gin-gonic/gin"
 	"gorm.io/gorm"
@@ -37,6 +39,23 @@ func parseTimeRange(c *gin.Context) (time.Time, time.Time, error) {
 
 var errInvalidRange = errors.New("to must be >= from")
 
+// parseOpenTimeRange reads optional from/to parameters. Unlike parseTimeRange
+// there is no default window: a missing bound is returned as the zero time.
+func parseOpenTimeRange(c *gin.Context) (time.Time, time.Time, error) {
+	from, err := parseTimeParam(strings.TrimSpace(c.Query("from")))
+	if err != nil {
+		return time.Time{}, time.Time{}, err
+	}
+	to, err := parseTimeParam(strings.TrimSpace(c.Query("to")))
+	if err != nil {
+		return time.Time{}, time.Time{}, err
+	}
+	if !from.IsZero() && !to.IsZero() && to.Before(from) {
+		return time.Time{}, time.Time{}, errInvalidRange
+	}
+	return from, to, nil
+}
+
 func parseTimeParam(value string) (time.Time, error) {
 	if value == "" {
 		return time.Time{}, nil
@@ -81,96 +100,148 @@ func parseLimit(raw string, def, min, max int) int {
 	return parsed
 }
 
-func applyRunFilters(db *gorm.DB, c *gin.Context) *gorm.DB {
-	if v := strings.TrimSpace(c.Query("repo")); v != "" {
-		db = db.Where("repo = ?", v)
+// parseQueryFilter reads the shared equality filters from the query string.
+func parseQueryFilter(c *gin.Context) queryFilter {
+	return queryFilter{
+		Repo:           strings.TrimSpace(c.Query("repo")),
+		RulesetVersion: strings.TrimSpace(c.Query("ruleset_version")),
+		AgentVersion:   strings.TrimSpace(c.Query("agent_version")),
+		CodeChangeID:   strings.TrimSpace(c.Query("code_change_id")),
+		RuleID:         strings.TrimSpace(c.Query("rule_id")),
+		Category:       strings.TrimSpace(c.Query("category")),
+		Owner:          strings.TrimSpace(c.Query("owner")),
+		Severity:       strings.ToLower(strings.TrimSpace(c.Query("severity"))),
+		Repos:          visibleRepos(c),
 	}
-	if v := strings.TrimSpace(c.Query("ruleset_version")); v != "" {
-		db = db.Where("ruleset_version = ?", v)
+}
+
+// repoScopeSQL restricts column to the repos of scope. A nil scope allows
+// every repo and returns ""; an empty one allows none.
+func repoScopeSQL(column string, scope repoScope) (string, []interface{}) {
+	if scope == nil {
+		return "", nil
+	}
+	if len(scope) == 0 {
+		return "1 = 0", nil
+	}
+	parts := make([]string, 0, len(scope))
+	args := make([]interface{}, 0, len(scope))
+	for _, pattern := range scope {
+		if prefix, ok := strings.CutSuffix(pattern, "*"); ok {
+			// SUBSTR instead of LIKE, so _ and % in repo names match
+			// literally on every backend.
+			parts = append(parts, fmt.Sprintf("SUBSTR(%s, 1, %d) = ?", column, utf8.RuneCountInString(prefix)))
+			args = append(args, prefix)
+		} else {
+			parts = append(parts, column+" = ?")
+			args = append(args, pattern)
+		}
 	}
-	if v := strings.TrimSpace(c.Query("agent_version")); v != "" {
-		db = db.Where("agent_version = ?", v)
+	return "(" + strings.Join(parts, " OR ") + ")", args
+}
+
+// applyRepoScope is repoScopeSQL for a Gorm query.
+func applyRepoScope(db *gorm.DB, column string, scope repoScope) *gorm.DB {
+	if sql, args := repoScopeSQL(column, scope); sql != "" {
+		return db.Where(sql, args...)
+	}
+	return db
+}
+
+func applyRunFilters(db *gorm.DB, f queryFilter) *gorm.DB {
+	if f.Repo != "" {
+		db = db.Where("repo = ?", f.Repo)
 	}
-	if v := strings.TrimSpace(c.Query("code_change_id")); v != "" {
-		db = db.Where("code_change_id = ?", v)
+	db = applyRepoScope(db, "repo", f.Repos)
+	if f.RulesetVersion != "" {
+		db = db.Where("ruleset_version = ?", f.RulesetVersion)
+	}
+	if f.AgentVersion != "" {
+		db = db.Where("agent_version = ?", f.AgentVersion)
+	}
+	if f.CodeChangeID != "" {
+		db = db.Where("code_change_id = ?", f.CodeChangeID)
 	}
 	return db
 }
 
-func applyChangeFilters(db *gorm.DB, c *gin.Context) *gorm.DB {
-	if v := strings.TrimSpace(c.Query("repo")); v != "" {
-		db = db.Where("repo = ?", v)
+func applyChangeFilters(db *gorm.DB, f queryFilter) *gorm.DB {
+	if f.Repo != "" {
+		db = db.Where("repo = ?", f.Repo)
 	}
-	if v := strings.TrimSpace(c.Query("ruleset_version")); v != "" {
-		db = db.Where("last_ruleset_version = ?", v)
+	db = applyRepoScope(db, "repo", f.Repos)
+	if f.RulesetVersion != "" {
+		db = db.Where("last_ruleset_version = ?", f.RulesetVersion)
 	}
-	if v := strings.TrimSpace(c.Query("code_change_id")); v != "" {
-		db = db.Where("code_change_id = ?", v)
+	if f.CodeChangeID != "" {
+		db = db.Where("code_change_id = ?", f.CodeChangeID)
 	}
 	return db
 }
 
-func applyRunFilterSQL(sql string, c *gin.Context) string {
-	if strings.TrimSpace(c.Query("repo")) != "" {
+func applyRunFilterSQL(sql string, f queryFilter) string {
+	if f.Repo != "" {
 		sql += " AND repo = ?"
 	}
-	if strings.TrimSpace(c.Query("ruleset_version")) != "" {
+	if f.RulesetVersion != "" {
 		sql += " AND ruleset_version = ?"
 	}
-	if strings.TrimSpace(c.Query("agent_version")) != "" {
+	if f.AgentVersion != "" {
 		sql += " AND agent_version = ?"
 	}
-	if strings.TrimSpace(c.Query("code_change_id")) != "" {
+	if f.CodeChangeID != "" {
 		sql += " AND code_change_id = ?"
 	}
+	if scopeSQL, _ := repoScopeSQL("repo", f.Repos); scopeSQL != "" {
+		sql += " AND " + scopeSQL
+	}
 	return sql
 }
 
-func buildRunFilterArgs(c *gin.Context) []interface{} {
+func buildRunFilterArgs(f queryFilter) []interface{} {
 	args := make([]interface{}, 0, 4)
-	if v := strings.TrimSpace(c.Query("repo")); v != "" {
-		args = append(args, v)
+	if f.Repo != "" {
+		args = append(args, f.Repo)
 	}
-	if v := strings.TrimSpace(c.Query("ruleset_version")); v != "" {
-		args = append(args, v)
+	if f.RulesetVersion != "" {
+		args = append(args, f.RulesetVersion)
 	}
-	if v := strings.TrimSpace(c.Query("agent_version")); v != "" {
-		args = append(args, v)
+	if f.AgentVersion != "" {
+		args = append(args, f.AgentVersion)
 	}
-	if v := strings.TrimSpace(c.Query("code_change_id")); v != "" {
-		args = append(args, v)
+	if f.CodeChangeID != "" {
+		args = append(args, f.CodeChangeID)
 	}
-	return args
-}
-
-func loadTotalRuns(db *gorm.DB, from, to time.Time, c *gin.Context) (uint64, error) {
-	filtered := applyRunFilters(db.Model(&CrAgentRun{}), c).
-		Where("reported_at BETWEEN ? AND ?", from, to)
-	var total uint64
-	if err := filtered.Select("COUNT(*)").Scan(&total).Error; err != nil {
-		return 0, err
-	}
-	return total, nil
+	_, scopeArgs := repoScopeSQL("repo", f.Repos)
+	return append(args, scopeArgs...)
 }
 
-func ruleFilterSQL(alias string, c *gin.Context) (string, []interface{}) {
+func ruleFilterSQL(alias string, f queryFilter) (string, []interface{}) {
 	prefix := ""
 	if alias != "" {
 		prefix = alias + "."
 	}
-	parts := make([]string, 0, 3)
-	args := make([]interface{}, 0, 3)
-	if v := strings.TrimSpace(c.Query("repo")); v != "" {
+	parts := make([]string, 0, 4)
+	args := make([]interface{}, 0, 6)
+	if f.Repo != "" {
 		parts = append(parts, prefix+"repo = ?")
-		args = append(args, v)
+		args = append(args, f.Repo)
 	}
-	if v := strings.TrimSpace(c.Query("ruleset_version")); v != "" {
+	if scopeSQL, scopeArgs := repoScopeSQL(prefix+"repo", f.Repos); scopeSQL != "" {
+		parts = append(parts, scopeSQL)
+		args = append(args, scopeArgs...)
+	}
+	if f.RulesetVersion != "" {
 		parts = append(parts, prefix+"ruleset_version = ?")
-		args = append(args, v)
+		args = append(args, f.RulesetVersion)
 	}
-	if v := strings.TrimSpace(c.Query("rule_id")); v != "" {
+	if f.RuleID != "" {
 		parts = append(parts, prefix+"rule_id = ?")
-		args = append(args, v)
+		args = append(args, f.RuleID)
+	}
+	if catalogSQL, catalogArgs := catalogFilterSQL(f); catalogSQL != "" {
+		parts = append(parts, prefix+"rule_id IN ("+catalogSQL+")")
+		args = append(args, catalogArgs...)
 	}
 	if len(parts) == 0 {
 		return "", args
@@ -178,9 +249,9 @@ func ruleFilterSQL(alias string, c *gin.Context) (string, []interface{}) {
 	return " AND " + strings.Join(parts, " AND "), args
 }
 
-func buildRuleQualityBaseSQL(c *gin.Context, from, to time.Time) (string, []interface{}) {
-	filterA, argsA := ruleFilterSQL("", c)
-	filterR, argsR := ruleFilterSQL("r", c)
+func buildRuleQualityBaseSQL(d sqlDialect, f queryFilter, from, to time.Time) (string, []interface{}) {
+	filterA, argsA := ruleFilterSQL("", f)
+	filterR, argsR := ruleFilterSQL("r", f)
 
 	aSQL := "SELECT rule_id, COALESCE(SUM(hit_count),0) AS total_hits, COUNT(DISTINCT run_id) AS run_count, MAX(reported_at) AS last_seen_at " +
 		"FROM cr_agent_run_rule WHERE reported_at BETWEEN ? AND ?" + filterA + " GROUP BY rule_id"
@@ -201,18 +272,46 @@ func buildRuleQualityBaseSQL(c *gin.Context, from, to time.Time) (string, []inte
 		"AVG(max_hit - final_hit) AS avg_drop " +
 		"FROM (" + tSQL + ") t GROUP BY rule_id"
 
+	// fSQL counts finding-level transitions; new findings of a change's first
+	// tracked run (prev_run_id = 0) are not "introduced" by a fix attempt.
+	fSQL := "SELECT rule_id, " +
+		"SUM(CASE WHEN status = 'fixed' THEN finding_count ELSE 0 END) AS fixed_findings, " +
+		"SUM(CASE WHEN status = 'new' AND prev_run_id <> 0 THEN finding_count ELSE 0 END) AS introduced_findings, " +
+		"SUM(CASE WHEN status = 'persisted' THEN finding_count ELSE 0 END) AS persisted_findings " +
+		"FROM cr_finding_transition WHERE reported_at BETWEEN ? AND ?" + filterA + " GROUP BY rule_id"
+
+	// gSQL counts reviewer verdicts on the runs reported in range.
+	gSQL := "SELECT rule_id, COUNT(*) AS feedback_count, " +
+		"SUM(CASE WHEN verdict = 'accepted' THEN 1 ELSE 0 END) AS accepted_count, " +
+		"SUM(CASE WHEN verdict = 'false_positive' THEN 1 ELSE 0 END) AS false_positive_count " +
+		"FROM cr_finding_feedback WHERE reported_at BETWEEN ? AND ?" + filterA + " GROUP BY rule_id"
+
 	mainSQL := "SELECT a.rule_id, a.total_hits, a.run_count, a.last_seen_at, " +
 		"COALESCE(b.change_count,0) AS change_count, " +
-		"(b.fix_count / NULLIF(b.change_count,0)) AS fix_rate, " +
-		"(b.disappear_count / NULLIF(b.change_count,0)) AS disappear_rate, " +
-		"b.avg_drop AS avg_drop " +
-		"FROM (" + aSQL + ") a LEFT JOIN (" + bSQL + ") b ON a.rule_id = b.rule_id"
+		"COALESCE(b.fix_count,0) AS fix_count, " +
+		d.ratioExpr("b.fix_count", "b.change_count") + " AS fix_rate, " +
+		d.ratioExpr("b.disappear_count", "b.change_count") + " AS disappear_rate, " +
+		"b.avg_drop AS avg_drop, " +
+		"COALESCE(f.fixed_findings,0) AS fixed_findings, " +
+		"COALESCE(f.introduced_findings,0) AS introduced_findings, " +
+		"COALESCE(f.persisted_findings,0) AS persisted_findings, " +
+		"COALESCE(g.feedback_count,0) AS feedback_count, " +
+		"COALESCE(g.false_positive_count,0) AS false_positive_count, " +
+		d.ratioExpr("g.accepted_count", "g.feedback_count") + " AS acceptance_rate, " +
+		d.ratioExpr("g.false_positive_count", "g.feedback_count") + " AS false_positive_rate " +
+		"FROM (" + aSQL + ") a LEFT JOIN (" + bSQL + ") b ON a.rule_id = b.rule_id " +
+		"LEFT JOIN (" + fSQL + ") f ON a.rule_id = f.rule_id " +
+		"LEFT JOIN (" + gSQL + ") g ON a.rule_id = g.rule_id"
 
 	args := []interface{}{from, to}
 	args = append(args, argsA...)
 	args = append(args, from, to)
 	args = append(args, argsR...)
 	args = append(args, from, to)
+	args = append(args, from, to)
+	args = append(args, argsA...)
+	args = append(args, from, to)
+	args = append(args, argsA...)
 
 	return mainSQL, args
 }
@@ -239,6 +338,16 @@ func buildRuleQualityRows(rows []ruleQualityAggRow, totalRuns uint64) []ruleQual
 			value := row.AvgDrop.Float64
 			avgDrop = &value
 		}
+		var acceptanceRate *float64
+		if row.AcceptanceRate.Valid {
+			value := row.AcceptanceRate.Float64
+			acceptanceRate = &value
+		}
+		var falsePositiveRate *float64
+		if row.FalsePositiveRate.Valid {
+			value := row.FalsePositiveRate.Float64
+			falsePositiveRate = &value
+		}
 		resp = append(resp, ruleQualityRow{
 			RuleID:        row.RuleID,
 			TotalHits:     row.TotalHits,
@@ -248,7 +357,15 @@ func buildRuleQualityRows(rows []ruleQualityAggRow, totalRuns uint64) []ruleQual
 			FixRate:       fixRate,
 			DisappearRate: disappearRate,
 			AvgDrop:       avgDrop,
-			LastSeenAt:    row.LastSeenAt,
+			LastSeenAt:    row.LastSeenAt.Time,
+
+			FixedFindings:      row.FixedFindings,
+			IntroducedFindings: row.IntroducedFindings,
+			PersistedFindings:  row.PersistedFindings,
+
+			FeedbackCount:     row.FeedbackCount,
+			AcceptanceRate:    acceptanceRate,
+			FalsePositiveRate: falsePositiveRate,
 		})
 	}
 	return resp
@@ -258,7 +375,7 @@ func loadTopVersions(filtered *gorm.DB, column string) ([]versionBucketCount, er
 	var rows []versionBucketCount
 	if err := filtered.Select(column + " AS version, COUNT(*) AS runs").
 		Group(column).
-		Order("runs DESC").
+		Order("runs DESC, version").
 		Limit(5).
 		Scan(&rows).Error; err != nil {
 		return nil, err
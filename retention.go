@@ -0,0 +1,443 @@
+package main
+
+import (
+	"compress/gzip"
+	"encoding/json"
+	"fmt"
+	"log"
+	"os"
+	"path/filepath"
+	"strconv"
+	"strings"
+	"time"
+)
+
+// retentionConfig is the `retention` section of config.yaml. Ages accept Go
+// durations plus a day suffix ("90d"); an empty age keeps that table forever.
+type retentionConfig struct {
+	Enabled    bool   `yaml:"enabled"`
+	Interval   string `yaml:"interval"`
+	BatchSize  int    `yaml:"batch_size"`
+	BatchPause string `yaml:"batch_pause"`
+	RunRules   string `yaml:"run_rules"`
+	Runs       string `yaml:"runs"`
+	Summaries  string `yaml:"summaries"`
+	Archive    struct {
+		Enabled bool   `yaml:"enabled"`
+		Dir     string `yaml:"dir"`
+	} `yaml:"archive"`
+}
+
+const (
+	defaultRetentionInterval   = time.Hour
+	defaultRetentionBatchSize  = 1000
+	defaultRetentionBatchPause = 200 * time.Millisecond
+	defaultRetentionArchiveDir = "archive"
+)
+
+// retentionPolicy is a validated retentionConfig. Zero ages disable purging
+// of that table.
+type retentionPolicy struct {
+	Interval   time.Duration
+	BatchSize  int
+	BatchPause time.Duration
+	RunRules   time.Duration
+	Runs       time.Duration
+	Summaries  time.Duration
+	ArchiveDir string
+}
+
+func newRetentionPolicy(cfg retentionConfig) (retentionPolicy, error) {
+	policy := retentionPolicy{
+		Interval:   defaultRetentionInterval,
+		BatchSize:  defaultRetentionBatchSize,
+		BatchPause: defaultRetentionBatchPause,
+	}
+	var err error
+	if cfg.Interval != "" {
+		if policy.Interval, err = parseRetentionDuration(cfg.Interval); err != nil || policy.Interval <= 0 {
+			return policy, fmt.Errorf("retention.interval: invalid duration %q", cfg.Interval)
+		}
+	}
+	if cfg.BatchSize != 0 {
+		if cfg.BatchSize < 1 || cfg.BatchSize > 10000 {
+			return policy, fmt.Errorf("retention.batch_size must be between 1 and 10000")
+		}
+		policy.BatchSize = cfg.BatchSize
+	}
+	if cfg.BatchPause != "" {
+		if policy.BatchPause, err = parseRetentionDuration(cfg.BatchPause); err != nil || policy.BatchPause < 0 {
+			return policy, fmt.Errorf("retention.batch_pause: invalid duration %q", cfg.BatchPause)
+		}
+	}
+	for _, age := range []struct {
+		key   string
+		value string
+		dst   *time.Duration
+	}{
+		{"run_rules", cfg.RunRules, &policy.RunRules},
+		{"runs", cfg.Runs, &policy.Runs},
+		{"summaries", cfg.Summaries, &policy.Summaries},
+	} {
+		if age.value == "" {
+			continue
+		}
+		if *age.dst, err = parseRetentionDuration(age.value); err != nil || *age.dst <= 0 {
+			return policy, fmt.Errorf("retention.%s: invalid duration %q", age.key, age.value)
+		}
+	}
+	if policy.Runs > 0 && policy.RunRules > policy.Runs {
+		return policy, fmt.Errorf("retention.run_rules (%s) cannot be longer than retention.runs (%s); rule rows are deleted with their run", cfg.RunRules, cfg.Runs)
+	}
+	if policy.Runs > 0 && policy.Summaries > 0 && policy.Summaries < policy.Runs {
+		return policy, fmt.Errorf("retention.summaries (%s) cannot be shorter than retention.runs (%s); rebuild-summaries would recreate them", cfg.Summaries, cfg.Runs)
+	}
+	if cfg.Archive.Enabled {
+		policy.ArchiveDir = cfg.Archive.Dir
+		if policy.ArchiveDir == "" {
+			policy.ArchiveDir = defaultRetentionArchiveDir
+		}
+	}
+	return policy, nil
+}
+
+// runsRetainedSince is the oldest reported_at that is guaranteed to still be
+// in cr_agent_run; the zero time when runs are kept forever.
+func (p retentionPolicy) runsRetainedSince(now time.Time) time.Time {
+	if p.Runs <= 0 {
+		return time.Time{}
+	}
+	return now.Add(-p.Runs)
+}
+
+// ruleRowsRetainedSince is the same bound for cr_agent_run_rule.
+func (p retentionPolicy) ruleRowsRetainedSince(now time.Time) time.Time {
+	if p.RunRules <= 0 {
+		return p.runsRetainedSince(now)
+	}
+	return now.Add(-p.RunRules)
+}
+
+// parseRetentionDuration extends time.ParseDuration with whole days ("90d").
+func parseRetentionDuration(value string) (time.Duration, error) {
+	value = strings.TrimSpace(value)
+	if days, ok := strings.CutSuffix(value, "d"); ok {
+		n, err := strconv.Atoi(days)
+		if err != nil {
+			return 0, err
+		}
+		return time.Duration(n) * 24 * time.Hour, nil
+	}
+	return time.ParseDuration(value)
+}
+
+// retentionTally counts the rows one retention pass deleted per table.
+type retentionTally struct {
+	RunRules  int
+	Runs      int
+	Summaries int
+}
+
+// runRetention deletes (and archives) everything older than the policy ages,
+// one batch at a time, pausing between batches so ingestion is not starved of
+// locks.
+func runRetention(store Store, policy retentionPolicy, now time.Time) (retentionTally, error) {
+	var tally retentionTally
+	stamp := now.UTC().Format("20060102T150405Z")
+
+	if policy.RunRules > 0 {
+		archive := archiveBatches[CrAgentRunRule](policy, "cr_agent_run_rule", stamp, newArchivedRunRule)
+		n, err := purgeInBatches(policy, func() (int, error) {
+			return store.PurgeRunRules(now.Add(-policy.RunRules), policy.BatchSize, archive)
+		})
+		tally.RunRules = n
+		if err != nil {
+			return tally, fmt.Errorf("purge cr_agent_run_rule: %w", err)
+		}
+	}
+	if policy.Runs > 0 {
+		archive := runArchive{
+			Runs:        archiveBatches[CrAgentRun](policy, "cr_agent_run", stamp, newArchivedRun),
+			Findings:    archiveBatches[CrAgentRunFinding](policy, "cr_agent_run_finding", stamp, newArchivedFinding),
+			Transitions: archiveBatches[CrFindingTransition](policy, "cr_finding_transition", stamp, newArchivedTransition),
+			Feedback:    archiveBatches[CrFindingFeedback](policy, "cr_finding_feedback", stamp, newArchivedFeedback),
+		}
+		n, err := purgeInBatches(policy, func() (int, error) {
+			return store.PurgeRuns(now.Add(-policy.Runs), policy.BatchSize, archive)
+		})
+		tally.Runs = n
+		if err != nil {
+			return tally, fmt.Errorf("purge cr_agent_run: %w", err)
+		}
+	}
+	if policy.Summaries > 0 {
+		archive := archiveBatches[CodeChangeSummary](policy, "code_change_summary", stamp, newArchivedSummary)
+		n, err := purgeInBatches(policy, func() (int, error) {
+			return store.PurgeSummaries(now.Add(-policy.Summaries), policy.BatchSize, archive)
+		})
+		tally.Summaries = n
+		if err != nil {
+			return tally, fmt.Errorf("purge code_change_summary: %w", err)
+		}
+	}
+	return tally, nil
+}
+
+func purgeInBatches(policy retentionPolicy, purge func() (int, error)) (int, error) {
+	total := 0
+	for {
+		n, err := purge()
+		total += n
+		if err != nil || n < policy.BatchSize {
+			return total, err
+		}
+		time.Sleep(policy.BatchPause)
+	}
+}
+
+// startRetentionJob runs a retention pass right away and then every
+// policy.Interval for the lifetime of the process.
+func startRetentionJob(store Store, policy retentionPolicy) {
+	go func() {
+		for {
+			tally, err := runRetention(store, policy, time.Now())
+			if err != nil {
+				log.Printf("retention: %v", err)
+			}
+			if tally != (retentionTally{}) {
+				log.Printf("retention: deleted %d rule rows, %d runs, %d summaries", tally.RunRules, tally.Runs, tally.Summaries)
+			}
+			time.Sleep(policy.Interval)
+		}
+	}()
+}
+
+// runArchive holds the archive callbacks PurgeRuns passes a batch of runs
+// and the rows deleted with them to before deleting them; a nil callback
+// skips that table.
+type runArchive struct {
+	Runs        func([]CrAgentRun) error
+	Findings    func([]CrAgentRunFinding) error
+	Transitions func([]CrFindingTransition) error
+	Feedback    func([]CrFindingFeedback) error
+}
+
+// archiveBatches returns the archive callback for one table, or nil when
+// archival is disabled. Each batch is appended to
+// <dir>/<table>-<stamp>.ndjson.gz as its own gzip member and synced before the
+// rows are deleted; concatenated members read back as one gzip stream.
+func archiveBatches[T any](policy retentionPolicy, table, stamp string, convert func(T) interface{}) func([]T) error {
+	if policy.ArchiveDir == "" {
+		return nil
+	}
+	path := filepath.Join(policy.ArchiveDir, table+"-"+stamp+".ndjson.gz")
+	return func(rows []T) error {
+		if err := os.MkdirAll(policy.ArchiveDir, 0o755); err != nil {
+			return err
+		}
+		f, err := os.OpenFile(path, os.O_CREATE|os.O_APPEND|os.O_WRONLY, 0o644)
+		if err != nil {
+			return err
+		}
+		defer f.Close()
+
+		gz := gzip.NewWriter(f)
+		enc := json.NewEncoder(gz)
+		for _, row := range rows {
+			if err := enc.Encode(convert(row)); err != nil {
+				return err
+			}
+		}
+		if err := gz.Close(); err != nil {
+			return err
+		}
+		if err := f.Sync(); err != nil {
+			return err
+		}
+		return f.Close()
+	}
+}
+
+// archivedRun uses the ingestion field names, so an archive can be replayed
+// with `ingest -file` after decompressing it.
+type archivedRun struct {
+	RunPrimaryID       uint64          `json:"run_primary_id"`
+	Repo               string          `json:"repo"`
+	CodeChangeID       string          `json:"code_change_id"`
+	AgentRunID         string          `json:"agent_run_id"`
+	ReportedAt         time.Time       `json:"reported_at"`
+	DiffLines          uint32          `json:"diff_lines"`
+	AgentVersion       string          `json:"agent_version"`
+	RulesetVersion     string          `json:"ruleset_version"`
+	TriggeredTotalHits uint32          `json:"triggered_total_hits"`
+	RuleHits           json.RawMessage `json:"rule_hits"`
+	CreatedAt          time.Time       `json:"created_at"`
+}
+
+func newArchivedRun(run CrAgentRun) interface{} {
+	return archivedRun{
+		RunPrimaryID:       run.ID,
+		Repo:               run.Repo,
+		CodeChangeID:       run.CodeChangeID,
+		AgentRunID:         run.AgentRunID,
+		ReportedAt:         run.ReportedAt.UTC(),
+		DiffLines:          run.DiffLines,
+		AgentVersion:       run.AgentVersion,
+		RulesetVersion:     run.RulesetVersion,
+		TriggeredTotalHits: run.TriggeredTotalHits,
+		RuleHits:           json.RawMessage(run.RuleHitsJSON),
+		CreatedAt:          run.CreatedAt.UTC(),
+	}
+}
+
+type archivedRunRule struct {
+	ID             uint64    `json:"id"`
+	RunID          uint64    `json:"run_id"`
+	Repo           string    `json:"repo"`
+	CodeChangeID   string    `json:"code_change_id"`
+	ReportedAt     time.Time `json:"reported_at"`
+	RulesetVersion string    `json:"ruleset_version"`
+	RuleID         string    `json:"rule_id"`
+	HitCount       uint32    `json:"hit_count"`
+}
+
+func newArchivedRunRule(rule CrAgentRunRule) interface{} {
+	return archivedRunRule{
+		ID:             rule.ID,
+		RunID:          rule.RunID,
+		Repo:           rule.Repo,
+		CodeChangeID:   rule.CodeChangeID,
+		ReportedAt:     rule.ReportedAt.UTC(),
+		RulesetVersion: rule.RulesetVersion,
+		RuleID:         rule.RuleID,
+		HitCount:       rule.HitCount,
+	}
+}
+
+type archivedFinding struct {
+	ID           uint64    `json:"id"`
+	RunID        uint64    `json:"run_id"`
+	Repo         string    `json:"repo"`
+	CodeChangeID string    `json:"code_change_id"`
+	ReportedAt   time.Time `json:"reported_at"`
+	RuleID       string    `json:"rule_id"`
+	FilePath     string    `json:"file_path"`
+	StartLine    uint32    `json:"start_line"`
+	EndLine      uint32    `json:"end_line"`
+	Severity     string    `json:"severity"`
+	Fingerprint  string    `json:"fingerprint"`
+}
+
+func newArchivedFinding(finding CrAgentRunFinding) interface{} {
+	return archivedFinding{
+		ID:           finding.ID,
+		RunID:        finding.RunID,
+		Repo:         finding.Repo,
+		CodeChangeID: finding.CodeChangeID,
+		ReportedAt:   finding.ReportedAt.UTC(),
+		RuleID:       finding.RuleID,
+		FilePath:     finding.FilePath,
+		StartLine:    finding.StartLine,
+		EndLine:      finding.EndLine,
+		Severity:     finding.Severity,
+		Fingerprint:  finding.Fingerprint,
+	}
+}
+
+type archivedTransition struct {
+	ID             uint64    `json:"id"`
+	RunID          uint64    `json:"run_id"`
+	PrevRunID      uint64    `json:"prev_run_id"`
+	Repo           string    `json:"repo"`
+	CodeChangeID   string    `json:"code_change_id"`
+	ReportedAt     time.Time `json:"reported_at"`
+	RulesetVersion string    `json:"ruleset_version"`
+	RuleID         string    `json:"rule_id"`
+	Fingerprint    string    `json:"fingerprint"`
+	Status         string    `json:"status"`
+	FindingCount   uint32    `json:"finding_count"`
+	FilePath       string    `json:"file_path"`
+	StartLine      uint32    `json:"start_line"`
+}
+
+func newArchivedTransition(t CrFindingTransition) interface{} {
+	return archivedTransition{
+		ID:             t.ID,
+		RunID:          t.RunID,
+		PrevRunID:      t.PrevRunID,
+		Repo:           t.Repo,
+		CodeChangeID:   t.CodeChangeID,
+		ReportedAt:     t.ReportedAt.UTC(),
+		RulesetVersion: t.RulesetVersion,
+		RuleID:         t.RuleID,
+		Fingerprint:    t.Fingerprint,
+		Status:         t.Status,
+		FindingCount:   t.FindingCount,
+		FilePath:       t.FilePath,
+		StartLine:      t.StartLine,
+	}
+}
+
+type archivedFeedback struct {
+	ID             uint64    `json:"id"`
+	RunID          uint64    `json:"run_id"`
+	Repo           string    `json:"repo"`
+	CodeChangeID   string    `json:"code_change_id"`
+	ReportedAt     time.Time `json:"reported_at"`
+	RulesetVersion string    `json:"ruleset_version"`
+	RuleID         string    `json:"rule_id"`
+	FindingID      uint64    `json:"finding_id"`
+	Fingerprint    string    `json:"fingerprint"`
+	Actor          string    `json:"actor"`
+	Verdict        string    `json:"verdict"`
+	Comment        string    `json:"comment"`
+	CreatedAt      time.Time `json:"created_at"`
+}
+
+func newArchivedFeedback(feedback CrFindingFeedback) interface{} {
+	return archivedFeedback{
+		ID:             feedback.ID,
+		RunID:          feedback.RunID,
+		Repo:           feedback.Repo,
+		CodeChangeID:   feedback.CodeChangeID,
+		ReportedAt:     feedback.ReportedAt.UTC(),
+		RulesetVersion: feedback.RulesetVersion,
+		RuleID:         feedback.RuleID,
+		FindingID:      feedback.FindingID,
+		Fingerprint:    feedback.Fingerprint,
+		Actor:          feedback.Actor,
+		Verdict:        feedback.Verdict,
+		Comment:        feedback.Comment,
+		CreatedAt:      feedback.CreatedAt.UTC(),
+	}
+}
+
+type archivedSummary struct {
+	Repo               string    `json:"repo"`
+	CodeChangeID       string    `json:"code_change_id"`
+	RunCount           uint32    `json:"run_count"`
+	FirstReportedAt    time.Time `json:"first_reported_at"`
+	LastReportedAt     time.Time `json:"last_reported_at"`
+	MaxTotalHits       uint32    `json:"max_total_hits"`
+	MaxRunID           uint64    `json:"max_run_id"`
+	MinTotalHits       uint32    `json:"min_total_hits"`
+	MinRunID           uint64    `json:"min_run_id"`
+	LastRulesetVersion string    `json:"last_ruleset_version"`
+	ImprovementRate    *float64  `json:"improvement_rate"`
+}
+
+func newArchivedSummary(summary CodeChangeSummary) interface{} {
+	return archivedSummary{
+		Repo:               summary.Repo,
+		CodeChangeID:       summary.CodeChangeID,
+		RunCount:           summary.RunCount,
+		FirstReportedAt:    summary.FirstReportedAt.UTC(),
+		LastReportedAt:     summary.LastReportedAt.UTC(),
+		MaxTotalHits:       summary.MaxTotalHits,
+		MaxRunID:           summary.MaxRunID,
+		MinTotalHits:       summary.MinTotalHits,
+		MinRunID:           summary.MinRunID,
+		LastRulesetVersion: summary.LastRulesetVersion,
+		ImprovementRate:    summary.ImprovementRate,
+	}
+}
@@ -0,0 +1,90 @@
+package main
+
+import (
+	"bufio"
+	"compress/gzip"
+	"os"
+	"path/filepath"
+	"testing"
+	"time"
+)
+
+// readArchive returns the lines of every archive file of table in dir.
+func readArchive(t *testing.T, dir, table string) []map[string]interface{} {
+	t.Helper()
+	paths, err := filepath.Glob(filepath.Join(dir, table+"-*.ndjson.gz"))
+	if err != nil {
+		t.Fatal(err)
+	}
+	var lines []map[string]interface{}
+	for _, path := range paths {
+		f, err := os.Open(path)
+		if err != nil {
+			t.Fatal(err)
+		}
+		gz, err := gzip.NewReader(f)
+		if err != nil {
+			t.Fatal(err)
+		}
+		scanner := bufio.NewScanner(gz)
+		for scanner.Scan() {
+			var line map[string]interface{}
+			decodeJSON(t, scanner.Bytes(), &line)
+			lines = append(lines, line)
+		}
+		f.Close()
+	}
+	return lines
+}
+
+func TestRetentionArchivesRunDependents(t *testing.T) {
+	store := newTestStore(t)
+	now := time.Now().UTC()
+	old, recent := now.Add(-48*time.Hour), now.Add(-time.Hour)
+	var oldRun uint64
+	for i, at := range []time.Time{old, old.Add(time.Minute), recent} {
+		run := testRun("org/a", "c1", i+1, at, map[string]uint32{"R1": uint32(2 - i%2)})
+		id, _, err := store.CreateAgentRun(pendingAgentRun{Req: run, DiffLines: *run.DiffLines})
+		if err != nil {
+			t.Fatal(err)
+		}
+		if i == 0 {
+			oldRun = id
+		}
+	}
+	if _, err := store.RecordFeedback(feedbackRequest{RunID: oldRun, RuleID: "R1", Fingerprint: "R1-0", Verdict: verdictFalsePositive, Actor: "alice"}); err != nil {
+		t.Fatal(err)
+	}
+
+	dir := t.TempDir()
+	policy := retentionPolicy{BatchSize: 1, Runs: 24 * time.Hour, ArchiveDir: dir}
+	tally, err := runRetention(store, policy, now)
+	if err != nil {
+		t.Fatal(err)
+	}
+	if tally.Runs != 2 {
+		t.Fatalf("deleted %d runs, want 2", tally.Runs)
+	}
+
+	for table, want := range map[string]int{
+		"cr_agent_run":          2,
+		"cr_agent_run_finding":  3,
+		"cr_finding_transition": 4, // run 2 fixes one finding of run 1
+		"cr_finding_feedback":   1,
+	} {
+		lines := readArchive(t, dir, table)
+		if len(lines) != want {
+			t.Errorf("%s: archived %d rows, want %d: %v", table, len(lines), want, lines)
+		}
+	}
+	if fb := readArchive(t, dir, "cr_finding_feedback"); len(fb) == 1 && (fb[0]["actor"] != "alice" || fb[0]["run_id"] != float64(oldRun)) {
+		t.Errorf("archived feedback %v", fb[0])
+	}
+	for _, model := range []interface{}{&CrAgentRun{}, &CrAgentRunRule{}, &CrAgentRunFinding{}, &CrFindingTransition{}, &CrFindingFeedback{}} {
+		var left int64
+		store.db.Model(model).Where("reported_at < ?", now.Add(-24*time.Hour)).Count(&left)
+		if left != 0 {
+			t.Errorf("%T: %d expired rows left", model, left)
+		}
+	}
+}
@@ -0,0 +1,545 @@
+package main
+
+import (
+	"sort"
+	"time"
+
+	"gorm.io/gorm"
+)
+
+// rollupGranularities are the bucket sizes kept in cr_run_rollup and
+// cr_rule_rollup.
+var rollupGranularities = []struct {
+	Name string
+	Size time.Duration
+}{
+	{"hour", time.Hour},
+	{"day", 24 * time.Hour},
+}
+
+var (
+	runRollupKeys      = []string{"granularity", "bucket_start", "repo", "ruleset_version", "agent_version"}
+	runRollupCounters  = []string{"run_count", "total_hits", "total_diff_lines"}
+	ruleRollupKeys     = []string{"granularity", "bucket_start", "repo", "ruleset_version", "agent_version", "rule_id"}
+	ruleRollupCounters = []string{"hit_count", "run_count"}
+)
+
+// foldRollups turns freshly inserted runs into rollup increments for every
+// granularity. ruleHits is aligned with runs. Rows come back in key order so
+// concurrent upserts lock them in the same order.
+func foldRollups(runs []CrAgentRun, ruleHits []map[string]uint32) ([]CrRunRollup, []CrRuleRollup) {
+	type runKey struct {
+		Granularity    string
+		BucketStart    time.Time
+		Repo           string
+		RulesetVersion string
+		AgentVersion   string
+	}
+	type ruleKey struct {
+		runKey
+		RuleID string
+	}
+	runIndex := make(map[runKey]int)
+	ruleIndex := make(map[ruleKey]int)
+	var runRollups []CrRunRollup
+	var ruleRollups []CrRuleRollup
+
+	for i, run := range runs {
+		for _, g := range rollupGranularities {
+			key := runKey{g.Name, run.ReportedAt.UTC().Truncate(g.Size), run.Repo, run.RulesetVersion, run.AgentVersion}
+			j, ok := runIndex[key]
+			if !ok {
+				j = len(runRollups)
+				runIndex[key] = j
+				runRollups = append(runRollups, CrRunRollup{
+					Granularity:    key.Granularity,
+					BucketStart:    key.BucketStart,
+					Repo:           key.Repo,
+					RulesetVersion: key.RulesetVersion,
+					AgentVersion:   key.AgentVersion,
+				})
+			}
+			runRollups[j].RunCount++
+			runRollups[j].TotalHits += uint64(run.TriggeredTotalHits)
+			runRollups[j].TotalDiffLines += uint64(run.DiffLines)
+
+			for ruleID, hits := range ruleHits[i] {
+				rk := ruleKey{key, ruleID}
+				k, ok := ruleIndex[rk]
+				if !ok {
+					k = len(ruleRollups)
+					ruleIndex[rk] = k
+					ruleRollups = append(ruleRollups, CrRuleRollup{
+						Granularity:    key.Granularity,
+						BucketStart:    key.BucketStart,
+						Repo:           key.Repo,
+						RulesetVersion: key.RulesetVersion,
+						AgentVersion:   key.AgentVersion,
+						RuleID:         ruleID,
+					})
+				}
+				ruleRollups[k].HitCount += uint64(hits)
+				ruleRollups[k].RunCount++
+			}
+		}
+	}
+
+	sort.Slice(runRollups, func(a, b int) bool {
+		x, y := runRollups[a], runRollups[b]
+		if x.Granularity != y.Granularity {
+			return x.Granularity < y.Granularity
+		}
+		if !x.BucketStart.Equal(y.BucketStart) {
+			return x.BucketStart.Before(y.BucketStart)
+		}
+		if x.Repo != y.Repo {
+			return x.Repo < y.Repo
+		}
+		if x.RulesetVersion != y.RulesetVersion {
+			return x.RulesetVersion < y.RulesetVersion
+		}
+		return x.AgentVersion < y.AgentVersion
+	})
+	sort.Slice(ruleRollups, func(a, b int) bool {
+		x, y := ruleRollups[a], ruleRollups[b]
+		if x.Granularity != y.Granularity {
+			return x.Granularity < y.Granularity
+		}
+		if !x.BucketStart.Equal(y.BucketStart) {
+			return x.BucketStart.Before(y.BucketStart)
+		}
+		if x.Repo != y.Repo {
+			return x.Repo < y.Repo
+		}
+		if x.RulesetVersion != y.RulesetVersion {
+			return x.RulesetVersion < y.RulesetVersion
+		}
+		if x.AgentVersion != y.AgentVersion {
+			return x.AgentVersion < y.AgentVersion
+		}
+		return x.RuleID < y.RuleID
+	})
+	return runRollups, ruleRollups
+}
+
+// upsertRollups adds freshly inserted runs to the rollup tables inside the
+// ingestion transaction.
+func (s *gormStore) upsertRollups(tx *gorm.DB, runs []CrAgentRun, ruleHits []map[string]uint32) error {
+	runRollups, ruleRollups := foldRollups(runs, ruleHits)
+	if len(runRollups) > 0 {
+		if err := tx.Clauses(s.dialect.counterUpsert("cr_run_rollup", runRollupKeys, runRollupCounters)).
+			CreateInBatches(&runRollups, batchInsertSize).Error; err != nil {
+			return err
+		}
+	}
+	if len(ruleRollups) > 0 {
+		if err := tx.Clauses(s.dialect.counterUpsert("cr_rule_rollup", ruleRollupKeys, ruleRollupCounters)).
+			CreateInBatches(&ruleRollups, batchInsertSize).Error; err != nil {
+			return err
+		}
+	}
+	return nil
+}
+
+// adjustRunRollupHits moves the total_hits of the run rollups covering run
+// from its stored triggered_total_hits to hits, e.g. when verify repairs the
+// total. The run counts and rule rollups are left as they are.
+func adjustRunRollupHits(tx *gorm.DB, run CrAgentRun, hits uint64) error {
+	old := uint64(run.TriggeredTotalHits)
+	if hits == old {
+		return nil
+	}
+	var delta interface{} = gorm.Expr("total_hits + ?", hits-old)
+	if hits < old {
+		delta = subtractCounter("total_hits", old-hits)
+	}
+	runRollups, _ := foldRollups([]CrAgentRun{run}, []map[string]uint32{nil})
+	for _, row := range runRollups {
+		if err := tx.Model(&CrRunRollup{}).Where("granularity = ? AND bucket_start = ? AND repo = ? AND ruleset_version = ? AND agent_version = ?",
+			row.Granularity, row.BucketStart, row.Repo, row.RulesetVersion, row.AgentVersion).
+			Update("total_hits", delta).Error; err != nil {
+			return err
+		}
+	}
+	return nil
+}
+
+// rollupSegment is one piece of a query range: whole buckets of Granularity
+// read from a rollup table, or raw rows when Granularity is empty. Ranges are
+// [From, To) except for the final raw segment, which keeps the inclusive end
+// of the caller's BETWEEN.
+type rollupSegment struct {
+	Granularity string
+	From        time.Time
+	To          time.Time
+	ToInclusive bool
+}
+
+// planRollupSegments splits [from, to] into raw edges, whole hours and (when
+// allowDays) whole days. It returns nil when the range does not contain a
+// whole hour, in which case the plain raw query is just as cheap.
+func planRollupSegments(from, to time.Time, allowDays bool) []rollupSegment {
+	from, to = from.UTC(), to.UTC()
+	hourStart := ceilTime(from, time.Hour)
+	hourEnd := to.Truncate(time.Hour)
+	if !hourStart.Before(hourEnd) {
+		return nil
+	}
+
+	var segments []rollupSegment
+	add := func(granularity string, segFrom, segTo time.Time, inclusive bool) {
+		if segFrom.Before(segTo) || (inclusive && segFrom.Equal(segTo)) {
+			segments = append(segments, rollupSegment{Granularity: granularity, From: segFrom, To: segTo, ToInclusive: inclusive})
+		}
+	}
+
+	add("", from, hourStart, false)
+	dayStart := ceilTime(from, 24*time.Hour)
+	dayEnd := to.Truncate(24 * time.Hour)
+	if allowDays && dayStart.Before(dayEnd) {
+		add("hour", hourStart, dayStart, false)
+		add("day", dayStart, dayEnd, false)
+		add("hour", dayEnd, hourEnd, false)
+	} else {
+		add("hour", hourStart, hourEnd, false)
+	}
+	add("", hourEnd, to, true)
+	return segments
+}
+
+func ceilTime(t time.Time, d time.Duration) time.Time {
+	truncated := t.Truncate(d)
+	if truncated.Equal(t) {
+		return t
+	}
+	return truncated.Add(d)
+}
+
+// canUseRollups reports whether f only filters on columns the rollups keep.
+func canUseRollups(f queryFilter) bool {
+	return f.CodeChangeID == ""
+}
+
+// segmentRange restricts a query to one segment, on reported_at for raw rows
+// and on bucket_start for rollups.
+func segmentRange(db *gorm.DB, seg rollupSegment) *gorm.DB {
+	if seg.Granularity == "" {
+		db = db.Where("reported_at >= ?", seg.From)
+		if seg.ToInclusive {
+			return db.Where("reported_at <= ?", seg.To)
+		}
+		return db.Where("reported_at < ?", seg.To)
+	}
+	return db.Where("granularity = ? AND bucket_start >= ? AND bucket_start < ?", seg.Granularity, seg.From, seg.To)
+}
+
+type runGroupRow struct {
+	Repo           string
+	RulesetVersion string
+	AgentVersion   string
+	Runs           uint64
+	Hits           uint64
+	DiffLines      uint64
+}
+
+// loadRunTotalsFromRollups is LoadRunTotals for planned segments. Each segment
+// is grouped by (repo, ruleset_version, agent_version), which is enough to
+// derive the totals, the distinct repos and both version rankings.
+func (s *gormStore) loadRunTotalsFromRollups(segments []rollupSegment, f queryFilter) (runTotals, error) {
+	var totals runTotals
+	repos := make(map[string]struct{})
+	rulesetRuns := make(map[string]uint64)
+	agentRuns := make(map[string]uint64)
+
+	for _, seg := range segments {
+		var query *gorm.DB
+		if seg.Granularity == "" {
+			query = s.db.Model(&CrAgentRun{}).
+				Select("repo, ruleset_version, agent_version, COUNT(*) AS runs, COALESCE(SUM(triggered_total_hits),0) AS hits, COALESCE(SUM(diff_lines),0) AS diff_lines")
+		} else {
+			query = s.db.Model(&CrRunRollup{}).
+				Select("repo, ruleset_version, agent_version, SUM(run_count) AS runs, SUM(total_hits) AS hits, SUM(total_diff_lines) AS diff_lines")
+		}
+		var rows []runGroupRow
+		if err := segmentRange(applyRunFilters(query, f), seg).
+			Group("repo, ruleset_version, agent_version").Scan(&rows).Error; err != nil {
+			return totals, err
+		}
+		for _, row := range rows {
+			totals.TotalRuns += row.Runs
+			totals.TotalHits += row.Hits
+			totals.TotalDiffLines += row.DiffLines
+			repos[row.Repo] = struct{}{}
+			rulesetRuns[row.RulesetVersion] += row.Runs
+			agentRuns[row.AgentVersion] += row.Runs
+		}
+	}
+
+	totals.ActiveRepos = uint64(len(repos))
+	totals.TopRulesetVersions = topVersionCounts(rulesetRuns)
+	totals.TopAgentVersions = topVersionCounts(agentRuns)
+	return totals, nil
+}
+
+// topVersionCounts ranks versions like loadTopVersions does in SQL.
+func topVersionCounts(runs map[string]uint64) []versionBucketCount {
+	var rows []versionBucketCount
+	for version, n := range runs {
+		rows = append(rows, versionBucketCount{Version: version, Runs: n})
+	}
+	sort.Slice(rows, func(a, b int) bool {
+		if rows[a].Runs != rows[b].Runs {
+			return rows[a].Runs > rows[b].Runs
+		}
+		return rows[a].Version < rows[b].Version
+	})
+	if len(rows) > 5 {
+		rows = rows[:5]
+	}
+	return rows
+}
+
+type bucketSums struct {
+	Runs      uint64
+	Hits      uint64
+	DiffLines uint64
+}
+
+// loadTimeseriesFromRollups is LoadTimeseries for planned segments. Partial
+// buckets at the edges are merged with rollup buckets by their label.
+func (s *gormStore) loadTimeseriesFromRollups(segments []rollupSegment, f queryFilter, metric, bucket string) ([]timeSeriesPoint, error) {
+	sums := make(map[string]*bucketSums)
+	addSums := func(label string, runs, hits, diffLines uint64) {
+		b := sums[label]
+		if b == nil {
+			b = &bucketSums{}
+			sums[label] = b
+		}
+		b.Runs += runs
+		b.Hits += hits
+		b.DiffLines += diffLines
+	}
+
+	for _, seg := range segments {
+		if seg.Granularity == "" {
+			// A raw edge never crosses an hour boundary, so it is one bucket
+			// labelled in Go rather than by the database's time zone.
+			var row struct {
+				Runs      uint64
+				Hits      uint64
+				DiffLines uint64
+			}
+			if err := segmentRange(applyRunFilters(s.db.Model(&CrAgentRun{}), f), seg).
+				Select("COUNT(*) AS runs, COALESCE(SUM(triggered_total_hits),0) AS hits, COALESCE(SUM(diff_lines),0) AS diff_lines").
+				Scan(&row).Error; err != nil {
+				return nil, err
+			}
+			if row.Runs > 0 {
+				addSums(rollupBucketLabel(seg.From, bucket), row.Runs, row.Hits, row.DiffLines)
+			}
+			continue
+		}
+
+		var rows []struct {
+			BucketStart scanTime
+			Runs        uint64
+			Hits        uint64
+			DiffLines   uint64
+		}
+		if err := segmentRange(applyRunFilters(s.db.Model(&CrRunRollup{}), f), seg).
+			Select("bucket_start, SUM(run_count) AS runs, SUM(total_hits) AS hits, SUM(total_diff_lines) AS diff_lines").
+			Group("bucket_start").Scan(&rows).Error; err != nil {
+			return nil, err
+		}
+		for _, row := range rows {
+			addSums(rollupBucketLabel(row.BucketStart.Time, bucket), row.Runs, row.Hits, row.DiffLines)
+		}
+	}
+
+	var points []timeSeriesPoint
+	for label, b := range sums {
+		point := timeSeriesPoint{Bucket: label}
+		switch metric {
+		case "runs":
+			point.Value = float64(b.Runs)
+		case "hits":
+			point.Value = float64(b.Hits)
+		case "density":
+			if b.DiffLines > 0 {
+				point.Value = float64(b.Hits) / float64(b.DiffLines)
+			}
+		}
+		points = append(points, point)
+	}
+	sort.Slice(points, func(a, b int) bool { return points[a].Bucket < points[b].Bucket })
+	return points, nil
+}
+
+// rollupBucketLabel renders the UTC bucket holding start the way the
+// dialects' bucketExpr does for UTC datetimes. Rollup buckets and raw edges
+// are both labelled with it, so they merge whatever time zone the database
+// connection uses.
+func rollupBucketLabel(start time.Time, bucket string) string {
+	start = start.UTC()
+	if bucket == "hour" {
+		return start.Format("2006-01-02 15:00:00")
+	}
+	return start.Format("2006-01-02") + "T00:00:00Z"
+}
+
+// listTopRulesFromRollups is ListTopRules for planned segments.
+func (s *gormStore) listTopRulesFromRollups(segments []rollupSegment, f queryFilter, limit int) ([]topRuleRow, error) {
+	totals := make(map[string]*topRuleRow)
+	for _, seg := range segments {
+		var query *gorm.DB
+		if seg.Granularity == "" {
+			query = s.db.Table("cr_agent_run_rule").
+				Select("rule_id, COALESCE(SUM(hit_count),0) AS total_hits, COUNT(*) AS run_count")
+		} else {
+			query = s.db.Model(&CrRuleRollup{}).
+				Select("rule_id, SUM(hit_count) AS total_hits, SUM(run_count) AS run_count")
+		}
+		if f.Repo != "" {
+			query = query.Where("repo = ?", f.Repo)
+		}
+		query = applyRepoScope(query, "repo", f.Repos)
+		query = applyCatalogFilter(query, f)
+		var rows []topRuleRow
+		if err := segmentRange(query, seg).Group("rule_id").Scan(&rows).Error; err != nil {
+			return nil, err
+		}
+		for _, row := range rows {
+			t := totals[row.RuleID]
+			if t == nil {
+				t = &topRuleRow{RuleID: row.RuleID}
+				totals[row.RuleID] = t
+			}
+			t.TotalHits += row.TotalHits
+			t.RunCount += row.RunCount
+		}
+	}
+
+	var rows []topRuleRow
+	for _, t := range totals {
+		rows = append(rows, *t)
+	}
+	sort.Slice(rows, func(a, b int) bool {
+		if rows[a].TotalHits != rows[b].TotalHits {
+			return rows[a].TotalHits > rows[b].TotalHits
+		}
+		return rows[a].RuleID < rows[b].RuleID
+	})
+	if len(rows) > limit {
+		rows = rows[:limit]
+	}
+	return rows, nil
+}
+
+// rollupRebuildResult reports a RebuildRollups run. From/To are the day
+// boundaries actually rebuilt after clamping to the retention windows.
+type rollupRebuildResult struct {
+	From           time.Time
+	To             time.Time
+	Days           int
+	RunRollupRows  int64
+	RuleRollupRows int64
+}
+
+// RebuildRollups recomputes both rollup tables from raw rows for the whole
+// days overlapping [from, to]; zero from/to mean the first run and now. Days
+// whose raw rows may have been purged by retention are left untouched, since
+// the rollups are then the only record of them.
+func (s *gormStore) RebuildRollups(from, to time.Time) (rollupRebuildResult, error) {
+	var result rollupRebuildResult
+	if from.IsZero() {
+		var first struct{ First scanTime }
+		if err := s.db.Model(&CrAgentRun{}).Select("MIN(reported_at) AS first").Scan(&first).Error; err != nil {
+			return result, err
+		}
+		if first.First.IsZero() {
+			return result, nil
+		}
+		from = first.First.Time
+	}
+	if to.IsZero() {
+		to = time.Now()
+	}
+
+	const day = 24 * time.Hour
+	now := time.Now()
+	runsFrom := from.UTC().Truncate(day)
+	if since := s.retention.runsRetainedSince(now); !since.IsZero() && runsFrom.Before(since) {
+		runsFrom = ceilTime(since.UTC(), day)
+	}
+	rulesFrom := runsFrom
+	if since := s.retention.ruleRowsRetainedSince(now); !since.IsZero() && rulesFrom.Before(since) {
+		rulesFrom = ceilTime(since.UTC(), day)
+	}
+	end := ceilTime(to.UTC(), day)
+	if end.Equal(to.UTC()) {
+		// to is inclusive, so a day starting exactly at to is included too.
+		end = end.Add(day)
+	}
+	result.From, result.To = runsFrom, end
+
+	for dayStart := runsFrom; dayStart.Before(end); dayStart = dayStart.Add(day) {
+		dayEnd := dayStart.Add(day)
+		err := s.db.Transaction(func(tx *gorm.DB) error {
+			n, err := s.rebuildRunRollupDay(tx, dayStart, dayEnd)
+			if err != nil {
+				return err
+			}
+			result.RunRollupRows += n
+			if dayStart.Before(rulesFrom) {
+				return nil
+			}
+			n, err = s.rebuildRuleRollupDay(tx, dayStart, dayEnd)
+			result.RuleRollupRows += n
+			return err
+		})
+		if err != nil {
+			return result, err
+		}
+		result.Days++
+	}
+	return result, nil
+}
+
+func (s *gormStore) rebuildRunRollupDay(tx *gorm.DB, dayStart, dayEnd time.Time) (int64, error) {
+	if err := tx.Where("bucket_start >= ? AND bucket_start < ?", dayStart, dayEnd).Delete(&CrRunRollup{}).Error; err != nil {
+		return 0, err
+	}
+	var inserted int64
+	for _, g := range rollupGranularities {
+		bucketStart := s.dialect.bucketStartExpr("reported_at", g.Name)
+		result := tx.Exec("INSERT INTO cr_run_rollup (granularity, bucket_start, repo, ruleset_version, agent_version, run_count, total_hits, total_diff_lines) "+
+			"SELECT '"+g.Name+"', "+bucketStart+", repo, ruleset_version, agent_version, COUNT(*), SUM(triggered_total_hits), SUM(diff_lines) "+
+			"FROM cr_agent_run WHERE reported_at >= ? AND reported_at < ? "+
+			"GROUP BY "+bucketStart+", repo, ruleset_version, agent_version", dayStart, dayEnd)
+		if result.Error != nil {
+			return inserted, result.Error
+		}
+		inserted += result.RowsAffected
+	}
+	return inserted, nil
+}
+
+func (s *gormStore) rebuildRuleRollupDay(tx *gorm.DB, dayStart, dayEnd time.Time) (int64, error) {
+	if err := tx.Where("bucket_start >= ? AND bucket_start < ?", dayStart, dayEnd).Delete(&CrRuleRollup{}).Error; err != nil {
+		return 0, err
+	}
+	var inserted int64
+	for _, g := range rollupGranularities {
+		bucketStart := s.dialect.bucketStartExpr("rr.reported_at", g.Name)
+		result := tx.Exec("INSERT INTO cr_rule_rollup (granularity, bucket_start, repo, ruleset_version, agent_version, rule_id, hit_count, run_count) "+
+			"SELECT '"+g.Name+"', "+bucketStart+", rr.repo, rr.ruleset_version, r.agent_version, rr.rule_id, SUM(rr.hit_count), COUNT(*) "+
+			"FROM cr_agent_run_rule rr JOIN cr_agent_run r ON r.id = rr.run_id "+
+			"WHERE rr.reported_at >= ? AND rr.reported_at < ? "+
+			"GROUP BY "+bucketStart+", rr.repo, rr.ruleset_version, r.agent_version, rr.rule_id", dayStart, dayEnd)
+		if result.Error != nil {
+			return inserted, result.Error
+		}
+		inserted += result.RowsAffected
+	}
+	return inserted, nil
+}
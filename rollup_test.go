@@ -0,0 +1,177 @@
+package main
+
+import (
+	"fmt"
+	"reflect"
+	"testing"
+	"time"
+)
+
+// rollupRuns reports a run every 37 minutes over three days, all in change
+// c1 so that filtering on it reads the same runs from the raw tables.
+func rollupRuns(t *testing.T, store *gormStore) {
+	t.Helper()
+	start := mustTime(t, "2026-10-01T00:03:00Z")
+	for i := 0; i < 3*24*60/37; i++ {
+		run := testRun([]string{"org/a", "org/b"}[i%2], "c1", i+1, start.Add(time.Duration(i)*37*time.Minute),
+			map[string]uint32{"R1": uint32(i % 3), "R2": uint32(i % 5), fmt.Sprintf("R%d", 3+i%4): 1})
+		for ruleID, hits := range run.RuleHits {
+			if hits == 0 {
+				delete(run.RuleHits, ruleID)
+			}
+		}
+		run.TriggeredTotalHits = 0
+		for _, hits := range run.RuleHits {
+			run.TriggeredTotalHits += hits
+		}
+		run.Findings = nil
+		diffLines := uint32(10 + i%7)
+		run.DiffLines = &diffLines
+		run.RulesetVersion = []string{"r1", "r2", "r3"}[i%3]
+		run.AgentVersion = []string{"v1", "v2"}[i/50%2]
+		if _, _, err := store.CreateAgentRun(pendingAgentRun{Req: run, DiffLines: diffLines}); err != nil {
+			t.Fatal(err)
+		}
+	}
+}
+
+// rawTopRules is the top rules query without the rollup tables.
+func rawTopRules(t *testing.T, store *gormStore, from, to time.Time, repo string, limit int) []topRuleRow {
+	t.Helper()
+	query := store.db.Table("cr_agent_run_rule").
+		Select("rule_id, COALESCE(SUM(hit_count),0) AS total_hits, COUNT(*) AS run_count").
+		Where("reported_at BETWEEN ? AND ?", from, to)
+	if repo != "" {
+		query = query.Where("repo = ?", repo)
+	}
+	var rows []topRuleRow
+	if err := query.Group("rule_id").Order("total_hits DESC, rule_id").Limit(limit).Scan(&rows).Error; err != nil {
+		t.Fatal(err)
+	}
+	return rows
+}
+
+// rollupView is what the three rollup-backed reads return for one range.
+type rollupView struct {
+	Totals     runTotals
+	Timeseries map[string][]timeSeriesPoint
+	TopRules   []topRuleRow
+}
+
+// loadRollupView reads the range through the rollups, or with raw set from
+// the raw tables only.
+func loadRollupView(t *testing.T, store *gormStore, from, to time.Time, repo string, raw bool) rollupView {
+	t.Helper()
+	f := queryFilter{Repo: repo}
+	if raw {
+		// A code_change_id filter turns the rollups off; every run is in c1.
+		f.CodeChangeID = "c1"
+	}
+	var view rollupView
+	var err error
+	if view.Totals, err = store.LoadRunTotals(from, to, f); err != nil {
+		t.Fatal(err)
+	}
+	view.Timeseries = make(map[string][]timeSeriesPoint)
+	for _, metric := range []string{"runs", "hits", "density"} {
+		for _, bucket := range []string{"hour", "day"} {
+			points, err := store.LoadTimeseries(from, to, f, metric, bucket)
+			if err != nil {
+				t.Fatal(err)
+			}
+			view.Timeseries[metric+"/"+bucket] = points
+		}
+	}
+	if raw {
+		view.TopRules = rawTopRules(t, store, from, to, repo, 50)
+	} else if view.TopRules, err = store.ListTopRules(from, to, queryFilter{Repo: repo}, 50); err != nil {
+		t.Fatal(err)
+	}
+	return view
+}
+
+func TestRollupsMatchRawRows(t *testing.T) {
+	store := newTestStore(t)
+	rollupRuns(t, store)
+
+	cases := []struct {
+		name     string
+		from, to string
+	}{
+		{name: "partial first and last hour", from: "2026-10-01T10:17:00Z", to: "2026-10-01T15:42:00Z"},
+		{name: "partial first and last day", from: "2026-10-01T10:17:00Z", to: "2026-10-03T05:09:00Z"},
+		{name: "whole days", from: "2026-10-01T00:00:00Z", to: "2026-10-03T00:00:00Z"},
+		{name: "whole hours", from: "2026-10-02T03:00:00Z", to: "2026-10-02T09:00:00Z"},
+		{name: "under an hour", from: "2026-10-02T10:05:00Z", to: "2026-10-02T10:50:00Z"},
+		{name: "across an hour boundary under an hour", from: "2026-10-02T10:40:00Z", to: "2026-10-02T11:20:00Z"},
+		{name: "last hour of a day into the next", from: "2026-10-01T23:10:00Z", to: "2026-10-02T01:30:00Z"},
+		{name: "beyond the data", from: "2026-09-30T12:00:00Z", to: "2026-10-04T12:00:00Z"},
+	}
+	for _, tc := range cases {
+		for _, repo := range []string{"", "org/b"} {
+			t.Run(tc.name+"/"+repo, func(t *testing.T) {
+				from, to := mustTime(t, tc.from), mustTime(t, tc.to)
+				got := loadRollupView(t, store, from, to, repo, false)
+				want := loadRollupView(t, store, from, to, repo, true)
+				if got.Totals.TotalRuns == 0 && tc.name != "under an hour" {
+					t.Fatalf("no runs in range")
+				}
+				if !reflect.DeepEqual(got, want) {
+					t.Fatalf("rollups:\n%+v\nraw rows:\n%+v", got, want)
+				}
+			})
+		}
+	}
+}
+
+// TestRollupsOutliveRetention reads a range that retention has partly purged:
+// the rollups still answer with what the raw rows said before the purge.
+func TestRollupsOutliveRetention(t *testing.T) {
+	store := newTestStore(t)
+	rollupRuns(t, store)
+
+	from, to := mustTime(t, "2026-10-01T00:00:00Z"), mustTime(t, "2026-10-03T05:09:00Z")
+	want := loadRollupView(t, store, from, to, "", true)
+
+	// Keep the runs from 2026-10-02 on.
+	now := mustTime(t, "2026-10-12T00:00:00Z")
+	policy := retentionPolicy{BatchSize: 100, RunRules: 10 * 24 * time.Hour, Runs: 10 * 24 * time.Hour}
+	if tally, err := runRetention(store, policy, now); err != nil || tally.Runs == 0 {
+		t.Fatalf("retention: %+v %v", tally, err)
+	}
+	if raw := loadRollupView(t, store, from, to, "", true); raw.Totals.TotalRuns >= want.Totals.TotalRuns {
+		t.Fatalf("raw rows still hold %d runs after the purge", raw.Totals.TotalRuns)
+	}
+	if got := loadRollupView(t, store, from, to, "", false); !reflect.DeepEqual(got, want) {
+		t.Fatalf("rollups after the purge:\n%+v\nraw rows before it:\n%+v", got, want)
+	}
+}
+
+func TestRollupBucketLabelIsUTC(t *testing.T) {
+	shanghai := time.FixedZone("CST", 8*3600)
+	start := time.Date(2026, 10, 2, 7, 30, 0, 0, shanghai) // 2026-10-01T23:30Z
+	if got := rollupBucketLabel(start, "hour"); got != "2026-10-01 23:00:00" {
+		t.Fatalf("hour label %q", got)
+	}
+	if got := rollupBucketLabel(start, "day"); got != "2026-10-01T00:00:00Z" {
+		t.Fatalf("day label %q", got)
+	}
+}
+
+// The raw edges are labelled by their start, which only works while neither
+// of them crosses an hour boundary.
+func TestRawSegmentsStayWithinAnHour(t *testing.T) {
+	base := mustTime(t, "2026-10-01T00:00:00Z")
+	for _, from := range []time.Duration{0, 17 * time.Minute, 59*time.Minute + 59*time.Second, 23*time.Hour + 10*time.Minute} {
+		for _, length := range []time.Duration{time.Hour, 90 * time.Minute, 25 * time.Hour, 49*time.Hour + 7*time.Minute} {
+			for _, allowDays := range []bool{false, true} {
+				segments := planRollupSegments(base.Add(from), base.Add(from+length), allowDays)
+				for _, seg := range segments {
+					if seg.Granularity == "" && seg.From.Truncate(time.Hour) != seg.To.Add(-time.Nanosecond).Truncate(time.Hour) && !seg.From.Equal(seg.To) {
+						t.Fatalf("from +%s, length %s: raw segment %+v crosses an hour", from, length, seg)
+					}
+				}
+			}
+		}
+	}
+}
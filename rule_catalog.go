@@ -0,0 +1,356 @@
+package main
+
+import (
+	"fmt"
+	"net/url"
+	"os"
+	"sort"
+	"strings"
+	"time"
+	"unicode/utf8"
+
+	"gopkg.in/yaml.v3"
+	"gorm.io/gorm"
+	"gorm.io/gorm/clause"
+)
+
+const (
+	maxRuleTitleLen    = 256
+	maxRuleCategoryLen = 64
+	maxRuleOwnerLen    = 128
+	maxDocsURLLen      = 512
+	// maxCatalogRules bounds the rules of one catalog upload or YAML file.
+	maxCatalogRules = 1000
+)
+
+// ruleCatalogRule is the registered metadata of one rule as uploaded through
+// POST /v1/rule-catalog or a YAML catalog file.
+type ruleCatalogRule struct {
+	RuleID   string `json:"rule_id" yaml:"rule_id"`
+	Title    string `json:"title" yaml:"title"`
+	Category string `json:"category" yaml:"category"`
+	// Severity is optional and uses the finding severities.
+	Severity        string   `json:"severity" yaml:"severity"`
+	Owner           string   `json:"owner" yaml:"owner"`
+	DocsURL         string   `json:"docs_url" yaml:"docs_url"`
+	RulesetVersions []string `json:"ruleset_versions" yaml:"ruleset_versions"`
+}
+
+// ruleCatalogFile is the body of POST /v1/rule-catalog and the layout of a
+// YAML catalog file.
+type ruleCatalogFile struct {
+	Rules []ruleCatalogRule `json:"rules" yaml:"rules"`
+}
+
+// ruleCatalogEntry is a stored catalog rule as returned by the API.
+type ruleCatalogEntry struct {
+	ruleCatalogRule
+	UpdatedAt time.Time `json:"updated_at"`
+}
+
+// ruleCatalogQuery selects one page of the catalog; empty fields are ignored.
+type ruleCatalogQuery struct {
+	RuleID         string
+	Category       string
+	Owner          string
+	Severity       string
+	RulesetVersion string
+	Limit          int
+	Offset         int
+}
+
+type ruleCatalogUpsertResult struct {
+	Created uint64 `json:"created"`
+	Updated uint64 `json:"updated"`
+}
+
+// loadRuleCatalogFile reads a YAML catalog file. Unknown keys are rejected so
+// typos do not silently drop metadata.
+func loadRuleCatalogFile(path string) ([]ruleCatalogRule, error) {
+	f, err := os.Open(path)
+	if err != nil {
+		return nil, err
+	}
+	defer f.Close()
+
+	var file ruleCatalogFile
+	dec := yaml.NewDecoder(f)
+	dec.KnownFields(true)
+	if err := dec.Decode(&file); err != nil {
+		return nil, fmt.Errorf("%s: %w", path, err)
+	}
+	return file.Rules, nil
+}
+
+// validateRuleCatalog checks an upload against the column sizes of
+// cr_rule_catalog / cr_rule_catalog_version.
+func validateRuleCatalog(rules []ruleCatalogRule) []fieldError {
+	var errs []fieldError
+	add := func(field, code, message string) {
+		errs = append(errs, fieldError{Field: field, Code: code, Message: message})
+	}
+	if len(rules) == 0 {
+		add("rules", "required", "rules must contain at least one rule")
+		return errs
+	}
+	if len(rules) > maxCatalogRules {
+		add("rules", "too_long", fmt.Sprintf("rules must contain at most %d entries", maxCatalogRules))
+		return errs
+	}
+
+	seen := make(map[string]int, len(rules))
+	for i, rule := range rules {
+		prefix := fmt.Sprintf("rules[%d].", i)
+		checkLen := func(field, value string, maxLen int) {
+			if utf8.RuneCountInString(value) > maxLen {
+				add(prefix+field, "too_long", fmt.Sprintf("%s must be at most %d characters", field, maxLen))
+			}
+		}
+		switch {
+		case rule.RuleID == "":
+			add(prefix+"rule_id", "required", "rule_id is required")
+		case utf8.RuneCountInString(rule.RuleID) > maxRuleIDLen:
+			add(prefix+"rule_id", "too_long", fmt.Sprintf("rule_id must be at most %d characters", maxRuleIDLen))
+		case !isValidRuleID(rule.RuleID):
+			add(prefix+"rule_id", "invalid_format", "rule_id may only contain letters, digits and . _ - : /")
+		default:
+			if j, ok := seen[rule.RuleID]; ok {
+				add(prefix+"rule_id", "duplicate", fmt.Sprintf("rule_id %s is already listed at rules[%d]", rule.RuleID, j))
+			}
+			seen[rule.RuleID] = i
+		}
+		if strings.TrimSpace(rule.Title) == "" {
+			add(prefix+"title", "required", "title is required")
+		} else {
+			checkLen("title", rule.Title, maxRuleTitleLen)
+		}
+		checkLen("category", rule.Category, maxRuleCategoryLen)
+		checkLen("owner", rule.Owner, maxRuleOwnerLen)
+		if rule.Severity != "" && !findingSeverities[rule.Severity] {
+			add(prefix+"severity", "invalid_format", "severity must be info|warning|error|critical")
+		}
+		if rule.DocsURL != "" {
+			if u, err := url.Parse(rule.DocsURL); err != nil || (u.Scheme != "http" && u.Scheme != "https") || u.Host == "" {
+				add(prefix+"docs_url", "invalid_format", "docs_url must be an http(s) URL")
+			} else {
+				checkLen("docs_url", rule.DocsURL, maxDocsURLLen)
+			}
+		}
+		for j, version := range rule.RulesetVersions {
+			field := fmt.Sprintf("%sruleset_versions[%d]", prefix, j)
+			if strings.TrimSpace(version) == "" {
+				add(field, "required", "ruleset versions must not be empty")
+			} else if utf8.RuneCountInString(version) > maxVersionLen {
+				add(field, "too_long", fmt.Sprintf("ruleset versions must be at most %d characters", maxVersionLen))
+			}
+		}
+	}
+	return errs
+}
+
+// UpsertRuleCatalog registers rules, replacing the metadata and ruleset
+// versions of rules that are already in the catalog.
+func (s *gormStore) UpsertRuleCatalog(rules []ruleCatalogRule) (ruleCatalogUpsertResult, error) {
+	var result ruleCatalogUpsertResult
+	now := time.Now().UTC()
+	ruleIDs := make([]string, 0, len(rules))
+	records := make([]CrRuleCatalog, 0, len(rules))
+	var versions []CrRuleCatalogVersion
+	for _, rule := range rules {
+		ruleIDs = append(ruleIDs, rule.RuleID)
+		records = append(records, CrRuleCatalog{
+			RuleID:    rule.RuleID,
+			Title:     rule.Title,
+			Category:  rule.Category,
+			Severity:  rule.Severity,
+			Owner:     rule.Owner,
+			DocsURL:   rule.DocsURL,
+			CreatedAt: now,
+			UpdatedAt: now,
+		})
+		seen := make(map[string]bool, len(rule.RulesetVersions))
+		for _, version := range rule.RulesetVersions {
+			if !seen[version] {
+				seen[version] = true
+				versions = append(versions, CrRuleCatalogVersion{RuleID: rule.RuleID, RulesetVersion: version})
+			}
+		}
+	}
+
+	err := s.db.Transaction(func(tx *gorm.DB) error {
+		var existing int64
+		if err := tx.Model(&CrRuleCatalog{}).Where("rule_id IN ?", ruleIDs).Count(&existing).Error; err != nil {
+			return err
+		}
+		result.Updated = uint64(existing)
+		result.Created = uint64(len(rules)) - result.Updated
+
+		upsert := clause.OnConflict{
+			Columns:   []clause.Column{{Name: "rule_id"}},
+			DoUpdates: clause.AssignmentColumns([]string{"title", "category", "severity", "owner", "docs_url", "updated_at"}),
+		}
+		if err := tx.Clauses(upsert).CreateInBatches(&records, batchInsertSize).Error; err != nil {
+			return err
+		}
+		if err := tx.Where("rule_id IN ?", ruleIDs).Delete(&CrRuleCatalogVersion{}).Error; err != nil {
+			return err
+		}
+		if len(versions) == 0 {
+			return nil
+		}
+		return tx.CreateInBatches(&versions, batchInsertSize).Error
+	})
+	if err != nil {
+		return ruleCatalogUpsertResult{}, err
+	}
+	return result, nil
+}
+
+// DeleteRuleCatalog removes ruleID from the catalog and reports whether it
+// was registered.
+func (s *gormStore) DeleteRuleCatalog(ruleID string) (bool, error) {
+	var deleted int64
+	err := s.db.Transaction(func(tx *gorm.DB) error {
+		if err := tx.Where("rule_id = ?", ruleID).Delete(&CrRuleCatalogVersion{}).Error; err != nil {
+			return err
+		}
+		result := tx.Where("rule_id = ?", ruleID).Delete(&CrRuleCatalog{})
+		deleted = result.RowsAffected
+		return result.Error
+	})
+	return deleted > 0, err
+}
+
+func (s *gormStore) catalogMatching(q ruleCatalogQuery) *gorm.DB {
+	query := s.db.Model(&CrRuleCatalog{})
+	if q.RuleID != "" {
+		query = query.Where("rule_id = ?", q.RuleID)
+	}
+	if q.Category != "" {
+		query = query.Where("category = ?", q.Category)
+	}
+	if q.Owner != "" {
+		query = query.Where("owner = ?", q.Owner)
+	}
+	if q.Severity != "" {
+		query = query.Where("severity = ?", q.Severity)
+	}
+	if q.RulesetVersion != "" {
+		query = query.Where("rule_id IN (SELECT rule_id FROM cr_rule_catalog_version WHERE ruleset_version = ?)", q.RulesetVersion)
+	}
+	return query
+}
+
+// ListRuleCatalog returns one page of the catalog ordered by rule_id together
+// with the number of rules matching q.
+func (s *gormStore) ListRuleCatalog(q ruleCatalogQuery) ([]ruleCatalogEntry, uint64, error) {
+	var total int64
+	if err := s.catalogMatching(q).Count(&total).Error; err != nil {
+		return nil, 0, err
+	}
+	var records []CrRuleCatalog
+	if err := s.catalogMatching(q).Order("rule_id").Limit(q.Limit).Offset(q.Offset).Find(&records).Error; err != nil {
+		return nil, 0, err
+	}
+	entries, err := s.catalogEntries(records)
+	return entries, uint64(total), err
+}
+
+// LookupRuleCatalog returns the catalog entries of ruleIDs keyed by rule_id;
+// unregistered rules are absent.
+func (s *gormStore) LookupRuleCatalog(ruleIDs []string) (map[string]*ruleCatalogEntry, error) {
+	lookup := make(map[string]*ruleCatalogEntry, len(ruleIDs))
+	for start := 0; start < len(ruleIDs); start += batchInsertSize {
+		end := start + batchInsertSize
+		if end > len(ruleIDs) {
+			end = len(ruleIDs)
+		}
+		var records []CrRuleCatalog
+		if err := s.db.Where("rule_id IN ?", ruleIDs[start:end]).Find(&records).Error; err != nil {
+			return nil, err
+		}
+		entries, err := s.catalogEntries(records)
+		if err != nil {
+			return nil, err
+		}
+		for i := range entries {
+			lookup[entries[i].RuleID] = &entries[i]
+		}
+	}
+	return lookup, nil
+}
+
+// catalogEntries loads the ruleset versions of records, sorted, into API
+// entries.
+func (s *gormStore) catalogEntries(records []CrRuleCatalog) ([]ruleCatalogEntry, error) {
+	if len(records) == 0 {
+		return nil, nil
+	}
+	ruleIDs := make([]string, 0, len(records))
+	for _, record := range records {
+		ruleIDs = append(ruleIDs, record.RuleID)
+	}
+	var versions []CrRuleCatalogVersion
+	if err := s.db.Where("rule_id IN ?", ruleIDs).Order("rule_id, ruleset_version").Find(&versions).Error; err != nil {
+		return nil, err
+	}
+	byRule := make(map[string][]string, len(records))
+	for _, version := range versions {
+		byRule[version.RuleID] = append(byRule[version.RuleID], version.RulesetVersion)
+	}
+
+	entries := make([]ruleCatalogEntry, 0, len(records))
+	for _, record := range records {
+		ruleVersions := byRule[record.RuleID]
+		if ruleVersions == nil {
+			ruleVersions = []string{}
+		}
+		sort.Strings(ruleVersions)
+		entries = append(entries, ruleCatalogEntry{
+			ruleCatalogRule: ruleCatalogRule{
+				RuleID:          record.RuleID,
+				Title:           record.Title,
+				Category:        record.Category,
+				Severity:        record.Severity,
+				Owner:           record.Owner,
+				DocsURL:         record.DocsURL,
+				RulesetVersions: ruleVersions,
+			},
+			UpdatedAt: record.UpdatedAt,
+		})
+	}
+	return entries, nil
+}
+
+// catalogFilterSQL returns a subquery selecting the rule_ids whose catalog
+// metadata matches the Category, Owner and Severity of f, or "" when none of
+// them is set. Rules missing from the catalog never match.
+func catalogFilterSQL(f queryFilter) (string, []interface{}) {
+	parts := make([]string, 0, 3)
+	args := make([]interface{}, 0, 3)
+	if f.Category != "" {
+		parts = append(parts, "category = ?")
+		args = append(args, f.Category)
+	}
+	if f.Owner != "" {
+		parts = append(parts, "owner = ?")
+		args = append(args, f.Owner)
+	}
+	if f.Severity != "" {
+		parts = append(parts, "severity = ?")
+		args = append(args, f.Severity)
+	}
+	if len(parts) == 0 {
+		return "", nil
+	}
+	return "SELECT rule_id FROM cr_rule_catalog WHERE " + strings.Join(parts, " AND "), args
+}
+
+// applyCatalogFilter narrows a query over a table with a rule_id column to
+// the rules matching the catalog filters of f.
+func applyCatalogFilter(db *gorm.DB, f queryFilter) *gorm.DB {
+	if sub, args := catalogFilterSQL(f); sub != "" {
+		db = db.Where("rule_id IN ("+sub+")", args...)
+	}
+	return db
+}
@@ -0,0 +1,232 @@
+package main
+
+import (
+	"net/http"
+	"os"
+	"path/filepath"
+	"reflect"
+	"strings"
+	"testing"
+	"time"
+)
+
+func TestValidateRuleCatalog(t *testing.T) {
+	valid := ruleCatalogRule{RuleID: "R1", Title: "No panics", Severity: "error", DocsURL: "https://docs.example.com/R1", RulesetVersions: []string{"r1"}}
+	with := func(edit func(*ruleCatalogRule)) []ruleCatalogRule {
+		rule := valid
+		edit(&rule)
+		return []ruleCatalogRule{rule}
+	}
+	cases := []struct {
+		name  string
+		rules []ruleCatalogRule
+		want  []string // field:code
+	}{
+		{name: "valid", rules: []ruleCatalogRule{valid}},
+		{name: "empty", rules: nil, want: []string{"rules:required"}},
+		{name: "too many", rules: make([]ruleCatalogRule, maxCatalogRules+1), want: []string{"rules:too_long"}},
+		{name: "duplicate", rules: []ruleCatalogRule{valid, valid}, want: []string{"rules[1].rule_id:duplicate"}},
+		{name: "missing fields", rules: []ruleCatalogRule{{}}, want: []string{"rules[0].rule_id:required", "rules[0].title:required"}},
+		{name: "bad rule id", rules: with(func(r *ruleCatalogRule) { r.RuleID = "R 1" }), want: []string{"rules[0].rule_id:invalid_format"}},
+		{name: "long title", rules: with(func(r *ruleCatalogRule) { r.Title = strings.Repeat("t", maxRuleTitleLen+1) }), want: []string{"rules[0].title:too_long"}},
+		{name: "unknown severity", rules: with(func(r *ruleCatalogRule) { r.Severity = "fatal" }), want: []string{"rules[0].severity:invalid_format"}},
+		{name: "no severity", rules: with(func(r *ruleCatalogRule) { r.Severity = "" })},
+		{name: "docs not http", rules: with(func(r *ruleCatalogRule) { r.DocsURL = "ftp://docs.example.com" }), want: []string{"rules[0].docs_url:invalid_format"}},
+		{name: "docs without host", rules: with(func(r *ruleCatalogRule) { r.DocsURL = "https:///R1" }), want: []string{"rules[0].docs_url:invalid_format"}},
+		{name: "blank version", rules: with(func(r *ruleCatalogRule) { r.RulesetVersions = []string{"r1", " "} }), want: []string{"rules[0].ruleset_versions[1]:required"}},
+	}
+	for _, tc := range cases {
+		t.Run(tc.name, func(t *testing.T) {
+			errs := validateRuleCatalog(tc.rules)
+			got := make([]string, 0, len(errs))
+			for _, e := range errs {
+				got = append(got, e.Field+":"+e.Code)
+			}
+			if strings.Join(got, ",") != strings.Join(tc.want, ",") {
+				t.Fatalf("errors %v, want %v", got, tc.want)
+			}
+		})
+	}
+}
+
+func TestLoadRuleCatalogFile(t *testing.T) {
+	dir := t.TempDir()
+	good := filepath.Join(dir, "catalog.yaml")
+	if err := os.WriteFile(good, []byte("rules:\n  - rule_id: R1\n    title: No panics\n    category: safety\n    ruleset_versions: [r1, r2]\n"), 0o644); err != nil {
+		t.Fatal(err)
+	}
+	rules, err := loadRuleCatalogFile(good)
+	if err != nil {
+		t.Fatal(err)
+	}
+	want := []ruleCatalogRule{{RuleID: "R1", Title: "No panics", Category: "safety", RulesetVersions: []string{"r1", "r2"}}}
+	if !reflect.DeepEqual(rules, want) {
+		t.Fatalf("rules %+v, want %+v", rules, want)
+	}
+
+	typo := filepath.Join(dir, "typo.yaml")
+	if err := os.WriteFile(typo, []byte("rules:\n  - rule_id: R1\n    titel: No panics\n"), 0o644); err != nil {
+		t.Fatal(err)
+	}
+	if _, err := loadRuleCatalogFile(typo); err == nil || !strings.Contains(err.Error(), "titel") {
+		t.Fatalf("unknown key: %v, want an error naming it", err)
+	}
+}
+
+type catalogPage struct {
+	Data  []ruleCatalogEntry `json:"data"`
+	Total uint64             `json:"total"`
+}
+
+func TestRuleCatalogEndpoints(t *testing.T) {
+	store := newTestStore(t)
+	base := newTestServer(t, store, authPolicy{}, alertPolicy{})
+	upload := func(rules ...ruleCatalogRule) (int, []byte) {
+		t.Helper()
+		return doRequest(t, http.MethodPost, base+"/v1/rule-catalog", ruleCatalogFile{Rules: rules}, nil)
+	}
+	list := func(query string) catalogPage {
+		t.Helper()
+		status, body := doRequest(t, http.MethodGet, base+"/api/rule-catalog?"+query, nil, nil)
+		if status != http.StatusOK {
+			t.Fatalf("rule-catalog?%s: %d %s", query, status, body)
+		}
+		var page catalogPage
+		decodeJSON(t, body, &page)
+		return page
+	}
+	type upsertResponse struct {
+		Created uint64 `json:"created"`
+		Updated uint64 `json:"updated"`
+	}
+
+	status, body := upload(
+		ruleCatalogRule{RuleID: "R1", Title: "No panics", Category: "safety", Owner: "team-a", Severity: "error", RulesetVersions: []string{"r2", "r1"}},
+		ruleCatalogRule{RuleID: "R2", Title: "Naming", Category: "style", Owner: "team-b", RulesetVersions: []string{"r1"}},
+	)
+	var first upsertResponse
+	decodeJSON(t, body, &first)
+	if status != http.StatusOK || first.Created != 2 || first.Updated != 0 {
+		t.Fatalf("first upload: %d %s", status, body)
+	}
+
+	// Re-uploading replaces the metadata and the version list.
+	status, body = upload(
+		ruleCatalogRule{RuleID: "R1", Title: "Never panic", Category: "safety", Owner: "team-a", Severity: "critical", RulesetVersions: []string{"r3", "r3"}},
+		ruleCatalogRule{RuleID: "R3", Title: "Docs", Category: "style", Owner: "team-b"},
+	)
+	var second upsertResponse
+	decodeJSON(t, body, &second)
+	if status != http.StatusOK || second.Created != 1 || second.Updated != 1 {
+		t.Fatalf("second upload: %d %s", status, body)
+	}
+
+	all := list("")
+	if all.Total != 3 || len(all.Data) != 3 {
+		t.Fatalf("catalog: %+v", all)
+	}
+	r1 := all.Data[0]
+	if r1.RuleID != "R1" || r1.Title != "Never panic" || r1.Severity != "critical" || !reflect.DeepEqual(r1.RulesetVersions, []string{"r3"}) || r1.UpdatedAt.IsZero() {
+		t.Fatalf("R1 after update: %+v", r1)
+	}
+	if r3 := all.Data[2]; r3.RuleID != "R3" || r3.RulesetVersions == nil || len(r3.RulesetVersions) != 0 {
+		t.Fatalf("R3 versions: %+v", r3)
+	}
+
+	cases := []struct {
+		query string
+		want  []string
+	}{
+		{"category=style", []string{"R2", "R3"}},
+		{"owner=team-a", []string{"R1"}},
+		{"severity=CRITICAL", []string{"R1"}},
+		{"ruleset_version=r1", []string{"R2"}},
+		{"rule_id=R3", []string{"R3"}},
+		{"category=style&limit=1&offset=1", []string{"R3"}},
+	}
+	for _, tc := range cases {
+		page := list(tc.query)
+		got := make([]string, 0, len(page.Data))
+		for _, entry := range page.Data {
+			got = append(got, entry.RuleID)
+		}
+		if !reflect.DeepEqual(got, tc.want) {
+			t.Errorf("%s: %v, want %v", tc.query, got, tc.want)
+		}
+	}
+	if status, _ := doRequest(t, http.MethodGet, base+"/api/rule-catalog?severity=fatal", nil, nil); status != http.StatusBadRequest {
+		t.Errorf("bad severity filter: %d, want 400", status)
+	}
+
+	status, body = upload(ruleCatalogRule{RuleID: "R4"})
+	var invalid validationErrResponse
+	decodeJSON(t, body, &invalid)
+	if status != http.StatusBadRequest || len(invalid.Details) != 1 || invalid.Details[0].Field != "rules[0].title" {
+		t.Fatalf("invalid upload: %d %s", status, body)
+	}
+
+	deletes := []struct {
+		query  string
+		status int
+	}{
+		{"rule_id=R2", http.StatusOK},
+		{"rule_id=R2", http.StatusNotFound},
+		{"", http.StatusBadRequest},
+	}
+	for _, tc := range deletes {
+		if status, body := doRequest(t, http.MethodDelete, base+"/v1/rule-catalog?"+tc.query, nil, nil); status != tc.status {
+			t.Errorf("delete %q: %d %s, want %d", tc.query, status, body, tc.status)
+		}
+	}
+	var versions int64
+	store.db.Model(&CrRuleCatalogVersion{}).Where("rule_id = ?", "R2").Count(&versions)
+	if versions != 0 {
+		t.Fatalf("%d versions left for the deleted rule", versions)
+	}
+}
+
+// TestCatalogFiltersRuleQueries narrows top rules by catalog metadata and
+// attaches the catalog entry; unregistered rules never match a filter.
+func TestCatalogFiltersRuleQueries(t *testing.T) {
+	store := newTestStore(t)
+	base := newTestServer(t, store, authPolicy{}, alertPolicy{})
+	at := time.Now().Add(-time.Hour).UTC().Truncate(time.Second)
+	storeRuns(t, store, testRun("org/a", "c1", 1, at, map[string]uint32{"R1": 1, "R2": 2, "R3": 3}))
+	if _, err := store.UpsertRuleCatalog([]ruleCatalogRule{
+		{RuleID: "R1", Title: "No panics", Category: "safety", Owner: "team-a", Severity: "error"},
+		{RuleID: "R2", Title: "Naming", Category: "style", Owner: "team-a"},
+	}); err != nil {
+		t.Fatal(err)
+	}
+
+	cases := []struct {
+		query string
+		want  []string
+	}{
+		{"", []string{"R3", "R2", "R1"}},
+		{"category=safety", []string{"R1"}},
+		{"owner=team-a", []string{"R2", "R1"}},
+		{"severity=error&owner=team-a", []string{"R1"}},
+		{"category=none", []string{}},
+	}
+	for _, tc := range cases {
+		status, body := doRequest(t, http.MethodGet, base+"/api/rules/top?"+tc.query, nil, nil)
+		if status != http.StatusOK {
+			t.Fatalf("rules/top?%s: %d %s", tc.query, status, body)
+		}
+		var resp struct {
+			Data []topRuleRow `json:"data"`
+		}
+		decodeJSON(t, body, &resp)
+		got := []string{}
+		for _, row := range resp.Data {
+			got = append(got, row.RuleID)
+			if registered := row.RuleID != "R3"; (row.Catalog != nil) != registered {
+				t.Errorf("%s: catalog of %s is %+v", tc.query, row.RuleID, row.Catalog)
+			}
+		}
+		if !reflect.DeepEqual(got, tc.want) {
+			t.Errorf("%s: %v, want %v", tc.query, got, tc.want)
+		}
+	}
+}
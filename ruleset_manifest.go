@@ -0,0 +1,318 @@
+package main
+
+import (
+	"database/sql"
+	"errors"
+	"fmt"
+	"sort"
+	"strings"
+	"time"
+	"unicode/utf8"
+
+	"gorm.io/gorm"
+)
+
+const (
+	maxConfigHashLen = 128
+	// maxManifestRules bounds the rules of one ruleset manifest.
+	maxManifestRules = 5000
+)
+
+// Rule changes reported by DiffRulesetManifests.
+const (
+	ruleAdded     = "added"
+	ruleRemoved   = "removed"
+	ruleModified  = "modified"
+	ruleUnchanged = "unchanged"
+)
+
+var ruleChangeOrder = map[string]int{ruleAdded: 0, ruleRemoved: 1, ruleModified: 2, ruleUnchanged: 3}
+
+// errManifestNotFound is returned by DiffRulesetManifests when one of the
+// versions has no manifest.
+var errManifestNotFound = errors.New("ruleset manifest not found")
+
+type manifestRule struct {
+	RuleID     string `json:"rule_id"`
+	ConfigHash string `json:"config_hash"`
+}
+
+// rulesetManifestRequest is the body of POST /v1/ruleset-manifests; it
+// replaces the whole manifest of RulesetVersion.
+type rulesetManifestRequest struct {
+	RulesetVersion string         `json:"ruleset_version"`
+	Rules          []manifestRule `json:"rules"`
+}
+
+type rulesetManifestSummary struct {
+	RulesetVersion string    `json:"ruleset_version"`
+	RuleCount      uint64    `json:"rule_count"`
+	UploadedAt     time.Time `json:"uploaded_at"`
+}
+
+// rulesetManifestSummaryRow is rulesetManifestSummary as scanned from the
+// database.
+type rulesetManifestSummaryRow struct {
+	RulesetVersion string
+	RuleCount      uint64
+	UploadedAt     scanTime
+}
+
+// ruleVersionStats is what one ruleset version observed for one rule in the
+// diff window.
+type ruleVersionStats struct {
+	TotalHits uint64 `json:"total_hits"`
+	// RunCount is the number of runs of the version in which the rule hit.
+	RunCount uint64 `json:"run_count"`
+	// HitsPerRun divides TotalHits by all runs of the version, so versions
+	// with different traffic compare; null when the version has no runs.
+	HitsPerRun *float64 `json:"hits_per_run"`
+	FixRate    *float64 `json:"fix_rate"`
+}
+
+type rulesetDiffRow struct {
+	RuleID           string           `json:"rule_id"`
+	Change           string           `json:"change"`
+	BaseConfigHash   string           `json:"base_config_hash"`
+	TargetConfigHash string           `json:"target_config_hash"`
+	Base             ruleVersionStats `json:"base"`
+	Target           ruleVersionStats `json:"target"`
+	// The deltas are target minus base, null when either side is.
+	HitsPerRunDelta *float64 `json:"hits_per_run_delta"`
+	FixRateDelta    *float64 `json:"fix_rate_delta"`
+
+	Catalog *ruleCatalogEntry `json:"catalog"`
+}
+
+type rulesetDiffSummary struct {
+	Added      uint64 `json:"added"`
+	Removed    uint64 `json:"removed"`
+	Modified   uint64 `json:"modified"`
+	Unchanged  uint64 `json:"unchanged"`
+	BaseRuns   uint64 `json:"base_runs"`
+	TargetRuns uint64 `json:"target_runs"`
+}
+
+type rulesetDiff struct {
+	Summary rulesetDiffSummary
+	Rows    []rulesetDiffRow
+}
+
+func validateRulesetManifest(req rulesetManifestRequest) []fieldError {
+	var errs []fieldError
+	add := func(field, code, message string) {
+		errs = append(errs, fieldError{Field: field, Code: code, Message: message})
+	}
+	if strings.TrimSpace(req.RulesetVersion) == "" {
+		add("ruleset_version", "required", "ruleset_version is required")
+	} else if utf8.RuneCountInString(req.RulesetVersion) > maxVersionLen {
+		add("ruleset_version", "too_long", fmt.Sprintf("ruleset_version must be at most %d characters", maxVersionLen))
+	}
+	if len(req.Rules) == 0 {
+		add("rules", "required", "rules must contain at least one rule")
+		return errs
+	}
+	if len(req.Rules) > maxManifestRules {
+		add("rules", "too_long", fmt.Sprintf("rules must contain at most %d entries", maxManifestRules))
+		return errs
+	}
+
+	seen := make(map[string]int, len(req.Rules))
+	for i, rule := range req.Rules {
+		prefix := fmt.Sprintf("rules[%d].", i)
+		switch {
+		case rule.RuleID == "":
+			add(prefix+"rule_id", "required", "rule_id is required")
+		case utf8.RuneCountInString(rule.RuleID) > maxRuleIDLen:
+			add(prefix+"rule_id", "too_long", fmt.Sprintf("rule_id must be at most %d characters", maxRuleIDLen))
+		case !isValidRuleID(rule.RuleID):
+			add(prefix+"rule_id", "invalid_format", "rule_id may only contain letters, digits and . _ - : /")
+		default:
+			if j, ok := seen[rule.RuleID]; ok {
+				add(prefix+"rule_id", "duplicate", fmt.Sprintf("rule_id %s is already listed at rules[%d]", rule.RuleID, j))
+			}
+			seen[rule.RuleID] = i
+		}
+		if strings.TrimSpace(rule.ConfigHash) == "" {
+			add(prefix+"config_hash", "required", "config_hash is required")
+		} else if utf8.RuneCountInString(rule.ConfigHash) > maxConfigHashLen {
+			add(prefix+"config_hash", "too_long", fmt.Sprintf("config_hash must be at most %d characters", maxConfigHashLen))
+		}
+	}
+	return errs
+}
+
+// ReplaceRulesetManifest stores the manifest of req.RulesetVersion and
+// reports whether it replaced an earlier upload.
+func (s *gormStore) ReplaceRulesetManifest(req rulesetManifestRequest) (bool, error) {
+	now := time.Now().UTC()
+	rows := make([]CrRulesetManifest, 0, len(req.Rules))
+	for _, rule := range req.Rules {
+		rows = append(rows, CrRulesetManifest{
+			RulesetVersion: req.RulesetVersion,
+			RuleID:         rule.RuleID,
+			ConfigHash:     rule.ConfigHash,
+			UploadedAt:     now,
+		})
+	}
+
+	var replaced bool
+	err := s.db.Transaction(func(tx *gorm.DB) error {
+		result := tx.Where("ruleset_version = ?", req.RulesetVersion).Delete(&CrRulesetManifest{})
+		if result.Error != nil {
+			return result.Error
+		}
+		replaced = result.RowsAffected > 0
+		return tx.CreateInBatches(&rows, batchInsertSize).Error
+	})
+	return replaced, err
+}
+
+// ListRulesetManifests returns every uploaded manifest, newest upload first.
+func (s *gormStore) ListRulesetManifests() ([]rulesetManifestSummary, error) {
+	var rows []rulesetManifestSummaryRow
+	if err := s.db.Model(&CrRulesetManifest{}).
+		Select("ruleset_version, COUNT(*) AS rule_count, MAX(uploaded_at) AS uploaded_at").
+		Group("ruleset_version").Order("uploaded_at DESC, ruleset_version").Scan(&rows).Error; err != nil {
+		return nil, err
+	}
+	var manifests []rulesetManifestSummary
+	for _, row := range rows {
+		manifests = append(manifests, rulesetManifestSummary{RulesetVersion: row.RulesetVersion, RuleCount: row.RuleCount, UploadedAt: row.UploadedAt.Time})
+	}
+	return manifests, nil
+}
+
+// LoadRulesetManifest returns the rules of version ordered by rule_id, or
+// errManifestNotFound.
+func (s *gormStore) LoadRulesetManifest(version string) ([]manifestRule, error) {
+	var rules []manifestRule
+	if err := s.db.Model(&CrRulesetManifest{}).Select("rule_id, config_hash").
+		Where("ruleset_version = ?", version).Order("rule_id").Scan(&rules).Error; err != nil {
+		return nil, err
+	}
+	if len(rules) == 0 {
+		return nil, fmt.Errorf("%w: %s", errManifestNotFound, version)
+	}
+	return rules, nil
+}
+
+// DiffRulesetManifests compares the manifests of base and target and joins
+// every changed rule with what each version observed in [from, to], limited
+// to f.Repo. includeUnchanged also lists the rules whose hash did not change.
+func (s *gormStore) DiffRulesetManifests(base, target string, from, to time.Time, f queryFilter, includeUnchanged bool) (rulesetDiff, error) {
+	var diff rulesetDiff
+	baseRules, err := s.LoadRulesetManifest(base)
+	if err != nil {
+		return diff, err
+	}
+	targetRules, err := s.LoadRulesetManifest(target)
+	if err != nil {
+		return diff, err
+	}
+
+	baseHashes := make(map[string]string, len(baseRules))
+	for _, rule := range baseRules {
+		baseHashes[rule.RuleID] = rule.ConfigHash
+	}
+	for _, rule := range targetRules {
+		row := rulesetDiffRow{RuleID: rule.RuleID, TargetConfigHash: rule.ConfigHash}
+		baseHash, ok := baseHashes[rule.RuleID]
+		delete(baseHashes, rule.RuleID)
+		switch {
+		case !ok:
+			row.Change = ruleAdded
+			diff.Summary.Added++
+		case baseHash != rule.ConfigHash:
+			row.Change = ruleModified
+			row.BaseConfigHash = baseHash
+			diff.Summary.Modified++
+		default:
+			row.Change = ruleUnchanged
+			row.BaseConfigHash = baseHash
+			diff.Summary.Unchanged++
+			if !includeUnchanged {
+				continue
+			}
+		}
+		diff.Rows = append(diff.Rows, row)
+	}
+	for ruleID, hash := range baseHashes {
+		diff.Rows = append(diff.Rows, rulesetDiffRow{RuleID: ruleID, Change: ruleRemoved, BaseConfigHash: hash})
+		diff.Summary.Removed++
+	}
+	sort.Slice(diff.Rows, func(a, b int) bool {
+		if diff.Rows[a].Change != diff.Rows[b].Change {
+			return ruleChangeOrder[diff.Rows[a].Change] < ruleChangeOrder[diff.Rows[b].Change]
+		}
+		return diff.Rows[a].RuleID < diff.Rows[b].RuleID
+	})
+
+	baseStats, baseRuns, err := s.loadRuleVersionStats(base, from, to, f)
+	if err != nil {
+		return diff, err
+	}
+	targetStats, targetRuns, err := s.loadRuleVersionStats(target, from, to, f)
+	if err != nil {
+		return diff, err
+	}
+	diff.Summary.BaseRuns = baseRuns
+	diff.Summary.TargetRuns = targetRuns
+	for i := range diff.Rows {
+		row := &diff.Rows[i]
+		row.Base = ruleStatsFor(baseStats, row.RuleID, baseRuns)
+		row.Target = ruleStatsFor(targetStats, row.RuleID, targetRuns)
+		row.HitsPerRunDelta = deltaOf(row.Base.HitsPerRun, row.Target.HitsPerRun)
+		row.FixRateDelta = deltaOf(row.Base.FixRate, row.Target.FixRate)
+	}
+	return diff, nil
+}
+
+// loadRuleVersionStats runs the rule quality query for one ruleset version
+// under the remaining filters of f and returns its rows keyed by rule_id,
+// plus the number of runs of the version.
+func (s *gormStore) loadRuleVersionStats(version string, from, to time.Time, f queryFilter) (map[string]ruleQualityAggRow, uint64, error) {
+	scope := f
+	scope.RulesetVersion = version
+	runs, err := s.CountRuns(from, to, scope)
+	if err != nil {
+		return nil, 0, err
+	}
+	baseSQL, args := buildRuleQualityBaseSQL(s.dialect, scope, from, to)
+	var rows []ruleQualityAggRow
+	if err := s.db.Raw("SELECT rule_id, total_hits, run_count, change_count, fix_count, fix_rate, "+
+		"feedback_count, false_positive_count, false_positive_rate FROM ("+baseSQL+") q", args...).Scan(&rows).Error; err != nil {
+		return nil, 0, err
+	}
+	stats := make(map[string]ruleQualityAggRow, len(rows))
+	for _, row := range rows {
+		stats[row.RuleID] = row
+	}
+	return stats, runs, nil
+}
+
+func ruleStatsFor(stats map[string]ruleQualityAggRow, ruleID string, runs uint64) ruleVersionStats {
+	row := stats[ruleID]
+	result := ruleVersionStats{TotalHits: row.TotalHits, RunCount: row.RunCount, FixRate: nullFloatPtr(row.FixRate)}
+	if runs > 0 {
+		value := float64(row.TotalHits) / float64(runs)
+		result.HitsPerRun = &value
+	}
+	return result
+}
+
+func nullFloatPtr(v sql.NullFloat64) *float64 {
+	if !v.Valid {
+		return nil
+	}
+	value := v.Float64
+	return &value
+}
+
+func deltaOf(base, target *float64) *float64 {
+	if base == nil || target == nil {
+		return nil
+	}
+	value := *target - *base
+	return &value
+}
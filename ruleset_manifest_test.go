@@ -0,0 +1,220 @@
+package main
+
+import (
+	"net/http"
+	"reflect"
+	"strings"
+	"testing"
+	"time"
+)
+
+func TestValidateRulesetManifest(t *testing.T) {
+	rule := manifestRule{RuleID: "R1", ConfigHash: "3b7c9e"}
+	cases := []struct {
+		name string
+		req  rulesetManifestRequest
+		want []string // field:code
+	}{
+		{name: "valid", req: rulesetManifestRequest{RulesetVersion: "r1", Rules: []manifestRule{rule}}},
+		{name: "no version", req: rulesetManifestRequest{RulesetVersion: " ", Rules: []manifestRule{rule}}, want: []string{"ruleset_version:required"}},
+		{name: "long version", req: rulesetManifestRequest{RulesetVersion: strings.Repeat("v", maxVersionLen+1), Rules: []manifestRule{rule}},
+			want: []string{"ruleset_version:too_long"}},
+		{name: "no rules", req: rulesetManifestRequest{RulesetVersion: "r1"}, want: []string{"rules:required"}},
+		{name: "too many", req: rulesetManifestRequest{RulesetVersion: "r1", Rules: make([]manifestRule, maxManifestRules+1)},
+			want: []string{"rules:too_long"}},
+		{name: "duplicate", req: rulesetManifestRequest{RulesetVersion: "r1", Rules: []manifestRule{rule, rule}}, want: []string{"rules[1].rule_id:duplicate"}},
+		{name: "missing fields", req: rulesetManifestRequest{RulesetVersion: "r1", Rules: []manifestRule{{}}},
+			want: []string{"rules[0].rule_id:required", "rules[0].config_hash:required"}},
+		{name: "bad rule id", req: rulesetManifestRequest{RulesetVersion: "r1", Rules: []manifestRule{{RuleID: "R 1", ConfigHash: "x"}}},
+			want: []string{"rules[0].rule_id:invalid_format"}},
+		{name: "long hash", req: rulesetManifestRequest{RulesetVersion: "r1", Rules: []manifestRule{{RuleID: "R1", ConfigHash: strings.Repeat("h", maxConfigHashLen+1)}}},
+			want: []string{"rules[0].config_hash:too_long"}},
+	}
+	for _, tc := range cases {
+		t.Run(tc.name, func(t *testing.T) {
+			errs := validateRulesetManifest(tc.req)
+			got := make([]string, 0, len(errs))
+			for _, e := range errs {
+				got = append(got, e.Field+":"+e.Code)
+			}
+			if strings.Join(got, ",") != strings.Join(tc.want, ",") {
+				t.Fatalf("errors %v, want %v", got, tc.want)
+			}
+		})
+	}
+}
+
+// uploadManifest uploads rules given as "rule_id=config_hash".
+func uploadManifest(t *testing.T, base, version string, rules ...string) (int, []byte) {
+	t.Helper()
+	req := rulesetManifestRequest{RulesetVersion: version}
+	for _, rule := range rules {
+		ruleID, hash, _ := strings.Cut(rule, "=")
+		req.Rules = append(req.Rules, manifestRule{RuleID: ruleID, ConfigHash: hash})
+	}
+	return doRequest(t, http.MethodPost, base+"/v1/ruleset-manifests", req, nil)
+}
+
+func TestRulesetManifestEndpoints(t *testing.T) {
+	store := newTestStore(t)
+	base := newTestServer(t, store, authPolicy{}, alertPolicy{})
+	type uploadResponse struct {
+		RuleCount int  `json:"rule_count"`
+		Replaced  bool `json:"replaced"`
+	}
+
+	uploads := []struct {
+		version  string
+		rules    []string
+		count    int
+		replaced bool
+	}{
+		{"r1", []string{"R1=a", "R2=b"}, 2, false},
+		{"r2", []string{"R2=b", "R1=a", "R3=c"}, 3, false},
+		// A second upload replaces the whole list.
+		{"r2", []string{"R3=c2", "R1=a"}, 2, true},
+	}
+	for _, u := range uploads {
+		status, body := uploadManifest(t, base, u.version, u.rules...)
+		var resp uploadResponse
+		decodeJSON(t, body, &resp)
+		if status != http.StatusOK || resp.RuleCount != u.count || resp.Replaced != u.replaced {
+			t.Fatalf("upload %s %v: %d %s", u.version, u.rules, status, body)
+		}
+	}
+	if status, body := uploadManifest(t, base, "r3", "R1="); status != http.StatusBadRequest {
+		t.Fatalf("invalid upload: %d %s", status, body)
+	}
+
+	status, body := doRequest(t, http.MethodGet, base+"/api/ruleset-manifests", nil, nil)
+	var list struct {
+		Data []rulesetManifestSummary `json:"data"`
+	}
+	decodeJSON(t, body, &list)
+	if status != http.StatusOK || len(list.Data) != 2 || list.Data[0].RulesetVersion != "r2" || list.Data[0].RuleCount != 2 || list.Data[1].RuleCount != 2 {
+		t.Fatalf("manifests: %d %s", status, body)
+	}
+
+	status, body = doRequest(t, http.MethodGet, base+"/api/ruleset-manifests/rules?ruleset_version=r2", nil, nil)
+	var rules struct {
+		Data []manifestRule `json:"data"`
+	}
+	decodeJSON(t, body, &rules)
+	if want := []manifestRule{{"R1", "a"}, {"R3", "c2"}}; status != http.StatusOK || !reflect.DeepEqual(rules.Data, want) {
+		t.Fatalf("r2 rules: %d %s", status, body)
+	}
+
+	for query, want := range map[string]int{"ruleset_version=r9": http.StatusNotFound, "": http.StatusBadRequest} {
+		if status, body := doRequest(t, http.MethodGet, base+"/api/ruleset-manifests/rules?"+query, nil, nil); status != want {
+			t.Errorf("rules?%s: %d %s, want %d", query, status, body, want)
+		}
+	}
+}
+
+func TestRulesetDiffEndpoint(t *testing.T) {
+	store := newTestStore(t)
+	base := newTestServer(t, store, authPolicy{}, alertPolicy{})
+	now := time.Now().Add(-time.Hour).UTC().Truncate(time.Second)
+
+	// r1: two runs, R2 hits once. r2: four runs, R2 hits three times.
+	specs := []struct {
+		version string
+		hits    map[string]uint32
+	}{
+		{"r1", map[string]uint32{"R1": 1, "R2": 1}},
+		{"r1", map[string]uint32{}},
+		{"r2", map[string]uint32{"R2": 2, "R4": 1}},
+		{"r2", map[string]uint32{"R2": 1}},
+		{"r2", map[string]uint32{}},
+		{"r2", map[string]uint32{}},
+	}
+	for i, spec := range specs {
+		run := testRun("org/a", "c1", i+1, now.Add(time.Duration(i)*time.Minute), spec.hits)
+		run.RulesetVersion = spec.version
+		storeRuns(t, store, run)
+	}
+	for _, m := range []struct {
+		version string
+		rules   []string
+	}{
+		{"r1", []string{"R1=a", "R2=b", "R3=c"}},
+		{"r2", []string{"R1=a", "R2=b2", "R4=d"}},
+		{"r3", []string{"R1=a"}},
+	} {
+		if status, body := uploadManifest(t, base, m.version, m.rules...); status != http.StatusOK {
+			t.Fatalf("upload %s: %d %s", m.version, status, body)
+		}
+	}
+	if _, err := store.UpsertRuleCatalog([]ruleCatalogRule{{RuleID: "R2", Title: "Naming"}}); err != nil {
+		t.Fatal(err)
+	}
+
+	type diffResponse struct {
+		Summary rulesetDiffSummary `json:"summary"`
+		Data    []rulesetDiffRow   `json:"data"`
+	}
+	load := func(query string) diffResponse {
+		t.Helper()
+		status, body := doRequest(t, http.MethodGet, base+"/api/ruleset-manifests/diff?"+query, nil, nil)
+		if status != http.StatusOK {
+			t.Fatalf("diff?%s: %d %s", query, status, body)
+		}
+		var resp diffResponse
+		decodeJSON(t, body, &resp)
+		return resp
+	}
+
+	diff := load("base=r1&target=r2")
+	wantSummary := rulesetDiffSummary{Added: 1, Removed: 1, Modified: 1, Unchanged: 1, BaseRuns: 2, TargetRuns: 4}
+	if diff.Summary != wantSummary {
+		t.Fatalf("summary %+v, want %+v", diff.Summary, wantSummary)
+	}
+	var changes []string
+	for _, row := range diff.Data {
+		changes = append(changes, row.Change+" "+row.RuleID)
+	}
+	if want := []string{"added R4", "removed R3", "modified R2"}; !reflect.DeepEqual(changes, want) {
+		t.Fatalf("changes %v, want %v", changes, want)
+	}
+
+	modified := diff.Data[2]
+	if modified.BaseConfigHash != "b" || modified.TargetConfigHash != "b2" || modified.Catalog == nil || modified.Catalog.Title != "Naming" {
+		t.Fatalf("modified row %+v", modified)
+	}
+	if modified.Base.TotalHits != 1 || modified.Target.TotalHits != 3 || modified.Target.RunCount != 2 {
+		t.Fatalf("R2 stats: base %+v, target %+v", modified.Base, modified.Target)
+	}
+	if !closeTo(modified.Base.HitsPerRun, 0.5) || !closeTo(modified.Target.HitsPerRun, 0.75) || !closeTo(modified.HitsPerRunDelta, 0.25) {
+		t.Fatalf("R2 hits per run: %v %v %v", modified.Base.HitsPerRun, modified.Target.HitsPerRun, modified.HitsPerRunDelta)
+	}
+	// A removed rule has no target hits, but the target still ran.
+	if removed := diff.Data[1]; !closeTo(removed.Target.HitsPerRun, 0) || removed.Catalog != nil {
+		t.Fatalf("removed row %+v", removed)
+	}
+
+	all := load("base=r1&target=r2&include_unchanged=true")
+	if len(all.Data) != 4 || all.Data[3].Change != ruleUnchanged || all.Data[3].RuleID != "R1" {
+		t.Fatalf("with unchanged: %+v", all.Data)
+	}
+
+	// r3 has a manifest but no runs: its rates and the deltas are null.
+	idle := load("base=r1&target=r3")
+	if idle.Summary.TargetRuns != 0 || idle.Summary.Removed != 2 {
+		t.Fatalf("idle summary %+v", idle.Summary)
+	}
+	for _, row := range idle.Data {
+		if row.Target.HitsPerRun != nil || row.HitsPerRunDelta != nil {
+			t.Fatalf("idle row %+v", row)
+		}
+	}
+
+	for query, want := range map[string]int{
+		"base=r1":           http.StatusBadRequest,
+		"base=r1&target=r9": http.StatusNotFound,
+		"base=r9&target=r1": http.StatusNotFound,
+	} {
+		if status, body := doRequest(t, http.MethodGet, base+"/api/ruleset-manifests/diff?"+query, nil, nil); status != want {
+			t.Errorf("diff?%s: %d %s, want %d", query, status, body, want)
+		}
+	}
+}
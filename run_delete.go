@@ -0,0 +1,269 @@
+package main
+
+import (
+	"encoding/json"
+	"errors"
+	"time"
+
+	"gorm.io/gorm"
+)
+
+// runDeletePageSize is the number of runs DeleteAgentRuns removes per
+// statement.
+const runDeletePageSize = 500
+
+// runDeleteFilter selects the runs removed by DeleteAgentRuns; zero From/To
+// leave that side of the range open.
+type runDeleteFilter struct {
+	Repo           string
+	CodeChangeID   string
+	AgentVersion   string
+	RulesetVersion string
+	From           time.Time
+	To             time.Time
+}
+
+// runDeleteResult reports what a run deletion removed, or would remove in
+// dry-run mode, where only Runs and Changes are filled.
+type runDeleteResult struct {
+	DryRun   bool   `json:"dry_run"`
+	Runs     uint64 `json:"deleted_runs"`
+	RuleRows uint64 `json:"deleted_rule_rows"`
+	Findings uint64 `json:"deleted_findings"`
+	Feedback uint64 `json:"deleted_feedback"`
+	// Changes counts the distinct changes the runs belonged to; their
+	// summaries and fix tracking are recomputed from the runs left.
+	Changes          uint64 `json:"affected_changes"`
+	SummariesDeleted uint64 `json:"summaries_deleted"`
+	// SummariesSkipped counts changes whose summary starts before the run
+	// retention window; it cannot be recomputed and is left unchanged.
+	SummariesSkipped uint64 `json:"summaries_skipped"`
+}
+
+// DeleteAgentRun removes one run like DeleteAgentRuns does. It returns
+// errRunNotFound when the run does not exist.
+func (s *gormStore) DeleteAgentRun(repo, codeChangeID, agentRunID string) (runDeleteResult, error) {
+	result := runDeleteResult{}
+	retainedSince := s.retention.runsRetainedSince(time.Now())
+	err := s.db.Transaction(func(tx *gorm.DB) error {
+		var runs []CrAgentRun
+		if err := tx.Where("repo = ? AND code_change_id = ? AND agent_run_id = ?", repo, codeChangeID, agentRunID).
+			Find(&runs).Error; err != nil {
+			return err
+		}
+		if len(runs) == 0 {
+			return errRunNotFound
+		}
+		result.Changes = 1
+		if err := deleteRunPage(tx, runs, &result); err != nil {
+			return err
+		}
+		return recomputeDeletedChanges(tx, []changeKey{{repo, codeChangeID}}, retainedSince, &result)
+	})
+	return result, err
+}
+
+// DeleteAgentRuns removes the runs matching f together with their rule rows,
+// findings, finding transitions and feedback, takes them out of the rollups,
+// and recomputes the summary and fix tracking of their changes from the runs
+// left. The runs of each change are deleted in one transaction, so when an
+// error stops the deletion every change is either done or untouched; the
+// result then counts the changes already done and is returned with the
+// error. With dryRun it only counts the runs and changes.
+func (s *gormStore) DeleteAgentRuns(f runDeleteFilter, dryRun bool) (runDeleteResult, error) {
+	result := runDeleteResult{DryRun: dryRun}
+	matching := func(db *gorm.DB) *gorm.DB {
+		query := applyRunFilters(db.Model(&CrAgentRun{}), queryFilter{
+			Repo:           f.Repo,
+			CodeChangeID:   f.CodeChangeID,
+			AgentVersion:   f.AgentVersion,
+			RulesetVersion: f.RulesetVersion,
+		})
+		if !f.From.IsZero() {
+			query = query.Where("reported_at >= ?", f.From)
+		}
+		if !f.To.IsZero() {
+			query = query.Where("reported_at <= ?", f.To)
+		}
+		return query
+	}
+
+	var keys []changeKey
+	if err := matching(s.db).Distinct("repo", "code_change_id").Order("repo, code_change_id").Scan(&keys).Error; err != nil {
+		return result, err
+	}
+	if dryRun {
+		if err := matching(s.db).Select("COUNT(*)").Scan(&result.Runs).Error; err != nil {
+			return result, err
+		}
+		result.Changes = uint64(len(keys))
+		return result, nil
+	}
+
+	retainedSince := s.retention.runsRetainedSince(time.Now())
+	for _, key := range keys {
+		change := runDeleteResult{Changes: 1}
+		err := s.db.Transaction(func(tx *gorm.DB) error {
+			var afterID uint64
+			for {
+				var runs []CrAgentRun
+				if err := matching(tx).Where("repo = ? AND code_change_id = ? AND id > ?", key.Repo, key.CodeChangeID, afterID).
+					Order("id").Limit(runDeletePageSize).Find(&runs).Error; err != nil {
+					return err
+				}
+				if len(runs) == 0 {
+					return recomputeDeletedChanges(tx, []changeKey{key}, retainedSince, &change)
+				}
+				if err := deleteRunPage(tx, runs, &change); err != nil {
+					return err
+				}
+				afterID = runs[len(runs)-1].ID
+			}
+		})
+		if err != nil {
+			return result, err
+		}
+		result.add(change)
+	}
+	return result, nil
+}
+
+func (r *runDeleteResult) add(o runDeleteResult) {
+	r.Runs += o.Runs
+	r.RuleRows += o.RuleRows
+	r.Findings += o.Findings
+	r.Feedback += o.Feedback
+	r.Changes += o.Changes
+	r.SummariesDeleted += o.SummariesDeleted
+	r.SummariesSkipped += o.SummariesSkipped
+}
+
+// deleteRunPage deletes runs with their rule rows, findings and feedback
+// inside tx and takes them out of the rollups. The changes they belonged to
+// are left for recomputeDeletedChanges.
+func deleteRunPage(tx *gorm.DB, runs []CrAgentRun, result *runDeleteResult) error {
+	ids := make([]uint64, 0, len(runs))
+	ruleHits := make([]map[string]uint32, 0, len(runs))
+	for _, run := range runs {
+		ids = append(ids, run.ID)
+		var hits map[string]uint32
+		if err := json.Unmarshal(run.RuleHitsJSON, &hits); err != nil {
+			return err
+		}
+		ruleHits = append(ruleHits, hits)
+	}
+
+	deleted := tx.Where("run_id IN ?", ids).Delete(&CrAgentRunRule{})
+	if deleted.Error != nil {
+		return deleted.Error
+	}
+	result.RuleRows += uint64(deleted.RowsAffected)
+	deleted = tx.Where("run_id IN ?", ids).Delete(&CrAgentRunFinding{})
+	if deleted.Error != nil {
+		return deleted.Error
+	}
+	result.Findings += uint64(deleted.RowsAffected)
+	deleted = tx.Where("run_id IN ?", ids).Delete(&CrFindingFeedback{})
+	if deleted.Error != nil {
+		return deleted.Error
+	}
+	result.Feedback += uint64(deleted.RowsAffected)
+	deleted = tx.Where("id IN ?", ids).Delete(&CrAgentRun{})
+	if deleted.Error != nil {
+		return deleted.Error
+	}
+	if deleted.RowsAffected != int64(len(ids)) {
+		// Another deletion removed some of the runs first; rolling back keeps
+		// the rollups from being decremented twice.
+		return errors.New("runs were deleted concurrently, retry the deletion")
+	}
+	result.Runs += uint64(deleted.RowsAffected)
+
+	return subtractRollups(tx, runs, ruleHits)
+}
+
+// recomputeDeletedChanges recomputes the fix tracking and summaries of the
+// changes runs were deleted from, once all of their runs are gone. The
+// transitions of the deleted runs go with the change-wide recompute.
+// Summaries starting before retainedSince are left alone.
+func recomputeDeletedChanges(tx *gorm.DB, keys []changeKey, retainedSince time.Time, result *runDeleteResult) error {
+	if _, err := refreshFindingTransitions(tx, keys, nil); err != nil {
+		return err
+	}
+	return recomputeDeletedSummaries(tx, keys, retainedSince, result)
+}
+
+// subtractRollups takes deleted runs back out of the rollup tables, removing
+// buckets that no run is left in. Counters never go below zero, which covers
+// runs ingested before the rollups were built.
+func subtractRollups(tx *gorm.DB, runs []CrAgentRun, ruleHits []map[string]uint32) error {
+	runRollups, ruleRollups := foldRollups(runs, ruleHits)
+	for _, row := range runRollups {
+		query := tx.Model(&CrRunRollup{}).Where("granularity = ? AND bucket_start = ? AND repo = ? AND ruleset_version = ? AND agent_version = ?",
+			row.Granularity, row.BucketStart, row.Repo, row.RulesetVersion, row.AgentVersion)
+		if err := query.Updates(map[string]interface{}{
+			"run_count":        subtractCounter("run_count", row.RunCount),
+			"total_hits":       subtractCounter("total_hits", row.TotalHits),
+			"total_diff_lines": subtractCounter("total_diff_lines", row.TotalDiffLines),
+		}).Error; err != nil {
+			return err
+		}
+		if err := tx.Where("granularity = ? AND bucket_start = ? AND repo = ? AND ruleset_version = ? AND agent_version = ? AND run_count = 0",
+			row.Granularity, row.BucketStart, row.Repo, row.RulesetVersion, row.AgentVersion).Delete(&CrRunRollup{}).Error; err != nil {
+			return err
+		}
+	}
+	for _, row := range ruleRollups {
+		query := tx.Model(&CrRuleRollup{}).Where("granularity = ? AND bucket_start = ? AND repo = ? AND ruleset_version = ? AND agent_version = ? AND rule_id = ?",
+			row.Granularity, row.BucketStart, row.Repo, row.RulesetVersion, row.AgentVersion, row.RuleID)
+		if err := query.Updates(map[string]interface{}{
+			"hit_count": subtractCounter("hit_count", row.HitCount),
+			"run_count": subtractCounter("run_count", row.RunCount),
+		}).Error; err != nil {
+			return err
+		}
+		if err := tx.Where("granularity = ? AND bucket_start = ? AND repo = ? AND ruleset_version = ? AND agent_version = ? AND rule_id = ? AND run_count = 0",
+			row.Granularity, row.BucketStart, row.Repo, row.RulesetVersion, row.AgentVersion, row.RuleID).Delete(&CrRuleRollup{}).Error; err != nil {
+			return err
+		}
+	}
+	return nil
+}
+
+// subtractCounter lowers an unsigned counter column by n, stopping at zero.
+func subtractCounter(column string, n uint64) interface{} {
+	return gorm.Expr("CASE WHEN "+column+" > ? THEN "+column+" - ? ELSE 0 END", n, n)
+}
+
+// recomputeDeletedSummaries rebuilds the summaries of keys from the runs left,
+// deleting those of changes without runs.
+func recomputeDeletedSummaries(tx *gorm.DB, keys []changeKey, retainedSince time.Time, result *runDeleteResult) error {
+	var stored []CodeChangeSummary
+	if err := tx.Select("repo, code_change_id, first_reported_at").
+		Where("(repo, code_change_id) IN ?", changeKeyArgs(keys)).Find(&stored).Error; err != nil {
+		return err
+	}
+	skipped := make(map[changeKey]bool)
+	for _, row := range stored {
+		if row.FirstReportedAt.Before(retainedSince) {
+			skipped[changeKey{row.Repo, row.CodeChangeID}] = true
+		}
+	}
+	result.SummariesSkipped += uint64(len(skipped))
+
+	var recompute []changeKey
+	for _, key := range keys {
+		if !skipped[key] {
+			recompute = append(recompute, key)
+		}
+	}
+	if len(recompute) == 0 {
+		return nil
+	}
+	rebuilt, err := recomputeCodeChangeSummaries(tx, recompute)
+	if err != nil {
+		return err
+	}
+	result.SummariesDeleted += uint64(len(recompute) - len(rebuilt))
+	return replaceCodeChangeSummaries(tx, recompute, rebuilt)
+}
@@ -0,0 +1,110 @@
+package main
+
+import "math"
+
+// confidenceZ is the normal quantile of the two-sided 95% intervals reported
+// by the comparison endpoints.
+const confidenceZ = 1.96
+
+// estimate is a point estimate with its 95% confidence interval. Value is
+// null without data; the interval is null when it cannot be estimated, e.g.
+// from a single observation.
+type estimate struct {
+	Value  *float64 `json:"value"`
+	CILow  *float64 `json:"ci_low"`
+	CIHigh *float64 `json:"ci_high"`
+	N      uint64   `json:"n"`
+}
+
+// difference is b - a of two estimates with a 95% interval. Significant
+// reports that the interval excludes zero.
+type difference struct {
+	Value       *float64 `json:"value"`
+	CILow       *float64 `json:"ci_low"`
+	CIHigh      *float64 `json:"ci_high"`
+	Significant bool     `json:"significant"`
+}
+
+func floatPtr(v float64) *float64 {
+	return &v
+}
+
+// proportionEstimate estimates successes/n with a Wilson score interval,
+// which stays inside [0, 1] for small n and rates near the bounds.
+func proportionEstimate(successes, n uint64) estimate {
+	if n == 0 {
+		return estimate{}
+	}
+	nf := float64(n)
+	p := float64(successes) / nf
+	z2 := confidenceZ * confidenceZ
+	center := (p + z2/(2*nf)) / (1 + z2/nf)
+	half := confidenceZ * math.Sqrt(p*(1-p)/nf+z2/(4*nf*nf)) / (1 + z2/nf)
+	low, high := math.Max(0, center-half), math.Min(1, center+half)
+	if successes == 0 {
+		low = 0
+	}
+	if successes == n {
+		high = 1
+	}
+	return estimate{Value: floatPtr(p), CILow: floatPtr(low), CIHigh: floatPtr(high), N: n}
+}
+
+// meanEstimate estimates the mean of n observations from their sum and sum of
+// squares.
+func meanEstimate(n uint64, sum, sumSq float64) estimate {
+	if n == 0 {
+		return estimate{}
+	}
+	nf := float64(n)
+	mean := sum / nf
+	e := estimate{Value: floatPtr(mean), N: n}
+	if n < 2 {
+		return e
+	}
+	variance := math.Max(0, (sumSq-nf*mean*mean)/(nf-1))
+	half := confidenceZ * math.Sqrt(variance/nf)
+	e.CILow = floatPtr(mean - half)
+	e.CIHigh = floatPtr(mean + half)
+	return e
+}
+
+// ratioEstimate estimates sum(y)/sum(x) over n paired observations, e.g. hits
+// per diff line, using the delta method for its standard error.
+func ratioEstimate(n uint64, sumY, sumX, sumYY, sumXX, sumXY float64) estimate {
+	if n == 0 || sumX <= 0 {
+		return estimate{N: n}
+	}
+	nf := float64(n)
+	r := sumY / sumX
+	e := estimate{Value: floatPtr(r), N: n}
+	if n < 2 {
+		return e
+	}
+	residual := math.Max(0, sumYY-2*r*sumXY+r*r*sumXX)
+	half := confidenceZ * math.Sqrt(residual/(nf-1)/nf) / (sumX / nf)
+	e.CILow = floatPtr(r - half)
+	e.CIHigh = floatPtr(r + half)
+	return e
+}
+
+// diffEstimate compares b against a. The interval combines the arms of both
+// intervals (Newcombe's method), which reduces to the normal approximation
+// for symmetric intervals and stays sensible for Wilson intervals near 0 or
+// 1. Without an interval on either side only the point difference is
+// reported.
+func diffEstimate(a, b estimate) difference {
+	if a.Value == nil || b.Value == nil {
+		return difference{}
+	}
+	d := difference{Value: floatPtr(*b.Value - *a.Value)}
+	if a.CILow == nil || b.CILow == nil {
+		return d
+	}
+	low := *d.Value - math.Hypot(*b.Value-*b.CILow, *a.CIHigh-*a.Value)
+	high := *d.Value + math.Hypot(*b.CIHigh-*b.Value, *a.Value-*a.CILow)
+	d.CILow = floatPtr(low)
+	d.CIHigh = floatPtr(high)
+	d.Significant = low > 0 || high < 0
+	return d
+}
@@ -0,0 +1,161 @@
+package main
+
+import (
+	"math"
+	"testing"
+)
+
+// closeTo reports whether got rounds to want at four decimals, the precision
+// of the published tables.
+func closeTo(got *float64, want float64) bool {
+	return got != nil && math.Abs(*got-want) < 0.00005
+}
+
+// TestProportionEstimateWilson checks the Wilson score intervals against
+// Newcombe (1998), "Two-sided confidence intervals for the single proportion",
+// Statistics in Medicine 17:857-872, Table I, method 3.
+func TestProportionEstimateWilson(t *testing.T) {
+	cases := []struct {
+		successes, n uint64
+		low, high    float64
+	}{
+		{81, 263, 0.2553, 0.3662},
+		{15, 148, 0.0624, 0.1605},
+		{0, 20, 0, 0.1611},
+		{1, 29, 0.0061, 0.1718},
+	}
+	for _, tc := range cases {
+		e := proportionEstimate(tc.successes, tc.n)
+		if !closeTo(e.Value, float64(tc.successes)/float64(tc.n)) || !closeTo(e.CILow, tc.low) || !closeTo(e.CIHigh, tc.high) || e.N != tc.n {
+			t.Errorf("%d/%d: %v [%v, %v], want [%v, %v]", tc.successes, tc.n, *e.Value, *e.CILow, *e.CIHigh, tc.low, tc.high)
+		}
+	}
+	if e := proportionEstimate(29, 29); *e.CIHigh != 1 || *e.CILow >= 1 {
+		t.Errorf("29/29: [%v, %v], want the upper bound at 1", *e.CILow, *e.CIHigh)
+	}
+	if e := proportionEstimate(0, 0); e.Value != nil || e.CILow != nil {
+		t.Errorf("0/0: %+v, want no estimate", e)
+	}
+}
+
+// TestDiffEstimateNewcombe checks differences of Wilson intervals against
+// Newcombe (1998), "Interval estimation for the difference between
+// independent proportions", Statistics in Medicine 17:873-890, Table II,
+// method 10.
+func TestDiffEstimateNewcombe(t *testing.T) {
+	cases := []struct {
+		m, n, x, y       uint64 // m/n minus x/y
+		value, low, high float64
+		significant      bool
+	}{
+		{56, 70, 48, 80, 0.2, 0.0524, 0.3339, true},
+		{9, 10, 3, 10, 0.6, 0.1705, 0.8090, true},
+		{5, 56, 0, 29, 0.0893, -0.0381, 0.1926, false},
+		{0, 10, 0, 20, 0, -0.1611, 0.2775, false},
+		{0, 10, 0, 10, 0, -0.2775, 0.2775, false},
+	}
+	for _, tc := range cases {
+		d := diffEstimate(proportionEstimate(tc.x, tc.y), proportionEstimate(tc.m, tc.n))
+		if !closeTo(d.Value, tc.value) || !closeTo(d.CILow, tc.low) || !closeTo(d.CIHigh, tc.high) || d.Significant != tc.significant {
+			t.Errorf("%d/%d - %d/%d: %v [%v, %v] significant %v, want %v [%v, %v] %v",
+				tc.m, tc.n, tc.x, tc.y, *d.Value, *d.CILow, *d.CIHigh, d.Significant, tc.value, tc.low, tc.high, tc.significant)
+		}
+	}
+	if d := diffEstimate(estimate{}, proportionEstimate(1, 2)); d.Value != nil {
+		t.Errorf("difference without a baseline: %+v", d)
+	}
+	// A side without an interval gives only the point difference.
+	if d := diffEstimate(meanEstimate(1, 3, 9), meanEstimate(2, 3, 5)); !closeTo(d.Value, -1.5) || d.CILow != nil || d.Significant {
+		t.Errorf("difference without an interval: %+v", d)
+	}
+}
+
+func TestMeanEstimate(t *testing.T) {
+	// 1..5: mean 3, sample standard deviation sqrt(2.5).
+	e := meanEstimate(5, 15, 55)
+	half := 1.96 * math.Sqrt(2.5/5)
+	if !closeTo(e.Value, 3) || !closeTo(e.CILow, 3-half) || !closeTo(e.CIHigh, 3+half) {
+		t.Errorf("mean of 1..5: %v [%v, %v]", *e.Value, *e.CILow, *e.CIHigh)
+	}
+	if e := meanEstimate(1, 4, 16); !closeTo(e.Value, 4) || e.CILow != nil {
+		t.Errorf("single observation: %+v, want no interval", e)
+	}
+}
+
+// TestRatioEstimateDeltaMethod checks the delta-method interval against the
+// cases it must reduce to.
+func TestRatioEstimateDeltaMethod(t *testing.T) {
+	ys := []float64{3, 7, 2, 9, 4, 6}
+	var sumY, sumYY float64
+	for _, y := range ys {
+		sumY += y
+		sumYY += y * y
+	}
+	n := uint64(len(ys))
+
+	// With the same x in every observation the ratio is the mean of y / x,
+	// and so is its interval.
+	const x = 4.0
+	nf := float64(n)
+	r := ratioEstimate(n, sumY, x*nf, sumYY, x*x*nf, x*sumY)
+	m := meanEstimate(n, sumY, sumYY)
+	if !closeTo(r.Value, *m.Value/x) || !closeTo(r.CILow, *m.CILow/x) || !closeTo(r.CIHigh, *m.CIHigh/x) {
+		t.Errorf("constant x: %v [%v, %v], want %v [%v, %v]", *r.Value, *r.CILow, *r.CIHigh, *m.Value/x, *m.CILow/x, *m.CIHigh/x)
+	}
+
+	// y exactly proportional to x leaves no residual, so no uncertainty.
+	var sumX, sumXX, sumXY, sumY2, sumYY2 float64
+	for _, xi := range ys {
+		y := 0.25 * xi
+		sumX += xi
+		sumXX += xi * xi
+		sumXY += xi * y
+		sumY2 += y
+		sumYY2 += y * y
+	}
+	r = ratioEstimate(n, sumY2, sumX, sumYY2, sumXX, sumXY)
+	if !closeTo(r.Value, 0.25) || !closeTo(r.CILow, 0.25) || !closeTo(r.CIHigh, 0.25) {
+		t.Errorf("proportional y: %v [%v, %v], want 0.25 with no width", *r.Value, *r.CILow, *r.CIHigh)
+	}
+
+	// Worked example: x = 10, 20, 30 and y = 1, 3, 2 give r = 0.1, residuals
+	// 0, 1, -1 and a standard error of sqrt(2/2/3) / 20.
+	se := math.Sqrt(1.0/3) / 20
+	r = ratioEstimate(3, 6, 60, 14, 1400, 130)
+	if !closeTo(r.Value, 0.1) || !closeTo(r.CILow, 0.1-1.96*se) || !closeTo(r.CIHigh, 0.1+1.96*se) {
+		t.Errorf("worked example: %v [%v, %v]", *r.Value, *r.CILow, *r.CIHigh)
+	}
+
+	if r := ratioEstimate(3, 1, 0, 1, 0, 0); r.Value != nil || r.N != 3 {
+		t.Errorf("zero denominator: %+v", r)
+	}
+	if r := ratioEstimate(1, 2, 4, 4, 16, 8); !closeTo(r.Value, 0.5) || r.CILow != nil {
+		t.Errorf("single observation: %+v, want no interval", r)
+	}
+}
+
+// TestHitDensityFromStoredRuns feeds the worked example above through
+// loadRunSums, so the SQL sums line up with ratioEstimate's arguments.
+func TestHitDensityFromStoredRuns(t *testing.T) {
+	store := newTestStore(t)
+	at := mustTime(t, "2026-03-02T10:00:00Z")
+	for i, run := range []struct {
+		lines uint32
+		hits  uint32
+	}{{10, 1}, {20, 3}, {30, 2}} {
+		req := testRun("org/a", "c1", i+1, at, map[string]uint32{"R1": run.hits})
+		lines := run.lines
+		req.DiffLines = &lines
+		if _, _, err := store.CreateAgentRun(pendingAgentRun{Req: req, DiffLines: lines}); err != nil {
+			t.Fatal(err)
+		}
+	}
+	sums, err := loadRunSums(store.runsInRange(at, at, queryFilter{}))
+	if err != nil {
+		t.Fatal(err)
+	}
+	se := math.Sqrt(1.0/3) / 20
+	if e := sums.hitDensity(); !closeTo(e.Value, 0.1) || !closeTo(e.CILow, 0.1-1.96*se) || !closeTo(e.CIHigh, 0.1+1.96*se) || sums.ZeroHitRuns != 0 {
+		t.Errorf("hit density %+v from %+v", e, sums)
+	}
+}
@@ -0,0 +1,221 @@
+package main
+
+import (
+	"time"
+)
+
+// Store is the persistence layer behind the ingestion and analytics handlers.
+// Handlers only parse and validate HTTP input; everything that touches the
+// database goes through a Store so backends can be swapped or faked.
+type Store interface {
+	// CreateAgentRun stores one validated run and folds it into
+	// code_change_summary. It reports idempotent=true when the
+	// (repo, code_change_id, agent_run_id) triple already exists.
+	CreateAgentRun(run pendingAgentRun) (runID uint64, idempotent bool, err error)
+	// CreateAgentRunBatch stores several runs at once; the result is aligned
+	// with runs. Runs that fail on their own carry an error in their result;
+	// err is only set when no run could be stored.
+	CreateAgentRunBatch(runs []pendingAgentRun) ([]storedRun, error)
+
+	LoadRunTotals(from, to time.Time, f queryFilter) (runTotals, error)
+	CountRuns(from, to time.Time, f queryFilter) (uint64, error)
+	LoadTimeseries(from, to time.Time, f queryFilter, metric, bucket string) ([]timeSeriesPoint, error)
+	ListRecentRuns(from, to time.Time, f queryFilter, limit int) ([]recentRunRow, error)
+	ListTopRules(from, to time.Time, f queryFilter, limit int) ([]topRuleRow, error)
+
+	LoadChangeEffectivenessStats(from, to time.Time, f queryFilter, minRuns int) (changeEffectivenessStats, error)
+	ListChangeEffectiveness(from, to time.Time, f queryFilter, q changeListQuery) ([]changeEffectivenessRow, error)
+	// ListChangeRuns returns the newest runs of f.CodeChangeID; zero from/to
+	// leave that side of the range open.
+	ListChangeRuns(from, to time.Time, f queryFilter, limit int) ([]changeRunRow, error)
+
+	LoadRuleQualityStats(from, to time.Time, f queryFilter, minRuns, minChanges int) (ruleQualityStats, error)
+	ListRuleQuality(from, to time.Time, f queryFilter, q ruleQualityListQuery) ([]ruleQualityAggRow, error)
+	LoadRuleQualityTrend(from, to time.Time, f queryFilter, bucket string) ([]ruleQualityTrendPoint, error)
+
+	// ListFindings returns one page of the findings selected by q and the
+	// total number of matches.
+	ListFindings(q findingQuery) ([]findingRow, uint64, error)
+	// LoadFindingTimeline returns the newest limit tracked runs of the change
+	// f.Repo / f.CodeChangeID with their classified findings, oldest first;
+	// a non-empty f.RuleID narrows the findings.
+	LoadFindingTimeline(f queryFilter, limit int) ([]findingTimelineRun, error)
+	// UpsertRuleCatalog registers rules in the rule catalog, replacing the
+	// metadata of rules already registered.
+	UpsertRuleCatalog(rules []ruleCatalogRule) (ruleCatalogUpsertResult, error)
+	DeleteRuleCatalog(ruleID string) (bool, error)
+	ListRuleCatalog(q ruleCatalogQuery) ([]ruleCatalogEntry, uint64, error)
+	// LookupRuleCatalog returns the catalog entries of ruleIDs keyed by
+	// rule_id; unregistered rules are absent.
+	LookupRuleCatalog(ruleIDs []string) (map[string]*ruleCatalogEntry, error)
+
+	// ReplaceRulesetManifest stores the manifest of one ruleset version,
+	// replacing an earlier upload; it reports whether one existed.
+	ReplaceRulesetManifest(req rulesetManifestRequest) (bool, error)
+	ListRulesetManifests() ([]rulesetManifestSummary, error)
+	// LoadRulesetManifest and DiffRulesetManifests return errManifestNotFound
+	// for a version without a manifest.
+	LoadRulesetManifest(version string) ([]manifestRule, error)
+	DiffRulesetManifests(base, target string, from, to time.Time, f queryFilter, includeUnchanged bool) (rulesetDiff, error)
+	// CompareRulesets compares two ruleset versions over the same window
+	// with 95% confidence intervals.
+	CompareRulesets(a, b string, from, to time.Time, f queryFilter, minRuns, limit int) (rulesetComparison, error)
+	// DetectAgentRegressions compares agent versions with their predecessor
+	// on the repos both ran in, newest version first.
+	DetectAgentRegressions(from, to time.Time, f queryFilter, q agentRegressionQuery) ([]agentVersionRegression, error)
+	// ReplaceAgentRegressions and ListAgentRegressions back the agent
+	// regression job and /api/agent-versions/regressions/recorded.
+	ReplaceAgentRegressions(regressions []CrAgentRegression) (newVersions []string, cleared int, err error)
+	ListAgentRegressions() ([]recordedRegressionRow, error)
+
+	// RecordFeedback stores a reviewer verdict on a rule hit or finding of a
+	// run. It returns errRunNotFound or a *feedbackTargetError when the
+	// target does not exist.
+	RecordFeedback(req feedbackRequest) (feedbackResponse, error)
+
+	// LoadDailyRepoTotals, ReplaceAnomalies and ListAnomalies back the
+	// anomaly job and /api/anomalies.
+	LoadDailyRepoTotals(from, to time.Time) ([]dailyRepoTotals, error)
+	ReplaceAnomalies(days []time.Time, anomalies []CrAnomaly) (int, error)
+	ListAnomalies(q anomalyQuery) ([]anomalyRow, uint64, error)
+
+	// ListAlertRules, UpsertAlertRule and DeleteAlertRule manage the alert
+	// rules created through the API; rules from config.yaml are not stored.
+	ListAlertRules() ([]alertRuleSpec, error)
+	UpsertAlertRule(rule alertRuleSpec) (created bool, err error)
+	DeleteAlertRule(name string) (bool, error)
+	// LoadAlertStates and SaveAlertStates keep the firing state of every
+	// rule between evaluation passes.
+	LoadAlertStates() (map[string]CrAlertState, error)
+	SaveAlertStates(states []CrAlertState) error
+	CreateAlertSilence(silence CrAlertSilence) (alertSilenceRow, error)
+	ListAlertSilences(q alertSilenceQuery) ([]alertSilenceRow, error)
+	// ExpireAlertSilence ends a silence now; it returns errSilenceNotFound
+	// for an unknown id.
+	ExpireAlertSilence(id uint64, now time.Time) (alertSilenceRow, error)
+
+	// CreateAPIKey, ListAPIKeys, RotateAPIKey and RevokeAPIKey manage the
+	// ingestion API keys, which are stored as hashes. RotateAPIKey and
+	// RevokeAPIKey return errAPIKeyNotFound for unknown or revoked keys.
+	CreateAPIKey(name string, repos []string, keyHash, keyPrefix string) (apiKeyRow, error)
+	ListAPIKeys(includeRevoked bool) ([]apiKeyRow, error)
+	RotateAPIKey(id uint64, keyHash, keyPrefix string, grace time.Duration) (apiKeyRow, error)
+	RevokeAPIKey(id uint64, now time.Time) (apiKeyRow, error)
+	// LookupAPIKey returns the active key hashing to keyHash, or nil.
+	LookupAPIKey(keyHash string, now time.Time) (*apiKeyAuth, error)
+	TouchAPIKey(id uint64, now time.Time) error
+
+	// AppendAuditEntry adds one entry to the append-only audit log.
+	AppendAuditEntry(entry CrAuditLog) error
+	ListAuditEntries(q auditQuery) ([]auditRow, uint64, error)
+
+	// DeleteAgentRun and DeleteAgentRuns remove bogus runs with everything
+	// derived from them and recompute the summaries of their changes.
+	// DeleteAgentRun returns errRunNotFound for an unknown run.
+	DeleteAgentRun(repo, codeChangeID, agentRunID string) (runDeleteResult, error)
+	DeleteAgentRuns(f runDeleteFilter, dryRun bool) (runDeleteResult, error)
+
+	// RebuildCodeChangeSummaries recomputes code_change_summary from the raw
+	// runs of the changes in scope; dryRun only reports the differences.
+	RebuildCodeChangeSummaries(from, to time.Time, f queryFilter, dryRun bool) (summaryRebuildResult, error)
+	// VerifyData cross-checks runs, rule rows and summaries, optionally
+	// repairing what it finds.
+	VerifyData(repair bool) (verifyReport, error)
+	// RebuildRollups recomputes cr_run_rollup and cr_rule_rollup from raw rows
+	// for the whole days overlapping [from, to].
+	RebuildRollups(from, to time.Time) (rollupRebuildResult, error)
+	// RebuildFindingTransitions recomputes finding fix tracking for the
+	// changes matching f.Repo and f.CodeChangeID.
+	RebuildFindingTransitions(f queryFilter) (findingTrackingRebuildResult, error)
+
+	// PurgeRunRules, PurgeRuns and PurgeSummaries delete at most limit rows
+	// older than cutoff and return how many were deleted. A non-nil archive
+	// receives the rows first; if it fails nothing is deleted. PurgeRuns also
+	// deletes the rule rows, findings, finding transitions and feedback of the
+	// runs it removes; see runArchive for what it archives.
+	PurgeRunRules(cutoff time.Time, limit int, archive func([]CrAgentRunRule) error) (int, error)
+	PurgeRuns(cutoff time.Time, limit int, archive runArchive) (int, error)
+	PurgeSummaries(cutoff time.Time, limit int, archive func([]CodeChangeSummary) error) (int, error)
+}
+
+// storedRun is the outcome of one run of CreateAgentRunBatch. Err is set when
+// that run could not be stored; the other runs of the batch are unaffected.
+type storedRun struct {
+	RunPrimaryID uint64
+	Idempotent   bool
+	Err          error
+}
+
+// queryFilter holds the optional equality filters shared by the analytics
+// endpoints. Empty fields are ignored; each query applies the fields that make
+// sense for its table.
+type queryFilter struct {
+	Repo           string
+	RulesetVersion string
+	AgentVersion   string
+	CodeChangeID   string
+	RuleID         string
+
+	// Category, Owner and Severity match rule catalog metadata and only
+	// apply to rule-level queries.
+	Category string
+	Owner    string
+	Severity string
+
+	// Repos limits every query to the repos the caller may see; nil means
+	// every repo.
+	Repos repoScope
+}
+
+type runTotals struct {
+	TotalRuns          uint64
+	TotalHits          uint64
+	TotalDiffLines     uint64
+	ActiveRepos        uint64
+	TopRulesetVersions []versionBucketCount
+	TopAgentVersions   []versionBucketCount
+}
+
+type changeEffectivenessStats struct {
+	TotalChanges       uint64
+	ImprovingChanges   uint64
+	StableChanges      uint64
+	AvgImprovementRate float64
+}
+
+// changeListQuery pages through code_change_summary. Sort must be one of the
+// columns whitelisted by the handler.
+type changeListQuery struct {
+	MinRuns int
+	Sort    string
+	Desc    bool
+	Limit   int
+	Offset  int
+	// RatedOnly skips changes without an improvement_rate (single-run changes).
+	RatedOnly bool
+}
+
+// ruleQualityListQuery pages through the per-rule quality aggregation. Sort
+// must be one of the columns whitelisted by the handler.
+type ruleQualityListQuery struct {
+	MinRuns    int
+	MinChanges int
+	Sort       string
+	Desc       bool
+	Limit      int
+	Offset     int
+}
+
+type ruleQualityStats struct {
+	TotalRules         uint64
+	AvgFixRate         float64
+	AvgDisappearRate   float64
+	AvgRunCount        float64
+	TotalHitCount      uint64
+	TotalRuleRunCount  uint64
+	TotalFixedFindings uint64
+
+	AvgAcceptanceRate    float64
+	AvgFalsePositiveRate float64
+	TotalFeedback        uint64
+}
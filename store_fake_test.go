@@ -0,0 +1,123 @@
+package main
+
+import (
+	"fmt"
+	"sync"
+)
+
+// fakeStore is an in-memory Store for handler tests that do not need a
+// database. Only the methods the handler tests reach are implemented; any
+// other one panics on the nil embedded Store. When err is set, every
+// implemented method except AppendAuditEntry returns it.
+type fakeStore struct {
+	Store
+
+	mu       sync.Mutex
+	err      error
+	runs     map[agentRunKey]fakeRun
+	nextID   uint64
+	feedback []feedbackRequest
+}
+
+type fakeRun struct {
+	ID       uint64
+	RuleHits map[string]uint32
+}
+
+func newFakeStore() *fakeStore {
+	return &fakeStore{runs: make(map[agentRunKey]fakeRun)}
+}
+
+func (f *fakeStore) setErr(err error) {
+	f.mu.Lock()
+	defer f.mu.Unlock()
+	f.err = err
+}
+
+func (f *fakeStore) runCount() int {
+	f.mu.Lock()
+	defer f.mu.Unlock()
+	return len(f.runs)
+}
+
+func (f *fakeStore) CreateAgentRun(run pendingAgentRun) (uint64, bool, error) {
+	f.mu.Lock()
+	defer f.mu.Unlock()
+	if f.err != nil {
+		return 0, false, f.err
+	}
+	id, idempotent := f.createLocked(run)
+	return id, idempotent, nil
+}
+
+// CreateAgentRunBatch stores all runs or, when err is set, none of them.
+func (f *fakeStore) CreateAgentRunBatch(runs []pendingAgentRun) ([]storedRun, error) {
+	f.mu.Lock()
+	defer f.mu.Unlock()
+	if f.err != nil {
+		return nil, f.err
+	}
+	results := make([]storedRun, 0, len(runs))
+	for _, run := range runs {
+		id, idempotent := f.createLocked(run)
+		results = append(results, storedRun{RunPrimaryID: id, Idempotent: idempotent})
+	}
+	return results, nil
+}
+
+func (f *fakeStore) createLocked(run pendingAgentRun) (uint64, bool) {
+	key := agentRunKey{Repo: run.Req.Repo, CodeChangeID: run.Req.CodeChangeID, AgentRunID: run.Req.AgentRunID}
+	if existing, ok := f.runs[key]; ok {
+		return existing.ID, true
+	}
+	f.nextID++
+	f.runs[key] = fakeRun{ID: f.nextID, RuleHits: run.Req.RuleHits}
+	return f.nextID, false
+}
+
+// RecordFeedback checks the run and rule like the SQL store does; findings
+// are not tracked.
+func (f *fakeStore) RecordFeedback(req feedbackRequest) (feedbackResponse, error) {
+	f.mu.Lock()
+	defer f.mu.Unlock()
+	if f.err != nil {
+		return feedbackResponse{}, f.err
+	}
+	var run fakeRun
+	found := false
+	for key, r := range f.runs {
+		if req.RunID != 0 && r.ID == req.RunID ||
+			req.RunID == 0 && key == (agentRunKey{Repo: req.Repo, CodeChangeID: req.CodeChangeID, AgentRunID: req.AgentRunID}) {
+			run, found = r, req.Repos == nil || req.Repos.allows(key.Repo)
+			break
+		}
+	}
+	if !found {
+		return feedbackResponse{}, errRunNotFound
+	}
+	if run.RuleHits[req.RuleID] == 0 {
+		return feedbackResponse{}, &feedbackTargetError{fieldError{Field: "rule_id", Code: "not_found", Message: fmt.Sprintf("run %d has no hit of %s", run.ID, req.RuleID)}}
+	}
+	f.feedback = append(f.feedback, req)
+	return feedbackResponse{OK: true, FeedbackID: uint64(len(f.feedback)), RunID: run.ID}, nil
+}
+
+func (f *fakeStore) DeleteAgentRun(repo, codeChangeID, agentRunID string) (runDeleteResult, error) {
+	f.mu.Lock()
+	defer f.mu.Unlock()
+	if f.err != nil {
+		return runDeleteResult{}, f.err
+	}
+	key := agentRunKey{Repo: repo, CodeChangeID: codeChangeID, AgentRunID: agentRunID}
+	if _, ok := f.runs[key]; !ok {
+		return runDeleteResult{}, errRunNotFound
+	}
+	delete(f.runs, key)
+	return runDeleteResult{Runs: 1, Changes: 1}, nil
+}
+
+// AppendAuditEntry discards the entry; the handler tests that use the fake
+// do not look at the audit log.
+func (f *fakeStore) AppendAuditEntry(entry CrAuditLog) error {
+	return nil
+}
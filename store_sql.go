@@ -0,0 +1,567 @@
+package main
+
+import (
+	"encoding/json"
+	"errors"
+	"sort"
+	"time"
+
+	"gorm.io/datatypes"
+	"gorm.io/gorm"
+)
+
+// gormStore implements Store on top of Gorm. Backend-specific SQL is delegated
+// to dialect.
+type gormStore struct {
+	db      *gorm.DB
+	dialect sqlDialect
+	// retention tells the rebuild and verify code which raw rows may already
+	// have been purged; zero ages mean nothing is ever purged.
+	retention retentionPolicy
+}
+
+func newGormStore(db *gorm.DB, dialect sqlDialect) *gormStore {
+	return &gormStore{db: db, dialect: dialect}
+}
+
+func (s *gormStore) runsInRange(from, to time.Time, f queryFilter) *gorm.DB {
+	return applyRunFilters(s.db.Model(&CrAgentRun{}), f).
+		Where("reported_at BETWEEN ? AND ?", from, to)
+}
+
+func (s *gormStore) LoadRunTotals(from, to time.Time, f queryFilter) (runTotals, error) {
+	if canUseRollups(f) {
+		if segments := planRollupSegments(from, to, true); segments != nil {
+			return s.loadRunTotalsFromRollups(segments, f)
+		}
+	}
+
+	var sums struct {
+		TotalRuns      uint64
+		TotalHits      uint64
+		TotalDiffLines uint64
+	}
+	if err := s.runsInRange(from, to, f).
+		Select("COUNT(*) AS total_runs, COALESCE(SUM(triggered_total_hits),0) AS total_hits, COALESCE(SUM(diff_lines),0) AS total_diff_lines").
+		Scan(&sums).Error; err != nil {
+		return runTotals{}, err
+	}
+	totals := runTotals{TotalRuns: sums.TotalRuns, TotalHits: sums.TotalHits, TotalDiffLines: sums.TotalDiffLines}
+
+	if err := s.runsInRange(from, to, f).Select("COUNT(DISTINCT repo)").Scan(&totals.ActiveRepos).Error; err != nil {
+		return totals, err
+	}
+
+	var err error
+	totals.TopRulesetVersions, err = loadTopVersions(s.runsInRange(from, to, f), "ruleset_version")
+	if err != nil {
+		return totals, err
+	}
+	totals.TopAgentVersions, err = loadTopVersions(s.runsInRange(from, to, f), "agent_version")
+	if err != nil {
+		return totals, err
+	}
+	return totals, nil
+}
+
+func (s *gormStore) CountRuns(from, to time.Time, f queryFilter) (uint64, error) {
+	var total uint64
+	if err := s.runsInRange(from, to, f).Select("COUNT(*)").Scan(&total).Error; err != nil {
+		return 0, err
+	}
+	return total, nil
+}
+
+func (s *gormStore) LoadTimeseries(from, to time.Time, f queryFilter, metric, bucket string) ([]timeSeriesPoint, error) {
+	if canUseRollups(f) {
+		if segments := planRollupSegments(from, to, bucket != "hour"); segments != nil {
+			return s.loadTimeseriesFromRollups(segments, f, metric, bucket)
+		}
+	}
+
+	valueExpr := "COUNT(*)"
+	switch metric {
+	case "hits":
+		valueExpr = "COALESCE(SUM(triggered_total_hits),0)"
+	case "density":
+		valueExpr = "COALESCE(" + s.dialect.ratioExpr("SUM(triggered_total_hits)", "SUM(diff_lines)") + ", 0)"
+	}
+
+	raw := "SELECT " + s.dialect.bucketExpr("reported_at", bucket) + " AS bucket, " + valueExpr + " AS value FROM cr_agent_run WHERE reported_at BETWEEN ? AND ?"
+	raw = applyRunFilterSQL(raw, f)
+	raw += " GROUP BY bucket ORDER BY bucket ASC"
+	args := append([]interface{}{from, to}, buildRunFilterArgs(f)...)
+
+	var rows []timeSeriesPoint
+	if err := s.db.Raw(raw, args...).Scan(&rows).Error; err != nil {
+		return nil, err
+	}
+	return rows, nil
+}
+
+func (s *gormStore) ListRecentRuns(from, to time.Time, f queryFilter, limit int) ([]recentRunRow, error) {
+	var rows []recentRunRow
+	if err := s.runsInRange(from, to, f).
+		Select("id, repo, code_change_id, agent_run_id, reported_at, diff_lines, triggered_total_hits, agent_version, ruleset_version").
+		Order("reported_at DESC").Limit(limit).Find(&rows).Error; err != nil {
+		return nil, err
+	}
+	return rows, nil
+}
+
+func (s *gormStore) ListTopRules(from, to time.Time, f queryFilter, limit int) ([]topRuleRow, error) {
+	if segments := planRollupSegments(from, to, true); segments != nil {
+		return s.listTopRulesFromRollups(segments, f, limit)
+	}
+
+	query := s.db.Table("cr_agent_run_rule").
+		Select("rule_id, COALESCE(SUM(hit_count),0) AS total_hits, COUNT(*) AS run_count").
+		Where("reported_at BETWEEN ? AND ?", from, to)
+	if f.Repo != "" {
+		query = query.Where("repo = ?", f.Repo)
+	}
+	query = applyRepoScope(query, "repo", f.Repos)
+	query = applyCatalogFilter(query, f)
+
+	var rows []topRuleRow
+	if err := query.Group("rule_id").Order("total_hits DESC, rule_id").Limit(limit).Scan(&rows).Error; err != nil {
+		return nil, err
+	}
+	return rows, nil
+}
+
+func (s *gormStore) changesInRange(from, to time.Time, f queryFilter, minRuns int) *gorm.DB {
+	return applyChangeFilters(s.db.Model(&CodeChangeSummary{}), f).
+		Where("last_reported_at BETWEEN ? AND ?", from, to).
+		Where("run_count >= ?", minRuns)
+}
+
+func (s *gormStore) LoadChangeEffectivenessStats(from, to time.Time, f queryFilter, minRuns int) (changeEffectivenessStats, error) {
+	var stats changeEffectivenessStats
+	if err := s.changesInRange(from, to, f, minRuns).Select("COUNT(*)").Scan(&stats.TotalChanges).Error; err != nil {
+		return stats, err
+	}
+	if err := s.changesInRange(from, to, f, minRuns).Where("max_total_hits > min_total_hits").
+		Select("COUNT(*)").Scan(&stats.ImprovingChanges).Error; err != nil {
+		return stats, err
+	}
+	if err := s.changesInRange(from, to, f, minRuns).Where("max_total_hits = min_total_hits").
+		Select("COUNT(*)").Scan(&stats.StableChanges).Error; err != nil {
+		return stats, err
+	}
+	if err := s.changesInRange(from, to, f, minRuns).
+		Select("COALESCE(AVG(improvement_rate),0)").Scan(&stats.AvgImprovementRate).Error; err != nil {
+		return stats, err
+	}
+	return stats, nil
+}
+
+func (s *gormStore) ListChangeEffectiveness(from, to time.Time, f queryFilter, q changeListQuery) ([]changeEffectivenessRow, error) {
+	direction := "ASC"
+	if q.Desc {
+		direction = "DESC"
+	}
+	orderExpr := q.Sort + " " + direction
+	if q.Sort == "improvement_rate" {
+		orderExpr = "improvement_rate IS NULL, improvement_rate " + direction
+	}
+
+	query := s.changesInRange(from, to, f, q.MinRuns).
+		Select("repo, code_change_id, run_count, max_total_hits, min_total_hits, (max_total_hits - min_total_hits) AS delta, improvement_rate, last_reported_at, last_ruleset_version")
+	if q.RatedOnly {
+		query = query.Where("improvement_rate IS NOT NULL")
+	}
+
+	var rows []changeEffectivenessRow
+	if err := query.Order(orderExpr).Order("last_reported_at DESC").Limit(q.Limit).Offset(q.Offset).Scan(&rows).Error; err != nil {
+		return nil, err
+	}
+	return rows, nil
+}
+
+func (s *gormStore) ListChangeRuns(from, to time.Time, f queryFilter, limit int) ([]changeRunRow, error) {
+	query := s.db.Model(&CrAgentRun{}).
+		Select("reported_at, triggered_total_hits, diff_lines").
+		Where("code_change_id = ?", f.CodeChangeID)
+	if f.Repo != "" {
+		query = query.Where("repo = ?", f.Repo)
+	}
+	query = applyRepoScope(query, "repo", f.Repos)
+	if !from.IsZero() {
+		query = query.Where("reported_at >= ?", from)
+	}
+	if !to.IsZero() {
+		query = query.Where("reported_at <= ?", to)
+	}
+
+	var rows []changeRunRow
+	if err := query.Order("reported_at DESC").Limit(limit).Find(&rows).Error; err != nil {
+		return nil, err
+	}
+	return rows, nil
+}
+
+func (s *gormStore) LoadRuleQualityStats(from, to time.Time, f queryFilter, minRuns, minChanges int) (ruleQualityStats, error) {
+	baseSQL, args := buildRuleQualityBaseSQL(s.dialect, f, from, to)
+	summarySQL := "SELECT COUNT(*) AS total_rules, " +
+		"COALESCE(AVG(fix_rate),0) AS avg_fix_rate, " +
+		"COALESCE(AVG(disappear_rate),0) AS avg_disappear_rate, " +
+		"COALESCE(AVG(run_count),0) AS avg_run_count, " +
+		"COALESCE(SUM(total_hits),0) AS total_hit_count, " +
+		"COALESCE(SUM(run_count),0) AS total_rule_run_count, " +
+		"COALESCE(SUM(fixed_findings),0) AS total_fixed_findings, " +
+		"COALESCE(AVG(acceptance_rate),0) AS avg_acceptance_rate, " +
+		"COALESCE(AVG(false_positive_rate),0) AS avg_false_positive_rate, " +
+		"COALESCE(SUM(feedback_count),0) AS total_feedback " +
+		"FROM (" + baseSQL + ") q WHERE run_count >= ? AND change_count >= ?"
+	args = append(args, minRuns, minChanges)
+
+	var stats ruleQualityStats
+	if err := s.db.Raw(summarySQL, args...).Scan(&stats).Error; err != nil {
+		return stats, err
+	}
+	return stats, nil
+}
+
+func (s *gormStore) ListRuleQuality(from, to time.Time, f queryFilter, q ruleQualityListQuery) ([]ruleQualityAggRow, error) {
+	direction := "ASC"
+	if q.Desc {
+		direction = "DESC"
+	}
+	orderExpr := q.Sort + " " + direction
+	switch q.Sort {
+	case "fix_rate", "disappear_rate", "acceptance_rate", "false_positive_rate":
+		orderExpr = q.Sort + " IS NULL, " + q.Sort + " " + direction
+	}
+
+	baseSQL, args := buildRuleQualityBaseSQL(s.dialect, f, from, to)
+	listSQL := "SELECT rule_id, total_hits, run_count, last_seen_at, change_count, fix_rate, disappear_rate, avg_drop, " +
+		"fixed_findings, introduced_findings, persisted_findings, feedback_count, acceptance_rate, false_positive_rate " +
+		"FROM (" + baseSQL + ") q " +
+		"WHERE run_count >= ? AND change_count >= ? ORDER BY " + orderExpr + " LIMIT ? OFFSET ?"
+	args = append(args, q.MinRuns, q.MinChanges, q.Limit, q.Offset)
+
+	var rows []ruleQualityAggRow
+	if err := s.db.Raw(listSQL, args...).Scan(&rows).Error; err != nil {
+		return nil, err
+	}
+	return rows, nil
+}
+
+func (s *gormStore) LoadRuleQualityTrend(from, to time.Time, f queryFilter, bucket string) ([]ruleQualityTrendPoint, error) {
+	filterSQL, args := ruleFilterSQL("r", f)
+	trendSQL := "SELECT " + s.dialect.bucketExpr("reported_at", bucket) + " AS bucket, COALESCE(SUM(hit_count),0) AS value FROM cr_agent_run_rule r " +
+		"WHERE r.reported_at BETWEEN ? AND ?" + filterSQL +
+		" GROUP BY bucket ORDER BY bucket ASC"
+	allArgs := append([]interface{}{from, to}, args...)
+
+	var rows []ruleQualityTrendPoint
+	if err := s.db.Raw(trendSQL, allArgs...).Scan(&rows).Error; err != nil {
+		return nil, err
+	}
+	return rows, nil
+}
+
+func (s *gormStore) CreateAgentRun(p pendingAgentRun) (uint64, bool, error) {
+	req := p.Req
+	var existing CrAgentRun
+	query := s.db.Where("repo = ? AND code_change_id = ? AND agent_run_id = ?", req.Repo, req.CodeChangeID, req.AgentRunID)
+	if err := query.First(&existing).Error; err == nil {
+		return existing.ID, true, nil
+	} else if !errors.Is(err, gorm.ErrRecordNotFound) {
+		return 0, false, err
+	}
+
+	run, err := newAgentRunRecord(req, p.DiffLines)
+	if err != nil {
+		return 0, false, err
+	}
+
+	err = s.db.Transaction(func(tx *gorm.DB) error {
+		if err := tx.Create(&run).Error; err != nil {
+			return err
+		}
+
+		if rules := buildRunRuleRecords(run, req.RuleHits); len(rules) > 0 {
+			if err := tx.Create(&rules).Error; err != nil {
+				return err
+			}
+		}
+		if findings := buildFindingRecords(run, req.Findings); len(findings) > 0 {
+			if err := tx.CreateInBatches(&findings, batchInsertSize).Error; err != nil {
+				return err
+			}
+		}
+		if err := trackFindings(tx, []CrAgentRun{run}, [][]findingRequest{req.Findings}); err != nil {
+			return err
+		}
+		if err := s.upsertRollups(tx, []CrAgentRun{run}, []map[string]uint32{req.RuleHits}); err != nil {
+			return err
+		}
+
+		summary := CodeChangeSummary{
+			Repo:               run.Repo,
+			CodeChangeID:       run.CodeChangeID,
+			RunCount:           1,
+			FirstReportedAt:    run.ReportedAt,
+			LastReportedAt:     run.ReportedAt,
+			MaxTotalHits:       run.TriggeredTotalHits,
+			MaxRunID:           run.ID,
+			MinTotalHits:       run.TriggeredTotalHits,
+			MinRunID:           run.ID,
+			LastRulesetVersion: run.RulesetVersion,
+			ImprovementRate:    nil,
+		}
+		return s.upsertCodeChangeSummaries(tx, []CodeChangeSummary{summary})
+	})
+	if err != nil {
+		if errors.Is(err, gorm.ErrDuplicatedKey) {
+			if err := query.First(&existing).Error; err == nil {
+				return existing.ID, true, nil
+			}
+		}
+		return 0, false, err
+	}
+
+	return run.ID, false, nil
+}
+
+// CreateAgentRunBatch ingests several runs with bulk inserts in one
+// transaction. Duplicates (already stored or repeated within the batch)
+// resolve to the existing primary id and are flagged idempotent. When a
+// concurrent writer stores one of the runs first, the whole batch is retried
+// against the runs stored by then. If the batch still fails, every run is
+// stored on its own, so one bad run only fails itself.
+func (s *gormStore) CreateAgentRunBatch(runs []pendingAgentRun) ([]storedRun, error) {
+	var err error
+	for attempt := 1; attempt <= maxBatchAttempts; attempt++ {
+		var results []storedRun
+		if results, err = s.createAgentRunBatchOnce(runs); err == nil {
+			return results, nil
+		}
+		if !errors.Is(err, gorm.ErrDuplicatedKey) {
+			break
+		}
+	}
+	return s.createAgentRunsOneByOne(runs, err)
+}
+
+// createAgentRunsOneByOne stores runs through CreateAgentRun and records the
+// error of each run that fails. It returns batchErr when none was stored.
+func (s *gormStore) createAgentRunsOneByOne(runs []pendingAgentRun, batchErr error) ([]storedRun, error) {
+	results := make([]storedRun, len(runs))
+	stored := 0
+	for i, p := range runs {
+		runID, idempotent, err := s.CreateAgentRun(p)
+		if err != nil {
+			results[i].Err = err
+			continue
+		}
+		results[i] = storedRun{RunPrimaryID: runID, Idempotent: idempotent}
+		stored++
+	}
+	if stored == 0 {
+		return nil, batchErr
+	}
+	return results, nil
+}
+
+func (s *gormStore) createAgentRunBatchOnce(runs []pendingAgentRun) ([]storedRun, error) {
+	results := make([]storedRun, len(runs))
+	if len(runs) == 0 {
+		return results, nil
+	}
+
+	keys := make([][]interface{}, 0, len(runs))
+	for _, p := range runs {
+		keys = append(keys, []interface{}{p.Req.Repo, p.Req.CodeChangeID, p.Req.AgentRunID})
+	}
+	var existing []CrAgentRun
+	if err := s.db.Select("id, repo, code_change_id, agent_run_id").
+		Where("(repo, code_change_id, agent_run_id) IN ?", keys).
+		Find(&existing).Error; err != nil {
+		return nil, err
+	}
+	known := make(map[agentRunKey]uint64, len(existing))
+	for _, run := range existing {
+		known[agentRunKey{run.Repo, run.CodeChangeID, run.AgentRunID}] = run.ID
+	}
+
+	// firstIndex maps a key to the batch position that will insert it, so later
+	// repeats of the same run can pick up its id once the insert is done.
+	firstIndex := make(map[agentRunKey]int, len(runs))
+	records := make([]CrAgentRun, 0, len(runs))
+	recordIndex := make([]int, 0, len(runs))
+	for i, p := range runs {
+		key := agentRunKey{p.Req.Repo, p.Req.CodeChangeID, p.Req.AgentRunID}
+		if id, ok := known[key]; ok {
+			results[i] = storedRun{RunPrimaryID: id, Idempotent: true}
+			continue
+		}
+		if _, ok := firstIndex[key]; ok {
+			continue
+		}
+		run, err := newAgentRunRecord(p.Req, p.DiffLines)
+		if err != nil {
+			return nil, err
+		}
+		firstIndex[key] = i
+		records = append(records, run)
+		recordIndex = append(recordIndex, i)
+	}
+
+	if len(records) > 0 {
+		err := s.db.Transaction(func(tx *gorm.DB) error {
+			if err := tx.CreateInBatches(&records, batchInsertSize).Error; err != nil {
+				return err
+			}
+
+			var rules []CrAgentRunRule
+			var findings []CrAgentRunFinding
+			ruleHits := make([]map[string]uint32, len(records))
+			runFindings := make([][]findingRequest, len(records))
+			for j, run := range records {
+				ruleHits[j] = runs[recordIndex[j]].Req.RuleHits
+				runFindings[j] = runs[recordIndex[j]].Req.Findings
+				rules = append(rules, buildRunRuleRecords(run, ruleHits[j])...)
+				findings = append(findings, buildFindingRecords(run, runFindings[j])...)
+			}
+			if len(rules) > 0 {
+				if err := tx.CreateInBatches(&rules, batchInsertSize).Error; err != nil {
+					return err
+				}
+			}
+			if len(findings) > 0 {
+				if err := tx.CreateInBatches(&findings, batchInsertSize).Error; err != nil {
+					return err
+				}
+			}
+			if err := trackFindings(tx, records, runFindings); err != nil {
+				return err
+			}
+			if err := s.upsertRollups(tx, records, ruleHits); err != nil {
+				return err
+			}
+
+			return s.upsertCodeChangeSummaries(tx, foldCodeChangeSummaries(records))
+		})
+		if err != nil {
+			return nil, err
+		}
+	}
+
+	for j, run := range records {
+		results[recordIndex[j]] = storedRun{RunPrimaryID: run.ID}
+	}
+	for i, p := range runs {
+		if results[i].RunPrimaryID != 0 {
+			continue
+		}
+		first := firstIndex[agentRunKey{p.Req.Repo, p.Req.CodeChangeID, p.Req.AgentRunID}]
+		results[i] = storedRun{RunPrimaryID: results[first].RunPrimaryID, Idempotent: true}
+	}
+	return results, nil
+}
+
+func newAgentRunRecord(req agentRunRequest, diffLines uint32) (CrAgentRun, error) {
+	ruleHitsJSON, err := json.Marshal(req.RuleHits)
+	if err != nil {
+		return CrAgentRun{}, err
+	}
+	return CrAgentRun{
+		Repo:               req.Repo,
+		CodeChangeID:       req.CodeChangeID,
+		AgentRunID:         req.AgentRunID,
+		AgentVersion:       req.AgentVersion,
+		RulesetVersion:     req.RulesetVersion,
+		ReportedAt:         req.ReportedAt.UTC(),
+		DiffLines:          diffLines,
+		TriggeredTotalHits: req.TriggeredTotalHits,
+		RuleHitsJSON:       datatypes.JSON(ruleHitsJSON),
+	}, nil
+}
+
+func buildRunRuleRecords(run CrAgentRun, ruleHits map[string]uint32) []CrAgentRunRule {
+	rules := make([]CrAgentRunRule, 0, len(ruleHits))
+	for ruleID, count := range ruleHits {
+		rules = append(rules, CrAgentRunRule{
+			RunID:          run.ID,
+			Repo:           run.Repo,
+			CodeChangeID:   run.CodeChangeID,
+			ReportedAt:     run.ReportedAt,
+			RulesetVersion: run.RulesetVersion,
+			RuleID:         ruleID,
+			HitCount:       count,
+		})
+	}
+	return rules
+}
+
+// foldCodeChangeSummaries collapses freshly inserted runs into one summary row
+// per (repo, code_change_id), using the same tie-breaking as the upsert.
+func foldCodeChangeSummaries(runs []CrAgentRun) []CodeChangeSummary {
+	index := make(map[[2]string]int)
+	summaries := make([]CodeChangeSummary, 0, len(runs))
+	for _, run := range runs {
+		key := [2]string{run.Repo, run.CodeChangeID}
+		i, ok := index[key]
+		if !ok {
+			index[key] = len(summaries)
+			summaries = append(summaries, CodeChangeSummary{
+				Repo:               run.Repo,
+				CodeChangeID:       run.CodeChangeID,
+				RunCount:           1,
+				FirstReportedAt:    run.ReportedAt,
+				LastReportedAt:     run.ReportedAt,
+				MaxTotalHits:       run.TriggeredTotalHits,
+				MaxRunID:           run.ID,
+				MinTotalHits:       run.TriggeredTotalHits,
+				MinRunID:           run.ID,
+				LastRulesetVersion: run.RulesetVersion,
+			})
+			continue
+		}
+
+		s := &summaries[i]
+		s.RunCount++
+		if run.ReportedAt.Before(s.FirstReportedAt) {
+			s.FirstReportedAt = run.ReportedAt
+		}
+		if !run.ReportedAt.Before(s.LastReportedAt) {
+			s.LastReportedAt = run.ReportedAt
+			s.LastRulesetVersion = run.RulesetVersion
+		}
+		if run.TriggeredTotalHits > s.MaxTotalHits {
+			s.MaxTotalHits = run.TriggeredTotalHits
+			s.MaxRunID = run.ID
+		}
+		if run.TriggeredTotalHits < s.MinTotalHits {
+			s.MinTotalHits = run.TriggeredTotalHits
+			s.MinRunID = run.ID
+		}
+	}
+
+	for i := range summaries {
+		s := &summaries[i]
+		if s.RunCount >= 2 && s.MaxTotalHits > 0 {
+			rate := float64(s.MaxTotalHits-s.MinTotalHits) / float64(s.MaxTotalHits)
+			s.ImprovementRate = &rate
+		}
+	}
+	sort.Slice(summaries, func(a, b int) bool {
+		if summaries[a].Repo != summaries[b].Repo {
+			return summaries[a].Repo < summaries[b].Repo
+		}
+		return summaries[a].CodeChangeID < summaries[b].CodeChangeID
+	})
+	return summaries
+}
+
+// upsertCodeChangeSummaries merges partial summaries into code_change_summary.
+// Each row may describe more than one run; run_count is added, not incremented.
+func (s *gormStore) upsertCodeChangeSummaries(tx *gorm.DB, summaries []CodeChangeSummary) error {
+	if len(summaries) == 0 {
+		return nil
+	}
+	return tx.Clauses(s.dialect.summaryUpsert()).Create(&summaries).Error
+}
@@ -0,0 +1,125 @@
+package main
+
+import (
+	"time"
+
+	"gorm.io/gorm"
+)
+
+// PurgeRunRules deletes the oldest rule rows by primary key so each DELETE
+// only locks the rows it removes.
+func (s *gormStore) PurgeRunRules(cutoff time.Time, limit int, archive func([]CrAgentRunRule) error) (int, error) {
+	var rows []CrAgentRunRule
+	if err := s.db.Where("reported_at < ?", cutoff).Order("id").Limit(limit).Find(&rows).Error; err != nil {
+		return 0, err
+	}
+	if len(rows) == 0 {
+		return 0, nil
+	}
+	if archive != nil {
+		if err := archive(rows); err != nil {
+			return 0, err
+		}
+	}
+
+	ids := make([]uint64, 0, len(rows))
+	for _, row := range rows {
+		ids = append(ids, row.ID)
+	}
+	result := s.db.Where("id IN ?", ids).Delete(&CrAgentRunRule{})
+	return int(result.RowsAffected), result.Error
+}
+
+// PurgeRuns deletes the oldest runs together with their rule rows, findings,
+// finding transitions and feedback. The rule hits stay available in the
+// archived rule_hits_json; the other dependent rows are archived on their own.
+func (s *gormStore) PurgeRuns(cutoff time.Time, limit int, archive runArchive) (int, error) {
+	var rows []CrAgentRun
+	if err := s.db.Where("reported_at < ?", cutoff).Order("id").Limit(limit).Find(&rows).Error; err != nil {
+		return 0, err
+	}
+	if len(rows) == 0 {
+		return 0, nil
+	}
+
+	ids := make([]uint64, 0, len(rows))
+	for _, row := range rows {
+		ids = append(ids, row.ID)
+	}
+	if archive.Runs != nil {
+		if err := archive.Runs(rows); err != nil {
+			return 0, err
+		}
+	}
+	if err := archiveRunRows(s.db, ids, archive.Findings); err != nil {
+		return 0, err
+	}
+	if err := archiveRunRows(s.db, ids, archive.Transitions); err != nil {
+		return 0, err
+	}
+	if err := archiveRunRows(s.db, ids, archive.Feedback); err != nil {
+		return 0, err
+	}
+
+	var deleted int64
+	err := s.db.Transaction(func(tx *gorm.DB) error {
+		if err := tx.Where("run_id IN ?", ids).Delete(&CrAgentRunRule{}).Error; err != nil {
+			return err
+		}
+		if err := tx.Where("run_id IN ?", ids).Delete(&CrAgentRunFinding{}).Error; err != nil {
+			return err
+		}
+		if err := tx.Where("run_id IN ?", ids).Delete(&CrFindingTransition{}).Error; err != nil {
+			return err
+		}
+		if err := tx.Where("run_id IN ?", ids).Delete(&CrFindingFeedback{}).Error; err != nil {
+			return err
+		}
+		result := tx.Where("id IN ?", ids).Delete(&CrAgentRun{})
+		deleted = result.RowsAffected
+		return result.Error
+	})
+	return int(deleted), err
+}
+
+// archiveRunRows loads the rows of T that belong to the runs ids, in
+// primary key order, and passes them to archive. A nil archive does nothing.
+func archiveRunRows[T any](db *gorm.DB, ids []uint64, archive func([]T) error) error {
+	if archive == nil {
+		return nil
+	}
+	var rows []T
+	if err := db.Where("run_id IN ?", ids).Order("id").Find(&rows).Error; err != nil {
+		return err
+	}
+	if len(rows) == 0 {
+		return nil
+	}
+	return archive(rows)
+}
+
+// PurgeSummaries deletes summaries whose latest run is older than cutoff, i.e.
+// changes that have no runs left inside the retention window.
+func (s *gormStore) PurgeSummaries(cutoff time.Time, limit int, archive func([]CodeChangeSummary) error) (int, error) {
+	var rows []CodeChangeSummary
+	if err := s.db.Where("last_reported_at < ?", cutoff).Order("repo, code_change_id").Limit(limit).Find(&rows).Error; err != nil {
+		return 0, err
+	}
+	if len(rows) == 0 {
+		return 0, nil
+	}
+	if archive != nil {
+		if err := archive(rows); err != nil {
+			return 0, err
+		}
+	}
+
+	keys := make([]changeKey, 0, len(rows))
+	for _, row := range rows {
+		keys = append(keys, changeKey{row.Repo, row.CodeChangeID})
+	}
+	// Re-check the cutoff in case a late run refreshed the summary meanwhile.
+	result := s.db.Where("(repo, code_change_id) IN ?", changeKeyArgs(keys)).
+		Where("last_reported_at < ?", cutoff).Delete(&CodeChangeSummary{})
+	return int(result.RowsAffected), result.Error
+}
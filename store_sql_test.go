@@ -0,0 +1,518 @@
+package main
+
+import (
+	"errors"
+	"math"
+	"net/http"
+	"reflect"
+	"testing"
+	"time"
+
+	"gorm.io/gorm"
+)
+
+func loadSummary(t *testing.T, store *gormStore, repo, codeChangeID string) CodeChangeSummary {
+	t.Helper()
+	var summary CodeChangeSummary
+	if err := store.db.Where("repo = ? AND code_change_id = ?", repo, codeChangeID).First(&summary).Error; err != nil {
+		t.Fatalf("load summary %s/%s: %v", repo, codeChangeID, err)
+	}
+	return summary
+}
+
+// summaryRuns reports out of order, with a tie on last_reported_at and on
+// max_total_hits, so the upsert has to keep the right run ids and version.
+func summaryRuns(t *testing.T, codeChangeID string, seq int) []agentRunRequest {
+	specs := []struct {
+		at      string
+		hits    uint32
+		ruleset string
+	}{
+		{"2026-10-01T10:00:00Z", 4, "r1"},
+		{"2026-10-01T12:00:00Z", 1, "r2"},
+		{"2026-10-01T11:00:00Z", 6, "r3"},
+		{"2026-10-01T12:00:00Z", 6, "r4"},
+	}
+	runs := make([]agentRunRequest, 0, len(specs))
+	for i, spec := range specs {
+		run := testRun("org/a", codeChangeID, seq+i, mustTime(t, spec.at), map[string]uint32{"R1": spec.hits})
+		run.RulesetVersion = spec.ruleset
+		runs = append(runs, run)
+	}
+	return runs
+}
+
+func checkSummary(t *testing.T, got CodeChangeSummary, ids []uint64) {
+	t.Helper()
+	if got.RunCount != 4 {
+		t.Errorf("run_count %d, want 4", got.RunCount)
+	}
+	if !got.FirstReportedAt.Equal(mustTime(t, "2026-10-01T10:00:00Z")) || !got.LastReportedAt.Equal(mustTime(t, "2026-10-01T12:00:00Z")) {
+		t.Errorf("reported range %s - %s", got.FirstReportedAt, got.LastReportedAt)
+	}
+	// The first run reaching the maximum keeps it; a later run at the same
+	// last_reported_at wins the version.
+	if got.MaxTotalHits != 6 || got.MaxRunID != ids[2] {
+		t.Errorf("max %d/%d, want 6/%d", got.MaxTotalHits, got.MaxRunID, ids[2])
+	}
+	if got.MinTotalHits != 1 || got.MinRunID != ids[1] {
+		t.Errorf("min %d/%d, want 1/%d", got.MinTotalHits, got.MinRunID, ids[1])
+	}
+	if got.LastRulesetVersion != "r4" {
+		t.Errorf("last_ruleset_version %q, want r4", got.LastRulesetVersion)
+	}
+	if got.ImprovementRate == nil || math.Abs(*got.ImprovementRate-5.0/6.0) > improvementRateEpsilon {
+		t.Errorf("improvement_rate %v, want 5/6", got.ImprovementRate)
+	}
+}
+
+func TestSummaryUpsertSingleRuns(t *testing.T) {
+	store := newTestStore(t)
+	var ids []uint64
+	for _, run := range summaryRuns(t, "c1", 1) {
+		id, _, err := store.CreateAgentRun(pendingAgentRun{Req: run, DiffLines: *run.DiffLines})
+		if err != nil {
+			t.Fatal(err)
+		}
+		ids = append(ids, id)
+		if len(ids) == 1 {
+			if s := loadSummary(t, store, "org/a", "c1"); s.RunCount != 1 || s.ImprovementRate != nil {
+				t.Fatalf("single-run summary: %+v", s)
+			}
+		}
+	}
+	checkSummary(t, loadSummary(t, store, "org/a", "c1"), ids)
+}
+
+func TestSummaryUpsertBatch(t *testing.T) {
+	store := newTestStore(t)
+	runs := summaryRuns(t, "c2", 1)
+	// The first run is stored on its own, so the batch merges into an
+	// existing row as well as folding several runs.
+	id, _, err := store.CreateAgentRun(pendingAgentRun{Req: runs[0], DiffLines: *runs[0].DiffLines})
+	if err != nil {
+		t.Fatal(err)
+	}
+	pending := make([]pendingAgentRun, 0, len(runs)-1)
+	for _, run := range runs[1:] {
+		pending = append(pending, pendingAgentRun{Req: run, DiffLines: *run.DiffLines})
+	}
+	results, err := store.CreateAgentRunBatch(pending)
+	if err != nil {
+		t.Fatal(err)
+	}
+	ids := []uint64{id}
+	for _, res := range results {
+		ids = append(ids, res.RunPrimaryID)
+	}
+	checkSummary(t, loadSummary(t, store, "org/a", "c2"), ids)
+}
+
+func bucketRuns(t *testing.T, store *gormStore) {
+	t.Helper()
+	specs := []struct {
+		at   string
+		hits uint32
+	}{
+		{"2026-10-01T01:10:00Z", 1},
+		{"2026-10-01T01:50:00Z", 2},
+		{"2026-10-01T02:30:00Z", 3},
+		{"2026-10-02T05:00:00Z", 4},
+	}
+	for i, spec := range specs {
+		run := testRun("org/a", "c1", i+1, mustTime(t, spec.at), map[string]uint32{"R1": spec.hits})
+		if _, _, err := store.CreateAgentRun(pendingAgentRun{Req: run, DiffLines: *run.DiffLines}); err != nil {
+			t.Fatal(err)
+		}
+	}
+}
+
+func TestTimeseriesBuckets(t *testing.T) {
+	store := newTestStore(t)
+	bucketRuns(t, store)
+
+	cases := []struct {
+		name     string
+		from, to string
+		metric   string
+		bucket   string
+		want     []timeSeriesPoint
+	}{
+		{
+			// Whole hours and days are read from the rollups.
+			name: "hour", from: "2026-10-01T00:00:00Z", to: "2026-10-03T00:00:00Z", metric: "runs", bucket: "hour",
+			want: []timeSeriesPoint{{"2026-10-01 01:00:00", 2}, {"2026-10-01 02:00:00", 1}, {"2026-10-02 05:00:00", 1}},
+		},
+		{
+			name: "day", from: "2026-10-01T00:00:00Z", to: "2026-10-03T00:00:00Z", metric: "hits", bucket: "day",
+			want: []timeSeriesPoint{{"2026-10-01T00:00:00Z", 6}, {"2026-10-02T00:00:00Z", 4}},
+		},
+		{
+			// Partial hours at the edges come from the raw runs.
+			name: "partial edges", from: "2026-10-01T01:30:00Z", to: "2026-10-02T05:30:00Z", metric: "runs", bucket: "hour",
+			want: []timeSeriesPoint{{"2026-10-01 01:00:00", 1}, {"2026-10-01 02:00:00", 1}, {"2026-10-02 05:00:00", 1}},
+		},
+		{
+			// Less than a whole hour: raw runs only.
+			name: "raw", from: "2026-10-01T01:00:00Z", to: "2026-10-01T01:55:00Z", metric: "runs", bucket: "hour",
+			want: []timeSeriesPoint{{"2026-10-01 01:00:00", 2}},
+		},
+	}
+	for _, tc := range cases {
+		t.Run(tc.name, func(t *testing.T) {
+			got, err := store.LoadTimeseries(mustTime(t, tc.from), mustTime(t, tc.to), queryFilter{}, tc.metric, tc.bucket)
+			if err != nil {
+				t.Fatal(err)
+			}
+			if !reflect.DeepEqual(got, tc.want) {
+				t.Fatalf("got %v, want %v", got, tc.want)
+			}
+		})
+	}
+}
+
+func TestRuleQualityTrendBuckets(t *testing.T) {
+	store := newTestStore(t)
+	bucketRuns(t, store)
+	from, to := mustTime(t, "2026-10-01T00:00:00Z"), mustTime(t, "2026-10-03T00:00:00Z")
+
+	hourly, err := store.LoadRuleQualityTrend(from, to, queryFilter{RuleID: "R1"}, "hour")
+	if err != nil {
+		t.Fatal(err)
+	}
+	wantHourly := []ruleQualityTrendPoint{{"2026-10-01 01:00:00", 3}, {"2026-10-01 02:00:00", 3}, {"2026-10-02 05:00:00", 4}}
+	if !reflect.DeepEqual(hourly, wantHourly) {
+		t.Fatalf("hourly: got %v, want %v", hourly, wantHourly)
+	}
+
+	daily, err := store.LoadRuleQualityTrend(from, to, queryFilter{RuleID: "R1"}, "day")
+	if err != nil {
+		t.Fatal(err)
+	}
+	wantDaily := []ruleQualityTrendPoint{{"2026-10-01T00:00:00Z", 6}, {"2026-10-02T00:00:00Z", 4}}
+	if !reflect.DeepEqual(daily, wantDaily) {
+		t.Fatalf("daily: got %v, want %v", daily, wantDaily)
+	}
+}
+
+func TestTimeseriesEndpointBucket(t *testing.T) {
+	store := newTestStore(t)
+	bucketRuns(t, store)
+	base := newTestServer(t, store, authPolicy{}, alertPolicy{})
+
+	status, body := doRequest(t, http.MethodGet, base+"/api/timeseries?from=2026-10-01T00:00:00Z&to=2026-10-03T00:00:00Z&metric=runs&bucket=day", nil, nil)
+	if status != http.StatusOK {
+		t.Fatalf("status %d %s", status, body)
+	}
+	var resp struct {
+		Data []timeSeriesPoint `json:"data"`
+	}
+	decodeJSON(t, body, &resp)
+	want := []timeSeriesPoint{{"2026-10-01T00:00:00Z", 3}, {"2026-10-02T00:00:00Z", 1}}
+	if !reflect.DeepEqual(resp.Data, want) {
+		t.Fatalf("got %v, want %v", resp.Data, want)
+	}
+}
+
+func pendingRuns(runs ...agentRunRequest) []pendingAgentRun {
+	pending := make([]pendingAgentRun, 0, len(runs))
+	for _, run := range runs {
+		pending = append(pending, pendingAgentRun{Req: run, DiffLines: *run.DiffLines})
+	}
+	return pending
+}
+
+func countRows(t *testing.T, store *gormStore, model interface{}) int64 {
+	t.Helper()
+	var n int64
+	if err := store.db.Model(model).Count(&n).Error; err != nil {
+		t.Fatal(err)
+	}
+	return n
+}
+
+// failFindingsOf makes every findings insert that contains a finding of
+// codeChangeID fail, or every findings insert for an empty codeChangeID.
+func failFindingsOf(t *testing.T, store *gormStore, codeChangeID string) {
+	t.Helper()
+	if err := store.db.Callback().Create().Before("gorm:create").Register("test:fail_findings", func(db *gorm.DB) {
+		rows := db.Statement.ReflectValue
+		if db.Statement.Table != "cr_agent_run_finding" || rows.Kind() != reflect.Slice {
+			return
+		}
+		for i := 0; i < rows.Len(); i++ {
+			if f, ok := rows.Index(i).Interface().(CrAgentRunFinding); ok && (codeChangeID == "" || f.CodeChangeID == codeChangeID) {
+				db.AddError(errors.New("disk full"))
+				return
+			}
+		}
+	}); err != nil {
+		t.Fatal(err)
+	}
+}
+
+// TestBatchFailsWhenNoRunIsStored fails every run after it is inserted and
+// checks that the batch reports the error and leaves nothing behind.
+func TestBatchFailsWhenNoRunIsStored(t *testing.T) {
+	store := newTestStore(t)
+	at := mustTime(t, "2026-10-01T10:00:00Z")
+	failFindingsOf(t, store, "")
+
+	batch := pendingRuns(
+		testRun("org/a", "c1", 1, at, map[string]uint32{"R1": 1}),
+		testRun("org/a", "c2", 2, at, map[string]uint32{"R1": 2}),
+	)
+	if _, err := store.CreateAgentRunBatch(batch); err == nil {
+		t.Fatal("batch succeeded despite the failing insert")
+	}
+	for _, model := range []interface{}{&CrAgentRun{}, &CrAgentRunRule{}, &CrAgentRunFinding{}, &CodeChangeSummary{}, &CrRunRollup{}, &CrRuleRollup{}} {
+		if n := countRows(t, store, model); n != 0 {
+			t.Errorf("%T: %d rows left by the failed batch", model, n)
+		}
+	}
+}
+
+// TestBatchFallsBackToSingleRuns fails one run of the batch: the batch
+// insert fails as a whole, and the per-run fallback stores the others.
+func TestBatchFallsBackToSingleRuns(t *testing.T) {
+	store := newTestStore(t)
+	at := mustTime(t, "2026-10-01T10:00:00Z")
+	failFindingsOf(t, store, "c2")
+
+	results, err := store.CreateAgentRunBatch(pendingRuns(
+		testRun("org/a", "c1", 1, at, map[string]uint32{"R1": 1}),
+		testRun("org/a", "c2", 2, at, map[string]uint32{"R1": 2}),
+		testRun("org/a", "c1", 3, at.Add(time.Minute), map[string]uint32{"R1": 4}),
+		testRun("org/a", "c1", 1, at, map[string]uint32{"R1": 1}),
+	))
+	if err != nil {
+		t.Fatal(err)
+	}
+	if results[0].Err != nil || results[0].Idempotent || results[2].Err != nil || results[2].Idempotent {
+		t.Fatalf("results %+v, want runs 1 and 3 stored", results)
+	}
+	if results[1].Err == nil || results[1].RunPrimaryID != 0 {
+		t.Fatalf("result %+v, want run 2 failed", results[1])
+	}
+	if !results[3].Idempotent || results[3].RunPrimaryID != results[0].RunPrimaryID {
+		t.Fatalf("result %+v, want the repeat of run 1 resolved to %d", results[3], results[0].RunPrimaryID)
+	}
+
+	if n := countRows(t, store, &CrAgentRun{}); n != 2 {
+		t.Fatalf("%d runs stored, want 2", n)
+	}
+	if s := loadSummary(t, store, "org/a", "c1"); s.RunCount != 2 || s.MaxTotalHits != 4 || s.MinTotalHits != 1 {
+		t.Fatalf("summary %+v, want both c1 runs", s)
+	}
+	var n int64
+	store.db.Model(&CodeChangeSummary{}).Where("code_change_id = ?", "c2").Count(&n)
+	if n != 0 {
+		t.Fatal("summary of the failed run c2 stored")
+	}
+	var hourly CrRunRollup
+	store.db.Where("granularity = ?", "hour").First(&hourly)
+	if hourly.RunCount != 2 || hourly.TotalHits != 5 {
+		t.Fatalf("hour rollup %+v, want 2 runs and 5 hits", hourly)
+	}
+}
+
+// TestBatchRetriesAfterConcurrentInsert stores one run of the batch between
+// the batch's duplicate check and its insert, as a concurrent writer would.
+func TestBatchRetriesAfterConcurrentInsert(t *testing.T) {
+	store := newTestStore(t)
+	at := mustTime(t, "2026-10-01T10:00:00Z")
+	runs := []agentRunRequest{
+		testRun("org/a", "c1", 1, at, map[string]uint32{"R1": 1}),
+		testRun("org/a", "c1", 2, at.Add(time.Minute), map[string]uint32{"R1": 2}),
+	}
+
+	var raced uint64
+	armed := true
+	if err := store.db.Callback().Query().After("gorm:query").Register("test:race", func(db *gorm.DB) {
+		if !armed || db.Statement.Table != "cr_agent_run" {
+			return
+		}
+		armed = false
+		id, _, err := store.CreateAgentRun(pendingRuns(runs[1])[0])
+		if err != nil {
+			db.AddError(err)
+		}
+		raced = id
+	}); err != nil {
+		t.Fatal(err)
+	}
+
+	results, err := store.CreateAgentRunBatch(pendingRuns(runs...))
+	if err != nil {
+		t.Fatal(err)
+	}
+	if raced == 0 || results[0].Idempotent || !results[1].Idempotent || results[1].RunPrimaryID != raced {
+		t.Fatalf("results %+v, want run 2 resolved to the concurrent id %d", results, raced)
+	}
+	if n := countRows(t, store, &CrAgentRun{}); n != 2 {
+		t.Fatalf("%d runs stored, want 2", n)
+	}
+	if s := loadSummary(t, store, "org/a", "c1"); s.RunCount != 2 || s.MaxTotalHits != 2 {
+		t.Fatalf("summary %+v, want 2 runs counted once", s)
+	}
+	var hourly CrRunRollup
+	store.db.Where("granularity = ?", "hour").First(&hourly)
+	if hourly.RunCount != 2 || hourly.TotalHits != 3 {
+		t.Fatalf("hour rollup %+v, want 2 runs and 3 hits", hourly)
+	}
+}
+
+// derivedState is everything DeleteAgentRun(s) maintains incrementally.
+type derivedState struct {
+	RunRollups  []CrRunRollup
+	RuleRollups []CrRuleRollup
+	Summaries   []CodeChangeSummary
+	Transitions []CrFindingTransition
+}
+
+func loadDerivedState(t *testing.T, store *gormStore) derivedState {
+	t.Helper()
+	var s derivedState
+	for _, q := range []struct {
+		dest  interface{}
+		order string
+	}{
+		{&s.RunRollups, "granularity, bucket_start, repo, ruleset_version, agent_version"},
+		{&s.RuleRollups, "granularity, bucket_start, repo, ruleset_version, agent_version, rule_id"},
+		{&s.Summaries, "repo, code_change_id"},
+		{&s.Transitions, "repo, code_change_id, reported_at, run_id, rule_id, fingerprint, status"},
+	} {
+		if err := store.db.Order(q.order).Find(q.dest).Error; err != nil {
+			t.Fatal(err)
+		}
+	}
+	for i := range s.Transitions {
+		s.Transitions[i].ID = 0
+	}
+	return s
+}
+
+// rebuildDerivedState throws the derived tables away and rebuilds them from
+// the raw rows.
+func rebuildDerivedState(t *testing.T, store *gormStore) derivedState {
+	t.Helper()
+	for _, model := range []interface{}{&CrRunRollup{}, &CrRuleRollup{}, &CodeChangeSummary{}, &CrFindingTransition{}} {
+		if err := store.db.Session(&gorm.Session{AllowGlobalUpdate: true}).Delete(model).Error; err != nil {
+			t.Fatal(err)
+		}
+	}
+	if _, err := store.RebuildRollups(time.Time{}, time.Time{}); err != nil {
+		t.Fatal(err)
+	}
+	if _, err := store.RebuildCodeChangeSummaries(time.Time{}, time.Time{}, queryFilter{}, false); err != nil {
+		t.Fatal(err)
+	}
+	if _, err := store.RebuildFindingTransitions(queryFilter{}); err != nil {
+		t.Fatal(err)
+	}
+	return loadDerivedState(t, store)
+}
+
+// deletionRuns spreads runs of two rulesets over several changes, hours and
+// days, with hits rising and falling so the fix tracking has work to do.
+func deletionRuns(t *testing.T) []agentRunRequest {
+	at := mustTime(t, "2026-10-01T10:00:00Z")
+	specs := []struct {
+		repo, change, ruleset string
+		offset                time.Duration
+		hits                  map[string]uint32
+	}{
+		{"org/a", "c1", "r1", 0, map[string]uint32{"R1": 3, "R2": 1}},
+		{"org/a", "c1", "r2", 30 * time.Minute, map[string]uint32{"R1": 1}},
+		{"org/a", "c1", "r1", 2 * time.Hour, map[string]uint32{"R1": 2, "R3": 1}},
+		{"org/a", "c1", "r1", 26 * time.Hour, map[string]uint32{"R3": 1}},
+		{"org/a", "c2", "r2", time.Hour, map[string]uint32{"R2": 2}},
+		{"org/a", "c2", "r2", 3 * time.Hour, map[string]uint32{"R2": 1}},
+		{"org/b", "c1", "r1", 0, map[string]uint32{"R1": 1}},
+		{"org/b", "c1", "r2", 25 * time.Hour, map[string]uint32{"R1": 2}},
+	}
+	runs := make([]agentRunRequest, 0, len(specs))
+	for i, spec := range specs {
+		run := testRun(spec.repo, spec.change, i+1, at.Add(spec.offset), spec.hits)
+		run.RulesetVersion = spec.ruleset
+		runs = append(runs, run)
+	}
+	return runs
+}
+
+func TestRunDeleteMatchesRebuild(t *testing.T) {
+	store := newTestStore(t)
+	runs := deletionRuns(t)
+	for _, run := range pendingRuns(runs...) {
+		if _, _, err := store.CreateAgentRun(run); err != nil {
+			t.Fatal(err)
+		}
+	}
+
+	// A run in the middle of a change, then every r2 run: org/a c2 loses all
+	// of its runs.
+	if _, err := store.DeleteAgentRun("org/a", "c1", runs[2].AgentRunID); err != nil {
+		t.Fatal(err)
+	}
+	result, err := store.DeleteAgentRuns(runDeleteFilter{RulesetVersion: "r2"}, false)
+	if err != nil {
+		t.Fatal(err)
+	}
+	if result.Runs != 4 || result.Changes != 3 || result.SummariesDeleted != 1 {
+		t.Fatalf("result %+v, want 4 runs of 3 changes and 1 summary deleted", result)
+	}
+
+	got := loadDerivedState(t, store)
+	want := rebuildDerivedState(t, store)
+	if !reflect.DeepEqual(got, want) {
+		t.Fatalf("after deletion:\n%+v\nfresh rebuild:\n%+v", got, want)
+	}
+	if len(got.Summaries) != 2 || len(got.Transitions) == 0 {
+		t.Fatalf("state %+v, want 2 summaries and some transitions", got)
+	}
+}
+
+// TestRunDeleteStopsBetweenChanges fails the deletion of the second change:
+// the first stays deleted and is counted, the second is untouched.
+func TestRunDeleteStopsBetweenChanges(t *testing.T) {
+	store := newTestStore(t)
+	runs := deletionRuns(t)
+	for _, run := range pendingRuns(runs...) {
+		if _, _, err := store.CreateAgentRun(run); err != nil {
+			t.Fatal(err)
+		}
+	}
+	before := loadDerivedState(t, store)
+
+	deletes := 0
+	if err := store.db.Callback().Delete().Before("gorm:delete").Register("test:fail", func(db *gorm.DB) {
+		if db.Statement.Table == "cr_agent_run" {
+			if deletes++; deletes == 2 {
+				db.AddError(errors.New("disk full"))
+			}
+		}
+	}); err != nil {
+		t.Fatal(err)
+	}
+	result, err := store.DeleteAgentRuns(runDeleteFilter{Repo: "org/a"}, false)
+	if err == nil {
+		t.Fatal("deletion succeeded despite the failing delete")
+	}
+	if result.Runs != 4 || result.Changes != 1 {
+		t.Fatalf("result %+v, want org/a c1 with 4 runs done", result)
+	}
+	var left []CrAgentRun
+	if err := store.db.Where("repo = ?", "org/a").Find(&left).Error; err != nil {
+		t.Fatal(err)
+	}
+	if len(left) != 2 || left[0].CodeChangeID != "c2" || left[1].CodeChangeID != "c2" {
+		t.Fatalf("runs left %+v, want the 2 runs of c2", left)
+	}
+	after := loadDerivedState(t, store)
+	if len(after.Summaries) != len(before.Summaries)-1 {
+		t.Fatalf("%d summaries, want %d", len(after.Summaries), len(before.Summaries)-1)
+	}
+	if want := rebuildDerivedState(t, store); !reflect.DeepEqual(after, want) {
+		t.Fatalf("after failed deletion:\n%+v\nfresh rebuild:\n%+v", after, want)
+	}
+}
@@ -0,0 +1,322 @@
+package main
+
+import (
+	"fmt"
+	"math"
+	"strings"
+	"time"
+
+	"gorm.io/gorm"
+)
+
+const (
+	// summaryRebuildPageSize is the number of changes recomputed per transaction.
+	summaryRebuildPageSize = 500
+	// maxSummaryRebuildDiffs caps the diffs listed in a rebuild result; the
+	// counters still cover every change.
+	maxSummaryRebuildDiffs = 1000
+	// improvementRateEpsilon absorbs the rounding of the decimal(6,5) column.
+	improvementRateEpsilon = 5e-6
+)
+
+// summaryRebuildResult reports what a rebuild of code_change_summary changed,
+// or would change in dry-run mode.
+type summaryRebuildResult struct {
+	DryRun    bool   `json:"dry_run"`
+	Scanned   uint64 `json:"scanned_changes"`
+	Unchanged uint64 `json:"unchanged"`
+	Created   uint64 `json:"created"`
+	Updated   uint64 `json:"updated"`
+	Deleted   uint64 `json:"deleted"`
+	// Skipped counts changes left alone because retention already purged some
+	// of their runs, so the stored summary cannot be rebuilt from raw data.
+	Skipped      uint64        `json:"skipped"`
+	Diffs        []summaryDiff `json:"diffs"`
+	DiffsOmitted uint64        `json:"diffs_omitted"`
+}
+
+// summaryDiff describes one code_change_summary row that differs from what
+// its runs imply. Action is create (row missing), update or delete (no runs
+// left for the change).
+type summaryDiff struct {
+	Repo         string               `json:"repo"`
+	CodeChangeID string               `json:"code_change_id"`
+	Action       string               `json:"action"`
+	Changes      []summaryFieldChange `json:"changes,omitempty"`
+}
+
+type summaryFieldChange struct {
+	Field string      `json:"field"`
+	Old   interface{} `json:"old"`
+	New   interface{} `json:"new"`
+}
+
+func (r *summaryRebuildResult) record(diff summaryDiff) {
+	switch diff.Action {
+	case "create":
+		r.Created++
+	case "update":
+		r.Updated++
+	case "delete":
+		r.Deleted++
+	}
+	if len(r.Diffs) < maxSummaryRebuildDiffs {
+		r.Diffs = append(r.Diffs, diff)
+	} else {
+		r.DiffsOmitted++
+	}
+}
+
+type changeKey struct {
+	Repo         string
+	CodeChangeID string
+}
+
+func changeKeyArgs(keys []changeKey) [][]interface{} {
+	args := make([][]interface{}, 0, len(keys))
+	for _, key := range keys {
+		args = append(args, []interface{}{key.Repo, key.CodeChangeID})
+	}
+	return args
+}
+
+// afterChangeKey pages through (repo, code_change_id) in key order.
+func afterChangeKey(db *gorm.DB, after *changeKey) *gorm.DB {
+	if after == nil {
+		return db
+	}
+	return db.Where("repo > ? OR (repo = ? AND code_change_id > ?)", after.Repo, after.Repo, after.CodeChangeID)
+}
+
+// RebuildCodeChangeSummaries recomputes code_change_summary from cr_agent_run
+// for every change with at least one run in [from, to] that matches f.Repo and
+// f.CodeChangeID (zero from/to leave that side open), and deletes scoped
+// summaries whose change has no runs at all. Each change is always recomputed
+// from all of its runs, not only the ones in range.
+//
+// Changes whose summary starts before the run retention window are skipped:
+// their oldest runs are gone and only the stored summary remembers them.
+//
+// Runs ingested while a page is being rewritten can be lost from its summary;
+// running the rebuild again fixes them.
+func (s *gormStore) RebuildCodeChangeSummaries(from, to time.Time, f queryFilter, dryRun bool) (summaryRebuildResult, error) {
+	result := summaryRebuildResult{DryRun: dryRun, Diffs: []summaryDiff{}}
+	scope := queryFilter{Repo: f.Repo, CodeChangeID: f.CodeChangeID}
+	retainedSince := s.retention.runsRetainedSince(time.Now())
+
+	var after *changeKey
+	for {
+		query := applyRunFilters(s.db.Model(&CrAgentRun{}), scope)
+		if !from.IsZero() {
+			query = query.Where("reported_at >= ?", from)
+		}
+		if !to.IsZero() {
+			query = query.Where("reported_at <= ?", to)
+		}
+		var keys []changeKey
+		if err := afterChangeKey(query, after).Distinct("repo", "code_change_id").
+			Order("repo, code_change_id").Limit(summaryRebuildPageSize).Scan(&keys).Error; err != nil {
+			return result, err
+		}
+		if len(keys) == 0 {
+			break
+		}
+		if err := s.db.Transaction(func(tx *gorm.DB) error {
+			return rebuildCodeChangeSummaryPage(tx, keys, retainedSince, dryRun, &result)
+		}); err != nil {
+			return result, err
+		}
+		after = &keys[len(keys)-1]
+	}
+
+	after = nil
+	for {
+		query := applyChangeFilters(s.db.Model(&CodeChangeSummary{}), scope).Where(summaryWithoutRunsSQL)
+		if !retainedSince.IsZero() {
+			query = query.Where("first_reported_at >= ?", retainedSince)
+		}
+		if !from.IsZero() {
+			query = query.Where("last_reported_at >= ?", from)
+		}
+		if !to.IsZero() {
+			query = query.Where("first_reported_at <= ?", to)
+		}
+		var keys []changeKey
+		if err := afterChangeKey(query, after).Select("repo, code_change_id").
+			Order("repo, code_change_id").Limit(summaryRebuildPageSize).Scan(&keys).Error; err != nil {
+			return result, err
+		}
+		if len(keys) == 0 {
+			break
+		}
+		result.Scanned += uint64(len(keys))
+		for _, key := range keys {
+			result.record(summaryDiff{Repo: key.Repo, CodeChangeID: key.CodeChangeID, Action: "delete"})
+		}
+		if !dryRun {
+			if err := s.db.Where("(repo, code_change_id) IN ?", changeKeyArgs(keys)).Where(summaryWithoutRunsSQL).
+				Delete(&CodeChangeSummary{}).Error; err != nil {
+				return result, err
+			}
+		}
+		after = &keys[len(keys)-1]
+	}
+
+	return result, nil
+}
+
+const summaryWithoutRunsSQL = "NOT EXISTS (SELECT 1 FROM cr_agent_run r " +
+	"WHERE r.repo = code_change_summary.repo AND r.code_change_id = code_change_summary.code_change_id)"
+
+// rebuildCodeChangeSummaryPage recomputes the summaries of keys, diffs them
+// against the stored rows and, unless dryRun, replaces the rows that differ.
+// Stored rows starting before retainedSince are skipped.
+func rebuildCodeChangeSummaryPage(tx *gorm.DB, keys []changeKey, retainedSince time.Time, dryRun bool, result *summaryRebuildResult) error {
+	rebuilt, err := recomputeCodeChangeSummaries(tx, keys)
+	if err != nil {
+		return err
+	}
+	var stored []CodeChangeSummary
+	if err := tx.Where("(repo, code_change_id) IN ?", changeKeyArgs(keys)).Find(&stored).Error; err != nil {
+		return err
+	}
+	storedByKey := make(map[changeKey]CodeChangeSummary, len(stored))
+	for _, row := range stored {
+		storedByKey[changeKey{row.Repo, row.CodeChangeID}] = row
+	}
+
+	var stale []CodeChangeSummary
+	for _, want := range rebuilt {
+		result.Scanned++
+		key := changeKey{want.Repo, want.CodeChangeID}
+		have, ok := storedByKey[key]
+		if !ok {
+			result.record(summaryDiff{Repo: key.Repo, CodeChangeID: key.CodeChangeID, Action: "create"})
+			stale = append(stale, want)
+			continue
+		}
+		if have.FirstReportedAt.Before(retainedSince) {
+			result.Skipped++
+			continue
+		}
+		changes := diffCodeChangeSummary(have, want)
+		if len(changes) == 0 {
+			result.Unchanged++
+			continue
+		}
+		result.record(summaryDiff{Repo: key.Repo, CodeChangeID: key.CodeChangeID, Action: "update", Changes: changes})
+		stale = append(stale, want)
+	}
+	if dryRun || len(stale) == 0 {
+		return nil
+	}
+
+	staleKeys := make([]changeKey, 0, len(stale))
+	for _, row := range stale {
+		staleKeys = append(staleKeys, changeKey{row.Repo, row.CodeChangeID})
+	}
+	return replaceCodeChangeSummaries(tx, staleKeys, stale)
+}
+
+// recomputeCodeChangeSummaries folds all runs of keys into fresh summaries.
+// Runs are folded in id order, the order the incremental upsert would have
+// seen them in, so ties on hit counts resolve the same way.
+func recomputeCodeChangeSummaries(tx *gorm.DB, keys []changeKey) ([]CodeChangeSummary, error) {
+	var runs []CrAgentRun
+	if err := tx.Select("id, repo, code_change_id, reported_at, triggered_total_hits, ruleset_version").
+		Where("(repo, code_change_id) IN ?", changeKeyArgs(keys)).
+		Order("id").Find(&runs).Error; err != nil {
+		return nil, err
+	}
+	return foldCodeChangeSummaries(runs), nil
+}
+
+// replaceCodeChangeSummaries overwrites the summaries of keys with rows; keys
+// without a row in rows are left deleted.
+func replaceCodeChangeSummaries(tx *gorm.DB, keys []changeKey, rows []CodeChangeSummary) error {
+	if len(keys) == 0 {
+		return nil
+	}
+	if err := tx.Where("(repo, code_change_id) IN ?", changeKeyArgs(keys)).Delete(&CodeChangeSummary{}).Error; err != nil {
+		return err
+	}
+	if len(rows) == 0 {
+		return nil
+	}
+	return tx.CreateInBatches(&rows, batchInsertSize).Error
+}
+
+func diffCodeChangeSummary(have, want CodeChangeSummary) []summaryFieldChange {
+	var changes []summaryFieldChange
+	add := func(field string, old, new interface{}) {
+		changes = append(changes, summaryFieldChange{Field: field, Old: old, New: new})
+	}
+	if have.RunCount != want.RunCount {
+		add("run_count", have.RunCount, want.RunCount)
+	}
+	if !have.FirstReportedAt.Equal(want.FirstReportedAt) {
+		add("first_reported_at", have.FirstReportedAt.UTC(), want.FirstReportedAt.UTC())
+	}
+	if !have.LastReportedAt.Equal(want.LastReportedAt) {
+		add("last_reported_at", have.LastReportedAt.UTC(), want.LastReportedAt.UTC())
+	}
+	if have.MaxTotalHits != want.MaxTotalHits {
+		add("max_total_hits", have.MaxTotalHits, want.MaxTotalHits)
+	}
+	if have.MaxRunID != want.MaxRunID {
+		add("max_run_id", have.MaxRunID, want.MaxRunID)
+	}
+	if have.MinTotalHits != want.MinTotalHits {
+		add("min_total_hits", have.MinTotalHits, want.MinTotalHits)
+	}
+	if have.MinRunID != want.MinRunID {
+		add("min_run_id", have.MinRunID, want.MinRunID)
+	}
+	if have.LastRulesetVersion != want.LastRulesetVersion {
+		add("last_ruleset_version", have.LastRulesetVersion, want.LastRulesetVersion)
+	}
+	if !sameImprovementRate(have.ImprovementRate, want.ImprovementRate) {
+		add("improvement_rate", have.ImprovementRate, want.ImprovementRate)
+	}
+	return changes
+}
+
+func sameImprovementRate(a, b *float64) bool {
+	if a == nil || b == nil {
+		return a == nil && b == nil
+	}
+	return math.Abs(*a-*b) <= improvementRateEpsilon
+}
+
+// describeSummaryDiff renders diff for command-line output.
+func describeSummaryDiff(diff summaryDiff) string {
+	switch diff.Action {
+	case "create":
+		return "summary row missing"
+	case "delete":
+		return "summary row has no runs"
+	}
+	changes := make([]string, 0, len(diff.Changes))
+	for _, change := range diff.Changes {
+		changes = append(changes, change.String())
+	}
+	return strings.Join(changes, ", ")
+}
+
+// String renders a field change for command-line output.
+func (c summaryFieldChange) String() string {
+	return fmt.Sprintf("%s %s -> %s", c.Field, formatSummaryValue(c.Old), formatSummaryValue(c.New))
+}
+
+func formatSummaryValue(value interface{}) string {
+	switch v := value.(type) {
+	case *float64:
+		if v == nil {
+			return "NULL"
+		}
+		return fmt.Sprintf("%.5f", *v)
+	case time.Time:
+		return v.Format(time.RFC3339Nano)
+	}
+	return fmt.Sprint(value)
+}
@@ -0,0 +1,169 @@
+package main
+
+import (
+	"testing"
+	"time"
+)
+
+// corruptSummaries ingests c1 (four runs), c2 and c3 in org/a and c1 in
+// org/b, then breaks the summaries: c1 is wrong, c2 is missing and c9 has no
+// runs at all.
+func corruptSummaries(t *testing.T, store *gormStore) []uint64 {
+	t.Helper()
+	var ids []uint64
+	runs := summaryRuns(t, "c1", 1)
+	runs = append(runs,
+		testRun("org/a", "c2", 10, mustTime(t, "2026-10-02T10:00:00Z"), map[string]uint32{"R1": 2}),
+		testRun("org/a", "c3", 11, mustTime(t, "2026-10-03T10:00:00Z"), map[string]uint32{"R1": 3}),
+		testRun("org/b", "c1", 12, mustTime(t, "2026-10-03T10:00:00Z"), map[string]uint32{"R1": 1}),
+	)
+	for _, run := range runs {
+		id, _, err := store.CreateAgentRun(pendingAgentRun{Req: run, DiffLines: *run.DiffLines})
+		if err != nil {
+			t.Fatal(err)
+		}
+		ids = append(ids, id)
+	}
+
+	if err := store.db.Model(&CodeChangeSummary{}).Where("repo = ? AND code_change_id = ?", "org/a", "c1").
+		Updates(map[string]interface{}{"run_count": 9, "max_run_id": 0}).Error; err != nil {
+		t.Fatal(err)
+	}
+	if err := store.db.Where("repo = ? AND code_change_id = ?", "org/a", "c2").Delete(&CodeChangeSummary{}).Error; err != nil {
+		t.Fatal(err)
+	}
+	orphan := loadSummary(t, store, "org/a", "c3")
+	orphan.CodeChangeID = "c9"
+	if err := store.db.Create(&orphan).Error; err != nil {
+		t.Fatal(err)
+	}
+	return ids[:4]
+}
+
+func summaryDiffsByChange(diffs []summaryDiff) map[string]summaryDiff {
+	byChange := make(map[string]summaryDiff, len(diffs))
+	for _, diff := range diffs {
+		byChange[diff.Repo+"/"+diff.CodeChangeID] = diff
+	}
+	return byChange
+}
+
+func TestSummaryRebuild(t *testing.T) {
+	store := newTestStore(t)
+	ids := corruptSummaries(t, store)
+
+	dry, err := store.RebuildCodeChangeSummaries(time.Time{}, time.Time{}, queryFilter{}, true)
+	if err != nil {
+		t.Fatal(err)
+	}
+	if !dry.DryRun || dry.Scanned != 5 || dry.Unchanged != 2 || dry.Created != 1 || dry.Updated != 1 || dry.Deleted != 1 {
+		t.Fatalf("dry run: %+v", dry)
+	}
+	diffs := summaryDiffsByChange(dry.Diffs)
+	if diffs["org/a/c2"].Action != "create" || diffs["org/a/c9"].Action != "delete" {
+		t.Fatalf("diffs: %+v", dry.Diffs)
+	}
+	fields := make(map[string]summaryFieldChange)
+	for _, change := range diffs["org/a/c1"].Changes {
+		fields[change.Field] = change
+	}
+	if len(fields) != 2 || fields["run_count"].Old != uint32(9) || fields["run_count"].New != uint32(4) || fields["max_run_id"].New != ids[2] {
+		t.Fatalf("c1 changes: %+v", diffs["org/a/c1"].Changes)
+	}
+	if s := loadSummary(t, store, "org/a", "c1"); s.RunCount != 9 {
+		t.Fatalf("dry run wrote summary %+v", s)
+	}
+
+	result, err := store.RebuildCodeChangeSummaries(time.Time{}, time.Time{}, queryFilter{}, false)
+	if err != nil {
+		t.Fatal(err)
+	}
+	if result.DryRun || result.Created != 1 || result.Updated != 1 || result.Deleted != 1 {
+		t.Fatalf("rebuild: %+v", result)
+	}
+	checkSummary(t, loadSummary(t, store, "org/a", "c1"), ids)
+	if s := loadSummary(t, store, "org/a", "c2"); s.RunCount != 1 || s.MaxTotalHits != 2 {
+		t.Fatalf("c2 summary %+v", s)
+	}
+	var n int64
+	store.db.Model(&CodeChangeSummary{}).Where("code_change_id = ?", "c9").Count(&n)
+	if n != 0 {
+		t.Fatal("summary without runs survived the rebuild")
+	}
+
+	again, err := store.RebuildCodeChangeSummaries(time.Time{}, time.Time{}, queryFilter{}, false)
+	if err != nil {
+		t.Fatal(err)
+	}
+	if again.Scanned != 4 || again.Unchanged != 4 || len(again.Diffs) != 0 {
+		t.Fatalf("second rebuild: %+v", again)
+	}
+}
+
+func TestSummaryRebuildScope(t *testing.T) {
+	cases := []struct {
+		name     string
+		from, to string
+		filter   queryFilter
+		changed  []string
+	}{
+		{name: "repo", filter: queryFilter{Repo: "org/b"}, changed: nil},
+		{name: "change", filter: queryFilter{Repo: "org/a", CodeChangeID: "c2"}, changed: []string{"org/a/c2"}},
+		// c1 has one run inside the range and is recomputed from all four.
+		{name: "range", from: "2026-10-01T11:30:00Z", to: "2026-10-01T12:30:00Z", changed: []string{"org/a/c1"}},
+		// c9 has no runs; its summary range overlaps [from, to].
+		{name: "range without runs", from: "2026-10-03T00:00:00Z", to: "2026-10-03T23:00:00Z", changed: []string{"org/a/c9"}},
+	}
+	for _, tc := range cases {
+		t.Run(tc.name, func(t *testing.T) {
+			store := newTestStore(t)
+			corruptSummaries(t, store)
+			var from, to time.Time
+			if tc.from != "" {
+				from, to = mustTime(t, tc.from), mustTime(t, tc.to)
+			}
+			result, err := store.RebuildCodeChangeSummaries(from, to, tc.filter, false)
+			if err != nil {
+				t.Fatal(err)
+			}
+			diffs := summaryDiffsByChange(result.Diffs)
+			if len(diffs) != len(tc.changed) {
+				t.Fatalf("diffs %+v, want %v", result.Diffs, tc.changed)
+			}
+			for _, change := range tc.changed {
+				if _, ok := diffs[change]; !ok {
+					t.Fatalf("diffs %+v, want %v", result.Diffs, tc.changed)
+				}
+			}
+		})
+	}
+}
+
+// TestSummaryRebuildSkipsPurgedChanges leaves alone a change whose summary
+// reaches back beyond the run retention window.
+func TestSummaryRebuildSkipsPurgedChanges(t *testing.T) {
+	store := newTestStore(t)
+	store.retention = retentionPolicy{Runs: 10 * 24 * time.Hour}
+	now := time.Now().UTC()
+	for i, at := range []time.Time{now.Add(-20 * 24 * time.Hour), now.Add(-24 * time.Hour)} {
+		run := testRun("org/a", "old", i+1, at, map[string]uint32{"R1": uint32(i + 1)})
+		if _, _, err := store.CreateAgentRun(pendingAgentRun{Req: run, DiffLines: *run.DiffLines}); err != nil {
+			t.Fatal(err)
+		}
+	}
+	// Retention purged the first run; only the summary still counts it.
+	if err := store.db.Where("agent_run_id = ?", testRun("org/a", "old", 1, now, nil).AgentRunID).Delete(&CrAgentRun{}).Error; err != nil {
+		t.Fatal(err)
+	}
+
+	result, err := store.RebuildCodeChangeSummaries(time.Time{}, time.Time{}, queryFilter{}, false)
+	if err != nil {
+		t.Fatal(err)
+	}
+	if result.Skipped != 1 || len(result.Diffs) != 0 {
+		t.Fatalf("rebuild: %+v", result)
+	}
+	if s := loadSummary(t, store, "org/a", "old"); s.RunCount != 2 {
+		t.Fatalf("summary %+v, want both runs still counted", s)
+	}
+}
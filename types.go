@@ -2,6 +2,8 @@ package main
 
 import (
 	"database/sql"
+	"database/sql/driver"
+	"fmt"
 	"time"
 )
 
@@ -45,6 +47,9 @@ type topRuleRow struct {
 	RuleID    string `json:"rule_id"`
 	TotalHits uint64 `json:"total_hits"`
 	RunCount  uint64 `json:"run_count"`
+
+	// Catalog is the rule's catalog metadata, null for unregistered rules.
+	Catalog *ruleCatalogEntry `json:"catalog" gorm:"-"`
 }
 
 type changeEffectivenessSummary struct {
@@ -77,17 +82,22 @@ type changeRunRow struct {
 }
 
 type ruleQualitySummary struct {
-	OK                bool      `json:"ok"`
-	From              time.Time `json:"from"`
-	To                time.Time `json:"to"`
-	TotalRules        uint64    `json:"total_rules"`
-	AvgFixRate        float64   `json:"avg_fix_rate"`
-	AvgDisappearRate  float64   `json:"avg_disappear_rate"`
-	AvgHitRate        float64   `json:"avg_hit_rate"`
-	TotalRunsInRange  uint64    `json:"total_runs"`
-	TotalActiveRules  uint64    `json:"total_active_rules"`
-	TotalHitCount     uint64    `json:"total_hit_count"`
-	TotalRuleRunCount uint64    `json:"total_rule_run_count"`
+	OK                 bool      `json:"ok"`
+	From               time.Time `json:"from"`
+	To                 time.Time `json:"to"`
+	TotalRules         uint64    `json:"total_rules"`
+	AvgFixRate         float64   `json:"avg_fix_rate"`
+	AvgDisappearRate   float64   `json:"avg_disappear_rate"`
+	AvgHitRate         float64   `json:"avg_hit_rate"`
+	TotalRunsInRange   uint64    `json:"total_runs"`
+	TotalActiveRules   uint64    `json:"total_active_rules"`
+	TotalHitCount      uint64    `json:"total_hit_count"`
+	TotalRuleRunCount  uint64    `json:"total_rule_run_count"`
+	TotalFixedFindings uint64    `json:"total_fixed_findings"`
+	// The feedback averages only cover rules with at least one verdict.
+	AvgAcceptanceRate    float64 `json:"avg_acceptance_rate"`
+	AvgFalsePositiveRate float64 `json:"avg_false_positive_rate"`
+	TotalFeedback        uint64  `json:"total_feedback"`
 }
 
 type ruleQualityRow struct {
@@ -100,20 +110,108 @@ type ruleQualityRow struct {
 	DisappearRate *float64  `json:"disappear_rate"`
 	AvgDrop       *float64  `json:"avg_drop"`
 	LastSeenAt    time.Time `json:"last_seen_at"`
+
+	// Finding-level counts from fix tracking; only runs that report findings
+	// contribute.
+	FixedFindings      uint64 `json:"fixed_findings"`
+	IntroducedFindings uint64 `json:"introduced_findings"`
+	PersistedFindings  uint64 `json:"persisted_findings"`
+
+	// Reviewer feedback on the rule's hits; the rates are null without any.
+	FeedbackCount     uint64   `json:"feedback_count"`
+	AcceptanceRate    *float64 `json:"acceptance_rate"`
+	FalsePositiveRate *float64 `json:"false_positive_rate"`
+
+	Catalog *ruleCatalogEntry `json:"catalog"`
 }
 
 type ruleQualityAggRow struct {
 	RuleID        string          `json:"rule_id"`
 	TotalHits     uint64          `json:"total_hits"`
 	RunCount      uint64          `json:"run_count"`
-	LastSeenAt    time.Time       `json:"last_seen_at"`
+	LastSeenAt    scanTime        `json:"last_seen_at"`
 	ChangeCount   uint64          `json:"change_count"`
 	FixRate       sql.NullFloat64 `json:"fix_rate"`
 	DisappearRate sql.NullFloat64 `json:"disappear_rate"`
 	AvgDrop       sql.NullFloat64 `json:"avg_drop"`
+
+	FixedFindings      uint64 `json:"fixed_findings"`
+	IntroducedFindings uint64 `json:"introduced_findings"`
+	PersistedFindings  uint64 `json:"persisted_findings"`
+
+	FeedbackCount  uint64          `json:"feedback_count"`
+	AcceptanceRate sql.NullFloat64 `json:"acceptance_rate"`
+	// FixCount and FalsePositiveCount are the numerators of FixRate and
+	// FalsePositiveRate, for confidence intervals.
+	FixCount           uint64          `json:"fix_count"`
+	FalsePositiveCount uint64          `json:"false_positive_count"`
+	FalsePositiveRate  sql.NullFloat64 `json:"false_positive_rate"`
 }
 
 type ruleQualityTrendPoint struct {
 	Bucket string `json:"bucket"`
 	Value  uint64 `json:"value"`
 }
+
+type batchItemResult struct {
+	Index        int          `json:"index"`
+	OK           bool         `json:"ok"`
+	RunPrimaryID uint64       `json:"run_primary_id,omitempty"`
+	Idempotent   bool         `json:"idempotent"`
+	Error        string       `json:"error,omitempty"`
+	Message      string       `json:"message,omitempty"`
+	Details      []fieldError `json:"details,omitempty"`
+}
+
+type batchResponse struct {
+	OK         bool              `json:"ok"`
+	Inserted   int               `json:"inserted"`
+	Idempotent int               `json:"idempotent"`
+	Rejected   int               `json:"rejected"`
+	Results    []batchItemResult `json:"results"`
+}
+
+// scanTime is a time.Time that can also be scanned from text. SQLite loses the
+// column type on aggregates such as MAX(reported_at) and returns the stored
+// string instead of a parsed time.
+type scanTime struct {
+	time.Time
+}
+
+var scanTimeLayouts = []string{
+	"2006-01-02 15:04:05.999999999-07:00",
+	"2006-01-02T15:04:05.999999999-07:00",
+	"2006-01-02 15:04:05.999999999",
+	"2006-01-02T15:04:05.999999999",
+	time.RFC3339Nano,
+}
+
+func (t *scanTime) Scan(value interface{}) error {
+	switch v := value.(type) {
+	case nil:
+		t.Time = time.Time{}
+		return nil
+	case time.Time:
+		t.Time = v
+		return nil
+	case []byte:
+		return t.parse(string(v))
+	case string:
+		return t.parse(v)
+	}
+	return fmt.Errorf("cannot scan %T into a time", value)
+}
+
+func (t scanTime) Value() (driver.Value, error) {
+	return t.Time, nil
+}
+
+func (t *scanTime) parse(value string) error {
+	for _, layout := range scanTimeLayouts {
+		if parsed, err := time.Parse(layout, value); err == nil {
+			t.Time = parsed.UTC()
+			return nil
+		}
+	}
+	return fmt.Errorf("cannot parse %q as a time", value)
+}
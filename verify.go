@@ -0,0 +1,308 @@
+package main
+
+import (
+	"encoding/json"
+	"fmt"
+	"sort"
+	"strings"
+	"time"
+
+	"gorm.io/gorm"
+)
+
+const (
+	// verifyPageSize is the number of runs checked (and repaired) per query.
+	verifyPageSize = 500
+	// maxVerifyIssues caps the issues listed in a report; the counters still
+	// cover every problem found.
+	maxVerifyIssues = 1000
+)
+
+// Issue kinds reported by VerifyData.
+const (
+	issueOrphanRuleRow       = "orphan_rule_row"
+	issueInvalidRuleHitsJSON = "invalid_rule_hits_json"
+	issueRuleRowMismatch     = "rule_row_mismatch"
+	issueTotalHitsMismatch   = "total_hits_mismatch"
+	issueSummaryDrift        = "summary_drift"
+)
+
+// verifyReport lists the inconsistencies found between cr_agent_run,
+// cr_agent_run_rule and code_change_summary.
+type verifyReport struct {
+	Repair              bool          `json:"repair"`
+	RunsScanned         uint64        `json:"runs_scanned"`
+	OrphanRuleRows      uint64        `json:"orphan_rule_rows"`
+	InvalidRuleHitsJSON uint64        `json:"invalid_rule_hits_json"`
+	RuleRowMismatches   uint64        `json:"rule_row_mismatches"`
+	TotalHitsMismatches uint64        `json:"total_hits_mismatches"`
+	SummaryDrift        uint64        `json:"summary_drift"`
+	Repaired            uint64        `json:"repaired"`
+	Issues              []verifyIssue `json:"issues"`
+	IssuesOmitted       uint64        `json:"issues_omitted"`
+}
+
+type verifyIssue struct {
+	Kind         string `json:"kind"`
+	RunID        uint64 `json:"run_id,omitempty"`
+	Repo         string `json:"repo,omitempty"`
+	CodeChangeID string `json:"code_change_id,omitempty"`
+	Message      string `json:"message"`
+	Repaired     bool   `json:"repaired"`
+}
+
+// Total is the number of problems found, repaired or not.
+func (r verifyReport) Total() uint64 {
+	return r.OrphanRuleRows + r.InvalidRuleHitsJSON + r.RuleRowMismatches + r.TotalHitsMismatches + r.SummaryDrift
+}
+
+func (r *verifyReport) add(issue verifyIssue) {
+	switch issue.Kind {
+	case issueOrphanRuleRow:
+		r.OrphanRuleRows++
+	case issueInvalidRuleHitsJSON:
+		r.InvalidRuleHitsJSON++
+	case issueRuleRowMismatch:
+		r.RuleRowMismatches++
+	case issueTotalHitsMismatch:
+		r.TotalHitsMismatches++
+	case issueSummaryDrift:
+		r.SummaryDrift++
+	}
+	if issue.Repaired {
+		r.Repaired++
+	}
+	if len(r.Issues) < maxVerifyIssues {
+		r.Issues = append(r.Issues, issue)
+	} else {
+		r.IssuesOmitted++
+	}
+}
+
+// VerifyData cross-checks the three tables. With repair it also fixes what it
+// finds, treating rule_hits_json as the source of truth for a run:
+//   - rule rows whose run no longer exists are deleted;
+//   - rule rows that disagree with rule_hits_json (or with their run's repo,
+//     change, time or ruleset) are rewritten from it;
+//   - triggered_total_hits is reset to sum(rule_hits_json), moving the
+//     total_hits of the run's rollup buckets by the same amount;
+//   - code_change_summary is rebuilt for drifted changes.
+//
+// Runs whose rule_hits_json cannot be parsed are only reported. Rule rows
+// missing for runs older than the rule retention window are expected and not
+// reported.
+func (s *gormStore) VerifyData(repair bool) (verifyReport, error) {
+	report := verifyReport{Repair: repair, Issues: []verifyIssue{}}
+	ruleRowsSince := s.retention.ruleRowsRetainedSince(time.Now())
+
+	if err := s.verifyOrphanRuleRows(repair, &report); err != nil {
+		return report, err
+	}
+
+	var afterID uint64
+	for {
+		var runs []verifyRunRow
+		if err := s.db.Model(&CrAgentRun{}).Select("id, repo, code_change_id, reported_at, ruleset_version, agent_version, triggered_total_hits, rule_hits_json").
+			Where("id > ?", afterID).Order("id").Limit(verifyPageSize).Find(&runs).Error; err != nil {
+			return report, err
+		}
+		if len(runs) == 0 {
+			break
+		}
+		report.RunsScanned += uint64(len(runs))
+		if err := s.db.Transaction(func(tx *gorm.DB) error {
+			return verifyRunPage(tx, runs, ruleRowsSince, repair, &report)
+		}); err != nil {
+			return report, err
+		}
+		afterID = runs[len(runs)-1].ID
+	}
+
+	// Summaries are checked last so a repair sees the corrected hit totals.
+	rebuild, err := s.RebuildCodeChangeSummaries(time.Time{}, time.Time{}, queryFilter{}, !repair)
+	if err != nil {
+		return report, err
+	}
+	for _, diff := range rebuild.Diffs {
+		report.add(verifyIssue{
+			Kind:         issueSummaryDrift,
+			Repo:         diff.Repo,
+			CodeChangeID: diff.CodeChangeID,
+			Message:      describeSummaryDiff(diff),
+			Repaired:     repair,
+		})
+	}
+	report.SummaryDrift += rebuild.DiffsOmitted
+	report.IssuesOmitted += rebuild.DiffsOmitted
+	if repair {
+		report.Repaired += rebuild.DiffsOmitted
+	}
+	return report, nil
+}
+
+// verifyRunRow reads rule_hits_json as raw bytes; datatypes.JSON would fail
+// the whole scan on a malformed snapshot instead of letting it be reported.
+type verifyRunRow struct {
+	ID                 uint64
+	Repo               string
+	CodeChangeID       string
+	ReportedAt         time.Time
+	RulesetVersion     string
+	AgentVersion       string
+	TriggeredTotalHits uint32
+	RuleHitsJSON       []byte
+}
+
+func (r verifyRunRow) run() CrAgentRun {
+	return CrAgentRun{
+		ID:                 r.ID,
+		Repo:               r.Repo,
+		CodeChangeID:       r.CodeChangeID,
+		ReportedAt:         r.ReportedAt,
+		RulesetVersion:     r.RulesetVersion,
+		AgentVersion:       r.AgentVersion,
+		TriggeredTotalHits: r.TriggeredTotalHits,
+	}
+}
+
+const ruleRowWithoutRunSQL = "NOT EXISTS (SELECT 1 FROM cr_agent_run r WHERE r.id = cr_agent_run_rule.run_id)"
+
+func (s *gormStore) verifyOrphanRuleRows(repair bool, report *verifyReport) error {
+	var afterID uint64
+	for {
+		var rows []CrAgentRunRule
+		if err := s.db.Select("id, run_id, repo, code_change_id, rule_id").
+			Where(ruleRowWithoutRunSQL).Where("id > ?", afterID).
+			Order("id").Limit(verifyPageSize).Find(&rows).Error; err != nil {
+			return err
+		}
+		if len(rows) == 0 {
+			return nil
+		}
+		ids := make([]uint64, 0, len(rows))
+		for _, row := range rows {
+			ids = append(ids, row.ID)
+			report.add(verifyIssue{
+				Kind:         issueOrphanRuleRow,
+				RunID:        row.RunID,
+				Repo:         row.Repo,
+				CodeChangeID: row.CodeChangeID,
+				Message:      fmt.Sprintf("rule row %d (%s) points to missing run %d", row.ID, row.RuleID, row.RunID),
+				Repaired:     repair,
+			})
+		}
+		if repair {
+			if err := s.db.Where("id IN ?", ids).Where(ruleRowWithoutRunSQL).Delete(&CrAgentRunRule{}).Error; err != nil {
+				return err
+			}
+		}
+		afterID = ids[len(ids)-1]
+	}
+}
+
+// verifyRunPage checks each run against its rule rows and hit total.
+func verifyRunPage(tx *gorm.DB, runs []verifyRunRow, ruleRowsSince time.Time, repair bool, report *verifyReport) error {
+	runIDs := make([]uint64, 0, len(runs))
+	for _, run := range runs {
+		runIDs = append(runIDs, run.ID)
+	}
+	var rules []CrAgentRunRule
+	if err := tx.Where("run_id IN ?", runIDs).Find(&rules).Error; err != nil {
+		return err
+	}
+	rulesByRun := make(map[uint64][]CrAgentRunRule, len(runs))
+	for _, rule := range rules {
+		rulesByRun[rule.RunID] = append(rulesByRun[rule.RunID], rule)
+	}
+
+	for _, row := range runs {
+		run := row.run()
+		issue := verifyIssue{RunID: run.ID, Repo: run.Repo, CodeChangeID: run.CodeChangeID, Repaired: repair}
+
+		var ruleHits map[string]uint32
+		if err := json.Unmarshal(row.RuleHitsJSON, &ruleHits); err != nil {
+			issue.Kind = issueInvalidRuleHitsJSON
+			issue.Message = "rule_hits_json is not a rule_id -> count object: " + err.Error()
+			issue.Repaired = false
+			report.add(issue)
+			continue
+		}
+
+		rowsRetained := !run.ReportedAt.Before(ruleRowsSince)
+		if problems := diffRunRuleRows(run, ruleHits, rulesByRun[run.ID], rowsRetained); len(problems) > 0 {
+			issue.Kind = issueRuleRowMismatch
+			issue.Message = strings.Join(problems, "; ")
+			report.add(issue)
+			if repair {
+				if err := tx.Where("run_id = ?", run.ID).Delete(&CrAgentRunRule{}).Error; err != nil {
+					return err
+				}
+				if rows := buildRunRuleRecords(run, ruleHits); rowsRetained && len(rows) > 0 {
+					if err := tx.Create(&rows).Error; err != nil {
+						return err
+					}
+				}
+			}
+		}
+
+		var sum uint64
+		for _, hits := range ruleHits {
+			sum += uint64(hits)
+		}
+		if sum != uint64(run.TriggeredTotalHits) {
+			issue.Kind = issueTotalHitsMismatch
+			issue.Message = fmt.Sprintf("triggered_total_hits is %d but rule_hits_json sums to %d", run.TriggeredTotalHits, sum)
+			report.add(issue)
+			if repair {
+				if err := tx.Model(&CrAgentRun{}).Where("id = ?", run.ID).
+					Update("triggered_total_hits", sum).Error; err != nil {
+					return err
+				}
+				if err := adjustRunRollupHits(tx, run, sum); err != nil {
+					return err
+				}
+			}
+		}
+	}
+	return nil
+}
+
+// diffRunRuleRows describes how the stored rule rows of run differ from its
+// rule_hits_json snapshot; nil means they agree. Missing rows only count when
+// rowsRetained, i.e. retention has not purged them yet.
+func diffRunRuleRows(run CrAgentRun, ruleHits map[string]uint32, rows []CrAgentRunRule, rowsRetained bool) []string {
+	var problems []string
+	seen := make(map[string]bool, len(rows))
+	for _, row := range rows {
+		if seen[row.RuleID] {
+			problems = append(problems, fmt.Sprintf("%s: duplicate rule row", row.RuleID))
+			continue
+		}
+		seen[row.RuleID] = true
+		want, ok := ruleHits[row.RuleID]
+		switch {
+		case !ok:
+			problems = append(problems, fmt.Sprintf("%s: rule row not in rule_hits_json", row.RuleID))
+		case row.HitCount != want:
+			problems = append(problems, fmt.Sprintf("%s: hit_count %d, rule_hits_json %d", row.RuleID, row.HitCount, want))
+		case row.Repo != run.Repo || row.CodeChangeID != run.CodeChangeID ||
+			row.RulesetVersion != run.RulesetVersion || !row.ReportedAt.Equal(run.ReportedAt):
+			problems = append(problems, fmt.Sprintf("%s: repo/code_change_id/ruleset_version/reported_at differ from the run", row.RuleID))
+		}
+	}
+
+	if !rowsRetained {
+		return problems
+	}
+	var missing []string
+	for ruleID := range ruleHits {
+		if !seen[ruleID] {
+			missing = append(missing, ruleID)
+		}
+	}
+	sort.Strings(missing)
+	for _, ruleID := range missing {
+		problems = append(problems, fmt.Sprintf("%s: missing rule row", ruleID))
+	}
+	return problems
+}
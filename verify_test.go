@@ -0,0 +1,77 @@
+package main
+
+import (
+	"reflect"
+	"testing"
+	"time"
+
+	"gorm.io/gorm"
+)
+
+func loadRunRollups(t *testing.T, store *gormStore) []CrRunRollup {
+	t.Helper()
+	var rows []CrRunRollup
+	if err := store.db.Order("granularity, bucket_start, repo, ruleset_version, agent_version").Find(&rows).Error; err != nil {
+		t.Fatal(err)
+	}
+	for i := range rows {
+		rows[i].BucketStart = rows[i].BucketStart.UTC()
+	}
+	return rows
+}
+
+// TestVerifyRepairAdjustsRollups stores two runs whose triggered_total_hits
+// disagree with rule_hits_json, as if they had been ingested that way, and
+// checks that the repair moves the rollup totals along with the runs.
+func TestVerifyRepairAdjustsRollups(t *testing.T) {
+	store := newTestStore(t)
+	// Both runs fall into the same hour and day buckets.
+	at := mustTime(t, "2026-10-01T10:10:00Z")
+	var ids []uint64
+	for i, hits := range []uint32{2, 4} {
+		run := testRun("org/a", "c1", i+1, at.Add(time.Duration(i)*time.Minute), map[string]uint32{"R1": hits})
+		id, _, err := store.CreateAgentRun(pendingAgentRun{Req: run, DiffLines: *run.DiffLines})
+		if err != nil {
+			t.Fatal(err)
+		}
+		ids = append(ids, id)
+	}
+	want := loadRunRollups(t, store)
+
+	// Run 1 claims 3 hits too many and run 2 one too few.
+	for _, tamper := range []struct {
+		id    uint64
+		delta int
+	}{{ids[0], 3}, {ids[1], -1}} {
+		if err := store.db.Model(&CrAgentRun{}).Where("id = ?", tamper.id).
+			Update("triggered_total_hits", gorm.Expr("triggered_total_hits + ?", tamper.delta)).Error; err != nil {
+			t.Fatal(err)
+		}
+		if err := store.db.Model(&CrRunRollup{}).Where("1 = 1").
+			Update("total_hits", gorm.Expr("total_hits + ?", tamper.delta)).Error; err != nil {
+			t.Fatal(err)
+		}
+	}
+	if reflect.DeepEqual(loadRunRollups(t, store), want) {
+		t.Fatal("tampering did not change the rollups")
+	}
+
+	report, err := store.VerifyData(true)
+	if err != nil {
+		t.Fatal(err)
+	}
+	if report.TotalHitsMismatches != 2 {
+		t.Fatalf("report %+v, want 2 total hits mismatches", report)
+	}
+	if got := loadRunRollups(t, store); !reflect.DeepEqual(got, want) {
+		t.Fatalf("rollups after repair:\n got %+v\nwant %+v", got, want)
+	}
+
+	report, err = store.VerifyData(false)
+	if err != nil {
+		t.Fatal(err)
+	}
+	if report.Total() != 0 {
+		t.Fatalf("issues left after repair: %+v", report)
+	}
+}